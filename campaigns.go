@@ -0,0 +1,505 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	campaignStatusRunning   = "running"
+	campaignStatusPaused    = "paused"
+	campaignStatusCancelled = "cancelled"
+	campaignStatusCompleted = "completed"
+
+	recipientStatusQueued    = "queued"
+	recipientStatusSending   = "sending"
+	recipientStatusSent      = "sent"
+	recipientStatusDelivered = "delivered"
+	recipientStatusRead      = "read"
+	recipientStatusFailed    = "failed"
+
+	defaultCampaignRate   = 10 // messages per minute
+	maxCampaignRate       = 60
+	maxCampaignJitter     = 300 // seconds
+	maxCampaignRecipients = 10000
+
+	campaignPollInterval = 1 * time.Second
+	// A campaign whose instance is not connected waits this long before trying again
+	campaignOfflineDelay = 1 * time.Minute
+)
+
+var (
+	recipientStatuses = []string{recipientStatusQueued, recipientStatusSending, recipientStatusSent, recipientStatusDelivered, recipientStatusRead, recipientStatusFailed}
+
+	templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+)
+
+// renderTemplateValue replaces the {{variable}} placeholders in every string of a
+// decoded JSON value and collects the names that have no value
+func renderTemplateValue(value interface{}, variables map[string]string, missing map[string]bool) interface{} {
+	switch v := value.(type) {
+	case string:
+		return templateVariablePattern.ReplaceAllStringFunc(v, func(placeholder string) string {
+			name := templateVariablePattern.FindStringSubmatch(placeholder)[1]
+			replacement, ok := variables[name]
+			if !ok {
+				missing[name] = true
+				return placeholder
+			}
+			return replacement
+		})
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			rendered[key] = renderTemplateValue(item, variables, missing)
+		}
+		return rendered
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, item := range v {
+			rendered[i] = renderTemplateValue(item, variables, missing)
+		}
+		return rendered
+	default:
+		return value
+	}
+}
+
+// renderTemplate renders a JSON object template, failing with the sorted list of
+// variables that have no value
+func renderTemplate(template map[string]interface{}, variables map[string]string) (map[string]interface{}, error) {
+	missing := map[string]bool{}
+	rendered := renderTemplateValue(template, variables, missing).(map[string]interface{})
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("missing variables: %s", strings.Join(names, ", "))
+	}
+	return rendered, nil
+}
+
+// QuietHours is a daily window, in the campaign's time zone, during which nothing is sent.
+// The window may wrap around midnight, e.g. 21:00 to 09:00.
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+func (q QuietHours) validate() error {
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return errors.New("quiet_hours.start must be HH:MM")
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return errors.New("quiet_hours.end must be HH:MM")
+	}
+	if start.Equal(end) {
+		return errors.New("quiet_hours.start and quiet_hours.end must differ")
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("invalid quiet_hours.timezone: %w", err)
+	}
+	return nil
+}
+
+// resumeAt returns the end of the quiet window containing now, or false outside quiet hours
+func (q QuietHours) resumeAt(now time.Time) (time.Time, bool) {
+	start, errStart := time.Parse("15:04", q.Start)
+	end, errEnd := time.Parse("15:04", q.End)
+	loc, errLoc := time.LoadLocation(q.Timezone)
+	if errStart != nil || errEnd != nil || errLoc != nil {
+		return time.Time{}, false
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+
+	resume := time.Date(local.Year(), local.Month(), local.Day(), end.Hour(), end.Minute(), 0, 0, loc)
+	if startMinute < endMinute {
+		return resume, minute >= startMinute && minute < endMinute
+	}
+	if minute >= startMinute {
+		return resume.AddDate(0, 0, 1), true
+	}
+	return resume, minute < endMinute
+}
+
+// Campaign sends one message template to a list of recipients at a limited rate
+type Campaign struct {
+	ID             string          `json:"id" db:"id"`
+	UserID         string          `json:"-" db:"user_id"`
+	Name           string          `json:"name" db:"name"`
+	Type           string          `json:"type" db:"type"`
+	Message        json.RawMessage `json:"message" db:"-"`
+	StoredMessage  string          `json:"-" db:"message"`
+	RatePerMinute  int             `json:"rate_per_minute" db:"rate_per_minute"`
+	JitterSeconds  int             `json:"jitter_seconds" db:"jitter_seconds"`
+	QuietHours     *QuietHours     `json:"quiet_hours" db:"-"`
+	QuietStart     string          `json:"-" db:"quiet_start"`
+	QuietEnd       string          `json:"-" db:"quiet_end"`
+	Timezone       string          `json:"-" db:"timezone"`
+	Status         string          `json:"status" db:"status"`
+	NextSendAtUnix int64           `json:"-" db:"next_send_at"`
+	NextSendAt     *time.Time      `json:"next_send_at" db:"-"`
+	Recipients     map[string]int  `json:"recipients" db:"-"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// fill sets the API fields from the stored columns
+func (c *Campaign) fill() {
+	c.Message = json.RawMessage(c.StoredMessage)
+	if c.QuietStart != "" {
+		c.QuietHours = &QuietHours{Start: c.QuietStart, End: c.QuietEnd, Timezone: c.Timezone}
+	}
+	if c.Status == campaignStatusRunning {
+		next := time.Unix(c.NextSendAtUnix, 0).UTC()
+		c.NextSendAt = &next
+	}
+}
+
+const campaignColumns = `id, user_id, name, type, message, rate_per_minute, jitter_seconds, quiet_start, quiet_end, timezone, status, next_send_at, created_at, updated_at`
+
+// CampaignRecipient is the delivery state of one recipient of a campaign
+type CampaignRecipient struct {
+	Position      int               `json:"position" db:"position"`
+	Phone         string            `json:"phone" db:"phone"`
+	Variables     map[string]string `json:"variables,omitempty" db:"-"`
+	StoredVars    string            `json:"-" db:"variables"`
+	Status        string            `json:"status" db:"status"`
+	MessageID     string            `json:"message_id" db:"message_id"`
+	Error         string            `json:"error,omitempty" db:"error"`
+	SentAtUnix    int64             `json:"-" db:"sent_at"`
+	DeliveredUnix int64             `json:"-" db:"delivered_at"`
+	ReadUnix      int64             `json:"-" db:"read_at"`
+	SentAt        *time.Time        `json:"sent_at,omitempty" db:"-"`
+	DeliveredAt   *time.Time        `json:"delivered_at,omitempty" db:"-"`
+	ReadAt        *time.Time        `json:"read_at,omitempty" db:"-"`
+}
+
+// fill sets the API fields from the stored columns
+func (r *CampaignRecipient) fill() {
+	if r.StoredVars != "" {
+		_ = json.Unmarshal([]byte(r.StoredVars), &r.Variables)
+	}
+	r.SentAt = unixTime(r.SentAtUnix)
+	r.DeliveredAt = unixTime(r.DeliveredUnix)
+	r.ReadAt = unixTime(r.ReadUnix)
+}
+
+// unixTime converts a stored Unix time, where 0 means unset
+func unixTime(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+	t := time.Unix(unix, 0).UTC()
+	return &t
+}
+
+// variables returns the template variables of the recipient, with phone always set
+func (r CampaignRecipient) variables() map[string]string {
+	variables := map[string]string{}
+	for key, value := range r.Variables {
+		variables[key] = value
+	}
+	variables["phone"] = r.Phone
+	return variables
+}
+
+// getCampaign returns a campaign of a user with its recipient counts
+func (s *server) getCampaign(userID string, id string) (Campaign, error) {
+	var campaign Campaign
+	err := s.db.Get(&campaign, "SELECT "+campaignColumns+" FROM campaigns WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return campaign, err
+	}
+	campaign.fill()
+	campaign.Recipients, err = campaignRecipientCounts(s.db, id)
+	return campaign, err
+}
+
+// campaignRecipientCounts counts the recipients of a campaign by status
+func campaignRecipientCounts(db *sqlx.DB, campaignID string) (map[string]int, error) {
+	var rows []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}
+	err := db.Select(&rows, "SELECT status, COUNT(*) AS count FROM campaign_recipients WHERE campaign_id = $1 GROUP BY status", campaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{"total": 0}
+	for _, status := range recipientStatuses {
+		counts[status] = 0
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+		counts["total"] += row.Count
+	}
+	return counts, nil
+}
+
+// CampaignRunner sends the running campaigns of a server, one recipient per due
+// campaign at a time. Instances send in parallel, each one message at a time.
+type CampaignRunner struct {
+	s    *server
+	wake chan struct{}
+
+	mu       sync.Mutex
+	busy     map[string]bool
+	inflight sync.WaitGroup
+}
+
+func newCampaignRunner(s *server) *CampaignRunner {
+	return &CampaignRunner{
+		s:    s,
+		wake: make(chan struct{}, 1),
+		busy: make(map[string]bool),
+	}
+}
+
+// StartCampaignRunner fails the sends interrupted by a previous shutdown and starts the runner
+func StartCampaignRunner(s *server) *CampaignRunner {
+	runner := newCampaignRunner(s)
+	runner.failInterrupted()
+	go runner.run()
+	log.Info().Msg("Campaign runner started")
+	return runner
+}
+
+// Wake makes the runner look for due campaigns right away
+func (c *CampaignRunner) Wake() {
+	if c == nil {
+		return
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// failInterrupted marks the recipients that were being sent to when the process
+// stopped as failed, so nobody receives the message twice
+func (c *CampaignRunner) failInterrupted() {
+	res, err := c.s.db.Exec("UPDATE campaign_recipients SET status=$1, error=$2 WHERE status=$3",
+		recipientStatusFailed, "interrupted while sending, the message may not have been sent", recipientStatusSending)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update interrupted campaign recipients")
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		log.Warn().Int64("count", n).Msg("Marked interrupted campaign recipients as failed")
+	}
+}
+
+func (c *CampaignRunner) run() {
+	ticker := time.NewTicker(campaignPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.wake:
+		}
+		c.sendDue(time.Now())
+	}
+}
+
+// sendDue makes one step of every running campaign that is due, in a goroutine per
+// instance. Instances still sending from a previous call are skipped until the next.
+func (c *CampaignRunner) sendDue(now time.Time) {
+	due := []Campaign{}
+	err := c.s.db.Select(&due, "SELECT "+campaignColumns+" FROM campaigns WHERE status = $1 AND next_send_at <= $2 ORDER BY next_send_at ASC",
+		campaignStatusRunning, now.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query campaigns")
+		return
+	}
+
+	users := []string{}
+	byUser := map[string][]Campaign{}
+	for _, campaign := range due {
+		campaign.fill()
+		if _, ok := byUser[campaign.UserID]; !ok {
+			users = append(users, campaign.UserID)
+		}
+		byUser[campaign.UserID] = append(byUser[campaign.UserID], campaign)
+	}
+
+	for _, userID := range users {
+		c.mu.Lock()
+		ready := !c.busy[userID]
+		if ready {
+			c.busy[userID] = true
+		}
+		c.mu.Unlock()
+		if !ready {
+			continue
+		}
+
+		campaigns := byUser[userID]
+		c.inflight.Add(1)
+		go func() {
+			defer c.inflight.Done()
+			for _, campaign := range campaigns {
+				c.step(campaign, now)
+			}
+			c.mu.Lock()
+			delete(c.busy, userID)
+			c.mu.Unlock()
+		}()
+	}
+}
+
+// step sends the campaign message to its next queued recipient, or postpones the
+// campaign during quiet hours and while the instance is not connected. A campaign
+// without queued recipients is complete. A campaign paused or cancelled since it
+// was found due sends nothing.
+func (c *CampaignRunner) step(campaign Campaign, now time.Time) {
+	var recipient CampaignRecipient
+	err := c.s.db.Get(&recipient, `
+		SELECT position, phone, variables, status, message_id, error, sent_at, delivered_at, read_at
+		FROM campaign_recipients WHERE campaign_id = $1 AND status = $2
+		ORDER BY position ASC LIMIT 1`, campaign.ID, recipientStatusQueued)
+	if err == sql.ErrNoRows {
+		c.complete(campaign)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("campaign", campaign.ID).Msg("Failed to get next campaign recipient")
+		return
+	}
+	recipient.fill()
+
+	if campaign.QuietHours != nil {
+		if resume, quiet := campaign.QuietHours.resumeAt(now); quiet {
+			c.postpone(campaign.ID, resume)
+			return
+		}
+	}
+	if clientManager.GetWhatsmeowClient(campaign.UserID) == nil {
+		c.postpone(campaign.ID, now.Add(campaignOfflineDelay))
+		return
+	}
+
+	res, err := c.s.db.Exec(`
+		UPDATE campaign_recipients SET status=$1 WHERE campaign_id=$2 AND position=$3 AND status=$4
+		AND EXISTS (SELECT 1 FROM campaigns WHERE id=$2 AND status=$5)`,
+		recipientStatusSending, campaign.ID, recipient.Position, recipientStatusQueued, campaignStatusRunning)
+	if err != nil {
+		log.Error().Err(err).Str("campaign", campaign.ID).Msg("Failed to claim campaign recipient")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+
+	result := c.send(campaign, recipient)
+	if result.Err != nil {
+		_, err = c.s.db.Exec("UPDATE campaign_recipients SET status=$1, error=$2 WHERE campaign_id=$3 AND position=$4",
+			recipientStatusFailed, result.Err.Error(), campaign.ID, recipient.Position)
+		log.Warn().Err(result.Err).Str("campaign", campaign.ID).Str("phone", recipient.Phone).Msg("Campaign message failed")
+	} else {
+		_, err = c.s.db.Exec("UPDATE campaign_recipients SET status=$1, message_id=$2, sent_at=$3 WHERE campaign_id=$4 AND position=$5",
+			recipientStatusSent, result.MessageID, time.Now().Unix(), campaign.ID, recipient.Position)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("campaign", campaign.ID).Msg("Failed to record campaign recipient state")
+	}
+
+	c.postpone(campaign.ID, time.Now().Add(campaignInterval(campaign.RatePerMinute, campaign.JitterSeconds)))
+}
+
+// send renders the message for a recipient and sends it through the campaign's send route
+func (c *CampaignRunner) send(campaign Campaign, recipient CampaignRecipient) sendRouteResult {
+	var template map[string]interface{}
+	if err := json.Unmarshal(campaign.Message, &template); err != nil {
+		return sendRouteResult{Err: fmt.Errorf("invalid campaign message: %w", err)}
+	}
+	payload, err := renderTemplate(template, recipient.variables())
+	if err != nil {
+		return sendRouteResult{Err: err}
+	}
+	payload["Phone"] = recipient.Phone
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return sendRouteResult{Err: err}
+	}
+
+	var token string
+	if err := c.s.db.Get(&token, "SELECT token FROM users WHERE id = $1", campaign.UserID); err != nil {
+		return sendRouteResult{Err: fmt.Errorf("instance not found: %w", err)}
+	}
+	return c.s.callSendRoute(token, campaign.Type, body)
+}
+
+// postpone sets when the next step of a campaign is due
+func (c *CampaignRunner) postpone(campaignID string, next time.Time) {
+	_, err := c.s.db.Exec("UPDATE campaigns SET next_send_at=$1 WHERE id=$2", next.Unix(), campaignID)
+	if err != nil {
+		log.Error().Err(err).Str("campaign", campaignID).Msg("Failed to postpone campaign")
+	}
+}
+
+// complete ends a running campaign that has no queued recipients left
+func (c *CampaignRunner) complete(campaign Campaign) {
+	_, err := c.s.db.Exec("UPDATE campaigns SET status=$1, updated_at=$2 WHERE id=$3 AND status=$4",
+		campaignStatusCompleted, time.Now(), campaign.ID, campaignStatusRunning)
+	if err != nil {
+		log.Error().Err(err).Str("campaign", campaign.ID).Msg("Failed to complete campaign")
+		return
+	}
+	log.Info().Str("campaign", campaign.ID).Str("userID", campaign.UserID).Msg("Campaign completed")
+}
+
+// campaignInterval is the delay between two messages of a campaign, with random jitter added
+func campaignInterval(ratePerMinute int, jitterSeconds int) time.Duration {
+	interval := time.Minute / time.Duration(ratePerMinute)
+	if jitterSeconds > 0 {
+		interval += time.Duration(rand.Int63n(int64(jitterSeconds) * int64(time.Second)))
+	}
+	return interval
+}
+
+// updateCampaignReceipts moves the campaign recipients of the acknowledged messages
+// forward to delivered or read; states never go back
+func updateCampaignReceipts(db *sqlx.DB, userID string, messageIDs []string, receiptType types.ReceiptType, timestamp time.Time) {
+	for _, messageID := range messageIDs {
+		var err error
+		switch receiptType {
+		case types.ReceiptTypeDelivered:
+			_, err = db.Exec("UPDATE campaign_recipients SET status=$1, delivered_at=$2 WHERE user_id=$3 AND message_id=$4 AND status=$5",
+				recipientStatusDelivered, timestamp.Unix(), userID, messageID, recipientStatusSent)
+		case types.ReceiptTypeRead, types.ReceiptTypePlayed:
+			_, err = db.Exec(`
+				UPDATE campaign_recipients SET status=$1, read_at=$2,
+					delivered_at=CASE WHEN delivered_at = 0 THEN $2 ELSE delivered_at END
+				WHERE user_id=$3 AND message_id=$4 AND status IN ($5, $6)`,
+				recipientStatusRead, timestamp.Unix(), userID, messageID, recipientStatusSent, recipientStatusDelivered)
+		default:
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("messageID", messageID).Msg("Failed to update campaign receipt")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	template := map[string]interface{}{
+		"Body":    "Hi {{name}}, your code is {{ code }}",
+		"Caption": "{{name}}",
+		"Buttons": []interface{}{map[string]interface{}{"Text": "Call {{phone}}"}},
+		"Delay":   float64(3),
+	}
+
+	rendered, err := renderTemplate(template, map[string]string{"name": "Ana", "code": "42", "phone": "5491155553934"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rendered["Body"] != "Hi Ana, your code is 42" || rendered["Caption"] != "Ana" || rendered["Delay"] != float64(3) {
+		t.Errorf("Unexpected rendering: %v", rendered)
+	}
+	button := rendered["Buttons"].([]interface{})[0].(map[string]interface{})
+	if button["Text"] != "Call 5491155553934" {
+		t.Errorf("Expected nested values to be rendered, got %v", button)
+	}
+	if template["Body"] != "Hi {{name}}, your code is {{ code }}" {
+		t.Errorf("The template must not be modified, got %v", template["Body"])
+	}
+
+	if _, err := renderTemplate(template, map[string]string{"name": "Ana"}); err == nil || err.Error() != "missing variables: code, phone" {
+		t.Errorf("Expected the missing variables to be listed, got %v", err)
+	}
+}
+
+func TestQuietHoursResumeAt(t *testing.T) {
+	overnight := QuietHours{Start: "21:00", End: "09:00", Timezone: "UTC"}
+	for _, tc := range []struct {
+		now    time.Time
+		quiet  bool
+		resume time.Time
+	}{
+		{time.Date(2025, 1, 10, 22, 30, 0, 0, time.UTC), true, time.Date(2025, 1, 11, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2025, 1, 10, 3, 0, 0, 0, time.UTC), true, time.Date(2025, 1, 10, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC), false, time.Time{}},
+	} {
+		resume, quiet := overnight.resumeAt(tc.now)
+		if quiet != tc.quiet || (quiet && !resume.Equal(tc.resume)) {
+			t.Errorf("At %v: expected %v until %v, got %v until %v", tc.now, tc.quiet, tc.resume, quiet, resume)
+		}
+	}
+
+	lunch := QuietHours{Start: "12:00", End: "13:30", Timezone: "UTC"}
+	if resume, quiet := lunch.resumeAt(time.Date(2025, 1, 10, 12, 45, 0, 0, time.UTC)); !quiet || resume.Hour() != 13 || resume.Minute() != 30 {
+		t.Errorf("Expected quiet until 13:30, got %v %v", quiet, resume)
+	}
+	if err := (QuietHours{Start: "9", End: "10:00", Timezone: "UTC"}).validate(); err == nil {
+		t.Error("Expected an invalid start to be rejected")
+	}
+}
+
+func TestCampaignLifecycle(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "CampaignUser",
+		"token":      "campaign-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "campaign-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	recipients := []interface{}{
+		map[string]interface{}{"phone": "5491155553934", "variables": map[string]string{"name": "Ana"}},
+		map[string]interface{}{"phone": "5491155553935"},
+	}
+	missing := executeRequest(t, s, newRequest("2", "campaigns.create", map[string]interface{}{
+		"token":      "campaign-token",
+		"type":       "text",
+		"message":    map[string]interface{}{"Body": "Hi {{name}}"},
+		"recipients": recipients,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, missing, "2", 400)
+
+	created := executeRequest(t, s, newRequest("3", "campaigns.create", map[string]interface{}{
+		"token":           "campaign-token",
+		"name":            "January sale",
+		"type":            "text",
+		"message":         map[string]interface{}{"Body": "Hi, offer for {{phone}}"},
+		"recipients":      recipients,
+		"rate_per_minute": 30,
+		"jitter_seconds":  2,
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, created, "3").(map[string]interface{})
+	campaignID, _ := result["id"].(string)
+	counts := result["recipients"].(map[string]interface{})
+	if campaignID == "" || result["status"] != campaignStatusRunning || counts["queued"] != float64(2) || counts["total"] != float64(2) {
+		t.Fatalf("Unexpected campaign: %v", result)
+	}
+
+	// An instance still sending is skipped until the next call
+	runner := newCampaignRunner(s)
+	runner.busy[userID] = true
+	runner.sendDue(time.Now())
+	runner.inflight.Wait()
+	campaign, err := s.getCampaign(userID, campaignID)
+	if err != nil || campaign.NextSendAtUnix > time.Now().Unix() {
+		t.Errorf("Expected a busy instance to be skipped, got %+v (%v)", campaign, err)
+	}
+	delete(runner.busy, userID)
+
+	// Without a session the campaign waits and its recipients stay queued
+	runner.sendDue(time.Now())
+	runner.inflight.Wait()
+	campaign, err = s.getCampaign(userID, campaignID)
+	if err != nil {
+		t.Fatalf("Failed to get campaign: %v", err)
+	}
+	if campaign.Recipients["queued"] != 2 || campaign.NextSendAtUnix <= time.Now().Unix() {
+		t.Errorf("Expected the campaign to be postponed, got %+v", campaign)
+	}
+
+	paused := executeRequest(t, s, newRequest("4", "campaigns.pause", map[string]interface{}{
+		"token": "campaign-token",
+		"id":    campaignID,
+	}).toJSON(t))
+	if result := assertJSONRPC20Success(t, paused, "4").(map[string]interface{}); result["status"] != campaignStatusPaused {
+		t.Errorf("Expected a paused campaign, got %v", result)
+	}
+	pausedAgain := executeRequest(t, s, newRequest("5", "campaigns.pause", map[string]interface{}{
+		"token": "campaign-token",
+		"id":    campaignID,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, pausedAgain, "5", 409)
+
+	resumed := executeRequest(t, s, newRequest("6", "campaigns.resume", map[string]interface{}{
+		"token": "campaign-token",
+		"id":    campaignID,
+	}).toJSON(t))
+	if result := assertJSONRPC20Success(t, resumed, "6").(map[string]interface{}); result["status"] != campaignStatusRunning {
+		t.Errorf("Expected a running campaign, got %v", result)
+	}
+
+	// Receipts move recipients forward and never back
+	if _, err := s.db.Exec("UPDATE campaign_recipients SET status=$1, message_id=$2 WHERE campaign_id=$3 AND position=0",
+		recipientStatusSent, "MSG1", campaignID); err != nil {
+		t.Fatalf("Failed to update recipient: %v", err)
+	}
+	now := time.Now()
+	updateCampaignReceipts(s.db, userID, []string{"MSG1"}, types.ReceiptTypeRead, now)
+	updateCampaignReceipts(s.db, userID, []string{"MSG1"}, types.ReceiptTypeDelivered, now.Add(time.Second))
+
+	list := executeRequest(t, s, newRequest("7", "campaigns.recipients", map[string]interface{}{
+		"token":  "campaign-token",
+		"id":     campaignID,
+		"status": "read",
+	}).toJSON(t))
+	listed := assertJSONRPC20Success(t, list, "7").(map[string]interface{})["recipients"].([]interface{})
+	if len(listed) != 1 {
+		t.Fatalf("Expected one read recipient, got %v", listed)
+	}
+	recipient := listed[0].(map[string]interface{})
+	if recipient["phone"] != "5491155553934" || recipient["read_at"] == nil || recipient["delivered_at"] == nil {
+		t.Errorf("Unexpected recipient: %v", recipient)
+	}
+
+	// A campaign without queued recipients completes
+	if _, err := s.db.Exec("UPDATE campaign_recipients SET status=$1 WHERE campaign_id=$2 AND position=1", recipientStatusFailed, campaignID); err != nil {
+		t.Fatalf("Failed to update recipient: %v", err)
+	}
+	runner.sendDue(time.Now())
+	runner.inflight.Wait()
+	if campaign, err = s.getCampaign(userID, campaignID); err != nil || campaign.Status != campaignStatusCompleted {
+		t.Errorf("Expected a completed campaign, got %+v (%v)", campaign, err)
+	}
+
+	cancelled := executeRequest(t, s, newRequest("8", "campaigns.cancel", map[string]interface{}{
+		"token": "campaign-token",
+		"id":    campaignID,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, cancelled, "8", 409)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	defaultChatListLimit = 50
+	maxChatListLimit     = 200
+	maxChatPreviewLength = 200
+)
+
+var errInvalidChatCursor = errors.New("invalid cursor")
+
+// Chat is a chat of an instance in the chat list. The last message and unread
+// count are kept from the messages the instance sees; the archived, pinned and
+// muted flags come from the app state whatsmeow syncs.
+type Chat struct {
+	JID          string           `json:"jid" db:"chat_jid"`
+	Name         string           `json:"name" db:"name"`
+	IsGroup      bool             `json:"is_group" db:"-"`
+	LastMessage  *ChatLastMessage `json:"last_message" db:"-"`
+	LastActivity time.Time        `json:"last_activity" db:"-"`
+	UnreadCount  int              `json:"unread_count" db:"unread_count"`
+	Archived     bool             `json:"archived" db:"-"`
+	Pinned       bool             `json:"pinned" db:"-"`
+	Muted        bool             `json:"muted" db:"-"`
+	MutedUntil   *time.Time       `json:"muted_until" db:"-"`
+
+	LastMessageID      string `json:"-" db:"last_message_id"`
+	LastMessageType    string `json:"-" db:"last_message_type"`
+	LastMessagePreview string `json:"-" db:"last_message_preview"`
+	LastSender         string `json:"-" db:"last_sender"`
+	LastFromMe         bool   `json:"-" db:"last_from_me"`
+	LastMessageAtUnix  int64  `json:"-" db:"last_message_at"`
+}
+
+// ChatLastMessage is the latest message of a chat
+type ChatLastMessage struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Preview   string    `json:"preview"`
+	Sender    string    `json:"sender"`
+	FromMe    bool      `json:"from_me"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// fill sets the API fields from the stored columns
+func (c *Chat) fill() {
+	c.LastActivity = time.Unix(c.LastMessageAtUnix, 0).UTC()
+	c.LastMessage = &ChatLastMessage{
+		ID:        c.LastMessageID,
+		Type:      c.LastMessageType,
+		Preview:   c.LastMessagePreview,
+		Sender:    c.LastSender,
+		FromMe:    c.LastFromMe,
+		Timestamp: c.LastActivity,
+	}
+	if jid, err := types.ParseJID(c.JID); err == nil {
+		c.IsGroup = jid.Server == types.GroupServer
+	}
+}
+
+const chatColumns = `chat_jid, name, unread_count, last_message_id, last_message_type, last_message_preview, last_sender, last_from_me, last_message_at`
+
+// chatMessage is a message that updates the chat list
+type chatMessage struct {
+	Chat    string
+	ID      string
+	Type    string
+	Preview string
+	Sender  string
+	FromMe  bool
+	At      time.Time
+	// Name is the chat name the message reveals, such as the push name of the
+	// other party of a private chat, or ""
+	Name string
+}
+
+// recordChatMessage makes a message the last one of its chat, unless the chat
+// already has a later one. Messages from others add to the unread count; a
+// message sent from another device of the account means the chat was read there.
+func recordChatMessage(db *sqlx.DB, userID string, msg chatMessage) error {
+	unread := 1
+	if msg.FromMe {
+		unread = 0
+	}
+	if len(msg.Preview) > maxChatPreviewLength {
+		msg.Preview = strings.ToValidUTF8(msg.Preview[:maxChatPreviewLength], "")
+	}
+	_, err := db.Exec(`
+		INSERT INTO chats (user_id, chat_jid, name, unread_count, last_message_id, last_message_type, last_message_preview, last_sender, last_from_me, last_message_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, chat_jid) DO UPDATE SET
+			name = CASE WHEN excluded.name <> '' THEN excluded.name ELSE chats.name END,
+			unread_count = CASE WHEN excluded.last_from_me THEN 0 ELSE chats.unread_count + excluded.unread_count END,
+			last_message_id = excluded.last_message_id,
+			last_message_type = excluded.last_message_type,
+			last_message_preview = excluded.last_message_preview,
+			last_sender = excluded.last_sender,
+			last_from_me = excluded.last_from_me,
+			last_message_at = excluded.last_message_at
+		WHERE chats.last_message_at <= excluded.last_message_at`,
+		userID, msg.Chat, msg.Name, unread, msg.ID, msg.Type, msg.Preview, msg.Sender, msg.FromMe, msg.At.Unix())
+	return err
+}
+
+// setChatUnread sets the unread count of a chat; a chat marked as unread with
+// nothing unread counts one unread message, as WhatsApp shows it
+func setChatUnread(db *sqlx.DB, userID string, chatJID string, read bool) error {
+	query := "UPDATE chats SET unread_count = 0 WHERE user_id = $1 AND chat_jid = $2"
+	if !read {
+		query = "UPDATE chats SET unread_count = 1 WHERE user_id = $1 AND chat_jid = $2 AND unread_count = 0"
+	}
+	_, err := db.Exec(query, userID, chatJID)
+	return err
+}
+
+// setChatName sets the name of a chat, such as the subject of a group
+func setChatName(db *sqlx.DB, userID string, chatJID string, name string) error {
+	_, err := db.Exec("UPDATE chats SET name = $1 WHERE user_id = $2 AND chat_jid = $3", name, userID, chatJID)
+	return err
+}
+
+// messagePreview returns the type of a message and the text shown for it in the chat list
+func messagePreview(msg *waE2E.Message) (string, string) {
+	switch {
+	case msg.GetConversation() != "":
+		return "text", msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		return "text", msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		return "image", msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		return "video", msg.GetVideoMessage().GetCaption()
+	case msg.GetAudioMessage() != nil:
+		return "audio", ""
+	case msg.GetDocumentMessage() != nil:
+		preview := msg.GetDocumentMessage().GetCaption()
+		if preview == "" {
+			preview = msg.GetDocumentMessage().GetFileName()
+		}
+		return "document", preview
+	case msg.GetStickerMessage() != nil:
+		return "sticker", ""
+	case msg.GetContactMessage() != nil:
+		return "contact", msg.GetContactMessage().GetDisplayName()
+	case msg.GetLocationMessage() != nil:
+		return "location", msg.GetLocationMessage().GetName()
+	case pollCreationOf(msg) != nil:
+		return "poll", pollCreationOf(msg).GetName()
+	}
+	return "", ""
+}
+
+// handleChatMessage updates the chat list with a received message. Reactions,
+// edits, revokes and poll votes do not change the last message.
+func (mycli *MyClient) handleChatMessage(evt *events.Message) {
+	if evt.Info.Chat.Server == types.BroadcastServer {
+		return
+	}
+	messageType, preview := messagePreview(evt.Message)
+	if messageType == "" {
+		return
+	}
+
+	msg := chatMessage{
+		Chat:    evt.Info.Chat.String(),
+		ID:      evt.Info.ID,
+		Type:    messageType,
+		Preview: preview,
+		Sender:  evt.Info.Sender.ToNonAD().String(),
+		FromMe:  evt.Info.IsFromMe,
+		At:      evt.Info.Timestamp,
+	}
+	if !evt.Info.IsGroup && !evt.Info.IsFromMe {
+		msg.Name = evt.Info.PushName
+	}
+	if err := recordChatMessage(mycli.db, mycli.userID, msg); err != nil {
+		log.Error().Err(err).Str("chat", msg.Chat).Msg("Failed to update chat list")
+	}
+}
+
+// historySyncChat returns the chat list entry of a conversation of a history sync:
+// its latest message with a preview, or its last activity if it has none, and the
+// unread count WhatsApp keeps for it. ownerJID is the sender of messages from the
+// account. It returns false for chats the list leaves out.
+func historySyncChat(conv *waHistorySync.Conversation, ownerJID string) (chatMessage, int, bool) {
+	chatJID, err := types.ParseJID(conv.GetID())
+	if err != nil || chatJID.Server == types.BroadcastServer {
+		return chatMessage{}, 0, false
+	}
+
+	msg := chatMessage{Chat: chatJID.String(), At: time.Unix(int64(conv.GetConversationTimestamp()), 0)}
+	latest := uint64(0)
+	for _, item := range conv.GetMessages() {
+		info := item.GetMessage()
+		messageType, preview := messagePreview(info.GetMessage())
+		if messageType == "" || info.GetMessageTimestamp() <= latest {
+			continue
+		}
+		latest = info.GetMessageTimestamp()
+		key := info.GetKey()
+		msg.ID = key.GetID()
+		msg.Type = messageType
+		msg.Preview = preview
+		msg.FromMe = key.GetFromMe()
+		msg.At = time.Unix(int64(latest), 0)
+		switch {
+		case msg.FromMe:
+			msg.Sender = ownerJID
+		case chatJID.Server == types.GroupServer:
+			msg.Sender = key.GetParticipant()
+			if msg.Sender == "" {
+				msg.Sender = info.GetParticipant()
+			}
+		default:
+			msg.Sender = msg.Chat
+		}
+	}
+	if msg.At.Unix() <= 0 {
+		return chatMessage{}, 0, false
+	}
+
+	msg.Name = conv.GetName()
+	if msg.Name == "" {
+		msg.Name = conv.GetDisplayName()
+	}
+	unread := int(conv.GetUnreadCount())
+	if unread == 0 && conv.GetMarkedAsUnread() {
+		unread = 1
+	}
+	return msg, unread, true
+}
+
+// recordHistorySyncChat adds a chat of a history sync to the chat list, or updates
+// it unless it already has a later message. The unread count is the one of the
+// sync, as WhatsApp counted it, rather than added to the stored one.
+func recordHistorySyncChat(db *sqlx.DB, userID string, msg chatMessage, unread int) error {
+	if len(msg.Preview) > maxChatPreviewLength {
+		msg.Preview = strings.ToValidUTF8(msg.Preview[:maxChatPreviewLength], "")
+	}
+	_, err := db.Exec(`
+		INSERT INTO chats (user_id, chat_jid, name, unread_count, last_message_id, last_message_type, last_message_preview, last_sender, last_from_me, last_message_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, chat_jid) DO UPDATE SET
+			name = CASE WHEN excluded.name <> '' THEN excluded.name ELSE chats.name END,
+			unread_count = excluded.unread_count,
+			last_message_id = excluded.last_message_id,
+			last_message_type = excluded.last_message_type,
+			last_message_preview = excluded.last_message_preview,
+			last_sender = excluded.last_sender,
+			last_from_me = excluded.last_from_me,
+			last_message_at = excluded.last_message_at
+		WHERE chats.last_message_at <= excluded.last_message_at`,
+		userID, msg.Chat, msg.Name, unread, msg.ID, msg.Type, msg.Preview, msg.Sender, msg.FromMe, msg.At.Unix())
+	if err != nil || msg.Name == "" {
+		return err
+	}
+	// A chat with later messages still takes its name from the sync
+	_, err = db.Exec("UPDATE chats SET name = $1 WHERE user_id = $2 AND chat_jid = $3 AND name = ''", msg.Name, userID, msg.Chat)
+	return err
+}
+
+// handleHistorySyncChats updates the chat list with the conversations of a history sync
+func (mycli *MyClient) handleHistorySyncChats(conversations []*waHistorySync.Conversation, ownerJID string) {
+	for _, conv := range conversations {
+		msg, unread, ok := historySyncChat(conv, ownerJID)
+		if !ok {
+			continue
+		}
+		if err := recordHistorySyncChat(mycli.db, mycli.userID, msg, unread); err != nil {
+			log.Error().Err(err).Str("chat", msg.Chat).Msg("Failed to update chat list from history sync")
+		}
+	}
+}
+
+// encodeChatCursor returns the cursor of the chats after c
+func encodeChatCursor(c Chat) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d|%s", c.LastMessageAtUnix, c.JID)))
+}
+
+// decodeChatCursor returns the last activity and JID of the chat a cursor follows
+func decodeChatCursor(cursor string) (int64, string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		if at, jid, ok := strings.Cut(string(decoded), "|"); ok {
+			if unix, err := strconv.ParseInt(at, 10, 64); err == nil {
+				return unix, jid, nil
+			}
+		}
+	}
+	return 0, "", errInvalidChatCursor
+}
+
+// listChats returns a page of the chats of a user, most recently active first,
+// with the cursor of the next page or "" on the last one
+func listChats(db *sqlx.DB, userID string, cursor string, limit int) ([]Chat, string, error) {
+	conditions := "user_id = $1"
+	args := []interface{}{userID}
+	if cursor != "" {
+		at, jid, err := decodeChatCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		conditions += " AND (last_message_at < $2 OR (last_message_at = $2 AND chat_jid > $3))"
+		args = append(args, at, jid)
+	}
+
+	chats := []Chat{}
+	query := fmt.Sprintf("SELECT %s FROM chats WHERE %s ORDER BY last_message_at DESC, chat_jid LIMIT $%d", chatColumns, conditions, len(args)+1)
+	if err := db.Select(&chats, query, append(args, limit+1)...); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(chats) > limit {
+		chats = chats[:limit]
+		next = encodeChatCursor(chats[limit-1])
+	}
+	for i := range chats {
+		chats[i].fill()
+	}
+	return chats, next, nil
+}
+
+// describeChats adds what the whatsmeow store knows about chats: contact names and
+// the app state flags. Groups without a name get it from WhatsApp, and keep it.
+func (s *server) describeChats(userID string, chats []Chat) {
+	client := clientManager.GetWhatsmeowClient(userID)
+	if client == nil || client.Store == nil || client.Store.ID == nil {
+		return
+	}
+	ctx := context.Background()
+
+	for i := range chats {
+		chat := &chats[i]
+		jid, err := types.ParseJID(chat.JID)
+		if err != nil {
+			continue
+		}
+
+		if settings, err := client.Store.ChatSettings.GetChatSettings(ctx, jid); err == nil && settings.Found {
+			chat.Archived = settings.Archived
+			chat.Pinned = settings.Pinned
+			if settings.MutedUntil.After(time.Now()) {
+				chat.Muted = true
+				mutedUntil := settings.MutedUntil.UTC()
+				chat.MutedUntil = &mutedUntil
+			}
+		}
+
+		switch {
+		case chat.IsGroup && chat.Name == "" && client.IsConnected():
+			info, err := client.GetGroupInfo(ctx, jid)
+			if err != nil {
+				log.Warn().Err(err).Str("chat", chat.JID).Msg("Failed to get group name for chat list")
+				continue
+			}
+			chat.Name = info.Name
+			if err := setChatName(s.db, userID, chat.JID, info.Name); err != nil {
+				log.Error().Err(err).Str("chat", chat.JID).Msg("Failed to store group name")
+			}
+		case !chat.IsGroup:
+			contact, err := client.Store.Contacts.GetContact(ctx, jid)
+			if err != nil || !contact.Found {
+				continue
+			}
+			for _, name := range []string{contact.FullName, contact.FirstName, contact.BusinessName, contact.PushName} {
+				if name != "" {
+					chat.Name = name
+					break
+				}
+			}
+		}
+	}
+}
+
+// sendPayloadPreview returns the chat list preview of a message sent through a send route
+func sendPayloadPreview(body []byte) string {
+	var payload map[string]interface{}
+	if json.Unmarshal(body, &payload) != nil {
+		return ""
+	}
+	for _, key := range []string{"Body", "Caption", "header", "Title", "Desc", "Name"} {
+		if value, ok := payload[key].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// backfillChats fills the chat list from the message history when it is created
+func backfillChats(tx *sqlx.Tx) error {
+	var latest []struct {
+		UserID      string    `db:"user_id"`
+		ChatJID     string    `db:"chat_jid"`
+		SenderJID   string    `db:"sender_jid"`
+		MessageID   string    `db:"message_id"`
+		Timestamp   time.Time `db:"timestamp"`
+		MessageType string    `db:"message_type"`
+		TextContent string    `db:"text_content"`
+	}
+	err := tx.Select(&latest, `
+		SELECT user_id, chat_jid, sender_jid, message_id, timestamp, message_type, COALESCE(text_content, '') AS text_content
+		FROM message_history
+		WHERE id IN (
+			SELECT MAX(id) FROM message_history
+			WHERE message_type NOT IN ('reaction', 'delete')
+			GROUP BY user_id, chat_jid
+		)`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range latest {
+		preview := m.TextContent
+		if preview == ":"+m.MessageType+":" {
+			preview = ""
+		}
+		if len(preview) > maxChatPreviewLength {
+			preview = strings.ToValidUTF8(preview[:maxChatPreviewLength], "")
+		}
+		_, err := tx.Exec(`
+			INSERT INTO chats (user_id, chat_jid, last_message_id, last_message_type, last_message_preview, last_sender, last_from_me, last_message_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (user_id, chat_jid) DO NOTHING`,
+			m.UserID, m.ChatJID, m.MessageID, m.MessageType, preview, m.SenderJID, m.SenderJID == "me", m.Timestamp.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
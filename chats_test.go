@@ -0,0 +1,232 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestChatList(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	for _, user := range []struct{ name, token string }{{"ChatsUser", "chats-token"}, {"OtherChatsUser", "other-chats-token"}} {
+		executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+			"adminToken": "test-admin-token",
+			"name":       user.name,
+			"token":      user.token,
+		}).toJSON(t))
+	}
+	userID := func(token string) string {
+		var id string
+		if err := s.db.Get(&id, "SELECT id FROM users WHERE token = $1", token); err != nil {
+			t.Fatalf("Failed to get user id: %v", err)
+		}
+		return id
+	}
+	mycli := &MyClient{db: s.db, userID: userID("chats-token")}
+
+	base := time.Date(2025, 4, 1, 8, 0, 0, 0, time.UTC)
+	alice := types.NewJID("5491155550001", types.DefaultUserServer)
+	bob := types.NewJID("5491155550002", types.DefaultUserServer)
+	group := types.NewJID("120363313346913103", types.GroupServer)
+	names := map[types.JID]string{alice: "Alice", bob: "Bob"}
+	receive := func(chat, sender types.JID, id string, fromMe bool, at time.Time, msg *waE2E.Message) {
+		mycli.handleChatMessage(&events.Message{
+			Info: types.MessageInfo{
+				MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsFromMe: fromMe, IsGroup: chat.Server == types.GroupServer},
+				ID:            id,
+				PushName:      names[sender],
+				Timestamp:     at,
+			},
+			Message: msg,
+		})
+	}
+	text := func(body string) *waE2E.Message { return &waE2E.Message{Conversation: proto.String(body)} }
+
+	receive(alice, alice, "A1", false, base, text("Hi"))
+	receive(alice, alice, "A2", false, base.Add(time.Minute), &waE2E.Message{ImageMessage: &waE2E.ImageMessage{Caption: proto.String("Look")}})
+	// Reactions do not change the last message, older messages are ignored
+	receive(alice, alice, "A3", false, base.Add(2*time.Minute), &waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{Text: proto.String("👍")}})
+	receive(alice, alice, "A0", false, base.Add(-time.Minute), text("Old"))
+	receive(bob, bob, "B1", false, base.Add(3*time.Minute), text("Hello"))
+	receive(bob, bob, "B2", false, base.Add(4*time.Minute), text("Are you there?"))
+	// A message sent from another device means the chat was read there
+	receive(group, types.NewJID("5491155559999", types.DefaultUserServer), "G1", true, base.Add(5*time.Minute), text("Meeting at 10"))
+	if err := recordChatMessage(s.db, userID("other-chats-token"), chatMessage{Chat: alice.String(), ID: "O1", Type: "text", At: base}); err != nil {
+		t.Fatalf("Failed to record chat message: %v", err)
+	}
+
+	// Marking a chat as unread from another device shows one unread message
+	if err := setChatUnread(s.db, mycli.userID, group.String(), false); err != nil {
+		t.Fatalf("Failed to mark chat unread: %v", err)
+	}
+	if err := setChatUnread(s.db, mycli.userID, bob.String(), true); err != nil {
+		t.Fatalf("Failed to mark chat read: %v", err)
+	}
+
+	list := func(requestID string, params map[string]interface{}) ([]map[string]interface{}, string) {
+		params["token"] = "chats-token"
+		got := executeRequest(t, s, newRequest(requestID, "chat.list", params).toJSON(t))
+		result := assertJSONRPC20Success(t, got, requestID).(map[string]interface{})
+		chats := []map[string]interface{}{}
+		for _, chat := range result["chats"].([]interface{}) {
+			chats = append(chats, chat.(map[string]interface{}))
+		}
+		return chats, result["next_cursor"].(string)
+	}
+
+	chats, next := list("2", map[string]interface{}{})
+	if len(chats) != 3 || next != "" {
+		t.Fatalf("Expected 3 chats and no next cursor, got %d %q", len(chats), next)
+	}
+	expected := []struct {
+		jid     string
+		name    string
+		unread  float64
+		id      string
+		preview string
+		isGroup bool
+	}{
+		{group.String(), "", 1, "G1", "Meeting at 10", true},
+		{bob.String(), "Bob", 0, "B2", "Are you there?", false},
+		{alice.String(), "Alice", 2, "A2", "Look", false},
+	}
+	for i, want := range expected {
+		chat := chats[i]
+		last := chat["last_message"].(map[string]interface{})
+		if chat["jid"] != want.jid || chat["name"] != want.name || chat["unread_count"] != want.unread ||
+			last["id"] != want.id || last["preview"] != want.preview || chat["is_group"] != want.isGroup {
+			t.Errorf("Unexpected chat %d: %v", i, chat)
+		}
+	}
+
+	// Cursor pagination
+	first, next := list("3", map[string]interface{}{"limit": 2})
+	if len(first) != 2 || next == "" {
+		t.Fatalf("Expected a page of 2 with a cursor, got %d %q", len(first), next)
+	}
+	second, last := list("4", map[string]interface{}{"limit": 2, "cursor": next})
+	if len(second) != 1 || last != "" || second[0]["jid"] != alice.String() {
+		t.Errorf("Unexpected second page: %v %q", second, last)
+	}
+
+	got := executeRequest(t, s, newRequest("5", "chat.list", map[string]interface{}{
+		"token":  "chats-token",
+		"cursor": "not-a-cursor",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, got, "5", 400)
+}
+
+func TestHistorySyncChats(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+	mycli := &MyClient{db: s.db, userID: "user1"}
+
+	base := time.Date(2025, 4, 1, 8, 0, 0, 0, time.UTC)
+	alice := "5491155550001@s.whatsapp.net"
+	bob := "5491155550002@s.whatsapp.net"
+	group := "120363313346913103@g.us"
+	message := func(id string, fromMe bool, participant string, at time.Time, msg *waE2E.Message) *waHistorySync.HistorySyncMsg {
+		return &waHistorySync.HistorySyncMsg{Message: &waWeb.WebMessageInfo{
+			Key:              &waCommon.MessageKey{ID: proto.String(id), FromMe: proto.Bool(fromMe), Participant: proto.String(participant)},
+			MessageTimestamp: proto.Uint64(uint64(at.Unix())),
+			Message:          msg,
+		}}
+	}
+	text := func(body string) *waE2E.Message { return &waE2E.Message{Conversation: proto.String(body)} }
+
+	// Bob has a live message later than the sync
+	if err := recordChatMessage(s.db, "user1", chatMessage{Chat: bob, ID: "B9", Type: "text", Preview: "Live", Sender: bob, At: base.Add(time.Hour)}); err != nil {
+		t.Fatalf("Failed to record chat message: %v", err)
+	}
+	mycli.handleHistorySyncChats([]*waHistorySync.Conversation{
+		{
+			ID:          proto.String(alice),
+			Name:        proto.String("Alice"),
+			UnreadCount: proto.Uint32(2),
+			Messages: []*waHistorySync.HistorySyncMsg{
+				message("A2", false, "", base.Add(2*time.Minute), text("Second")),
+				message("A3", false, "", base.Add(3*time.Minute), &waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{Text: proto.String("👍")}}),
+				message("A1", true, "", base.Add(time.Minute), text("First")),
+			},
+		},
+		{
+			ID:             proto.String(group),
+			Name:           proto.String("Team"),
+			MarkedAsUnread: proto.Bool(true),
+			Messages: []*waHistorySync.HistorySyncMsg{
+				message("G1", false, alice, base.Add(4*time.Minute), text("Meeting at 10")),
+			},
+		},
+		{ID: proto.String(bob), Name: proto.String("Bob"), UnreadCount: proto.Uint32(5), Messages: []*waHistorySync.HistorySyncMsg{message("B1", false, "", base, text("Old"))}},
+		{ID: proto.String("status@broadcast"), Messages: []*waHistorySync.HistorySyncMsg{message("S1", false, alice, base, text("Status"))}},
+	}, "5491155559999@s.whatsapp.net")
+
+	chats, _, err := listChats(s.db, "user1", "", 10)
+	if err != nil {
+		t.Fatalf("Failed to list chats: %v", err)
+	}
+	if len(chats) != 3 {
+		t.Fatalf("Expected 3 chats, got %d", len(chats))
+	}
+	expected := []struct {
+		jid, name, id, preview, sender string
+		unread                         int
+	}{
+		{bob, "Bob", "B9", "Live", bob, 1},
+		{group, "Team", "G1", "Meeting at 10", alice, 1},
+		{alice, "Alice", "A2", "Second", alice, 2},
+	}
+	for i, want := range expected {
+		chat := chats[i]
+		if chat.JID != want.jid || chat.Name != want.name || chat.LastMessageID != want.id || chat.LastMessagePreview != want.preview ||
+			chat.LastSender != want.sender || chat.UnreadCount != want.unread {
+			t.Errorf("Unexpected chat %d: %+v", i, chat)
+		}
+	}
+}
+
+func TestBackfillChats(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	base := time.Date(2025, 4, 1, 8, 0, 0, 0, time.UTC)
+	for i, m := range []struct{ chat, sender, id, messageType, text string }{
+		{"5491155550001@s.whatsapp.net", "5491155550001@s.whatsapp.net", "M1", "text", "First"},
+		{"5491155550001@s.whatsapp.net", "me", "M2", "image", ":image:"},
+		{"5491155550001@s.whatsapp.net", "5491155550001@s.whatsapp.net", "M3", "reaction", "👍"},
+	} {
+		_, err := s.db.Exec(`
+			INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link)
+			VALUES ('user1', $1, $2, $3, $4, $5, $6, '')`,
+			m.chat, m.sender, m.id, historyTime(base.Add(time.Duration(i)*time.Minute)), m.messageType, m.text)
+		if err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	tx := s.db.MustBegin()
+	if err := backfillChats(tx); err != nil {
+		t.Fatalf("Failed to backfill chats: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	chats, _, err := listChats(s.db, "user1", "", 10)
+	if err != nil {
+		t.Fatalf("Failed to list chats: %v", err)
+	}
+	if len(chats) != 1 || chats[0].LastMessageID != "M2" || chats[0].LastMessagePreview != "" || !chats[0].LastFromMe ||
+		!chats[0].LastActivity.Equal(base.Add(time.Minute)) {
+		t.Errorf("Unexpected chats: %+v", chats)
+	}
+}
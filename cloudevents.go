@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// webhookFormatCloudEvents sends a structured-mode CloudEvent (application/cloudevents+json)
+	webhookFormatCloudEvents = "cloudevents"
+	// webhookFormatCloudEventsBinary sends the event data as the body and the attributes as ce-* headers
+	webhookFormatCloudEventsBinary = "cloudevents-binary"
+
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsTypePrefix  = "wuzapi."
+)
+
+// CloudEvent is a CloudEvents 1.0 envelope around a wuzapi event.
+// userid and instancename are extension attributes.
+type CloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	Time            string                 `json:"time"`
+	Subject         string                 `json:"subject,omitempty"`
+	DataContentType string                 `json:"datacontenttype"`
+	UserID          string                 `json:"userid"`
+	InstanceName    string                 `json:"instancename,omitempty"`
+	Data            map[string]interface{} `json:"data"`
+}
+
+// isCloudEventsFormat reports whether a resolved webhook format produces CloudEvents
+func isCloudEventsFormat(format string) bool {
+	return format == webhookFormatCloudEvents || format == webhookFormatCloudEventsBinary
+}
+
+// newCloudEvent wraps the jsonData of a webhook payload in a CloudEvents envelope,
+// with the id and time of the event so every attempt to deliver it is the same event
+func newCloudEvent(event webhookEvent, jsonData string, userID string, instanceName string) (CloudEvent, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonData), &data); err != nil {
+		return CloudEvent{}, err
+	}
+
+	eventType, _ := data["type"].(string)
+	return CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              event.ID,
+		Source:          "/instances/" + userID,
+		Type:            cloudEventType(eventType, data),
+		Time:            event.Time.UTC().Format(time.RFC3339Nano),
+		Subject:         cloudEventSubject(data),
+		DataContentType: "application/json",
+		UserID:          userID,
+		InstanceName:    instanceName,
+		Data:            data,
+	}, nil
+}
+
+// binaryHeaders returns the ce-* headers of the binary content mode
+func (e CloudEvent) binaryHeaders() map[string]string {
+	headers := map[string]string{
+		"ce-specversion": e.SpecVersion,
+		"ce-id":          e.ID,
+		"ce-source":      e.Source,
+		"ce-type":        e.Type,
+		"ce-time":        e.Time,
+		"ce-userid":      e.UserID,
+	}
+	if e.Subject != "" {
+		headers["ce-subject"] = e.Subject
+	}
+	if e.InstanceName != "" {
+		headers["ce-instancename"] = e.InstanceName
+	}
+	return headers
+}
+
+// cloudEventType maps a wuzapi event type to a CloudEvents type, e.g.
+// Message -> wuzapi.message.received and ChatPresence -> wuzapi.chat.presence
+func cloudEventType(eventType string, data map[string]interface{}) string {
+	if eventType == "Message" {
+		if event, ok := data["event"].(map[string]interface{}); ok {
+			if info, ok := event["Info"].(map[string]interface{}); ok {
+				if fromMe, _ := info["IsFromMe"].(bool); fromMe {
+					return cloudEventsTypePrefix + "message.sent"
+				}
+			}
+		}
+		return cloudEventsTypePrefix + "message.received"
+	}
+	if eventType == "" {
+		return cloudEventsTypePrefix + "unknown"
+	}
+	return cloudEventsTypePrefix + dottedLowerCase(eventType)
+}
+
+// dottedLowerCase splits a CamelCase name into lower-case words joined by dots
+func dottedLowerCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// cloudEventSubject extracts the chat JID of an event when it has one
+func cloudEventSubject(data map[string]interface{}) string {
+	event, ok := data["event"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if info, ok := event["Info"].(map[string]interface{}); ok {
+		if chat, _ := info["Chat"].(string); chat != "" {
+			return chat
+		}
+	}
+	for _, field := range []string{"Chat", "From", "JID"} {
+		if value, _ := event[field].(string); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// rabbitFormat returns the message format used for RabbitMQ events (RABBITMQ_FORMAT)
+func rabbitFormat() string {
+	return os.Getenv("RABBITMQ_FORMAT")
+}
+
+// cloudEventJSON builds a structured-mode CloudEvent for RabbitMQ
+func cloudEventJSON(jsonData []byte, userID string, instanceName string) ([]byte, error) {
+	event, err := newWebhookEvent()
+	if err != nil {
+		return nil, err
+	}
+	cloudEvent, err := newCloudEvent(event, string(jsonData), userID, instanceName)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to build CloudEvent")
+		return nil, err
+	}
+	return json.Marshal(cloudEvent)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCloudEventType(t *testing.T) {
+	cases := map[string]string{
+		"ChatPresence":         "wuzapi.chat.presence",
+		"QRTimeout":            "wuzapi.qr.timeout",
+		"ReadReceipt":          "wuzapi.read.receipt",
+		"UndecryptableMessage": "wuzapi.undecryptable.message",
+	}
+	for eventType, expected := range cases {
+		if got := cloudEventType(eventType, nil); got != expected {
+			t.Errorf("cloudEventType(%q) = %q, want %q", eventType, got, expected)
+		}
+	}
+
+	sent := map[string]interface{}{"event": map[string]interface{}{"Info": map[string]interface{}{"IsFromMe": true}}}
+	if got := cloudEventType("Message", sent); got != "wuzapi.message.sent" {
+		t.Errorf("Expected wuzapi.message.sent, got %q", got)
+	}
+	if got := cloudEventType("Message", nil); got != "wuzapi.message.received" {
+		t.Errorf("Expected wuzapi.message.received, got %q", got)
+	}
+}
+
+func TestWebhookCloudEventsFormats(t *testing.T) {
+	var headers http.Header
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	payload := map[string]string{
+		"jsonData":     `{"type":"Message","event":{"Info":{"Chat":"123@s.whatsapp.net","IsFromMe":false}}}`,
+		"userID":       "user-1",
+		"instanceName": "Sales",
+	}
+
+	at := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	if _, _, err := postWebhookOnce(ts.URL, payload, "user-1", "", webhookEvent{ID: "E1", Time: at}, nil, webhookFormatCloudEvents, 1); err != nil {
+		t.Fatalf("Structured webhook failed: %v", err)
+	}
+	if ct := headers.Get("Content-Type"); ct != cloudEventsContentType {
+		t.Errorf("Expected %s content type, got %q", cloudEventsContentType, ct)
+	}
+	var event CloudEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("Invalid structured CloudEvent: %v", err)
+	}
+	if event.SpecVersion != "1.0" || event.Type != "wuzapi.message.received" || event.Source != "/instances/user-1" ||
+		event.Subject != "123@s.whatsapp.net" || event.InstanceName != "Sales" || event.ID != "E1" || event.Time != "2025-06-01T12:00:00Z" {
+		t.Errorf("Unexpected CloudEvent: %+v", event)
+	}
+	if event.Data["type"] != "Message" {
+		t.Errorf("Expected original event as data, got %v", event.Data)
+	}
+
+	if _, _, err := postWebhookOnce(ts.URL, payload, "user-1", "", webhookEvent{ID: "E1", Time: at}, nil, webhookFormatCloudEventsBinary, 1); err != nil {
+		t.Fatalf("Binary webhook failed: %v", err)
+	}
+	if headers.Get("ce-specversion") != "1.0" || headers.Get("ce-type") != "wuzapi.message.received" ||
+		headers.Get("ce-subject") != "123@s.whatsapp.net" || headers.Get("ce-id") != "E1" {
+		t.Errorf("Missing binary mode headers: %v", headers)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil || data["type"] != "Message" {
+		t.Errorf("Expected event data as body, got %s", body)
+	}
+}
+
+func TestWebhookCloudEventsRetryKeepsIdentity(t *testing.T) {
+	o := makeTestOutbox(t)
+
+	var ids, times []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("ce-id"))
+		times = append(times, r.Header.Get("ce-time"))
+		if len(ids) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	payload := map[string]string{"jsonData": `{"type":"Message"}`}
+	if err := o.Enqueue(ts.URL, payload, "user-1", "", "", nil, webhookFormatCloudEventsBinary); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	var entryID string
+	if err := o.db.Get(&entryID, "SELECT id FROM webhook_outbox"); err != nil {
+		t.Fatalf("Failed to read outbox entry: %v", err)
+	}
+
+	drainOutbox(o)
+	drainOutbox(o)
+
+	if len(ids) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(ids))
+	}
+	if ids[0] != entryID || ids[1] != entryID {
+		t.Errorf("Expected both attempts to carry ce-id %s, got %v", entryID, ids)
+	}
+	if times[0] == "" || times[0] != times[1] {
+		t.Errorf("Expected both attempts to carry the same ce-time, got %v", times)
+	}
+}
@@ -71,6 +71,16 @@ var supportedEventTypes = []string{
 	// Facebook/Meta Bridge
 	"FBMessage",
 
+	// Scheduled messages
+	"ScheduledMessageSent",
+	"ScheduledMessageFailed",
+
+	// Async send queue
+	"SendResult",
+
+	// Polls
+	"PollVote",
+
 	// Special - receives all events
 	"All",
 }
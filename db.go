@@ -118,6 +118,14 @@ type HistoryMessage struct {
 	MediaLink       string    `json:"media_link" db:"media_link"`
 	QuotedMessageID string    `json:"quoted_message_id,omitempty" db:"quoted_message_id"`
 	DataJson        string    `json:"data_json" db:"datajson"`
+	EditedAtUnix    int64     `json:"-" db:"edited_at"`
+	DeletedAtUnix   int64     `json:"-" db:"deleted_at"`
+	// Current state of the message, set by attachHistoryRevisions
+	EditedAt  *time.Time        `json:"edited_at,omitempty" db:"-"`
+	Deleted   bool              `json:"deleted" db:"-"`
+	DeletedAt *time.Time        `json:"deleted_at,omitempty" db:"-"`
+	Edits     []HistoryEdit     `json:"edits" db:"-"`
+	Reactions []HistoryReaction `json:"reactions" db:"-"`
 }
 
 func (s *server) saveMessageToHistory(userID, chatJID, senderJID, messageID, messageType, textContent, mediaLink, quotedMessageID, dataJson string) error {
@@ -137,6 +145,15 @@ func (s *server) saveMessageToHistory(userID, chatJID, senderJID, messageID, mes
 func (s *server) trimMessageHistory(userID, chatJID string, limit int) error {
 	var queryHistory, querySecrets string
 
+	// A legal hold keeps the history of the chat from being trimmed
+	onHold, err := historyOnHold(s.db, userID, chatJID)
+	if err != nil {
+		return fmt.Errorf("failed to check legal hold: %w", err)
+	}
+	if onHold {
+		return nil
+	}
+
 	if s.db.DriverName() == "postgres" {
 		queryHistory = `
             DELETE FROM message_history
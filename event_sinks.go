@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	sinkNameWebhook       = "webhook"
+	sinkNameGlobalWebhook = "globalwebhook"
+	sinkNameRabbitMQ      = "rabbitmq"
+	sinkNameKafka         = "kafka"
+	sinkNameNATS          = "nats"
+	sinkNameRedis         = "redis"
+
+	// sinkQueueSize is how many events an asynchronous sink may lag behind before events are dropped
+	sinkQueueSize = 1000
+	// sinkPublishTimeout bounds a single publish to a broker
+	sinkPublishTimeout = 10 * time.Second
+)
+
+// Sink names accepted in per-user overrides, whether or not the sink is configured
+var knownEventSinks = []string{sinkNameWebhook, sinkNameGlobalWebhook, sinkNameRabbitMQ, sinkNameKafka, sinkNameNATS, sinkNameRedis}
+
+// operatorEventSinks deliver to the server operator; only an admin can turn them off
+// for an instance
+var operatorEventSinks = []string{sinkNameGlobalWebhook, sinkNameRabbitMQ}
+
+// EventSink delivers the events an instance is subscribed to. The user webhook,
+// the global webhook and RabbitMQ are sinks, as are the optional brokers.
+type EventSink interface {
+	// Name identifies the sink in per-user overrides
+	Name() string
+	// Enabled reports whether the sink is configured on this server
+	Enabled() bool
+	// DefaultDestination is the topic, subject, stream or queue used without an
+	// override; sinks returning "" do not support destination overrides
+	DefaultDestination() string
+	// Publish delivers one event; destination is empty unless the user overrides it
+	Publish(ctx context.Context, event SinkEvent, destination string) error
+	Close() error
+}
+
+// SinkEvent is one event of an instance as handed to the sinks
+type SinkEvent struct {
+	UserID       string
+	Token        string
+	InstanceName string
+	Type         string
+	Path         string
+	Data         []byte // event JSON, as sent to webhooks in jsonData
+	HmacKey      []byte // encrypted HMAC key of the user
+}
+
+// SinkOverride changes how one sink handles the events of a user
+type SinkOverride struct {
+	Enabled     *bool  `json:"enabled,omitempty"`
+	Destination string `json:"destination,omitempty"`
+}
+
+// eventSinks holds the sinks every subscribed event is dispatched to
+var eventSinks = newEventSinkRegistry()
+
+// eventSinkOverridesCache holds the per-user sink overrides, keyed by user ID
+var eventSinkOverridesCache = cache.New(5*time.Minute, 10*time.Minute)
+
+type sinkJob struct {
+	event       SinkEvent
+	destination string
+}
+
+type registeredSink struct {
+	sink  EventSink
+	queue chan sinkJob // nil for sinks published inline
+}
+
+type eventSinkRegistry struct {
+	mu    sync.RWMutex
+	sinks []*registeredSink
+	wg    sync.WaitGroup
+}
+
+func newEventSinkRegistry() *eventSinkRegistry {
+	return &eventSinkRegistry{}
+}
+
+// Register adds a sink. Asynchronous sinks get a queue and a worker of their own,
+// so a slow broker neither blocks event handling nor reorders its own events.
+func (r *eventSinkRegistry) Register(sink EventSink, async bool) {
+	rs := &registeredSink{sink: sink}
+	if async {
+		rs.queue = make(chan sinkJob, sinkQueueSize)
+		r.wg.Add(1)
+		go r.worker(rs)
+	}
+
+	r.mu.Lock()
+	r.sinks = append(r.sinks, rs)
+	r.mu.Unlock()
+
+	log.Info().Str("sink", sink.Name()).Bool("enabled", sink.Enabled()).Msg("Event sink registered")
+}
+
+func (r *eventSinkRegistry) worker(rs *registeredSink) {
+	defer r.wg.Done()
+	for job := range rs.queue {
+		publishToSink(rs.sink, job)
+	}
+}
+
+func publishToSink(sink EventSink, job sinkJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), sinkPublishTimeout)
+	defer cancel()
+	if err := sink.Publish(ctx, job.event, job.destination); err != nil {
+		log.Error().
+			Err(err).
+			Str("sink", sink.Name()).
+			Str("userID", job.event.UserID).
+			Str("eventType", job.event.Type).
+			Msg("Failed to publish event to sink")
+	}
+}
+
+// Get returns the registered sink with the given name
+func (r *eventSinkRegistry) Get(name string) (EventSink, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rs := range r.sinks {
+		if rs.sink.Name() == name {
+			return rs.sink, true
+		}
+	}
+	return nil, false
+}
+
+// List returns the registered sinks in registration order
+func (r *eventSinkRegistry) List() []EventSink {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sinks := make([]EventSink, 0, len(r.sinks))
+	for _, rs := range r.sinks {
+		sinks = append(sinks, rs.sink)
+	}
+	return sinks
+}
+
+// Dispatch hands an event to every enabled sink the user has not turned off
+func (r *eventSinkRegistry) Dispatch(db *sqlx.DB, event SinkEvent) {
+	overrides, err := getEventSinkOverrides(db, event.UserID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", event.UserID).Msg("Failed to load event sink overrides")
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rs := range r.sinks {
+		override := overrides[rs.sink.Name()]
+		if !rs.sink.Enabled() || (override.Enabled != nil && !*override.Enabled) {
+			continue
+		}
+
+		job := sinkJob{event: event, destination: override.Destination}
+		if rs.queue == nil {
+			publishToSink(rs.sink, job)
+			continue
+		}
+		select {
+		case rs.queue <- job:
+		default:
+			log.Warn().
+				Str("sink", rs.sink.Name()).
+				Str("userID", event.UserID).
+				Str("eventType", event.Type).
+				Msg("Event sink queue full, dropping event")
+		}
+	}
+}
+
+// Close drains the queues of the asynchronous sinks and closes every sink
+func (r *eventSinkRegistry) Close() {
+	r.mu.Lock()
+	sinks := r.sinks
+	r.sinks = nil
+	r.mu.Unlock()
+
+	for _, rs := range sinks {
+		if rs.queue != nil {
+			close(rs.queue)
+		}
+	}
+	r.wg.Wait()
+
+	for _, rs := range sinks {
+		if err := rs.sink.Close(); err != nil {
+			log.Error().Err(err).Str("sink", rs.sink.Name()).Msg("Failed to close event sink")
+		}
+	}
+}
+
+// sinkDestinationBase returns the queue, topic, base subject or stream a sink
+// publishes to by default, or "" for sinks without destinations
+func sinkDestinationBase(name string) string {
+	switch name {
+	case sinkNameRabbitMQ:
+		return rabbitQueue
+	case sinkNameKafka:
+		return *kafkaTopic
+	case sinkNameNATS:
+		return *natsSubject
+	case sinkNameRedis:
+		return *redisStream
+	}
+	return ""
+}
+
+// tenantSinkPrefix returns the prefix the destinations an instance chooses for a
+// sink must have: the default destination followed by the user ID
+func tenantSinkPrefix(name string, userID string) string {
+	return sinkDestinationBase(name) + "." + userID
+}
+
+// validateSinkOverride returns an error if an override is not allowed. Instances
+// may only choose destinations of their own and leave the operator sinks alone;
+// admins may choose any destination. No one may publish to the command queue.
+func validateSinkOverride(name string, override SinkOverride, userID string, admin bool) error {
+	if !Find(knownEventSinks, name) {
+		return fmt.Errorf("unknown sink %q. Use: %s", name, strings.Join(knownEventSinks, ", "))
+	}
+	if override.Enabled != nil && !admin && Find(operatorEventSinks, name) {
+		return fmt.Errorf("sink %s is managed by the server operator", name)
+	}
+	if override.Destination == "" {
+		return nil
+	}
+	if sinkDestinationBase(name) == "" {
+		return fmt.Errorf("sink %s does not support a destination", name)
+	}
+	if name == sinkNameRabbitMQ && *rabbitCommandQueue != "" && override.Destination == *rabbitCommandQueue {
+		return fmt.Errorf("destination %q is the command queue", override.Destination)
+	}
+	if prefix := tenantSinkPrefix(name, userID); !admin && override.Destination != prefix && !strings.HasPrefix(override.Destination, prefix+".") {
+		return fmt.Errorf("destination of sink %s must be %s or start with %q", name, prefix, prefix+".")
+	}
+	return nil
+}
+
+// mergeSinkOverrides returns the overrides of an instance in effect: its own, where
+// allowed, with the ones set by an admin taking precedence
+func mergeSinkOverrides(userID string, tenant map[string]SinkOverride, admin map[string]SinkOverride) map[string]SinkOverride {
+	merged := map[string]SinkOverride{}
+	for name, override := range tenant {
+		// Overrides saved before the checks existed are not trusted
+		if validateSinkOverride(name, SinkOverride{Enabled: override.Enabled}, userID, false) != nil {
+			override.Enabled = nil
+		}
+		if override.Destination != "" && validateSinkOverride(name, SinkOverride{Destination: override.Destination}, userID, false) != nil {
+			override.Destination = ""
+		}
+		if override.Enabled != nil || override.Destination != "" {
+			merged[name] = override
+		}
+	}
+	for name, override := range admin {
+		current := merged[name]
+		if override.Enabled != nil {
+			current.Enabled = override.Enabled
+		}
+		if override.Destination != "" {
+			current.Destination = override.Destination
+		}
+		merged[name] = current
+	}
+	return merged
+}
+
+// getEventSinkOverrides returns the sink overrides in effect for a user, using the
+// cache when possible
+func getEventSinkOverrides(db *sqlx.DB, userID string) (map[string]SinkOverride, error) {
+	if cached, found := eventSinkOverridesCache.Get(userID); found {
+		return cached.(map[string]SinkOverride), nil
+	}
+	if db == nil {
+		return nil, nil
+	}
+
+	var encoded struct {
+		Tenant string `db:"event_sinks"`
+		Admin  string `db:"admin_event_sinks"`
+	}
+	err := db.Get(&encoded, "SELECT COALESCE(event_sinks, '') AS event_sinks, COALESCE(admin_event_sinks, '') AS admin_event_sinks FROM users WHERE id = $1", userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	overrides := mergeSinkOverrides(userID, parseEventSinkOverrides(encoded.Tenant), parseEventSinkOverrides(encoded.Admin))
+	eventSinkOverridesCache.Set(userID, overrides, cache.DefaultExpiration)
+	return overrides, nil
+}
+
+// parseEventSinkOverrides decodes the event_sinks or admin_event_sinks column,
+// ignoring malformed content
+func parseEventSinkOverrides(encoded string) map[string]SinkOverride {
+	overrides := map[string]SinkOverride{}
+	if encoded == "" {
+		return overrides
+	}
+	if err := json.Unmarshal([]byte(encoded), &overrides); err != nil {
+		log.Error().Err(err).Msg("Failed to decode event sink overrides")
+		return map[string]SinkOverride{}
+	}
+	return overrides
+}
+
+// brokerMessage renders an event for a message broker: the event JSON with userID
+// and instanceName added, or a structured CloudEvent
+func brokerMessage(event SinkEvent, format string) ([]byte, string, error) {
+	if format == webhookFormatCloudEvents {
+		data, err := cloudEventJSON(event.Data, event.UserID, event.InstanceName)
+		return data, cloudEventsContentType, err
+	}
+
+	var originalData map[string]interface{}
+	if err := json.Unmarshal(event.Data, &originalData); err != nil {
+		return nil, "", err
+	}
+	originalData["userID"] = event.UserID
+	originalData["instanceName"] = event.InstanceName
+
+	data, err := json.Marshal(originalData)
+	return data, "application/json", err
+}
+
+// instanceNameForToken returns the name of the instance of a token from the user cache
+func instanceNameForToken(token string) string {
+	if userinfo, found := userinfocache.Get(token); found {
+		return userinfo.(Values).Get("Name")
+	}
+	return ""
+}
+
+// webhookSink enqueues events for the webhook URL of the user
+type webhookSink struct{}
+
+func (webhookSink) Name() string               { return sinkNameWebhook }
+func (webhookSink) Enabled() bool              { return true }
+func (webhookSink) DefaultDestination() string { return "" }
+func (webhookSink) Close() error               { return nil }
+
+func (webhookSink) Publish(ctx context.Context, event SinkEvent, destination string) error {
+	sendToUserWebHookWithHmac(getUserWebhookUrl(event.Token), event.Path, event.Data, event.UserID, event.Token, event.HmacKey)
+	return nil
+}
+
+// globalWebhookSink enqueues the events of every user for the global webhook (WUZAPI_GLOBAL_WEBHOOK)
+type globalWebhookSink struct{}
+
+func (globalWebhookSink) Name() string               { return sinkNameGlobalWebhook }
+func (globalWebhookSink) Enabled() bool              { return *globalWebhook != "" }
+func (globalWebhookSink) DefaultDestination() string { return "" }
+func (globalWebhookSink) Close() error               { return nil }
+
+func (globalWebhookSink) Publish(ctx context.Context, event SinkEvent, destination string) error {
+	sendToGlobalWebHook(event.Data, event.Token, event.UserID)
+	return nil
+}
+
+// rabbitSink publishes events to RabbitMQ (RABBITMQ_URL); the destination is a queue
+type rabbitSink struct{}
+
+func (rabbitSink) Name() string               { return sinkNameRabbitMQ }
+func (rabbitSink) Enabled() bool              { return os.Getenv("RABBITMQ_URL") != "" }
+func (rabbitSink) DefaultDestination() string { return rabbitQueue }
+
+func (rabbitSink) Publish(ctx context.Context, event SinkEvent, destination string) error {
+	return sendToGlobalRabbit(event, destination)
+}
+
+func (rabbitSink) Close() error {
+	if rabbitConn != nil {
+		return rabbitConn.Close()
+	}
+	return nil
+}
+
+// InitEventSinks registers the built-in sinks and the brokers that are configured
+func InitEventSinks() {
+	eventSinks.Register(webhookSink{}, false)
+	eventSinks.Register(globalWebhookSink{}, false)
+	eventSinks.Register(rabbitSink{}, true)
+
+	if brokers := splitList(*kafkaBrokers); len(brokers) > 0 {
+		eventSinks.Register(newKafkaSink(brokers, *kafkaTopic), true)
+	}
+
+	if *natsURL != "" {
+		sink, err := newNatsSink(*natsURL, *natsSubject, *natsStream)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not connect to NATS. NATS publishing disabled.")
+		} else {
+			eventSinks.Register(sink, true)
+		}
+	}
+
+	if *redisURL != "" {
+		sink, err := newRedisSink(*redisURL, *redisStream, int64(*redisStreamMaxLen))
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid REDIS_URL. Redis Streams publishing disabled.")
+		} else {
+			eventSinks.Register(sink, true)
+		}
+	}
+}
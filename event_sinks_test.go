@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeSink records the events published to it
+type fakeSink struct {
+	name string
+	mu   sync.Mutex
+	jobs []sinkJob
+}
+
+func (f *fakeSink) Name() string               { return f.name }
+func (f *fakeSink) Enabled() bool              { return true }
+func (f *fakeSink) DefaultDestination() string { return "default" }
+func (f *fakeSink) Close() error               { return nil }
+
+func (f *fakeSink) Publish(ctx context.Context, event SinkEvent, destination string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.jobs = append(f.jobs, sinkJob{event: event, destination: destination})
+	return nil
+}
+
+func (f *fakeSink) published() []sinkJob {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sinkJob(nil), f.jobs...)
+}
+
+func TestEventSinkOverridesAndDispatch(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "SinkUser",
+		"token":      "sink-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "sink-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+	t.Cleanup(func() { eventSinkOverridesCache.Delete(userID) })
+
+	unknown := executeRequest(t, s, newRequest("2", "session.sinks.set", map[string]interface{}{
+		"token": "sink-token",
+		"sinks": map[string]interface{}{"kinesis": map[string]interface{}{"enabled": false}},
+	}).toJSON(t))
+	assertJSONRPC20Error(t, unknown, "2", 400)
+
+	webhookDestination := executeRequest(t, s, newRequest("3", "session.sinks.set", map[string]interface{}{
+		"token": "sink-token",
+		"sinks": map[string]interface{}{"webhook": map[string]interface{}{"destination": "elsewhere"}},
+	}).toJSON(t))
+	assertJSONRPC20Error(t, webhookDestination, "3", 400)
+
+	// Tenants cannot turn off operator sinks nor publish outside their own prefix
+	for i, sinks := range []map[string]interface{}{
+		{"globalwebhook": map[string]interface{}{"enabled": false}},
+		{"rabbitmq": map[string]interface{}{"enabled": false}},
+		{"kafka": map[string]interface{}{"destination": "tenant-a"}},
+		{"kafka": map[string]interface{}{"destination": "whatsapp_events.other"}},
+		{"kafka": map[string]interface{}{"destination": "whatsapp_events." + userID + "x"}},
+	} {
+		id := fmt.Sprintf("3.%d", i)
+		rejected := executeRequest(t, s, newRequest(id, "session.sinks.set", map[string]interface{}{
+			"token": "sink-token",
+			"sinks": sinks,
+		}).toJSON(t))
+		assertJSONRPC20Error(t, rejected, id, 400)
+	}
+
+	saved := executeRequest(t, s, newRequest("4", "session.sinks.set", map[string]interface{}{
+		"token": "sink-token",
+		"sinks": map[string]interface{}{
+			"kafka": map[string]interface{}{"destination": "whatsapp_events." + userID},
+			"redis": map[string]interface{}{"enabled": false},
+		},
+	}).toJSON(t))
+	assertJSONRPC20Success(t, saved, "4")
+
+	getResponse := executeRequest(t, s, newRequest("5", "session.sinks.get", map[string]interface{}{
+		"token": "sink-token",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, getResponse, "5").(map[string]interface{})
+	sinks := result["sinks"].([]interface{})
+	if len(sinks) != len(knownEventSinks) {
+		t.Fatalf("Expected %d sinks, got %v", len(knownEventSinks), sinks)
+	}
+	for _, item := range sinks {
+		sink := item.(map[string]interface{})
+		if sink["name"] == sinkNameRedis {
+			override := sink["override"].(map[string]interface{})
+			if override["enabled"] != false {
+				t.Errorf("Expected the redis override to be returned, got %v", sink)
+			}
+		}
+	}
+
+	registry := newEventSinkRegistry()
+	kafkaFake := &fakeSink{name: sinkNameKafka}
+	redisFake := &fakeSink{name: sinkNameRedis}
+	natsFake := &fakeSink{name: sinkNameNATS}
+	registry.Register(kafkaFake, true)
+	registry.Register(redisFake, false)
+	registry.Register(natsFake, false)
+
+	registry.Dispatch(s.db, SinkEvent{UserID: userID, Token: "sink-token", Type: "Message", Data: []byte(`{"type":"Message"}`)})
+	registry.Close()
+
+	if jobs := kafkaFake.published(); len(jobs) != 1 || jobs[0].destination != "whatsapp_events."+userID || jobs[0].event.Type != "Message" {
+		t.Errorf("Expected one Message to the topic of the instance, got %v", jobs)
+	}
+	if jobs := redisFake.published(); len(jobs) != 0 {
+		t.Errorf("Expected the disabled sink to receive nothing, got %v", jobs)
+	}
+	if jobs := natsFake.published(); len(jobs) != 1 || jobs[0].destination != "" {
+		t.Errorf("Expected one event with the default destination, got %v", jobs)
+	}
+
+	// An admin can choose any destination and turn off operator sinks, which wins
+	// over the instance and survives its delete
+	admin := executeRequest(t, s, newRequest("6", "admin.users.sinks.set", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"userId":     userID,
+		"sinks": map[string]interface{}{
+			"kafka":    map[string]interface{}{"destination": "tenant-a"},
+			"rabbitmq": map[string]interface{}{"enabled": false},
+		},
+	}).toJSON(t))
+	assertJSONRPC20Success(t, admin, "6")
+	commandQueue := *rabbitCommandQueue
+	*rabbitCommandQueue = "wuzapi_commands"
+	t.Cleanup(func() { *rabbitCommandQueue = commandQueue })
+	rejected := executeRequest(t, s, newRequest("7", "admin.users.sinks.set", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"userId":     userID,
+		"sinks":      map[string]interface{}{"rabbitmq": map[string]interface{}{"destination": "wuzapi_commands"}},
+	}).toJSON(t))
+	assertJSONRPC20Error(t, rejected, "7", 400)
+	missing := executeRequest(t, s, newRequest("8", "admin.users.sinks.get", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"userId":     "unknown",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, missing, "8", 404)
+
+	deleted := executeRequest(t, s, newRequest("9", "session.sinks.delete", map[string]interface{}{
+		"token": "sink-token",
+	}).toJSON(t))
+	assertJSONRPC20Success(t, deleted, "9")
+	overrides, err := getEventSinkOverrides(s.db, userID)
+	if err != nil || len(overrides) != 2 || overrides[sinkNameKafka].Destination != "tenant-a" ||
+		overrides[sinkNameRabbitMQ].Enabled == nil || *overrides[sinkNameRabbitMQ].Enabled {
+		t.Errorf("Expected the admin overrides after the instance delete, got %v (%v)", overrides, err)
+	}
+
+	deleted = executeRequest(t, s, newRequest("10", "admin.users.sinks.delete", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"userId":     userID,
+	}).toJSON(t))
+	assertJSONRPC20Success(t, deleted, "10")
+	if overrides, err := getEventSinkOverrides(s.db, userID); err != nil || len(overrides) != 0 {
+		t.Errorf("Expected no overrides after delete, got %v (%v)", overrides, err)
+	}
+}
+
+type fakeKafkaWriter struct {
+	messages []kafka.Message
+}
+
+func (f *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.messages = append(f.messages, msgs...)
+	return nil
+}
+
+func (f *fakeKafkaWriter) Close() error { return nil }
+
+type fakeJetStream struct {
+	messages []*nats.Msg
+}
+
+func (f *fakeJetStream) PublishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	f.messages = append(f.messages, msg)
+	return &jetstream.PubAck{Stream: "EVENTS", Sequence: uint64(len(f.messages))}, nil
+}
+
+type fakeRedisClient struct {
+	args []*redis.XAddArgs
+}
+
+func (f *fakeRedisClient) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	f.args = append(f.args, a)
+	cmd := redis.NewStringCmd(ctx)
+	cmd.SetVal("1-0")
+	return cmd
+}
+
+func (f *fakeRedisClient) Close() error { return nil }
+
+func TestBrokerSinksPublish(t *testing.T) {
+	previousFormat := *eventSinkFormat
+	t.Cleanup(func() { *eventSinkFormat = previousFormat })
+
+	event := SinkEvent{
+		UserID:       "user1",
+		InstanceName: "Sales",
+		Type:         "Message",
+		Data:         []byte(`{"type":"Message","event":{"Info":{"Chat":"123@s.whatsapp.net"}}}`),
+	}
+	ctx := context.Background()
+
+	writer := &fakeKafkaWriter{}
+	kafkaOut := &kafkaSink{writer: writer, topic: "whatsapp_events"}
+	if err := kafkaOut.Publish(ctx, event, ""); err != nil {
+		t.Fatalf("Kafka publish failed: %v", err)
+	}
+	if err := kafkaOut.Publish(ctx, event, "tenant-a"); err != nil {
+		t.Fatalf("Kafka publish failed: %v", err)
+	}
+	if len(writer.messages) != 2 || writer.messages[0].Topic != "whatsapp_events" || writer.messages[1].Topic != "tenant-a" {
+		t.Fatalf("Unexpected Kafka messages: %v", writer.messages)
+	}
+	if string(writer.messages[0].Key) != "user1" {
+		t.Errorf("Expected the user ID as key, got %q", writer.messages[0].Key)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(writer.messages[0].Value, &payload); err != nil {
+		t.Fatalf("Invalid Kafka payload: %v", err)
+	}
+	if payload["userID"] != "user1" || payload["instanceName"] != "Sales" || payload["type"] != "Message" {
+		t.Errorf("Unexpected Kafka payload: %v", payload)
+	}
+
+	js := &fakeJetStream{}
+	natsOut := &natsSink{js: js, subject: "wuzapi.events"}
+	if err := natsOut.Publish(ctx, event, ""); err != nil {
+		t.Fatalf("NATS publish failed: %v", err)
+	}
+	if len(js.messages) != 1 || js.messages[0].Subject != "wuzapi.events.user1.Message" {
+		t.Fatalf("Unexpected NATS messages: %v", js.messages)
+	}
+
+	*eventSinkFormat = webhookFormatCloudEvents
+	client := &fakeRedisClient{}
+	redisOut := &redisSink{client: client, stream: "whatsapp_events", maxLen: 1000}
+	if err := redisOut.Publish(ctx, event, ""); err != nil {
+		t.Fatalf("Redis publish failed: %v", err)
+	}
+	if len(client.args) != 1 || client.args[0].Stream != "whatsapp_events" || client.args[0].MaxLen != 1000 || !client.args[0].Approx {
+		t.Fatalf("Unexpected Redis XADD: %+v", client.args)
+	}
+	values := client.args[0].Values.(map[string]interface{})
+	if values["contentType"] != cloudEventsContentType {
+		t.Errorf("Expected a CloudEvent, got content type %v", values["contentType"])
+	}
+	var cloudEvent CloudEvent
+	if err := json.Unmarshal(values["data"].([]byte), &cloudEvent); err != nil {
+		t.Fatalf("Invalid CloudEvent: %v", err)
+	}
+	if cloudEvent.Type != "wuzapi.message.received" || cloudEvent.Subject != "123@s.whatsapp.net" {
+		t.Errorf("Unexpected CloudEvent: %+v", cloudEvent)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// subscriberBuffer is how many events a live subscriber may lag behind before it is dropped
+	subscriberBuffer = 256
+	// eventStreamKeepalive is the interval of comment lines that keep idle streams open through proxies
+	eventStreamKeepalive = 15 * time.Second
+)
+
+// eventStreams fans instance events out to live subscribers such as /events/stream
+var eventStreams = newEventStreamHub()
+
+// streamEvent is one event published to the streams of an instance
+type streamEvent struct {
+	ID   string
+	Seq  uint64
+	Type string
+	Data []byte
+}
+
+// eventStreamSubscriber receives the events of one instance, optionally filtered by type
+type eventStreamSubscriber struct {
+	types  []string
+	events chan streamEvent
+}
+
+func (sub *eventStreamSubscriber) wants(eventType string) bool {
+	return len(sub.types) == 0 || Find(sub.types, eventType)
+}
+
+// userEventStream keeps the recent events of one instance in a ring buffer so
+// clients can resume with Last-Event-ID
+type userEventStream struct {
+	nextSeq     uint64
+	buffer      []streamEvent
+	start       int
+	count       int
+	subscribers map[*eventStreamSubscriber]struct{}
+}
+
+// eventStreamHub holds the streams of every instance. A stream, and its buffer,
+// is created when the first subscriber of an instance connects.
+type eventStreamHub struct {
+	mu      sync.Mutex
+	epoch   string
+	streams map[string]*userEventStream
+}
+
+func newEventStreamHub() *eventStreamHub {
+	return &eventStreamHub{
+		epoch:   strconv.FormatInt(time.Now().Unix(), 36),
+		streams: make(map[string]*userEventStream),
+	}
+}
+
+func (h *eventStreamHub) bufferSize() int {
+	if *eventStreamBufferSize < 1 {
+		return 1
+	}
+	return *eventStreamBufferSize
+}
+
+// Publish sends an event to the subscribers of an instance and stores it for resumption.
+// Events of instances without a stream are ignored.
+func (h *eventStreamHub) Publish(userID string, eventType string, postmap map[string]interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream, ok := h.streams[userID]
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(postmap)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal event for stream")
+		return
+	}
+
+	stream.nextSeq++
+	event := streamEvent{
+		ID:   h.epoch + "-" + strconv.FormatUint(stream.nextSeq, 10),
+		Seq:  stream.nextSeq,
+		Type: eventType,
+		Data: data,
+	}
+
+	size := h.bufferSize()
+	if len(stream.buffer) != size {
+		stream.resize(size)
+	}
+	if stream.count < size {
+		stream.buffer[(stream.start+stream.count)%size] = event
+		stream.count++
+	} else {
+		stream.buffer[stream.start] = event
+		stream.start = (stream.start + 1) % size
+	}
+
+	for sub := range stream.subscribers {
+		if !sub.wants(eventType) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// Slow consumer: drop it, it can reconnect with Last-Event-ID
+			log.Warn().Str("userID", userID).Msg("Event stream subscriber too slow, disconnecting")
+			delete(stream.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// resize keeps the newest events when the configured buffer size changes
+func (stream *userEventStream) resize(size int) {
+	events := stream.ordered()
+	if len(events) > size {
+		events = events[len(events)-size:]
+	}
+	stream.buffer = make([]streamEvent, size)
+	copy(stream.buffer, events)
+	stream.start = 0
+	stream.count = len(events)
+}
+
+// ordered returns the buffered events from oldest to newest
+func (stream *userEventStream) ordered() []streamEvent {
+	events := make([]streamEvent, 0, stream.count)
+	for i := 0; i < stream.count; i++ {
+		events = append(events, stream.buffer[(stream.start+i)%len(stream.buffer)])
+	}
+	return events
+}
+
+// Subscribe registers a subscriber and returns the buffered events after lastEventID
+// that match the filter. An unknown or empty lastEventID returns no backlog.
+func (h *eventStreamHub) Subscribe(userID string, types []string, lastEventID string) (*eventStreamSubscriber, []streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream, ok := h.streams[userID]
+	if !ok {
+		stream = &userEventStream{subscribers: make(map[*eventStreamSubscriber]struct{})}
+		h.streams[userID] = stream
+	}
+
+	sub := &eventStreamSubscriber{types: types, events: make(chan streamEvent, subscriberBuffer)}
+	stream.subscribers[sub] = struct{}{}
+
+	var backlog []streamEvent
+	if seq, ok := h.parseEventID(lastEventID); ok {
+		for _, event := range stream.ordered() {
+			if event.Seq > seq && sub.wants(event.Type) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	return sub, backlog
+}
+
+// Unsubscribe removes a subscriber; its buffered events stay available for resumption
+func (h *eventStreamHub) Unsubscribe(userID string, sub *eventStreamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if stream, ok := h.streams[userID]; ok {
+		if _, ok := stream.subscribers[sub]; ok {
+			delete(stream.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// parseEventID extracts the sequence of an event ID issued by this process
+func (h *eventStreamHub) parseEventID(id string) (uint64, bool) {
+	epoch, seq, found := strings.Cut(id, "-")
+	if !found || epoch != h.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// formatSSE renders an event in the text/event-stream format
+func formatSSE(event streamEvent) string {
+	return fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
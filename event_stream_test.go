@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSEEvent reads lines until a complete event and returns its fields
+func readSSEEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+		if key, value, found := strings.Cut(line, ": "); found && key != "" {
+			fields[key] = value
+		}
+	}
+}
+
+func openEventStream(t *testing.T, ctx context.Context, url string, lastEventID string) *bufio.Reader {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	// The retry hint is written once the subscription is registered
+	if fields := readSSEEvent(t, reader); fields["retry"] == "" {
+		t.Fatalf("Expected retry hint first, got %v", fields)
+	}
+	return reader
+}
+
+func TestEventStreamFilterAndResume(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "StreamUser",
+		"token":      "stream-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "stream-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+	streamURL := ts.URL + "/events/stream?token=stream-token&events=Message"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	reader := openEventStream(t, ctx, streamURL, "")
+
+	eventStreams.Publish(userID, "ReadReceipt", map[string]interface{}{"type": "ReadReceipt"})
+	eventStreams.Publish(userID, "Message", map[string]interface{}{"type": "Message", "event": "first"})
+
+	first := readSSEEvent(t, reader)
+	if first["event"] != "Message" || !strings.Contains(first["data"], `"first"`) || first["id"] == "" {
+		t.Fatalf("Expected the first Message event, got %v", first)
+	}
+	cancel()
+
+	// Published while disconnected, delivered from the buffer on resume
+	eventStreams.Publish(userID, "Message", map[string]interface{}{"type": "Message", "event": "second"})
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reader = openEventStream(t, ctx, streamURL, first["id"])
+
+	second := readSSEEvent(t, reader)
+	if second["event"] != "Message" || !strings.Contains(second["data"], `"second"`) {
+		t.Fatalf("Expected the buffered Message event, got %v", second)
+	}
+}
@@ -85,6 +85,10 @@ type WebhookErrorPayload struct {
 	EncryptedHmacKey string                 `json:"encryptedHmacKey"`
 	AttemptTime      time.Time              `json:"attemptTime"`
 	ErrorMessage     string                 `json:"errorMessage"`
+	// ContentType and Body are what was posted, so it can be replayed verbatim;
+	// form posts have no Body and are rebuilt from Payload
+	ContentType string          `json:"contentType,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
 }
 type openGraphResult struct {
 	Title       string
@@ -115,6 +119,8 @@ var (
 
 	openGraphCache = cache.New(5*time.Minute, 10*time.Minute) // Cache Open Graph data for 5 minutes, cleanup every 10 minutes
 
+	webhookFallbackClient     *resty.Client
+	webhookFallbackClientOnce sync.Once
 )
 
 func Find(slice []string, val string) bool {
@@ -126,6 +132,17 @@ func Find(slice []string, val string) bool {
 	return false
 }
 
+// splitList splits a comma-separated setting, dropping blanks
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func isHTTPURL(input string) bool {
 	parsed, err := url.ParseRequestURI(input)
 	if err != nil {
@@ -239,150 +256,254 @@ func callHook(myurl string, payload map[string]string, userID string) {
 	callHookWithHmac(myurl, payload, userID, nil)
 }
 
-// webhook for regular messages with HMAC
-func callHookWithHmac(myurl string, payload map[string]string, userID string, encryptedHmacKey []byte) {
-	log.Info().Str("url", myurl).Str("userID", userID).Msg("Sending POST to client with retry logic")
-
-	client := clientManager.GetHTTPClient(userID)
-
-	// Retry settings
-	maxRetries := 1
-	if *webhookRetryEnabled {
-		maxRetries = *webhookRetryCount
+// webhookHTTPClient returns the per-user resty client, falling back to a shared
+// client when the user has not connected yet (e.g. outbox deliveries after a restart)
+func webhookHTTPClient(userID string) *resty.Client {
+	if client := clientManager.GetHTTPClient(userID); client != nil {
+		return client
 	}
+	webhookFallbackClientOnce.Do(func() {
+		webhookFallbackClient = resty.New()
+		webhookFallbackClient.SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
+		webhookFallbackClient.SetTimeout(30 * time.Second)
+	})
+	return webhookFallbackClient
+}
 
-	var lastError error
+// webhookRetryDelay returns the exponential backoff delay applied before the given retry (1-based)
+func webhookRetryDelay(retry int) time.Duration {
+	backoffFactor := 1 << uint(retry-1)
+	return time.Duration(*webhookRetryDelaySeconds) * time.Second * time.Duration(backoffFactor)
+}
 
-	var body interface{} = payload
+// webhookMaxAttempts returns how many times a webhook delivery is attempted
+func webhookMaxAttempts() int {
+	if *webhookRetryEnabled && *webhookRetryCount > 0 {
+		return *webhookRetryCount
+	}
+	return 1
+}
 
-	// Starts the retry loop.
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			backoffFactor := 1 << uint(attempt-1)
+// webhookFormat resolves the payload format of a delivery, defaulting to WEBHOOK_FORMAT
+func webhookFormat(format string) string {
+	if format == "" {
+		return os.Getenv("WEBHOOK_FORMAT")
+	}
+	return format
+}
 
-			// Calculate the final delay.
-			delayDuration := time.Duration(*webhookRetryDelaySeconds) * time.Second * time.Duration(backoffFactor)
+// webhookEvent identifies an event sent to a webhook. Every attempt to deliver it,
+// retries included, carries the same ID and Time, so receivers can drop duplicates.
+type webhookEvent struct {
+	ID   string
+	Time time.Time
+}
 
-			log.Warn().
-				Int("attempt", attempt+1).
-				Str("url", myurl).
-				Dur("delay", delayDuration).
-				Msg("Retrying webhook request with exponential backoff...")
+// newWebhookEvent identifies an event that happens now
+func newWebhookEvent() (webhookEvent, error) {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return webhookEvent{}, err
+	}
+	return webhookEvent{ID: id, Time: time.Now().UTC()}, nil
+}
 
-			time.Sleep(delayDuration)
+// postWebhookOnce performs a single webhook POST of an event and records it in the
+// delivery log. It returns the body that was actually sent so callers can forward
+// it to the error queue.
+func postWebhookOnce(myurl string, payload map[string]string, userID string, endpointID string, event webhookEvent, encryptedHmacKey []byte, format string, attempt int) (body interface{}, statusCode int, err error) {
+	client := webhookHTTPClient(userID)
+
+	start := time.Now()
+	defer func() {
+		recordWebhookDelivery(myurl, payload, userID, endpointID, format, "", attempt, statusCode, time.Since(start), err)
+		webhookBreakers.Record(myurl, err)
+	}()
+
+	body = payload
+	var req *resty.Request
+	var signatureHeaders map[string]string
+
+	if resolvedFormat := webhookFormat(format); isCloudEventsFormat(resolvedFormat) {
+		cloudEvent, ceErr := newCloudEvent(event, payload["jsonData"], userID, payload["instanceName"])
+		if ceErr != nil {
+			log.Error().Err(ceErr).Msg("Failed to build CloudEvent")
+			return body, 0, ceErr
 		}
 
-		var req *resty.Request
-		var hmacSignature string
-		var marshalErr error
+		// Structured mode sends the whole envelope, binary mode only the data
+		contentType := cloudEventsContentType
+		var ceBody interface{} = cloudEvent
+		if resolvedFormat == webhookFormatCloudEventsBinary {
+			contentType = "application/json"
+			ceBody = cloudEvent.Data
+		}
+		body = ceBody
 
-		format := os.Getenv("WEBHOOK_FORMAT")
+		jsonBody, marshalErr := json.Marshal(ceBody)
+		if marshalErr != nil {
+			log.Error().Err(marshalErr).Msg("Failed to marshal CloudEvent")
+			return body, 0, marshalErr
+		}
+		signatureHeaders = webhookSignatureHeaders(event.ID, jsonBody, webhookSignerFor(userID, encryptedHmacKey))
 
-		if format == "json" {
-			var jsonBody []byte
+		req = client.R().SetHeader("Content-Type", contentType).SetBody(jsonBody)
+		if resolvedFormat == webhookFormatCloudEventsBinary {
+			req.SetHeaders(cloudEvent.binaryHeaders())
+		}
 
-			if jsonStr, ok := payload["jsonData"]; ok {
-				var postmap map[string]interface{}
+	} else if resolvedFormat == "json" {
+		if jsonStr, ok := payload["jsonData"]; ok {
+			var postmap map[string]interface{}
 
-				if err := json.Unmarshal([]byte(jsonStr), &postmap); err == nil {
-					if instanceName, ok := payload["instanceName"]; ok {
-						postmap["instanceName"] = instanceName
-					}
-					postmap["userID"] = userID
-					body = postmap
+			if err := json.Unmarshal([]byte(jsonStr), &postmap); err == nil {
+				if instanceName, ok := payload["instanceName"]; ok {
+					postmap["instanceName"] = instanceName
 				}
+				postmap["userID"] = userID
+				body = postmap
 			}
+		}
 
-			// Marshal body to JSON for HMAC signature
-			jsonBody, marshalErr = json.Marshal(body)
-			if marshalErr != nil {
-				log.Error().Err(marshalErr).Msg("Failed to marshal body for HMAC")
-			}
+		// Marshal body to JSON for HMAC signature
+		jsonBody, marshalErr := json.Marshal(body)
+		if marshalErr != nil {
+			log.Error().Err(marshalErr).Msg("Failed to marshal body for HMAC")
+		}
 
-			// Generate HMAC signature if key exists
-			if len(encryptedHmacKey) > 0 && len(jsonBody) > 0 {
-				var err error
-				hmacSignature, err = generateHmacSignature(jsonBody, encryptedHmacKey)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to generate HMAC signature")
-				}
-			}
+		// Generate HMAC signature if key exists
+		signatureHeaders = webhookSignatureHeaders(event.ID, jsonBody, webhookSignerFor(userID, encryptedHmacKey))
 
-			req = client.R().SetHeader("Content-Type", "application/json").SetBody(body)
+		req = client.R().SetHeader("Content-Type", "application/json").SetBody(body)
 
-		} else {
+	} else {
 
-			if len(encryptedHmacKey) > 0 {
-				formData := url.Values{}
-				for k, v := range payload {
-					formData.Add(k, v)
-				}
-				formString := formData.Encode()
-				var err error
-				hmacSignature, err = generateHmacSignature([]byte(formString), encryptedHmacKey)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to generate HMAC signature")
-				}
+		if len(encryptedHmacKey) > 0 {
+			formData := url.Values{}
+			for k, v := range payload {
+				formData.Add(k, v)
 			}
-			req = client.R().SetFormData(payload)
-			body = payload
+			formString := formData.Encode()
+			signatureHeaders = webhookSignatureHeaders(event.ID, []byte(formString), webhookSignerFor(userID, encryptedHmacKey))
 		}
+		req = client.R().SetFormData(payload)
+	}
 
-		if hmacSignature != "" {
-			req.SetHeader("x-hmac-signature", hmacSignature)
-		}
+	if len(signatureHeaders) > 0 {
+		req.SetHeaders(signatureHeaders)
+	}
 
-		resp, postErr := req.Post(myurl)
+	resp, postErr := req.Post(myurl)
+	if postErr != nil {
+		log.Error().Err(postErr).Str("url", myurl).Msg("Webhook failed due to network/IO error")
+		return body, 0, postErr
+	}
 
-		lastError = postErr
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		log.Error().
+			Int("status", resp.StatusCode()).
+			Str("url", myurl).
+			Msg("Webhook failed due to non-2xx status code")
+		return body, resp.StatusCode(), fmt.Errorf("unexpected status code: %d. Body: %s", resp.StatusCode(), string(resp.Body()))
+	}
 
-		if postErr != nil {
-			log.Error().Err(postErr).Int("attempt", attempt+1).Str("url", myurl).Msg("Webhook failed due to network/IO error")
-			continue
-		}
+	log.Info().Int("status", resp.StatusCode()).Str("url", myurl).Msg("Webhook call successful")
+	return body, resp.StatusCode(), nil
+}
+
+// webhook for regular messages with HMAC
+func callHookWithHmac(myurl string, payload map[string]string, userID string, encryptedHmacKey []byte) error {
+	return callHookWithFormat(myurl, payload, userID, "", encryptedHmacKey, "")
+}
+
+// callHookWithFormat delivers a webhook to an endpoint with retries using the given
+// payload format. An empty endpointID is the user's own webhook.
+func callHookWithFormat(myurl string, payload map[string]string, userID string, endpointID string, encryptedHmacKey []byte, format string) error {
+	log.Info().Str("url", myurl).Str("userID", userID).Msg("Sending POST to client with retry logic")
 
-		if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
-			lastError = fmt.Errorf("unexpected status code: %d. Body: %s", resp.StatusCode(), string(resp.Body()))
-			log.Error().
-				Int("status", resp.StatusCode()).
+	maxRetries := webhookMaxAttempts()
+	event, err := newWebhookEvent()
+	if err != nil {
+		return err
+	}
+
+	var lastError error
+	var body interface{} = payload
+
+	// Starts the retry loop.
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			delayDuration := webhookRetryDelay(attempt)
+
+			log.Warn().
 				Int("attempt", attempt+1).
 				Str("url", myurl).
-				Msg("Webhook failed due to non-2xx status code")
+				Dur("delay", delayDuration).
+				Msg("Retrying webhook request with exponential backoff...")
 
-			if !*webhookRetryEnabled {
-				break
-			}
-			continue
+			time.Sleep(delayDuration)
 		}
 
-		log.Info().Int("status", resp.StatusCode()).Str("url", myurl).Msg("Webhook call successful")
-		return
+		if !webhookBreakers.Allow(myurl) {
+			log.Warn().Str("url", myurl).Msg("Webhook circuit open, shedding delivery")
+			lastError = errCircuitOpen
+			break
+		}
+
+		body, _, lastError = postWebhookOnce(myurl, payload, userID, endpointID, event, encryptedHmacKey, format, attempt+1)
+		if lastError == nil {
+			return nil
+		}
 	}
 
 	if lastError != nil {
 		log.Error().Str("url", myurl).Msg("Webhook permanently failed after all retries. Sending to error queue...")
+		publishWebhookError(myurl, body, userID, encryptedHmacKey, lastError)
+		return fmt.Errorf("webhook failed permanently: %w", lastError)
+	}
 
-		errorPayloadMap := make(map[string]interface{})
-		if p, ok := body.(map[string]string); ok {
+	return nil
+}
 
-			for k, v := range p {
-				errorPayloadMap[k] = v
-			}
-		} else if p, ok := body.(map[string]interface{}); ok {
+// publishWebhookError forwards a permanently failed webhook to the error queue
+func publishWebhookError(myurl string, body interface{}, userID string, encryptedHmacKey []byte, lastError error) {
+	PublishDataErrorToQueue(newWebhookErrorPayload(myurl, body, userID, encryptedHmacKey, lastError))
+}
 
-			errorPayloadMap = p
-		}
+// newWebhookErrorPayload builds the error queue message of a failed webhook body
+func newWebhookErrorPayload(myurl string, body interface{}, userID string, encryptedHmacKey []byte, lastError error) WebhookErrorPayload {
+	errorPayloadMap := make(map[string]interface{})
+	contentType := formContentType
+	var rawBody []byte
+	if p, ok := body.(map[string]string); ok {
 
-		errorPayload := WebhookErrorPayload{
-			URL:              myurl,
-			Payload:          errorPayloadMap,
-			UserID:           userID,
-			EncryptedHmacKey: hex.EncodeToString(encryptedHmacKey),
-			AttemptTime:      time.Now(),
-			ErrorMessage:     lastError.Error(),
+		for k, v := range p {
+			errorPayloadMap[k] = v
+		}
+	} else {
+		// JSON and CloudEvents bodies are marshalled again, which gives the bytes
+		// that were posted
+		contentType = "application/json"
+		if _, ok := body.(CloudEvent); ok {
+			contentType = cloudEventsContentType
+		}
+		var err error
+		if rawBody, err = json.Marshal(body); err != nil {
+			log.Error().Err(err).Msg("Failed to marshal failed webhook body")
+		} else if err := json.Unmarshal(rawBody, &errorPayloadMap); err != nil {
+			log.Error().Err(err).Msg("Failed to decode failed webhook body")
 		}
+	}
 
-		PublishDataErrorToQueue(errorPayload)
+	return WebhookErrorPayload{
+		URL:              myurl,
+		Payload:          errorPayloadMap,
+		UserID:           userID,
+		EncryptedHmacKey: hex.EncodeToString(encryptedHmacKey),
+		AttemptTime:      time.Now(),
+		ErrorMessage:     lastError.Error(),
+		ContentType:      contentType,
+		Body:             rawBody,
 	}
 }
 
@@ -391,31 +512,88 @@ func callHookFile(myurl string, payload map[string]string, userID string, file s
 	return callHookFileWithHmac(myurl, payload, userID, file, nil)
 }
 
-// webhook for messages with file attachments and HMAC
-func callHookFileWithHmac(myurl string, payload map[string]string, userID string, file string, encryptedHmacKey []byte) error {
-	log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST with retry logic")
+// postWebhookFileOnce performs a single multipart webhook POST of an event with the
+// file attached and records it in the delivery log
+func postWebhookFileOnce(myurl string, payload map[string]string, userID string, endpointID string, event webhookEvent, file string, encryptedHmacKey []byte, attempt int) (statusCode int, err error) {
+	client := webhookHTTPClient(userID)
+
+	start := time.Now()
+	defer func() {
+		recordWebhookDelivery(myurl, payload, userID, endpointID, "", file, attempt, statusCode, time.Since(start), err)
+		webhookBreakers.Record(myurl, err)
+	}()
+
+	finalPayload := webhookFilePayload(payload, file)
 
-	client := clientManager.GetHTTPClient(userID)
+	var signatureHeaders map[string]string
 
-	maxRetries := 1
-	if *webhookRetryEnabled {
-		maxRetries = *webhookRetryCount
+	if len(encryptedHmacKey) > 0 {
+		jsonPayload, err := json.Marshal(finalPayload)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to marshal payload for HMAC")
+		} else {
+			signatureHeaders = webhookSignatureHeaders(event.ID, jsonPayload, webhookSignerFor(userID, encryptedHmacKey))
+		}
 	}
 
-	var lastError error
+	req := client.R().
+		SetFiles(map[string]string{
+			"file": file,
+		}).
+		SetFormData(finalPayload)
+
+	if len(signatureHeaders) > 0 {
+		req.SetHeaders(signatureHeaders)
+	}
+
+	resp, postErr := req.Post(myurl)
+	if postErr != nil {
+		log.Error().Err(postErr).Str("url", myurl).Msg("File webhook failed due to network/IO error")
+		return 0, postErr
+	}
+
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		log.Error().
+			Int("status", resp.StatusCode()).
+			Str("url", myurl).
+			Msg("File webhook failed due to non-2xx status code")
+		return resp.StatusCode(), fmt.Errorf("unexpected status code: %d. Body: %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	log.Info().Int("status", resp.StatusCode()).Str("url", myurl).Msg("File webhook call successful")
+	return resp.StatusCode(), nil
+}
 
+func webhookFilePayload(payload map[string]string, file string) map[string]string {
 	finalPayload := make(map[string]string)
 	for k, v := range payload {
 		finalPayload[k] = v
 	}
 	finalPayload["file"] = file
+	return finalPayload
+}
+
+// webhook for messages with file attachments and HMAC
+func callHookFileWithHmac(myurl string, payload map[string]string, userID string, file string, encryptedHmacKey []byte) error {
+	return callHookFileToEndpoint(myurl, payload, userID, "", file, encryptedHmacKey)
+}
+
+// callHookFileToEndpoint delivers a file webhook to an endpoint with retries. An
+// empty endpointID is the user's own webhook.
+func callHookFileToEndpoint(myurl string, payload map[string]string, userID string, endpointID string, file string, encryptedHmacKey []byte) error {
+	log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST with retry logic")
+
+	maxRetries := webhookMaxAttempts()
+	event, err := newWebhookEvent()
+	if err != nil {
+		return err
+	}
+
+	var lastError error
 
-	// 2. Loop Retry
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			backoffFactor := 1 << uint(attempt-1)
-
-			delayDuration := time.Duration(*webhookRetryDelaySeconds) * time.Second * time.Duration(backoffFactor)
+			delayDuration := webhookRetryDelay(attempt)
 
 			log.Warn().
 				Int("attempt", attempt+1).
@@ -426,83 +604,45 @@ func callHookFileWithHmac(myurl string, payload map[string]string, userID string
 			time.Sleep(delayDuration)
 		}
 
-		var hmacSignature string
-		var jsonPayload []byte
-
-		if len(encryptedHmacKey) > 0 {
-			var err error
-			jsonPayload, err = json.Marshal(finalPayload)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to marshal payload for HMAC")
-			} else {
-				hmacSignature, err = generateHmacSignature(jsonPayload, encryptedHmacKey)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to generate HMAC signature")
-				}
-			}
-		}
-
-		req := client.R().
-			SetFiles(map[string]string{
-				"file": file,
-			}).
-			SetFormData(finalPayload)
-
-		if hmacSignature != "" {
-			req.SetHeader("x-hmac-signature", hmacSignature)
-		}
-
-		resp, postErr := req.Post(myurl)
-
-		lastError = postErr
-
-		if postErr != nil {
-			log.Error().Err(postErr).Int("attempt", attempt+1).Str("url", myurl).Msg("File webhook failed due to network/IO error")
-			continue
+		if !webhookBreakers.Allow(myurl) {
+			log.Warn().Str("url", myurl).Msg("Webhook circuit open, shedding delivery")
+			lastError = errCircuitOpen
+			break
 		}
 
-		if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
-			lastError = fmt.Errorf("unexpected status code: %d. Body: %s", resp.StatusCode(), string(resp.Body()))
-			log.Error().
-				Int("status", resp.StatusCode()).
-				Int("attempt", attempt+1).
-				Str("url", myurl).
-				Msg("File webhook failed due to non-2xx status code")
-
-			if !*webhookRetryEnabled {
-				break
-			}
-			continue
+		_, lastError = postWebhookFileOnce(myurl, payload, userID, endpointID, event, file, encryptedHmacKey, attempt+1)
+		if lastError == nil {
+			return nil
 		}
-
-		log.Info().Int("status", resp.StatusCode()).Str("url", myurl).Msg("File webhook call successful")
-		return nil
 	}
 
 	if lastError != nil {
 		log.Error().Str("url", myurl).Msg("File webhook permanently failed after all retries. Sending to error queue...")
+		publishWebhookFileError(myurl, payload, userID, file, encryptedHmacKey, lastError)
+		return fmt.Errorf("webhook failed permanently: %w", lastError)
+	}
 
-		errorPayloadMap := make(map[string]interface{})
-		for k, v := range finalPayload {
-			errorPayloadMap[k] = v
-		}
-
-		errorPayload := WebhookFileErrorPayload{
-			URL:              myurl,
-			Payload:          errorPayloadMap,
-			UserID:           userID,
-			EncryptedHmacKey: hex.EncodeToString(encryptedHmacKey),
-			FilePath:         file,
-			AttemptTime:      time.Now(),
-			ErrorMessage:     lastError.Error(),
-		}
+	return nil
+}
 
-		PublishFileErrorToQueue(errorPayload)
+// publishWebhookFileError forwards a permanently failed file webhook to the error queue
+func publishWebhookFileError(myurl string, payload map[string]string, userID string, file string, encryptedHmacKey []byte, lastError error) {
+	errorPayloadMap := make(map[string]interface{})
+	for k, v := range webhookFilePayload(payload, file) {
+		errorPayloadMap[k] = v
+	}
 
-		return fmt.Errorf("webhook failed permanently: %w", lastError)
+	errorPayload := WebhookFileErrorPayload{
+		URL:              myurl,
+		Payload:          errorPayloadMap,
+		UserID:           userID,
+		EncryptedHmacKey: hex.EncodeToString(encryptedHmacKey),
+		FilePath:         file,
+		AttemptTime:      time.Now(),
+		ErrorMessage:     lastError.Error(),
 	}
 
-	return nil
+	PublishFileErrorToQueue(errorPayload)
 }
 
 func (s *server) respondWithJSON(w http.ResponseWriter, statusCode int, payload interface{}) {
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// historyExportContentTypes are the export formats with their content type
+var historyExportContentTypes = map[string]string{
+	"jsonl": "application/x-ndjson",
+	"csv":   "text/csv; charset=utf-8",
+	"txt":   "text/plain; charset=utf-8",
+}
+
+// historyExportCSVHeader are the columns of a CSV export
+var historyExportCSVHeader = []string{"id", "timestamp", "chat_jid", "sender_jid", "message_id", "message_type", "text_content", "media_link", "quoted_message_id", "datajson", "edited_at", "deleted_at"}
+
+// historyMediaTypes are the message types whose media is attached to a ZIP export
+var historyMediaTypes = map[string]bool{"image": true, "video": true, "audio": true, "document": true, "sticker": true}
+
+// historyExportBatchSize is how many messages an export reads at a time. Each batch
+// is read before it is written, so no query stays open while the client downloads.
+var historyExportBatchSize = 500
+
+// historyExport is an export of the message history of a chat
+type historyExport struct {
+	ChatJID string
+	Format  string
+	From    *time.Time
+	To      *time.Time
+	Zip     bool
+}
+
+// parseHistoryExport reads an export from the query of /chat/history/export
+func parseHistoryExport(query url.Values) (historyExport, error) {
+	export := historyExport{
+		ChatJID: query.Get("chat_jid"),
+		Format:  query.Get("format"),
+	}
+	if export.ChatJID == "" {
+		return export, errors.New("chat_jid is required")
+	}
+	if export.Format == "" {
+		export.Format = "jsonl"
+	}
+	if _, ok := historyExportContentTypes[export.Format]; !ok {
+		return export, errors.New("format must be jsonl, csv or txt")
+	}
+
+	var err error
+	if export.From, err = parseHistoryTime(query, "from"); err != nil {
+		return export, err
+	}
+	if export.To, err = parseHistoryTime(query, "to"); err != nil {
+		return export, err
+	}
+	if value := query.Get("zip"); value != "" {
+		if export.Zip, err = strconv.ParseBool(value); err != nil {
+			return export, errors.New("invalid zip")
+		}
+	}
+	return export, nil
+}
+
+// fileName returns the name of the exported file, without extension
+func (export historyExport) fileName() string {
+	name := export.ChatJID
+	if jid, err := types.ParseJID(export.ChatJID); err == nil && jid.User != "" {
+		name = jid.User
+	}
+	return "chat-" + strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '"' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// batch returns the next messages of the export, oldest first: the first ones, or
+// the ones after the last message of the previous batch
+func (export historyExport) batch(db *sqlx.DB, userID string, after *HistoryMessage) ([]HistoryMessage, error) {
+	conditions := []string{"h.user_id = $1", "h.chat_jid = $2"}
+	args := []interface{}{userID, export.ChatJID}
+	if export.From != nil {
+		args = append(args, *export.From)
+		conditions = append(conditions, fmt.Sprintf("h.timestamp >= $%d", len(args)))
+	}
+	if export.To != nil {
+		args = append(args, *export.To)
+		conditions = append(conditions, fmt.Sprintf("h.timestamp <= $%d", len(args)))
+	}
+	if after != nil {
+		args = append(args, historyTime(after.Timestamp), after.ID)
+		conditions = append(conditions, fmt.Sprintf("(h.timestamp, h.id) > ($%d, $%d)", len(args)-1, len(args)))
+	}
+	args = append(args, historyExportBatchSize)
+
+	messages := []HistoryMessage{}
+	err := db.Select(&messages, "SELECT "+historyColumns+" FROM message_history h WHERE "+strings.Join(conditions, " AND ")+
+		fmt.Sprintf(" ORDER BY h.timestamp, h.id LIMIT $%d", len(args)), args...)
+	return messages, err
+}
+
+// historyExportWriter writes messages to w in an export format. With media, the
+// media links of the messages are given file names to be attached next to the export.
+type historyExportWriter struct {
+	format     string
+	w          io.Writer
+	csv        *csv.Writer
+	encoder    *json.Encoder
+	withMedia  bool
+	mediaNames map[string]string
+	usedNames  map[string]bool
+	media      []historyMedia
+}
+
+// historyMedia is a media file attached to a ZIP export
+type historyMedia struct {
+	Link string
+	Name string
+}
+
+func newHistoryExportWriter(format string, w io.Writer, withMedia bool) (*historyExportWriter, error) {
+	ew := &historyExportWriter{format: format, w: w, withMedia: withMedia, mediaNames: map[string]string{}, usedNames: map[string]bool{}}
+	switch format {
+	case "csv":
+		ew.csv = csv.NewWriter(w)
+		if err := ew.csv.Write(historyExportCSVHeader); err != nil {
+			return nil, err
+		}
+	case "jsonl":
+		ew.encoder = json.NewEncoder(w)
+	}
+	return ew, nil
+}
+
+// write writes a message
+func (ew *historyExportWriter) write(m HistoryMessage) error {
+	m.fill()
+	switch ew.format {
+	case "csv":
+		return ew.csv.Write([]string{
+			strconv.Itoa(m.ID), m.Timestamp.Format(time.RFC3339Nano), m.ChatJID, m.SenderJID, m.MessageID,
+			m.MessageType, m.TextContent, m.MediaLink, m.QuotedMessageID, m.DataJson,
+			exportTime(m.EditedAt), exportTime(m.DeletedAt),
+		})
+	case "txt":
+		line := whatsAppExportLine(m, ew.attach(m))
+		if line == "" {
+			return nil
+		}
+		_, err := io.WriteString(ew.w, line+"\n")
+		return err
+	default:
+		// Edits and reactions are listed by the history endpoints, not in exports
+		return ew.encoder.Encode(struct {
+			HistoryMessage
+			Edits     []HistoryEdit     `json:"edits,omitempty"`
+			Reactions []HistoryReaction `json:"reactions,omitempty"`
+		}{HistoryMessage: m})
+	}
+}
+
+// exportTime formats an optional time for a CSV export
+func exportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// attach returns the file name the media of a message is attached under, or "" if
+// it is not attached
+func (ew *historyExportWriter) attach(m HistoryMessage) string {
+	if !ew.withMedia || m.MediaLink == "" || !historyMediaTypes[m.MessageType] {
+		return ""
+	}
+	if name, ok := ew.mediaNames[m.MediaLink]; ok {
+		return name
+	}
+
+	name := "media"
+	if link, err := url.Parse(m.MediaLink); err == nil && path.Base(link.Path) != "/" && path.Base(link.Path) != "." {
+		name = path.Base(link.Path)
+	}
+	if ew.usedNames[name] {
+		name = m.MessageID + "-" + name
+	}
+	ew.usedNames[name] = true
+	ew.mediaNames[m.MediaLink] = name
+	ew.media = append(ew.media, historyMedia{Link: m.MediaLink, Name: name})
+	return name
+}
+
+// flush writes buffered data
+func (ew *historyExportWriter) flush() error {
+	if ew.csv != nil {
+		ew.csv.Flush()
+		return ew.csv.Error()
+	}
+	return nil
+}
+
+// whatsAppExportLine formats a message like WhatsApp's "Export chat". Reactions are
+// left out, as WhatsApp does; it returns "" for them.
+func whatsAppExportLine(m HistoryMessage, attachment string) string {
+	var content string
+	switch {
+	case m.MessageType == "reaction":
+		return ""
+	case m.MessageType == "delete" || m.Deleted:
+		content = "This message was deleted"
+	case historyMediaTypes[m.MessageType]:
+		content = "<Media omitted>"
+		if attachment != "" {
+			content = attachment + " (file attached)"
+		}
+		if caption := m.TextContent; caption != "" && caption != ":"+m.MessageType+":" {
+			content += "\n" + caption
+		}
+	default:
+		content = m.TextContent
+		if m.EditedAt != nil {
+			content += " <This message was edited>"
+		}
+	}
+	return m.Timestamp.In(time.Local).Format("02/01/2006, 15:04") + " - " + exportSenderName(m) + ": " + content
+}
+
+// exportSenderName returns the name a message sender is shown with in a text export:
+// its push name when the message has one, else its phone number
+func exportSenderName(m HistoryMessage) string {
+	if m.SenderJID == "me" {
+		return "You"
+	}
+	var event struct {
+		Info struct {
+			IsFromMe bool
+			PushName string
+		}
+	}
+	if m.DataJson != "" && json.Unmarshal([]byte(m.DataJson), &event) == nil {
+		if event.Info.IsFromMe {
+			return "You"
+		}
+		if event.Info.PushName != "" {
+			return event.Info.PushName
+		}
+	}
+	if jid, err := types.ParseJID(m.SenderJID); err == nil && jid.User != "" {
+		return "+" + jid.User
+	}
+	return m.SenderJID
+}
+
+// openHistoryMedia opens the media behind a history media link, from the user's S3
+// bucket when the link points to it
+func openHistoryMedia(ctx context.Context, userID string, link string) (io.ReadCloser, error) {
+	if key, ok := GetS3Manager().KeyFromURL(userID, link); ok {
+		return GetS3Manager().GetObject(ctx, userID, key)
+	}
+	if !isHTTPURL(link) {
+		return nil, fmt.Errorf("unsupported media link")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := globalHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("media download returned status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// writeHistoryExport streams the messages of the export to w, starting with the
+// first batch and reading the others as it goes. In a ZIP bundle, the export is
+// followed by the media of its messages; media that cannot be fetched is logged
+// and left out.
+func writeHistoryExport(ctx context.Context, w io.Writer, export historyExport, db *sqlx.DB, userID string, first []HistoryMessage) error {
+	out := w
+	var zw *zip.Writer
+	if export.Zip {
+		zw = zip.NewWriter(w)
+		var err error
+		if out, err = zw.Create(export.fileName() + "." + export.Format); err != nil {
+			return err
+		}
+	}
+
+	ew, err := newHistoryExportWriter(export.Format, out, export.Zip)
+	if err != nil {
+		return err
+	}
+	for batch := first; len(batch) > 0; {
+		for _, m := range batch {
+			if err := ew.write(m); err != nil {
+				return err
+			}
+		}
+		if len(batch) < historyExportBatchSize {
+			break
+		}
+		if batch, err = export.batch(db, userID, &batch[len(batch)-1]); err != nil {
+			return err
+		}
+	}
+	if err := ew.flush(); err != nil {
+		return err
+	}
+	if zw == nil {
+		return nil
+	}
+
+	for _, media := range ew.media {
+		body, err := openHistoryMedia(ctx, userID, media.Link)
+		if err != nil {
+			log.Warn().Err(err).Str("userID", userID).Str("link", media.Link).Msg("Failed to fetch media for history export")
+			continue
+		}
+		file, err := zw.Create(media.Name)
+		if err == nil {
+			_, err = io.Copy(file, body)
+		}
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryExport(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "ExportUser",
+		"token":      "export-token",
+		"history":    100,
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "export-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	chat := "5491155550001@s.whatsapp.net"
+	base := time.Date(2025, 2, 1, 10, 0, 0, 0, time.Local)
+	insert := func(sender, messageID, messageType, text, mediaLink, dataJSON string, at time.Time) {
+		_, err := s.db.Exec(`
+			INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link, datajson)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			userID, chat, sender, messageID, historyTime(at), messageType, text, mediaLink, dataJSON)
+		if err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+	insert(chat, "M1", "text", "Hello,\n\"there\"", "", `{"Info":{"PushName":"Alice"}}`, base)
+	insert("me", "M2", "text", "Hi Alice", "", "", base.Add(time.Minute))
+	insert(chat, "M3", "image", ":image:", "http://127.0.0.1:1/bucket/M3.jpg", "", base.Add(2*time.Minute))
+	insert(chat, "M4", "reaction", "👍", "", "", base.Add(3*time.Minute))
+	insert(chat, "M5", "text", "Next day", "", "", base.Add(24*time.Hour))
+
+	export := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/chat/history/export?chat_jid="+chat+query, nil)
+		req.Header.Set("token", "export-token")
+		recorder := httptest.NewRecorder()
+		s.router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	got := export("&format=jsonl&to=" + base.Add(time.Hour).Format(time.RFC3339))
+	if got.Code != http.StatusOK || got.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Unexpected response: %d %v", got.Code, got.Header())
+	}
+	lines := strings.Split(strings.TrimSpace(got.Body.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got %d: %s", len(lines), got.Body.String())
+	}
+	var first HistoryMessage
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first.MessageID != "M1" || first.DataJson == "" {
+		t.Errorf("Unexpected first line: %s (%v)", lines[0], err)
+	}
+
+	got = export("&format=csv")
+	records, err := csv.NewReader(got.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	if len(records) != 6 || records[0][0] != "id" || records[1][6] != "Hello,\n\"there\"" || records[3][7] != "http://127.0.0.1:1/bucket/M3.jpg" {
+		t.Errorf("Unexpected CSV: %v", records)
+	}
+
+	expected := strings.Join([]string{
+		"01/02/2025, 10:00 - Alice: Hello,",
+		`"there"`,
+		"01/02/2025, 10:01 - You: Hi Alice",
+		"01/02/2025, 10:02 - +5491155550001: <Media omitted>",
+		"02/02/2025, 10:00 - +5491155550001: Next day",
+		"",
+	}, "\n")
+	if got = export("&format=txt"); got.Body.String() != expected {
+		t.Errorf("Unexpected text export:\n%s", got.Body.String())
+	}
+
+	// Media that cannot be fetched is left out of the bundle
+	got = export("&format=txt&zip=true")
+	if got.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Unexpected content type: %v", got.Header())
+	}
+	archive, err := zip.NewReader(bytes.NewReader(got.Body.Bytes()), int64(got.Body.Len()))
+	if err != nil {
+		t.Fatalf("Invalid ZIP: %v", err)
+	}
+	if len(archive.File) != 1 || archive.File[0].Name != "chat-5491155550001.txt" {
+		t.Fatalf("Unexpected ZIP entries: %v", archive.File)
+	}
+	file, _ := archive.File[0].Open()
+	content, _ := io.ReadAll(file)
+	if !strings.Contains(string(content), "10:02 - +5491155550001: M3.jpg (file attached)") {
+		t.Errorf("Unexpected text export:\n%s", content)
+	}
+
+	if got = export("&format=xml"); got.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown format, got %d", got.Code)
+	}
+
+	response := executeRequest(t, s, newRequest("2", "chat.history.export", map[string]interface{}{
+		"token":    "export-token",
+		"chat_jid": chat,
+		"format":   "txt",
+	}).toJSON(t))
+	if result := assertJSONRPC20Success(t, response, "2"); result != expected {
+		t.Errorf("Unexpected stdio export: %v", result)
+	}
+}
+
+func TestHistoryExportBatches(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	previousBatchSize := historyExportBatchSize
+	historyExportBatchSize = 2
+	t.Cleanup(func() { historyExportBatchSize = previousBatchSize })
+
+	chat := "5491155550001@s.whatsapp.net"
+	base := time.Date(2025, 2, 1, 10, 0, 0, 0, time.Local)
+	// Messages sharing a timestamp across batch boundaries are neither repeated nor skipped
+	for i, minute := range []int{0, 1, 1, 1, 2, 3, 3} {
+		_, err := s.db.Exec(`
+			INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link)
+			VALUES ('user1', $1, $1, $2, $3, 'text', 'Hello', '')`,
+			chat, fmt.Sprintf("M%d", i+1), historyTime(base.Add(time.Duration(minute)*time.Minute)))
+		if err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	first, err := historyExport{ChatJID: chat, Format: "jsonl"}.batch(s.db, "user1", nil)
+	if err != nil || len(first) != 2 {
+		t.Fatalf("Expected a first batch of 2, got %d (%v)", len(first), err)
+	}
+	var out bytes.Buffer
+	if err := writeHistoryExport(context.Background(), &out, historyExport{ChatJID: chat, Format: "jsonl"}, s.db, "user1", first); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var m HistoryMessage
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("Invalid line %q: %v", line, err)
+		}
+		ids = append(ids, m.MessageID)
+	}
+	if strings.Join(ids, ",") != "M1,M2,M3,M4,M5,M6,M7" {
+		t.Errorf("Expected every message once and in order, got %v", ids)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHistoryLimit = 50
+
+// historyPagingParams are the /chat/history parameters that make the response a
+// page with a next cursor instead of a plain array
+var historyPagingParams = []string{"before", "after", "since", "until", "order", "sender_jid", "message_type"}
+
+// historyQuery is a query of the message history of a chat
+type historyQuery struct {
+	ChatJID     string
+	Before      string
+	After       string
+	Since       *time.Time
+	Until       *time.Time
+	Ascending   bool
+	SenderJID   string
+	MessageType string
+	Limit       int
+	// Paged is set when the query uses paging parameters
+	Paged bool
+}
+
+// parseHistoryQuery reads a query from the parameters of /chat/history
+func parseHistoryQuery(query url.Values) (historyQuery, error) {
+	q := historyQuery{
+		ChatJID:     query.Get("chat_jid"),
+		Before:      query.Get("before"),
+		After:       query.Get("after"),
+		SenderJID:   query.Get("sender_jid"),
+		MessageType: query.Get("message_type"),
+		Limit:       defaultHistoryLimit,
+	}
+	for _, name := range historyPagingParams {
+		if query.Get(name) != "" {
+			q.Paged = true
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		var err error
+		q.Limit, err = strconv.Atoi(value)
+		if err != nil {
+			return q, errors.New("invalid limit")
+		}
+	}
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+
+	var err error
+	if q.Since, err = parseHistoryTime(query, "since"); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseHistoryTime(query, "until"); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// cursorCondition returns the condition selecting the messages before or after a
+// cursor, which is an RFC 3339 time or the ID of a message of the chat. Messages
+// are ordered by time, then by row ID, so a message ID cursor is exact.
+func cursorCondition(cursor string, operator string, placeholder func(interface{}) string, userID string, chatJID string) string {
+	if t, err := time.Parse(time.RFC3339, cursor); err == nil {
+		return fmt.Sprintf("h.timestamp %s %s", operator, placeholder(historyTime(t)))
+	}
+	return fmt.Sprintf("(h.timestamp, h.id) %s (SELECT timestamp, id FROM message_history WHERE user_id = %s AND chat_jid = %s AND message_id = %s)",
+		operator, placeholder(userID), placeholder(chatJID), placeholder(cursor))
+}
+
+// checkCursors returns an error if a message ID cursor is not a message of the chat
+func (q historyQuery) checkCursors(s *server, userID string) error {
+	for _, cursor := range []string{q.Before, q.After} {
+		if cursor == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, cursor); err == nil {
+			continue
+		}
+		var found int
+		err := s.db.Get(&found, "SELECT 1 FROM message_history WHERE user_id = $1 AND chat_jid = $2 AND message_id = $3", userID, q.ChatJID, cursor)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("unknown cursor %q", cursor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build returns the SQL and arguments of the query, with the placeholders of the
+// database driver. It selects one row more than the limit, to tell if there is a
+// next page.
+func (q historyQuery) build(driver string, userID string) (string, []interface{}) {
+	args := []interface{}{}
+	placeholder := func(value interface{}) string {
+		args = append(args, value)
+		if driver == "postgres" {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
+	}
+
+	conditions := []string{"h.user_id = " + placeholder(userID), "h.chat_jid = " + placeholder(q.ChatJID)}
+	if q.Before != "" {
+		conditions = append(conditions, cursorCondition(q.Before, "<", placeholder, userID, q.ChatJID))
+	}
+	if q.After != "" {
+		conditions = append(conditions, cursorCondition(q.After, ">", placeholder, userID, q.ChatJID))
+	}
+	if q.Since != nil {
+		conditions = append(conditions, "h.timestamp >= "+placeholder(*q.Since))
+	}
+	if q.Until != nil {
+		conditions = append(conditions, "h.timestamp <= "+placeholder(*q.Until))
+	}
+	if q.SenderJID != "" {
+		conditions = append(conditions, "h.sender_jid = "+placeholder(q.SenderJID))
+	}
+	if q.MessageType != "" {
+		conditions = append(conditions, "h.message_type = "+placeholder(q.MessageType))
+	}
+
+	order := "DESC"
+	if q.Ascending {
+		order = "ASC"
+	}
+	limit := q.Limit
+	if q.Paged {
+		limit++
+	}
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM message_history h
+		WHERE %s
+		ORDER BY h.timestamp %s, h.id %s
+		LIMIT %s`,
+		historyColumns, strings.Join(conditions, " AND "), order, order, placeholder(limit))
+	return query, args
+}
+
+// page trims the extra row of a paged query and returns the cursor of the next
+// page, the ID of its last message, or "" when there are no more messages
+func (q historyQuery) page(messages []HistoryMessage) ([]HistoryMessage, string) {
+	if !q.Paged || len(messages) <= q.Limit || q.Limit < 1 {
+		return messages, ""
+	}
+	messages = messages[:q.Limit]
+	return messages, messages[len(messages)-1].MessageID
+}
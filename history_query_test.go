@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHistoryPaging(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "PagingUser",
+		"token":      "paging-token",
+		"history":    100,
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "paging-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	chat := "5491155550001@s.whatsapp.net"
+	base := time.Date(2025, 5, 1, 9, 0, 0, 0, time.UTC)
+	// M1..M7, one minute apart, except M4 and M5 which share a time
+	for i := 1; i <= 7; i++ {
+		at := base.Add(time.Duration(i) * time.Minute)
+		if i == 5 {
+			at = base.Add(4 * time.Minute)
+		}
+		sender, messageType := chat, "text"
+		if i%2 == 0 {
+			sender = "me"
+		}
+		if i == 3 {
+			messageType = "image"
+		}
+		_, err := s.db.Exec(`
+			INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, '')`,
+			userID, chat, sender, fmt.Sprintf("M%d", i), historyTime(at), messageType, fmt.Sprintf("Message %d", i))
+		if err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	history := func(requestID string, params map[string]interface{}) ([]string, string) {
+		params["token"] = "paging-token"
+		params["chat_jid"] = chat
+		got := executeRequest(t, s, newRequest(requestID, "chat.history", params).toJSON(t))
+		result := assertJSONRPC20Success(t, got, requestID).(map[string]interface{})
+		ids := []string{}
+		for _, message := range result["messages"].([]interface{}) {
+			ids = append(ids, message.(map[string]interface{})["message_id"].(string))
+		}
+		return ids, result["next_cursor"].(string)
+	}
+	expect := func(got []string, want ...string) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+
+	// Scrolling back, newest first, across messages sharing a time
+	ids, next := history("2", map[string]interface{}{"limit": 3, "order": "desc"})
+	expect(ids, "M7", "M6", "M5")
+	ids, next = history("3", map[string]interface{}{"limit": 3, "before": next})
+	expect(ids, "M4", "M3", "M2")
+	ids, next = history("4", map[string]interface{}{"limit": 3, "before": next})
+	expect(ids, "M1")
+	if next != "" {
+		t.Errorf("Expected no next cursor on the last page, got %q", next)
+	}
+
+	// Scrolling forward, oldest first
+	ids, next = history("5", map[string]interface{}{"limit": 4, "order": "asc", "after": "M2"})
+	expect(ids, "M3", "M4", "M5", "M6")
+	if next != "M6" {
+		t.Errorf("Expected next cursor M6, got %q", next)
+	}
+
+	// Time cursors and ranges
+	ids, _ = history("6", map[string]interface{}{"before": base.Add(3 * time.Minute).Format(time.RFC3339)})
+	expect(ids, "M2", "M1")
+	ids, _ = history("7", map[string]interface{}{
+		"since": base.Add(2 * time.Minute).Format(time.RFC3339),
+		"until": base.Add(4 * time.Minute).Format(time.RFC3339),
+		"order": "asc",
+	})
+	expect(ids, "M2", "M3", "M4", "M5")
+
+	// Sender and type filters
+	ids, _ = history("8", map[string]interface{}{"sender_jid": "me"})
+	expect(ids, "M6", "M4", "M2")
+	ids, _ = history("9", map[string]interface{}{"message_type": "image"})
+	expect(ids, "M3")
+
+	got := executeRequest(t, s, newRequest("10", "chat.history", map[string]interface{}{
+		"token":    "paging-token",
+		"chat_jid": chat,
+		"before":   "UNKNOWN",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, got, "10", 400)
+
+	// Without paging parameters the response is the plain array
+	got = executeRequest(t, s, newRequest("11", "chat.history", map[string]interface{}{
+		"token":    "paging-token",
+		"chat_jid": chat,
+		"limit":    2,
+	}).toJSON(t))
+	messages, ok := assertJSONRPC20Success(t, got, "11").([]interface{})
+	if !ok || len(messages) != 2 || messages[0].(map[string]interface{})["message_id"] != "M7" {
+		t.Errorf("Unexpected legacy response: %v", got["result"])
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// RetentionPolicy is how long the message history of an instance, or of one of its
+// chats when ChatJID is set, is kept. A chat policy without RetentionDays keeps the
+// period of the instance; 0 days keeps history forever. A legal hold keeps the
+// history it covers from being deleted, whatever the periods and history limit.
+type RetentionPolicy struct {
+	UserID        string     `json:"user_id" db:"user_id"`
+	ChatJID       string     `json:"chat_jid" db:"chat_jid"`
+	RetentionDays *int       `json:"retention_days" db:"retention_days"`
+	LegalHold     bool       `json:"legal_hold" db:"legal_hold"`
+	UpdatedAtUnix int64      `json:"-" db:"updated_at"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty" db:"-"`
+}
+
+// RetentionPreviewChat is the number of history messages of a chat a policy would
+// delete
+type RetentionPreviewChat struct {
+	ChatJID string `json:"chat_jid" db:"chat_jid"`
+	Count   int    `json:"count" db:"count"`
+}
+
+// retentionScope is a set of chats of an instance whose history is kept for the
+// same number of days: one chat, or all the chats without a policy of their own
+type retentionScope struct {
+	ChatJID string
+	Days    int
+	// Excluded are the chats with a policy of their own, for the instance scope
+	Excluded []string
+}
+
+// listRetentionPolicies returns the policies of an instance, its own first
+func listRetentionPolicies(db sqlx.Queryer, userID string) ([]RetentionPolicy, error) {
+	policies := []RetentionPolicy{}
+	err := sqlx.Select(db, &policies, "SELECT user_id, chat_jid, retention_days, legal_hold, updated_at FROM history_retention WHERE user_id = $1 ORDER BY chat_jid", userID)
+	for i := range policies {
+		policies[i].UpdatedAt = unixTime(policies[i].UpdatedAtUnix)
+	}
+	return policies, err
+}
+
+// setRetentionPolicy creates or replaces a policy
+func setRetentionPolicy(db *sqlx.DB, policy RetentionPolicy) error {
+	_, err := db.Exec(`
+		INSERT INTO history_retention (user_id, chat_jid, retention_days, legal_hold, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, chat_jid) DO UPDATE SET retention_days = excluded.retention_days,
+			legal_hold = excluded.legal_hold, updated_at = excluded.updated_at`,
+		policy.UserID, policy.ChatJID, policy.RetentionDays, policy.LegalHold, time.Now().Unix())
+	return err
+}
+
+// deleteRetentionPolicy removes a policy, and returns false if there was none
+func deleteRetentionPolicy(db *sqlx.DB, userID string, chatJID string) (bool, error) {
+	res, err := db.Exec("DELETE FROM history_retention WHERE user_id = $1 AND chat_jid = $2", userID, chatJID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// historyOnHold returns true if a legal hold covers the history of a chat
+func historyOnHold(db sqlx.Queryer, userID string, chatJID string) (bool, error) {
+	var holds int
+	err := sqlx.Get(db, &holds, "SELECT COUNT(*) FROM history_retention WHERE user_id = $1 AND chat_jid IN ('', $2) AND legal_hold = $3", userID, chatJID, true)
+	return holds > 0, err
+}
+
+// withRetentionPolicy returns the policies of an instance with policy added or
+// replacing the one of its chat
+func withRetentionPolicy(policies []RetentionPolicy, policy RetentionPolicy) []RetentionPolicy {
+	changed := []RetentionPolicy{policy}
+	for _, p := range policies {
+		if p.ChatJID != policy.ChatJID {
+			changed = append(changed, p)
+		}
+	}
+	return changed
+}
+
+// retentionScopes returns the scopes whose history expires under the policies of an
+// instance. The instance keeps history for defaultDays when it has no period of its
+// own. Chats on legal hold are left out, and a hold of the instance leaves out all.
+func retentionScopes(policies []RetentionPolicy, defaultDays int) []retentionScope {
+	instanceDays := defaultDays
+	var chats []RetentionPolicy
+	for _, p := range policies {
+		if p.ChatJID != "" {
+			chats = append(chats, p)
+			continue
+		}
+		if p.LegalHold {
+			return nil
+		}
+		if p.RetentionDays != nil {
+			instanceDays = *p.RetentionDays
+		}
+	}
+
+	scopes := []retentionScope{}
+	instance := retentionScope{Days: instanceDays}
+	for _, p := range chats {
+		instance.Excluded = append(instance.Excluded, p.ChatJID)
+		days := instanceDays
+		if p.RetentionDays != nil {
+			days = *p.RetentionDays
+		}
+		if !p.LegalHold && days > 0 {
+			scopes = append(scopes, retentionScope{ChatJID: p.ChatJID, Days: days})
+		}
+	}
+	if instanceDays > 0 {
+		scopes = append(scopes, instance)
+	}
+	return scopes
+}
+
+// where returns the condition selecting the history messages of an instance that
+// expired in the scope by now
+func (scope retentionScope) where(userID string, now time.Time) (string, []interface{}) {
+	args := []interface{}{userID, historyTime(now.AddDate(0, 0, -scope.Days))}
+	conditions := []string{"user_id = $1", "timestamp < $2"}
+	if scope.ChatJID != "" {
+		args = append(args, scope.ChatJID)
+		conditions = append(conditions, "chat_jid = $3")
+	} else if len(scope.Excluded) > 0 {
+		placeholders := make([]string, len(scope.Excluded))
+		for i, chat := range scope.Excluded {
+			args = append(args, chat)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		conditions = append(conditions, "chat_jid NOT IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// previewRetention counts, per chat, the history messages of an instance that would
+// be deleted under the policies by now
+func previewRetention(db *sqlx.DB, userID string, policies []RetentionPolicy, defaultDays int, now time.Time) (int, []RetentionPreviewChat, error) {
+	total := 0
+	chats := []RetentionPreviewChat{}
+	for _, scope := range retentionScopes(policies, defaultDays) {
+		where, args := scope.where(userID, now)
+		var counts []RetentionPreviewChat
+		if err := db.Select(&counts, "SELECT chat_jid, COUNT(*) AS count FROM message_history WHERE "+where+" GROUP BY chat_jid", args...); err != nil {
+			return 0, nil, err
+		}
+		for _, count := range counts {
+			total += count.Count
+		}
+		chats = append(chats, counts...)
+	}
+	sort.Slice(chats, func(i, j int) bool {
+		if chats[i].Count != chats[j].Count {
+			return chats[i].Count > chats[j].Count
+		}
+		return chats[i].ChatJID < chats[j].ChatJID
+	})
+	return total, chats, nil
+}
+
+// enforceRetention deletes the history messages of an instance that expired under
+// its policies by now, with their message secrets, edits and reactions, and returns
+// how many it deleted
+func enforceRetention(db *sqlx.DB, userID string, defaultDays int, now time.Time) (int64, error) {
+	policies, err := listRetentionPolicies(db, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, scope := range retentionScopes(policies, defaultDays) {
+		n, err := deleteExpiredHistory(db, userID, scope, now)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// deleteExpiredHistory deletes the history messages of an instance that expired in
+// a scope by now
+func deleteExpiredHistory(db *sqlx.DB, userID string, scope retentionScope, now time.Time) (int64, error) {
+	where, args := scope.where(userID, now)
+	expired := "SELECT message_id FROM message_history WHERE " + where
+	statements := []string{
+		"DELETE FROM message_edits WHERE user_id = $1 AND message_id IN (" + expired + ")",
+		"DELETE FROM message_reactions WHERE user_id = $1 AND message_id IN (" + expired + ")",
+	}
+	// On SQLite the whatsmeow store, with the message secrets, is a database of its own
+	if db.DriverName() == "postgres" {
+		statements = append(statements, "DELETE FROM whatsmeow_message_secrets WHERE message_id IN ("+expired+")")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, args...); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec("DELETE FROM message_history WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// InitHistoryRetention starts the janitor that deletes expired message history
+// every intervalMinutes, and vacuums SQLite databases after it deletes any
+func InitHistoryRetention(db *sqlx.DB, intervalMinutes int) {
+	if intervalMinutes <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(intervalMinutes) * time.Minute)
+		defer ticker.Stop()
+		for {
+			runHistoryJanitor(db, *historyRetentionDays, time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// runHistoryJanitor enforces the retention policies of all instances
+func runHistoryJanitor(db *sqlx.DB, defaultDays int, now time.Time) int64 {
+	var userIDs []string
+	if err := db.Select(&userIDs, "SELECT id FROM users"); err != nil {
+		log.Error().Err(err).Msg("Failed to list users for history retention")
+		return 0
+	}
+
+	var total int64
+	for _, userID := range userIDs {
+		deleted, err := enforceRetention(db, userID, defaultDays, now)
+		if err != nil {
+			log.Error().Err(err).Str("userID", userID).Msg("Failed to enforce history retention")
+		}
+		total += deleted
+	}
+	if total == 0 {
+		return 0
+	}
+
+	log.Info().Int64("count", total).Msg("Deleted expired message history")
+	if db.DriverName() == "sqlite" {
+		if _, err := db.Exec("VACUUM"); err != nil {
+			log.Error().Err(err).Msg("Failed to vacuum database after history retention")
+		}
+	}
+	return total
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHistoryRetention(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "RetentionUser",
+		"token":      "retention-token",
+		"history":    100,
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "retention-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	alice := "5491155550001@s.whatsapp.net"
+	bob := "5491155550002@s.whatsapp.net"
+	group := "120363313346913103@g.us"
+	now := time.Now()
+	// Each chat has a message of 10, 40 and 100 days ago
+	for _, chat := range []string{alice, bob, group} {
+		for _, days := range []int{10, 40, 100} {
+			_, err := s.db.Exec(`
+				INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link)
+				VALUES ($1, $2, $2, $3, $4, 'text', 'Hello', '')`,
+				userID, chat, fmt.Sprintf("%s-%d", chat, days), historyTime(now.AddDate(0, 0, -days)))
+			if err != nil {
+				t.Fatalf("Failed to insert message: %v", err)
+			}
+		}
+	}
+	if err := reactToHistoryMessage(s.db, userID, alice+"-100", "me", "👍", now); err != nil {
+		t.Fatalf("Failed to react: %v", err)
+	}
+
+	admin := func(requestID, method string, params map[string]interface{}) map[string]interface{} {
+		params["adminToken"] = "test-admin-token"
+		params["userId"] = userID
+		got := executeRequest(t, s, newRequest(requestID, method, params).toJSON(t))
+		return assertJSONRPC20Success(t, got, requestID).(map[string]interface{})
+	}
+	count := func() int {
+		var n int
+		if err := s.db.Get(&n, "SELECT COUNT(*) FROM message_history WHERE user_id = $1", userID); err != nil {
+			t.Fatalf("Failed to count messages: %v", err)
+		}
+		return n
+	}
+
+	// Keep 90 days, 30 for Bob, and hold the group
+	admin("2", "admin.users.retention.set", map[string]interface{}{"retention_days": 90})
+	admin("3", "admin.users.retention.set", map[string]interface{}{"chat_jid": bob, "retention_days": 30})
+	preview := admin("4", "admin.users.retention.preview", map[string]interface{}{"chat_jid": group, "legal_hold": true})
+	if preview["would_delete"] != float64(3) || preview["current"] != float64(4) {
+		t.Errorf("Unexpected preview: %v", preview)
+	}
+	chats := preview["chats"].([]interface{})
+	if len(chats) != 2 || chats[0].(map[string]interface{})["chat_jid"] != bob || chats[0].(map[string]interface{})["count"] != float64(2) {
+		t.Errorf("Unexpected preview chats: %v", chats)
+	}
+	admin("5", "admin.users.retention.set", map[string]interface{}{"chat_jid": group, "legal_hold": true})
+
+	policies := admin("6", "admin.users.retention.get", map[string]interface{}{})["policies"].([]interface{})
+	if len(policies) != 3 || policies[0].(map[string]interface{})["chat_jid"] != "" {
+		t.Errorf("Unexpected policies: %v", policies)
+	}
+	if count() != 9 {
+		t.Fatalf("Expected a preview not to delete anything")
+	}
+
+	if deleted := runHistoryJanitor(s.db, 0, now); deleted != 3 {
+		t.Errorf("Expected 3 messages deleted, got %d", deleted)
+	}
+	var left []string
+	if err := s.db.Select(&left, "SELECT message_id FROM message_history WHERE user_id = $1 ORDER BY message_id", userID); err != nil {
+		t.Fatalf("Failed to get messages: %v", err)
+	}
+	expected := fmt.Sprint([]string{group + "-10", group + "-100", group + "-40", alice + "-10", alice + "-40", bob + "-10"})
+	if fmt.Sprint(left) != expected {
+		t.Errorf("Expected %s left, got %v", expected, left)
+	}
+	var reactions int
+	if err := s.db.Get(&reactions, "SELECT COUNT(*) FROM message_reactions WHERE user_id = $1", userID); err != nil || reactions != 0 {
+		t.Errorf("Expected the reactions of deleted messages to be deleted, got %d (%v)", reactions, err)
+	}
+
+	// A hold also keeps the history limit from trimming the chat
+	if err := s.trimMessageHistory(userID, group, 1); err != nil {
+		t.Fatalf("Failed to trim history: %v", err)
+	}
+	if count() != 6 {
+		t.Errorf("Expected the held chat not to be trimmed")
+	}
+
+	// Without its hold, the group falls back to the instance period
+	admin("7", "admin.users.retention.delete", map[string]interface{}{"chat_jid": group})
+	if deleted := runHistoryJanitor(s.db, 0, now); deleted != 1 || count() != 5 {
+		t.Errorf("Expected 1 message deleted, got %d", deleted)
+	}
+
+	// An instance hold blocks everything, even the server default
+	admin("8", "admin.users.retention.set", map[string]interface{}{"legal_hold": true})
+	if deleted := runHistoryJanitor(s.db, 1, now); deleted != 0 {
+		t.Errorf("Expected nothing deleted under an instance hold, got %d", deleted)
+	}
+
+	got := executeRequest(t, s, newRequest("9", "admin.users.retention.set", map[string]interface{}{
+		"adminToken":     "test-admin-token",
+		"userId":         "unknown",
+		"retention_days": 30,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, got, "9", 404)
+	got = executeRequest(t, s, newRequest("10", "admin.users.retention.set", map[string]interface{}{
+		"adminToken":     "test-admin-token",
+		"userId":         userID,
+		"retention_days": -1,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, got, "10", 400)
+	got = executeRequest(t, s, newRequest("11", "admin.users.retention.delete", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"userId":     userID,
+		"chat_jid":   alice,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, got, "11", 404)
+}
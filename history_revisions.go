@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// HistoryEdit is an edit of a history message, with the text it replaced
+type HistoryEdit struct {
+	PreviousText string    `json:"previous_text" db:"previous_text"`
+	EditedAtUnix int64     `json:"-" db:"edited_at"`
+	EditedAt     time.Time `json:"edited_at" db:"-"`
+}
+
+// HistoryReaction is an emoji reacted to a history message, with who reacted with it
+type HistoryReaction struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	Senders []string `json:"senders"`
+}
+
+// fill sets the API fields of a history message from the stored columns
+func (m *HistoryMessage) fill() {
+	m.EditedAt = unixTime(m.EditedAtUnix)
+	m.DeletedAt = unixTime(m.DeletedAtUnix)
+	m.Deleted = m.DeletedAtUnix > 0
+}
+
+// editHistoryMessage replaces the text of a history message, keeping the text it
+// replaces as an edit
+func editHistoryMessage(db sqlx.Ext, userID string, messageID string, text string, at time.Time) error {
+	var current string
+	err := sqlx.Get(db, &current, "SELECT COALESCE(text_content, '') FROM message_history WHERE user_id = $1 AND message_id = $2", userID, messageID)
+	if err == sql.ErrNoRows || (err == nil && current == text) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("INSERT INTO message_edits (user_id, message_id, previous_text, edited_at) VALUES ($1, $2, $3, $4)",
+		userID, messageID, current, at.Unix()); err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE message_history SET text_content = $1, edited_at = $2 WHERE user_id = $3 AND message_id = $4",
+		text, at.Unix(), userID, messageID)
+	return err
+}
+
+// revokeHistoryMessage marks a history message as deleted for everyone. Its content
+// is kept.
+func revokeHistoryMessage(db sqlx.Ext, userID string, messageID string, at time.Time) error {
+	_, err := db.Exec("UPDATE message_history SET deleted_at = $1 WHERE user_id = $2 AND message_id = $3 AND deleted_at = 0",
+		at.Unix(), userID, messageID)
+	return err
+}
+
+// reactToHistoryMessage sets the reaction of sender to a history message; an empty
+// emoji removes it. Reactions older than the stored one are ignored. The message
+// does not need to be stored yet, as a history sync may bring it after.
+func reactToHistoryMessage(db sqlx.Ext, userID string, messageID string, sender string, emoji string, at time.Time) error {
+	if emoji == "" {
+		_, err := db.Exec("DELETE FROM message_reactions WHERE user_id = $1 AND message_id = $2 AND sender_jid = $3 AND reacted_at <= $4",
+			userID, messageID, sender, at.Unix())
+		return err
+	}
+	_, err := db.Exec(`
+		INSERT INTO message_reactions (user_id, message_id, sender_jid, emoji, reacted_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, message_id, sender_jid) DO UPDATE SET emoji = excluded.emoji, reacted_at = excluded.reacted_at
+		WHERE message_reactions.reacted_at <= excluded.reacted_at`,
+		userID, messageID, sender, emoji, at.Unix())
+	return err
+}
+
+// applyHistoryRevision applies an edit, revoke or reaction to the history message
+// it refers to, and returns true if the event was one. These events are not stored
+// as messages of their own.
+func (mycli *MyClient) applyHistoryRevision(evt *events.Message) bool {
+	var err error
+	var target string
+	if protocolMsg := evt.Message.GetProtocolMessage(); protocolMsg != nil {
+		target = protocolMsg.GetKey().GetID()
+		switch protocolMsg.GetType() {
+		case waE2E.ProtocolMessage_REVOKE:
+			err = revokeHistoryMessage(mycli.db, mycli.userID, target, evt.Info.Timestamp)
+		case waE2E.ProtocolMessage_MESSAGE_EDIT:
+			_, text := messagePreview(protocolMsg.GetEditedMessage())
+			err = editHistoryMessage(mycli.db, mycli.userID, target, text, evt.Info.Timestamp)
+		default:
+			return false
+		}
+	} else if reaction := evt.Message.GetReactionMessage(); reaction != nil {
+		target = reaction.GetKey().GetID()
+		sender := evt.Info.Sender.ToNonAD().String()
+		if evt.Info.IsFromMe {
+			sender = "me"
+		}
+		err = reactToHistoryMessage(mycli.db, mycli.userID, target, sender, reaction.GetText(), evt.Info.Timestamp)
+	} else {
+		return false
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("messageID", evt.Info.ID).Str("target", target).Msg("Failed to apply message revision to history")
+	}
+	return true
+}
+
+// attachHistoryRevisions sets the edits and reactions of history messages
+func attachHistoryRevisions(db *sqlx.DB, userID string, messages []*HistoryMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	index := make(map[string]*HistoryMessage, len(messages))
+	placeholders := make([]string, len(messages))
+	args := []interface{}{userID}
+	for i, m := range messages {
+		m.fill()
+		m.Edits = []HistoryEdit{}
+		m.Reactions = []HistoryReaction{}
+		index[m.MessageID] = m
+		args = append(args, m.MessageID)
+		placeholders[i] = fmt.Sprintf("$%d", i+2)
+	}
+	in := strings.Join(placeholders, ", ")
+
+	var edits []struct {
+		MessageID string `db:"message_id"`
+		HistoryEdit
+	}
+	err := db.Select(&edits, "SELECT message_id, previous_text, edited_at FROM message_edits WHERE user_id = $1 AND message_id IN ("+in+") ORDER BY edited_at, id", args...)
+	if err != nil {
+		return err
+	}
+	for _, edit := range edits {
+		edit.EditedAt = time.Unix(edit.EditedAtUnix, 0).UTC()
+		index[edit.MessageID].Edits = append(index[edit.MessageID].Edits, edit.HistoryEdit)
+	}
+
+	var reactions []struct {
+		MessageID string `db:"message_id"`
+		SenderJID string `db:"sender_jid"`
+		Emoji     string `db:"emoji"`
+	}
+	err = db.Select(&reactions, "SELECT message_id, sender_jid, emoji FROM message_reactions WHERE user_id = $1 AND message_id IN ("+in+") ORDER BY reacted_at, sender_jid", args...)
+	if err != nil {
+		return err
+	}
+	for _, reaction := range reactions {
+		m := index[reaction.MessageID]
+		aggregated := false
+		for i := range m.Reactions {
+			if m.Reactions[i].Emoji == reaction.Emoji {
+				m.Reactions[i].Count++
+				m.Reactions[i].Senders = append(m.Reactions[i].Senders, reaction.SenderJID)
+				aggregated = true
+				break
+			}
+		}
+		if !aggregated {
+			m.Reactions = append(m.Reactions, HistoryReaction{Emoji: reaction.Emoji, Count: 1, Senders: []string{reaction.SenderJID}})
+		}
+	}
+	return nil
+}
+
+// foldHistoryRevisions applies the reaction and delete rows stored before messages
+// had revisions to the messages they refer to, and removes them
+func foldHistoryRevisions(tx *sqlx.Tx) error {
+	var rows []struct {
+		UserID      string    `db:"user_id"`
+		SenderJID   string    `db:"sender_jid"`
+		MessageType string    `db:"message_type"`
+		Target      string    `db:"target"`
+		TextContent string    `db:"text_content"`
+		Timestamp   time.Time `db:"timestamp"`
+	}
+	err := tx.Select(&rows, `
+		SELECT user_id, sender_jid, message_type, COALESCE(quoted_message_id, '') AS target, COALESCE(text_content, '') AS text_content, timestamp
+		FROM message_history WHERE message_type IN ('reaction', 'delete') ORDER BY id`)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if row.MessageType == "delete" {
+			// Delete rows kept the ID of the deleted message as their text
+			err = revokeHistoryMessage(tx, row.UserID, row.TextContent, row.Timestamp)
+		} else if row.Target != "" {
+			err = reactToHistoryMessage(tx, row.UserID, row.Target, row.SenderJID, row.TextContent, row.Timestamp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM message_history WHERE message_type IN ('reaction', 'delete')")
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHistoryRevisions(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "RevisionsUser",
+		"token":      "revisions-token",
+		"history":    100,
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "revisions-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+	mycli := &MyClient{db: s.db, userID: userID}
+
+	alice := types.NewJID("5491155550001", types.DefaultUserServer)
+	bob := types.NewJID("5491155550002", types.DefaultUserServer)
+	group := types.NewJID("120363313346913103", types.GroupServer)
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, m := range []struct{ sender, id, text string }{{"me", "M1", "Lunch at 1?"}, {alice.String(), "M2", "Sure"}} {
+		_, err := s.db.Exec(`
+			INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link)
+			VALUES ($1, $2, $3, $4, $5, 'text', $6, '')`,
+			userID, group.String(), m.sender, m.id, historyTime(base.Add(time.Duration(i)*time.Minute)), m.text)
+		if err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	receive := func(sender types.JID, fromMe bool, at time.Time, msg *waE2E.Message) bool {
+		return mycli.applyHistoryRevision(&events.Message{
+			Info: types.MessageInfo{
+				MessageSource: types.MessageSource{Chat: group, Sender: sender, IsFromMe: fromMe, IsGroup: true},
+				ID:            fmt.Sprintf("E%d", at.Unix()),
+				Timestamp:     at,
+			},
+			Message: msg,
+		})
+	}
+	edit := func(id, text string) *waE2E.Message {
+		return &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+			Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+			Key:           &waCommon.MessageKey{ID: proto.String(id)},
+			EditedMessage: &waE2E.Message{Conversation: proto.String(text)},
+		}}
+	}
+	react := func(id, emoji string) *waE2E.Message {
+		return &waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{Key: &waCommon.MessageKey{ID: proto.String(id)}, Text: proto.String(emoji)}}
+	}
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+
+	if receive(alice, false, at(1), &waE2E.Message{Conversation: proto.String("Hi")}) {
+		t.Errorf("Expected a plain message not to be a revision")
+	}
+	receive(bob, true, at(2), edit("M1", "Lunch at 2?"))
+	receive(bob, true, at(3), edit("M1", "Lunch at 2:30?"))
+	receive(alice, false, at(4), react("M1", "👍"))
+	receive(bob, false, at(5), react("M1", "👍"))
+	receive(bob, true, at(6), react("M1", "❤️"))
+	// Bob changes his reaction, then an older one arrives late
+	receive(bob, false, at(7), react("M1", "😂"))
+	receive(bob, false, at(5), react("M1", "👎"))
+	receive(alice, false, at(8), react("M2", "🎉"))
+	receive(alice, false, at(9), react("M2", ""))
+	receive(alice, false, at(10), &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+		Type: waE2E.ProtocolMessage_REVOKE.Enum(),
+		Key:  &waCommon.MessageKey{ID: proto.String("M2")},
+	}})
+
+	got := executeRequest(t, s, newRequest("2", "chat.history", map[string]interface{}{
+		"token":    "revisions-token",
+		"chat_jid": group.String(),
+		"order":    "asc",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, got, "2").(map[string]interface{})
+	messages := result["messages"].([]interface{})
+	if len(messages) != 2 {
+		t.Fatalf("Expected the revisions not to be stored as messages, got %d messages", len(messages))
+	}
+
+	m1 := messages[0].(map[string]interface{})
+	if m1["text_content"] != "Lunch at 2:30?" || m1["deleted"] != false || m1["edited_at"] != at(3).Format(time.RFC3339) {
+		t.Errorf("Unexpected edited message: %v", m1)
+	}
+	edits := m1["edits"].([]interface{})
+	if len(edits) != 2 || edits[0].(map[string]interface{})["previous_text"] != "Lunch at 1?" ||
+		edits[1].(map[string]interface{})["previous_text"] != "Lunch at 2?" {
+		t.Errorf("Unexpected edits: %v", edits)
+	}
+	expected := fmt.Sprint([]interface{}{
+		map[string]interface{}{"emoji": "👍", "count": float64(1), "senders": []interface{}{alice.String()}},
+		map[string]interface{}{"emoji": "❤️", "count": float64(1), "senders": []interface{}{"me"}},
+		map[string]interface{}{"emoji": "😂", "count": float64(1), "senders": []interface{}{bob.String()}},
+	})
+	if fmt.Sprint(m1["reactions"]) != expected {
+		t.Errorf("Expected reactions %s, got %v", expected, m1["reactions"])
+	}
+
+	m2 := messages[1].(map[string]interface{})
+	if m2["text_content"] != "Sure" || m2["deleted"] != true || m2["deleted_at"] != at(10).Format(time.RFC3339) ||
+		len(m2["edits"].([]interface{})) != 0 || len(m2["reactions"].([]interface{})) != 0 {
+		t.Errorf("Unexpected deleted message: %v", m2)
+	}
+
+	// Search finds the message by its current text
+	got = executeRequest(t, s, newRequest("3", "chat.history.search", map[string]interface{}{
+		"token": "revisions-token",
+		"q":     "2:30",
+	}).toJSON(t))
+	results := assertJSONRPC20Success(t, got, "3").(map[string]interface{})["results"].([]interface{})
+	if len(results) != 1 || len(results[0].(map[string]interface{})["edits"].([]interface{})) != 2 {
+		t.Errorf("Unexpected search results: %v", results)
+	}
+}
+
+func TestFoldHistoryRevisions(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	chat := "5491155550001@s.whatsapp.net"
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, m := range []struct{ sender, id, messageType, text, quoted string }{
+		{chat, "M1", "text", "Hello", ""},
+		{"me", "M2", "text", "Oops", ""},
+		{"me", "R1", "reaction", "👍", "M1"},
+		{"me", "R2", "reaction", "😮", "M1"},
+		{chat, "D1", "delete", "M2", ""},
+	} {
+		_, err := s.db.Exec(`
+			INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link, quoted_message_id)
+			VALUES ('user1', $1, $2, $3, $4, $5, $6, '', $7)`,
+			chat, m.sender, m.id, historyTime(base.Add(time.Duration(i)*time.Minute)), m.messageType, m.text, m.quoted)
+		if err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	tx := s.db.MustBegin()
+	if err := foldHistoryRevisions(tx); err != nil {
+		t.Fatalf("Failed to fold revisions: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	var messages []HistoryMessage
+	if err := s.db.Select(&messages, "SELECT "+historyColumns+" FROM message_history h ORDER BY h.id"); err != nil {
+		t.Fatalf("Failed to get messages: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected the reaction and delete rows to be removed, got %d messages", len(messages))
+	}
+	revised := []*HistoryMessage{&messages[0], &messages[1]}
+	if err := attachHistoryRevisions(s.db, "user1", revised); err != nil {
+		t.Fatalf("Failed to attach revisions: %v", err)
+	}
+	if len(messages[0].Reactions) != 1 || messages[0].Reactions[0].Emoji != "😮" || messages[0].Deleted {
+		t.Errorf("Unexpected first message: %+v", messages[0])
+	}
+	if !messages[1].Deleted || !messages[1].DeletedAt.Equal(base.Add(4*time.Minute)) {
+		t.Errorf("Unexpected deleted message: %+v", messages[1])
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistorySearchLimit = 20
+	maxHistorySearchLimit     = 100
+)
+
+// historyColumns are the message_history columns of a HistoryMessage, for a query
+// that names the table h
+const historyColumns = `h.id, h.user_id, h.chat_jid, h.sender_jid, h.message_id, h.timestamp, h.message_type,
+	COALESCE(h.text_content, '') AS text_content, COALESCE(h.media_link, '') AS media_link,
+	COALESCE(h.quoted_message_id, '') AS quoted_message_id, COALESCE(h.datajson, '') AS datajson,
+	h.edited_at, h.deleted_at`
+
+// HistorySearchResult is a history message matching a search, with the matched
+// words of its text wrapped in <b></b>; a higher rank is a better match
+type HistorySearchResult struct {
+	HistoryMessage
+	Highlight string  `json:"highlight" db:"highlight"`
+	Rank      float64 `json:"rank" db:"rank"`
+}
+
+// historyTime converts a time to the zone history timestamps are stored in. They
+// are written with the local time of the server, and SQLite compares them as text.
+func historyTime(t time.Time) time.Time {
+	return t.In(time.Local)
+}
+
+// parseHistoryTime parses the RFC 3339 time of a history query parameter, if set
+func parseHistoryTime(query url.Values, name string) (*time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	t = historyTime(t)
+	return &t, nil
+}
+
+// ftsMatchQuery turns free text into an FTS5 query matching rows that contain all
+// of its words, quoting them so the text cannot use the FTS5 query syntax
+func ftsMatchQuery(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// historySearch is a full-text search over the message history of a user
+type historySearch struct {
+	Query       string
+	ChatJID     string
+	SenderJID   string
+	MessageType string
+	From        *time.Time
+	To          *time.Time
+	Limit       int
+	Offset      int
+}
+
+// parseHistorySearch reads a search from the query of /chat/history/search
+func parseHistorySearch(query url.Values) (historySearch, error) {
+	search := historySearch{
+		Query:       strings.TrimSpace(query.Get("q")),
+		ChatJID:     query.Get("chat_jid"),
+		SenderJID:   query.Get("sender_jid"),
+		MessageType: query.Get("message_type"),
+		Limit:       defaultHistorySearchLimit,
+	}
+	if search.Query == "" {
+		return search, fmt.Errorf("q is required")
+	}
+
+	var err error
+	if search.From, err = parseHistoryTime(query, "from"); err != nil {
+		return search, err
+	}
+	if search.To, err = parseHistoryTime(query, "to"); err != nil {
+		return search, err
+	}
+	if value := query.Get("limit"); value != "" {
+		search.Limit, err = strconv.Atoi(value)
+		if err != nil || search.Limit < 1 {
+			return search, fmt.Errorf("invalid limit")
+		}
+		if search.Limit > maxHistorySearchLimit {
+			search.Limit = maxHistorySearchLimit
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		search.Offset, err = strconv.Atoi(value)
+		if err != nil || search.Offset < 0 {
+			return search, fmt.Errorf("invalid offset")
+		}
+	}
+	return search, nil
+}
+
+// run returns a page of the messages of userID matching the search, best matches
+// first, with the total count of matches
+func (search historySearch) run(s *server, userID string) ([]HistorySearchResult, int, error) {
+	var from, match, highlight, rank string
+	args := []interface{}{}
+	if s.db.DriverName() == "postgres" {
+		args = append(args, search.Query)
+		from = "message_history h, plainto_tsquery('simple', $1) query"
+		match = "h.search_vector @@ query"
+		highlight = "ts_headline('simple', COALESCE(h.text_content, ''), query, 'StartSel=<b>, StopSel=</b>, HighlightAll=true')"
+		rank = "ts_rank(h.search_vector, query)"
+	} else {
+		args = append(args, ftsMatchQuery(search.Query))
+		from = "message_history_fts JOIN message_history h ON h.id = message_history_fts.rowid"
+		match = "message_history_fts MATCH $1"
+		highlight = "highlight(message_history_fts, 0, '<b>', '</b>')"
+		// bm25 is lower for better matches
+		rank = "-bm25(message_history_fts)"
+	}
+
+	conditions := []string{match}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	addCondition("h.user_id = $%d", userID)
+	if search.ChatJID != "" {
+		addCondition("h.chat_jid = $%d", search.ChatJID)
+	}
+	if search.SenderJID != "" {
+		addCondition("h.sender_jid = $%d", search.SenderJID)
+	}
+	if search.MessageType != "" {
+		addCondition("h.message_type = $%d", search.MessageType)
+	}
+	if search.From != nil {
+		addCondition("h.timestamp >= $%d", *search.From)
+	}
+	if search.To != nil {
+		addCondition("h.timestamp <= $%d", *search.To)
+	}
+	where := strings.Join(conditions, " AND ")
+
+	var total int
+	if err := s.db.Get(&total, "SELECT COUNT(*) FROM "+from+" WHERE "+where, args...); err != nil {
+		return nil, 0, err
+	}
+
+	results := []HistorySearchResult{}
+	query := fmt.Sprintf(`
+		SELECT %s, %s AS highlight, %s AS rank
+		FROM %s
+		WHERE %s
+		ORDER BY rank DESC, h.timestamp DESC
+		LIMIT $%d OFFSET $%d`,
+		historyColumns, highlight, rank, from, where, len(args)+1, len(args)+2)
+	if err := s.db.Select(&results, query, append(args, search.Limit, search.Offset)...); err != nil {
+		return nil, 0, err
+	}
+	messages := make([]*HistoryMessage, len(results))
+	for i := range results {
+		messages[i] = &results[i].HistoryMessage
+	}
+	return results, total, attachHistoryRevisions(s.db, userID, messages)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistorySearch(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	for _, user := range []struct{ name, token string }{{"SearchUser", "search-token"}, {"OtherUser", "other-search-token"}} {
+		executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+			"adminToken": "test-admin-token",
+			"name":       user.name,
+			"token":      user.token,
+			"history":    100,
+		}).toJSON(t))
+	}
+	userID := func(token string) string {
+		var id string
+		if err := s.db.Get(&id, "SELECT id FROM users WHERE token = $1", token); err != nil {
+			t.Fatalf("Failed to get user id: %v", err)
+		}
+		return id
+	}
+
+	base := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	insert := func(userID, chat, sender, messageID, messageType, text string, at time.Time) {
+		_, err := s.db.Exec(`
+			INSERT INTO message_history (user_id, chat_jid, sender_jid, message_id, timestamp, message_type, text_content, media_link)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, '')`,
+			userID, chat, sender, messageID, historyTime(at), messageType, text)
+		if err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+	alice := "5491155550001@s.whatsapp.net"
+	bob := "5491155550002@s.whatsapp.net"
+	id := userID("search-token")
+	insert(id, alice, alice, "M1", "text", "Is the invoice ready?", base)
+	insert(id, alice, "me", "M2", "text", "The invoice was sent, invoice number 42", base.Add(time.Hour))
+	insert(id, bob, bob, "M3", "image", "Photo of the café invoice", base.Add(2*time.Hour))
+	insert(id, bob, bob, "M4", "text", "See you tomorrow", base.Add(3*time.Hour))
+	insert(userID("other-search-token"), alice, alice, "M5", "text", "Another invoice", base)
+
+	search := func(requestID string, params map[string]interface{}) map[string]interface{} {
+		params["token"] = "search-token"
+		got := executeRequest(t, s, newRequest(requestID, "chat.history.search", params).toJSON(t))
+		return assertJSONRPC20Success(t, got, requestID).(map[string]interface{})
+	}
+	ids := func(result map[string]interface{}) []string {
+		ids := []string{}
+		for _, entry := range result["results"].([]interface{}) {
+			ids = append(ids, entry.(map[string]interface{})["message_id"].(string))
+		}
+		return ids
+	}
+
+	// Matches across chats of the caller only, best match first
+	result := search("2", map[string]interface{}{"q": "invoice"})
+	if got := ids(result); result["total"] != float64(3) || len(got) != 3 || got[0] != "M2" {
+		t.Errorf("Unexpected results: %v (total %v)", got, result["total"])
+	}
+	first := result["results"].([]interface{})[0].(map[string]interface{})
+	if first["highlight"] != "The <b>invoice</b> was sent, <b>invoice</b> number 42" {
+		t.Errorf("Unexpected highlight: %v", first["highlight"])
+	}
+
+	// All words must match, accents are ignored
+	if got := ids(search("3", map[string]interface{}{"q": "cafe invoice"})); len(got) != 1 || got[0] != "M3" {
+		t.Errorf("Unexpected results: %v", got)
+	}
+	if got := ids(search("4", map[string]interface{}{"q": "invoice tomorrow"})); len(got) != 0 {
+		t.Errorf("Unexpected results: %v", got)
+	}
+
+	// Filters by chat, sender, type and time
+	if got := ids(search("5", map[string]interface{}{"q": "invoice", "chat_jid": alice, "sender_jid": "me"})); len(got) != 1 || got[0] != "M2" {
+		t.Errorf("Unexpected results: %v", got)
+	}
+	if got := ids(search("6", map[string]interface{}{"q": "invoice", "message_type": "image"})); len(got) != 1 || got[0] != "M3" {
+		t.Errorf("Unexpected results: %v", got)
+	}
+	result = search("7", map[string]interface{}{
+		"q":    "invoice",
+		"from": base.Add(30 * time.Minute).Format(time.RFC3339),
+		"to":   base.Add(2 * time.Hour).Format(time.RFC3339),
+	})
+	if got := ids(result); len(got) != 2 {
+		t.Errorf("Unexpected results: %v", got)
+	}
+	result = search("8", map[string]interface{}{"q": "invoice", "limit": 1, "offset": 1})
+	if got := ids(result); result["total"] != float64(3) || len(got) != 1 {
+		t.Errorf("Unexpected page: %v", result)
+	}
+
+	// The FTS5 query syntax is not interpreted
+	if got := ids(search("9", map[string]interface{}{"q": `invoice" OR (`})); len(got) != 0 {
+		t.Errorf("Unexpected results: %v", got)
+	}
+
+	// Updates and deletes are reflected in the index
+	if _, err := s.db.Exec("UPDATE message_history SET text_content = 'Updated text' WHERE message_id = 'M1'"); err != nil {
+		t.Fatalf("Failed to update message: %v", err)
+	}
+	if _, err := s.db.Exec("DELETE FROM message_history WHERE message_id = 'M3'"); err != nil {
+		t.Fatalf("Failed to delete message: %v", err)
+	}
+	if got := ids(search("10", map[string]interface{}{"q": "invoice"})); len(got) != 1 || got[0] != "M2" {
+		t.Errorf("Unexpected results: %v", got)
+	}
+
+	got := executeRequest(t, s, newRequest("11", "chat.history.search", map[string]interface{}{
+		"token": "search-token",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, got, "11", 400)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+)
+
+// InitIdempotencyKeys releases the keys of requests interrupted by a previous
+// shutdown and purges expired keys every hour
+func InitIdempotencyKeys(db *sqlx.DB) {
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE status_code = 0"); err != nil {
+		log.Error().Err(err).Msg("Failed to release interrupted idempotency keys")
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for {
+			purgeIdempotencyKeys(db, time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+func purgeIdempotencyKeys(db *sqlx.DB, now time.Time) {
+	res, err := db.Exec("DELETE FROM idempotency_keys WHERE expires_at <= $1", now.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge idempotency keys")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Info().Int64("count", n).Msg("Purged expired idempotency keys")
+	}
+}
+
+// storedResponse is the response recorded for an idempotency key; StatusCode 0
+// means the first request is still being handled
+type storedResponse struct {
+	RequestHash string `db:"request_hash"`
+	StatusCode  int    `db:"status_code"`
+	Response    string `db:"response"`
+	ExpiresAt   int64  `db:"expires_at"`
+}
+
+// idempotent makes a send route honor the Idempotency-Key header: the first
+// response to a key is stored and returned again for repeats of the request,
+// which are not sent again. Server errors are not stored, so they can be retried.
+func (s *server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || *idempotencyTTL <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Idempotency-Key is too long"))
+			return
+		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not read Payload"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(r.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		now := time.Now()
+		expiresAt := now.Add(time.Duration(*idempotencyTTL) * time.Hour).Unix()
+		claimed, err := s.claimIdempotencyKey(txtid, key, requestHash, now, expiresAt)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to claim idempotency key")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to check Idempotency-Key"))
+			return
+		}
+
+		if !claimed {
+			var stored storedResponse
+			err := s.db.Get(&stored, `
+				SELECT request_hash, status_code, response, expires_at FROM idempotency_keys
+				WHERE user_id = $1 AND idempotency_key = $2`, txtid, key)
+			switch {
+			case err == sql.ErrNoRows:
+				s.Respond(w, r, http.StatusConflict, errors.New("a request with this Idempotency-Key is in progress"))
+			case err != nil:
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to check Idempotency-Key"))
+			case stored.RequestHash != requestHash:
+				s.Respond(w, r, http.StatusUnprocessableEntity, errors.New("Idempotency-Key was already used for a different request"))
+			case stored.StatusCode == 0:
+				s.Respond(w, r, http.StatusConflict, errors.New("a request with this Idempotency-Key is in progress"))
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(idempotencyReplayedHeader, "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write([]byte(stored.Response))
+			}
+			return
+		}
+
+		recorder := httptest.NewRecorder()
+		stored := false
+		defer func() {
+			if !stored {
+				if _, err := s.db.Exec("DELETE FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2", txtid, key); err != nil {
+					log.Error().Err(err).Str("userID", txtid).Msg("Failed to release idempotency key")
+				}
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+
+		if recorder.Code < http.StatusInternalServerError {
+			_, err := s.db.Exec(`
+				UPDATE idempotency_keys SET status_code = $1, response = $2
+				WHERE user_id = $3 AND idempotency_key = $4`,
+				recorder.Code, recorder.Body.String(), txtid, key)
+			if err != nil {
+				log.Error().Err(err).Str("userID", txtid).Msg("Failed to store response of idempotency key")
+			} else {
+				stored = true
+			}
+		}
+
+		copyRecordedResponse(w, recorder)
+	})
+}
+
+// copyRecordedResponse writes a response captured by a recorder to w
+func copyRecordedResponse(w http.ResponseWriter, recorder *httptest.ResponseRecorder) {
+	for name, values := range recorder.Header() {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(recorder.Code)
+	w.Write(recorder.Body.Bytes())
+}
+
+// claimIdempotencyKey records a key as in progress, taking over an expired one;
+// it returns false when the key is already held by another request.
+func (s *server) claimIdempotencyKey(userID string, key string, requestHash string, now time.Time, expiresAt int64) (bool, error) {
+	if _, err := s.db.Exec("DELETE FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2 AND expires_at <= $3",
+		userID, key, now.Unix()); err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec(`
+		INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, idempotency_key) DO NOTHING`,
+		userID, key, requestHash, now, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
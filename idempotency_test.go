@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "IdempotentUser",
+		"token":      "idempotent-token",
+	}).toJSON(t))
+
+	send := func(path string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("token", "idempotent-token")
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		recorder := httptest.NewRecorder()
+		s.router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	countJobs := func() int {
+		var count int
+		if err := s.db.Get(&count, "SELECT COUNT(*) FROM send_jobs"); err != nil {
+			t.Fatalf("Failed to count jobs: %v", err)
+		}
+		return count
+	}
+
+	body := `{"Phone":"5491155553934","Body":"Only once"}`
+	first := send("/chat/send/text?async=true", "order-42", body)
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", first.Code, first.Body.String())
+	}
+	repeat := send("/chat/send/text?async=true", "order-42", body)
+	if repeat.Code != http.StatusAccepted || repeat.Body.String() != first.Body.String() || repeat.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Errorf("Expected the first response to be replayed, got %d %s", repeat.Code, repeat.Body.String())
+	}
+	if count := countJobs(); count != 1 {
+		t.Errorf("Expected the message to be queued once, got %d jobs", count)
+	}
+
+	other := send("/chat/send/text?async=true", "order-42", `{"Phone":"5491155553934","Body":"Something else"}`)
+	if other.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a different request, got %d", other.Code)
+	}
+
+	// Server errors are not stored, so the request can be retried
+	failed := send("/chat/send/text", "order-43", body)
+	if failed.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500 without a session, got %d", failed.Code)
+	}
+	var stored int
+	if err := s.db.Get(&stored, "SELECT COUNT(*) FROM idempotency_keys WHERE idempotency_key = $1", "order-43"); err != nil || stored != 0 {
+		t.Errorf("Expected the failed response not to be stored, got %d (%v)", stored, err)
+	}
+
+	// An expired key is used again
+	if _, err := s.db.Exec("UPDATE idempotency_keys SET expires_at = $1", time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatalf("Failed to expire keys: %v", err)
+	}
+	again := send("/chat/send/text?async=true", "order-42", body)
+	if again.Code != http.StatusAccepted || again.Body.String() == first.Body.String() || countJobs() != 2 {
+		t.Errorf("Expected an expired key to send again, got %d %s", again.Code, again.Body.String())
+	}
+
+	// Over stdio the key is a parameter
+	params := map[string]interface{}{
+		"token":          "idempotent-token",
+		"idempotencyKey": "stdio-1",
+		"async":          true,
+		"Phone":          "5491155553934",
+		"Body":           "From stdio",
+	}
+	viaStdio := assertJSONRPC20Success(t, executeRequest(t, s, newRequest("2", "chat.send.text", params).toJSON(t)), "2").(map[string]interface{})
+	repeated := assertJSONRPC20Success(t, executeRequest(t, s, newRequest("3", "chat.send.text", params).toJSON(t)), "3").(map[string]interface{})
+	if viaStdio["JobId"] == nil || viaStdio["JobId"] != repeated["JobId"] || countJobs() != 3 {
+		t.Errorf("Expected the stdio send to be queued once, got %v and %v", viaStdio, repeated)
+	}
+
+	if _, err := s.db.Exec("UPDATE idempotency_keys SET expires_at = $1 WHERE idempotency_key = $2", time.Now().Unix(), "order-42"); err != nil {
+		t.Fatalf("Failed to expire key: %v", err)
+	}
+	purgeIdempotencyKeys(s.db, time.Now())
+	if err := s.db.Get(&stored, "SELECT COUNT(*) FROM idempotency_keys"); err != nil || stored != 1 {
+		t.Errorf("Expected only the stdio key to be kept, got %d (%v)", stored, err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaWriter is the part of *kafka.Writer used by the sink, so tests can use a fake
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaSink publishes events to a Kafka topic (KAFKA_BROKERS), keyed by user ID so
+// the events of an instance stay ordered within a partition
+type kafkaSink struct {
+	writer kafkaWriter
+	topic  string
+}
+
+func newKafkaSink(brokers []string, topic string) *kafkaSink {
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+		topic: topic,
+	}
+}
+
+func (k *kafkaSink) Name() string               { return sinkNameKafka }
+func (k *kafkaSink) Enabled() bool              { return true }
+func (k *kafkaSink) DefaultDestination() string { return k.topic }
+func (k *kafkaSink) Close() error               { return k.writer.Close() }
+
+func (k *kafkaSink) Publish(ctx context.Context, event SinkEvent, destination string) error {
+	data, contentType, err := brokerMessage(event, *eventSinkFormat)
+	if err != nil {
+		return err
+	}
+
+	topic := k.topic
+	if destination != "" {
+		topic = destination
+	}
+
+	return k.writer.WriteMessages(ctx, kafka.Message{
+		Topic: topic,
+		Key:   []byte(event.UserID),
+		Value: data,
+		Headers: []kafka.Header{
+			{Key: "content-type", Value: []byte(contentType)},
+			{Key: "event-type", Value: []byte(event.Type)},
+		},
+	})
+}
@@ -37,10 +37,13 @@ const (
 )
 
 type server struct {
-	db     *sqlx.DB
-	router *mux.Router
-	exPath string
-	mode   ServerMode
+	db        *sqlx.DB
+	router    *mux.Router
+	exPath    string
+	mode      ServerMode
+	scheduler *MessageScheduler
+	campaigns *CampaignRunner
+	sendQueue *SendQueue
 }
 
 // Replace the global variables
@@ -68,6 +71,34 @@ var (
 	webhookRetryCount        = flag.Int("retrycount", 5, "Number of times to retry failed webhooks")
 	webhookRetryDelaySeconds = flag.Int("retrydelay", 30, "Delay in seconds between webhook retries")
 	webhookErrorQueueName    = flag.String("errorqueue", "webhook_errors", "RabbitMQ queue name for failed webhooks")
+	webhookOutboxWorkers     = flag.Int("webhookworkers", 4, "Number of workers delivering webhooks from the outbox")
+	webhookDeliveryLogDays   = flag.Int("webhooklogdays", 7, "Days to keep the webhook delivery log (0 keeps it forever)")
+
+	webhookBreakerThreshold       = flag.Int("webhookbreaker", 5, "Consecutive failures that open the circuit of a webhook URL (0 disables)")
+	webhookBreakerCooldownSeconds = flag.Int("webhookbreakercooldown", 60, "Seconds a webhook circuit stays open before a probe is sent")
+
+	eventStreamBufferSize = flag.Int("eventbuffer", 500, "Events kept per instance for resuming event streams with Last-Event-ID")
+	wsOrigins             = flag.String("wsorigins", "", "Comma-separated origin host patterns allowed to open cross-origin WebSockets")
+
+	eventSinkFormat   = flag.String("sinkformat", "", "Message format of the Kafka, NATS and Redis sinks (empty or cloudevents)")
+	kafkaBrokers      = flag.String("kafkabrokers", "", "Comma-separated Kafka brokers to publish events to")
+	kafkaTopic        = flag.String("kafkatopic", "whatsapp_events", "Kafka topic for events")
+	natsURL           = flag.String("natsurl", "", "NATS server URL to publish events to with JetStream")
+	natsSubject       = flag.String("natssubject", "wuzapi.events", "Base NATS subject for events")
+	natsStream        = flag.String("natsstream", "", "JetStream stream to create for the event subjects (empty uses an existing stream)")
+	redisURL          = flag.String("redisurl", "", "Redis URL to publish events to a stream")
+	redisStream       = flag.String("redisstream", "whatsapp_events", "Redis stream for events")
+	redisStreamMaxLen = flag.Int("redismaxlen", 100000, "Approximate maximum length of the Redis stream (0 disables trimming)")
+
+	rabbitCommandQueue   = flag.String("rabbitcommandqueue", "", "RabbitMQ queue to consume commands from (empty disables the consumer)")
+	rabbitCommandWorkers = flag.Int("rabbitcommandworkers", 4, "Commands from RabbitMQ executed at the same time")
+
+	sendQueueRate        = flag.Int("sendqueuerate", 20, "Messages per minute each instance sends from its async send queue")
+	sendQueueMaxAttempts = flag.Int("sendqueueattempts", 5, "Attempts of a queued send before it fails")
+	idempotencyTTL       = flag.Int("idempotencyttl", 24, "Hours the response of a send is kept for its Idempotency-Key (0 ignores the header)")
+
+	historyRetentionDays   = flag.Int("historyretention", 0, "Days to keep message history of instances without a retention policy (0 keeps it forever)")
+	historyJanitorInterval = flag.Int("historyjanitor", 60, "Minutes between runs of the message history retention janitor (0 disables it)")
 
 	container        *sqlstore.Container
 	clientManager    = NewClientManager()
@@ -212,12 +243,105 @@ func main() {
 	if v := os.Getenv("WEBHOOK_ERROR_QUEUE_NAME"); v != "" {
 		*webhookErrorQueueName = v
 	}
+	if v := os.Getenv("WEBHOOK_OUTBOX_WORKERS"); v != "" {
+		if workers, err := strconv.Atoi(v); err == nil {
+			*webhookOutboxWorkers = workers
+		}
+	}
+	if v := os.Getenv("WEBHOOK_DELIVERY_LOG_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil {
+			*webhookDeliveryLogDays = days
+		}
+	}
+	if v := os.Getenv("WEBHOOK_BREAKER_THRESHOLD"); v != "" {
+		if threshold, err := strconv.Atoi(v); err == nil {
+			*webhookBreakerThreshold = threshold
+		}
+	}
+	if v := os.Getenv("WEBHOOK_BREAKER_COOLDOWN_SECONDS"); v != "" {
+		if cooldown, err := strconv.Atoi(v); err == nil {
+			*webhookBreakerCooldownSeconds = cooldown
+		}
+	}
+	if v := os.Getenv("EVENT_STREAM_BUFFER"); v != "" {
+		if size, err := strconv.Atoi(v); err == nil {
+			*eventStreamBufferSize = size
+		}
+	}
+	if v := os.Getenv("WS_ORIGINS"); v != "" {
+		*wsOrigins = v
+	}
+	if v := os.Getenv("EVENT_SINK_FORMAT"); v != "" {
+		*eventSinkFormat = v
+	}
+	if v := os.Getenv("KAFKA_BROKERS"); v != "" {
+		*kafkaBrokers = v
+	}
+	if v := os.Getenv("KAFKA_TOPIC"); v != "" {
+		*kafkaTopic = v
+	}
+	if v := os.Getenv("NATS_URL"); v != "" {
+		*natsURL = v
+	}
+	if v := os.Getenv("NATS_SUBJECT"); v != "" {
+		*natsSubject = v
+	}
+	if v := os.Getenv("NATS_STREAM"); v != "" {
+		*natsStream = v
+	}
+	if v := os.Getenv("REDIS_URL"); v != "" {
+		*redisURL = v
+	}
+	if v := os.Getenv("REDIS_STREAM"); v != "" {
+		*redisStream = v
+	}
+	if v := os.Getenv("REDIS_STREAM_MAXLEN"); v != "" {
+		if maxLen, err := strconv.Atoi(v); err == nil {
+			*redisStreamMaxLen = maxLen
+		}
+	}
+	if v := os.Getenv("RABBITMQ_COMMAND_QUEUE"); v != "" {
+		*rabbitCommandQueue = v
+	}
+	if v := os.Getenv("RABBITMQ_COMMAND_WORKERS"); v != "" {
+		if workers, err := strconv.Atoi(v); err == nil {
+			*rabbitCommandWorkers = workers
+		}
+	}
+	if v := os.Getenv("SEND_QUEUE_RATE"); v != "" {
+		if rate, err := strconv.Atoi(v); err == nil {
+			*sendQueueRate = rate
+		}
+	}
+	if v := os.Getenv("SEND_QUEUE_MAX_ATTEMPTS"); v != "" {
+		if attempts, err := strconv.Atoi(v); err == nil {
+			*sendQueueMaxAttempts = attempts
+		}
+	}
+	if v := os.Getenv("IDEMPOTENCY_TTL_HOURS"); v != "" {
+		if hours, err := strconv.Atoi(v); err == nil {
+			*idempotencyTTL = hours
+		}
+	}
+	if v := os.Getenv("HISTORY_RETENTION_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil {
+			*historyRetentionDays = days
+		}
+	}
+	if v := os.Getenv("HISTORY_JANITOR_MINUTES"); v != "" {
+		if minutes, err := strconv.Atoi(v); err == nil {
+			*historyJanitorInterval = minutes
+		}
+	}
 
 	log.Info().
 		Bool("enabled", *webhookRetryEnabled).
 		Int("count", *webhookRetryCount).
 		Int("delay", *webhookRetryDelaySeconds).
 		Str("queue", *webhookErrorQueueName).
+		Int("workers", *webhookOutboxWorkers).
+		Int("breaker_threshold", *webhookBreakerThreshold).
+		Int("breaker_cooldown", *webhookBreakerCooldownSeconds).
 		Msg("Webhook Retry Configured")
 
 	// Novo bloco para sobrescrever o osName pelo ENV, se existir
@@ -357,6 +481,7 @@ func main() {
 	}
 
 	InitRabbitMQ()
+	InitEventSinks()
 
 	ex, err := os.Executable()
 	if err != nil {
@@ -387,6 +512,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	webhookSigningDB = db
+	rabbitConfigDB = db
+	InitWebhookDeliveryLog(db, *webhookDeliveryLogDays)
+
+	// "wuzapi replay-webhooks" replays the webhook error queue and exits
+	if flag.Arg(0) == "replay-webhooks" {
+		os.Exit(runReplayWebhooksCommand(flag.Args()[1:]))
+	}
+
+	InitWebhookOutbox(db, *webhookOutboxWorkers)
+	InitIdempotencyKeys(db)
+	InitHistoryRetention(db, *historyJanitorInterval)
+
 	var dbLog waLog.Logger
 	if *waDebug != "" {
 		dbLog = waLog.Stdout("Database", *waDebug, *colorOutput)
@@ -425,6 +563,10 @@ func main() {
 	s.routes()
 
 	s.connectOnStartup()
+	StartRabbitCommandConsumer(s)
+	s.scheduler = StartMessageScheduler(s)
+	s.campaigns = StartCampaignRunner(s)
+	s.sendQueue = StartSendQueue(s)
 
 	if serverMode == Stdio {
 		startStdioMode(s)
@@ -463,6 +605,7 @@ func startHTTPMode(s *server) {
 					log.Error().Err(err).Msg("Failed to stop server")
 					os.Exit(1)
 				}
+				eventSinks.Close()
 
 				log.Info().Msg("Server Exited Properly")
 				os.Exit(0)
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	messageStatusSent      = "sent"
+	messageStatusDelivered = "delivered"
+	messageStatusRead      = "read"
+	messageStatusPlayed    = "played"
+
+	maxMessageStatusQuery = 500
+)
+
+// messageStatuses are the statuses of an outgoing message, in the order they are reached
+var messageStatuses = []string{messageStatusSent, messageStatusDelivered, messageStatusRead, messageStatusPlayed}
+
+// MessageStatus is the delivery state of an outgoing message
+type MessageStatus struct {
+	ID              string              `json:"id" db:"message_id"`
+	UserID          string              `json:"-" db:"user_id"`
+	Chat            string              `json:"chat" db:"chat_jid"`
+	Type            string              `json:"type" db:"message_type"`
+	Status          string              `json:"status" db:"status"`
+	SentAtUnix      int64               `json:"-" db:"sent_at"`
+	DeliveredAtUnix int64               `json:"-" db:"delivered_at"`
+	ReadAtUnix      int64               `json:"-" db:"read_at"`
+	PlayedAtUnix    int64               `json:"-" db:"played_at"`
+	SentAt          *time.Time          `json:"sent_at" db:"-"`
+	DeliveredAt     *time.Time          `json:"delivered_at" db:"-"`
+	ReadAt          *time.Time          `json:"read_at" db:"-"`
+	PlayedAt        *time.Time          `json:"played_at" db:"-"`
+	Participants    []ParticipantStatus `json:"participants,omitempty" db:"-"`
+}
+
+// ParticipantStatus is the delivery state of a group message for one participant
+type ParticipantStatus struct {
+	Participant     string     `json:"participant" db:"participant"`
+	Status          string     `json:"status" db:"status"`
+	DeliveredAtUnix int64      `json:"-" db:"delivered_at"`
+	ReadAtUnix      int64      `json:"-" db:"read_at"`
+	PlayedAtUnix    int64      `json:"-" db:"played_at"`
+	DeliveredAt     *time.Time `json:"delivered_at" db:"-"`
+	ReadAt          *time.Time `json:"read_at" db:"-"`
+	PlayedAt        *time.Time `json:"played_at" db:"-"`
+}
+
+// fill sets the API fields from the stored columns
+func (m *MessageStatus) fill() {
+	m.SentAt = unixTime(m.SentAtUnix)
+	m.DeliveredAt = unixTime(m.DeliveredAtUnix)
+	m.ReadAt = unixTime(m.ReadAtUnix)
+	m.PlayedAt = unixTime(m.PlayedAtUnix)
+}
+
+// fill sets the API fields from the stored columns
+func (p *ParticipantStatus) fill() {
+	p.DeliveredAt = unixTime(p.DeliveredAtUnix)
+	p.ReadAt = unixTime(p.ReadAtUnix)
+	p.PlayedAt = unixTime(p.PlayedAtUnix)
+}
+
+const messageStatusColumns = `message_id, user_id, chat_jid, message_type, status, sent_at, delivered_at, read_at, played_at`
+
+// getMessageStatus returns the status of an outgoing message with its group participants
+func (s *server) getMessageStatus(userID string, messageID string) (MessageStatus, error) {
+	var status MessageStatus
+	err := s.db.Get(&status, "SELECT "+messageStatusColumns+" FROM message_status WHERE user_id = $1 AND message_id = $2", userID, messageID)
+	if err != nil {
+		return status, err
+	}
+	status.fill()
+
+	err = s.db.Select(&status.Participants, `
+		SELECT participant, status, delivered_at, read_at, played_at FROM message_participant_status
+		WHERE user_id = $1 AND message_id = $2 ORDER BY participant`, userID, messageID)
+	for i := range status.Participants {
+		status.Participants[i].fill()
+	}
+	return status, err
+}
+
+// recordSentMessage starts tracking an outgoing message
+func recordSentMessage(db *sqlx.DB, userID string, messageID string, chatJID string, messageType string, sentAt time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO message_status (user_id, message_id, chat_jid, message_type, status, sent_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, message_id) DO NOTHING`,
+		userID, messageID, chatJID, messageType, messageStatusSent, sentAt.Unix())
+	return err
+}
+
+// advanceMessageStatus moves the rows of table matching where to status, if they
+// are behind it, and stamps the time of status and of the statuses it implies.
+// where uses placeholders from $3 on.
+func advanceMessageStatus(db *sqlx.DB, table string, status string, at int64, where string, args ...interface{}) error {
+	set := []string{"status = $1"}
+	previous := []string{}
+	for _, earlier := range messageStatuses {
+		if earlier == status {
+			break
+		}
+		previous = append(previous, "'"+earlier+"'")
+		if earlier != messageStatusSent {
+			set = append(set, fmt.Sprintf("%[1]s_at = CASE WHEN %[1]s_at = 0 THEN $2 ELSE %[1]s_at END", earlier))
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	set = append(set, status+"_at = $2")
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s AND status IN (%s)", table, strings.Join(set, ", "), where, strings.Join(previous, ", "))
+	_, err := db.Exec(query, append([]interface{}{status, at}, args...)...)
+	return err
+}
+
+// receiptStatus returns the message status a receipt reports, or "" for receipts not tracked
+func receiptStatus(receiptType types.ReceiptType) string {
+	switch receiptType {
+	case types.ReceiptTypeDelivered:
+		return messageStatusDelivered
+	case types.ReceiptTypeRead:
+		return messageStatusRead
+	case types.ReceiptTypePlayed:
+		return messageStatusPlayed
+	}
+	return ""
+}
+
+// updateMessageStatus applies a receipt to the tracked outgoing messages it refers to.
+// In groups the receipt also updates the status of its participant.
+func updateMessageStatus(db *sqlx.DB, userID string, evt *events.Receipt) {
+	status := receiptStatus(evt.Type)
+	if status == "" {
+		return
+	}
+	at := evt.Timestamp.Unix()
+
+	for _, messageID := range evt.MessageIDs {
+		var tracked int
+		err := db.Get(&tracked, "SELECT 1 FROM message_status WHERE user_id = $1 AND message_id = $2", userID, messageID)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Error().Err(err).Str("messageID", messageID).Msg("Failed to get message status")
+			}
+			continue
+		}
+
+		if err := advanceMessageStatus(db, "message_status", status, at, "user_id = $3 AND message_id = $4", userID, messageID); err != nil {
+			log.Error().Err(err).Str("messageID", messageID).Msg("Failed to update message status")
+		}
+
+		if !evt.IsGroup || evt.Sender.IsEmpty() {
+			continue
+		}
+		participant := evt.Sender.ToNonAD().String()
+		_, err = db.Exec(`
+			INSERT INTO message_participant_status (user_id, message_id, participant, status)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, message_id, participant) DO NOTHING`,
+			userID, messageID, participant, messageStatusSent)
+		if err == nil {
+			err = advanceMessageStatus(db, "message_participant_status", status, at,
+				"user_id = $3 AND message_id = $4 AND participant = $5", userID, messageID, participant)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("messageID", messageID).Str("participant", participant).Msg("Failed to update participant status")
+		}
+	}
+}
+
+// tracked records the messages sent through a send route so their receipts can
+// update their status, and makes them the last message of their chat
+func (s *server) tracked(messageType string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not read Payload"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		recorder := httptest.NewRecorder()
+		next.ServeHTTP(recorder, r)
+		copyRecordedResponse(w, recorder)
+
+		if recorder.Code < 200 || recorder.Code >= 300 {
+			return
+		}
+		var envelope struct {
+			Data struct {
+				Id        string
+				Timestamp int64
+			} `json:"data"`
+		}
+		var request struct {
+			Phone string
+			Group string `json:"group"`
+		}
+		_ = json.Unmarshal(recorder.Body.Bytes(), &envelope)
+		_ = json.Unmarshal(body, &request)
+		destination := request.Phone
+		if destination == "" {
+			destination = request.Group
+		}
+		if envelope.Data.Id == "" || destination == "" {
+			return
+		}
+		chat, ok := parseJID(destination)
+		if !ok {
+			return
+		}
+
+		sentAt := time.Now()
+		if envelope.Data.Timestamp > 0 {
+			sentAt = time.Unix(envelope.Data.Timestamp, 0)
+		}
+		if err := recordSentMessage(s.db, txtid, envelope.Data.Id, chat.String(), messageType, sentAt); err != nil {
+			log.Error().Err(err).Str("messageID", envelope.Data.Id).Msg("Failed to record sent message")
+		}
+		err = recordChatMessage(s.db, txtid, chatMessage{
+			Chat:    chat.String(),
+			ID:      envelope.Data.Id,
+			Type:    messageType,
+			Preview: sendPayloadPreview(body),
+			Sender:  "me",
+			FromMe:  true,
+			At:      sentAt,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("messageID", envelope.Data.Id).Msg("Failed to update chat list")
+		}
+	})
+}
+
+// sendRoute wraps the handler of a send route: idempotency keys, queued sends and status tracking
+func (s *server) sendRoute(messageType string, handler http.Handler) http.Handler {
+	return s.idempotent(s.queueable(messageType, s.tracked(messageType, handler)))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestMessageStatusTracking(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "StatusUser",
+		"token":      "status-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "status-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	sent := time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC)
+	group := types.NewJID("120363313346913103", types.GroupServer)
+	if err := recordSentMessage(s.db, userID, "MSG1", "5491155553934@s.whatsapp.net", "text", sent); err != nil {
+		t.Fatalf("Failed to record message: %v", err)
+	}
+	if err := recordSentMessage(s.db, userID, "MSG2", group.String(), "image", sent.Add(time.Minute)); err != nil {
+		t.Fatalf("Failed to record message: %v", err)
+	}
+
+	receipt := func(ids []string, receiptType types.ReceiptType, at time.Time, isGroup bool, sender string) *events.Receipt {
+		source := types.MessageSource{Chat: types.NewJID("5491155553934", types.DefaultUserServer), IsGroup: isGroup}
+		if isGroup {
+			source.Chat = group
+			source.Sender = types.NewJID(sender, types.DefaultUserServer)
+		}
+		return &events.Receipt{MessageSource: source, MessageIDs: ids, Timestamp: at, Type: receiptType}
+	}
+
+	// Statuses only move forward, and a read implies delivery
+	updateMessageStatus(s.db, userID, receipt([]string{"MSG1", "UNKNOWN"}, types.ReceiptTypeRead, sent.Add(2*time.Minute), false, ""))
+	updateMessageStatus(s.db, userID, receipt([]string{"MSG1"}, types.ReceiptTypeDelivered, sent.Add(3*time.Minute), false, ""))
+	updateMessageStatus(s.db, userID, receipt([]string{"MSG2"}, types.ReceiptTypeDelivered, sent.Add(2*time.Minute), true, "5491155550001"))
+	updateMessageStatus(s.db, userID, receipt([]string{"MSG2"}, types.ReceiptTypeRead, sent.Add(3*time.Minute), true, "5491155550002"))
+
+	got := executeRequest(t, s, newRequest("2", "chat.message.status", map[string]interface{}{
+		"token": "status-token",
+		"id":    "MSG1",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, got, "2").(map[string]interface{})
+	if result["status"] != messageStatusRead || result["delivered_at"] != sent.Add(2*time.Minute).Format(time.RFC3339) || result["participants"] != nil {
+		t.Errorf("Unexpected status: %v", result)
+	}
+
+	status, err := s.getMessageStatus(userID, "MSG2")
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if status.Status != messageStatusRead || len(status.Participants) != 2 ||
+		status.Participants[0].Status != messageStatusDelivered || status.Participants[1].Status != messageStatusRead {
+		t.Errorf("Unexpected group status: %+v", status)
+	}
+
+	var untracked int
+	if err := s.db.Get(&untracked, "SELECT COUNT(*) FROM message_status WHERE message_id = $1", "UNKNOWN"); err != nil || untracked != 0 {
+		t.Errorf("Receipts of untracked messages must be ignored, got %d (%v)", untracked, err)
+	}
+
+	query := executeRequest(t, s, newRequest("3", "chat.message.status.query", map[string]interface{}{
+		"token": "status-token",
+		"Ids":   []string{"MSG1", "MSG2", "MSG3"},
+	}).toJSON(t))
+	result = assertJSONRPC20Success(t, query, "3").(map[string]interface{})
+	summary := result["summary"].(map[string]interface{})
+	notFound := result["not_found"].([]interface{})
+	if len(result["messages"].([]interface{})) != 2 || summary["read"] != float64(2) || len(notFound) != 1 || notFound[0] != "MSG3" {
+		t.Errorf("Unexpected bulk status: %v", result)
+	}
+
+	byChat := executeRequest(t, s, newRequest("4", "chat.message.status.query", map[string]interface{}{
+		"token": "status-token",
+		"Chat":  "5491155553934",
+		"Since": sent.Format(time.RFC3339),
+	}).toJSON(t))
+	result = assertJSONRPC20Success(t, byChat, "4").(map[string]interface{})
+	if result["total"] != float64(1) {
+		t.Errorf("Expected one message in the chat, got %v", result)
+	}
+
+	missing := executeRequest(t, s, newRequest("5", "chat.message.status", map[string]interface{}{
+		"token": "status-token",
+		"id":    "MSG3",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, missing, "5", 404)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -75,6 +76,106 @@ var migrations = []Migration{
 		Name:  "add_days_to_sync_history",
 		UpSQL: addDaysToSyncHistorySQL,
 	},
+	{
+		ID:    10,
+		Name:  "add_webhook_outbox",
+		UpSQL: addWebhookOutboxSQL,
+	},
+	{
+		ID:    11,
+		Name:  "add_webhook_deliveries",
+		UpSQL: addWebhookDeliveriesSQL,
+	},
+	{
+		ID:    12,
+		Name:  "add_webhook_endpoints",
+		UpSQL: addWebhookEndpointsSQL,
+	},
+	{
+		ID:    13,
+		Name:  "add_hmac_signing_scheme",
+		UpSQL: addHmacSigningSchemeSQL,
+	},
+	{
+		ID:    14,
+		Name:  "add_event_sinks",
+		UpSQL: addEventSinksSQL,
+	},
+	{
+		ID:    15,
+		Name:  "add_rabbitmq_config",
+		UpSQL: addRabbitMQConfigSQL,
+	},
+	{
+		ID:    16,
+		Name:  "add_scheduled_messages",
+		UpSQL: addScheduledMessagesSQL,
+	},
+	{
+		ID:    17,
+		Name:  "add_campaigns",
+		UpSQL: addCampaignsSQL,
+	},
+	{
+		ID:    18,
+		Name:  "add_send_jobs",
+		UpSQL: addSendJobsSQL,
+	},
+	{
+		ID:    19,
+		Name:  "add_idempotency_keys",
+		UpSQL: addIdempotencyKeysSQL,
+	},
+	{
+		ID:    20,
+		Name:  "add_message_templates",
+		UpSQL: addMessageTemplatesSQL,
+	},
+	{
+		ID:    21,
+		Name:  "add_message_status",
+		UpSQL: addMessageStatusSQL,
+	},
+	{
+		ID:    22,
+		Name:  "add_polls",
+		UpSQL: addPollsSQL,
+	},
+	{
+		ID:    23,
+		Name:  "add_message_history_search",
+		UpSQL: addMessageHistorySearchSQL,
+	},
+	{
+		ID:    24,
+		Name:  "add_chats",
+		UpSQL: addChatsSQL,
+	},
+	{
+		ID:    25,
+		Name:  "add_message_revisions",
+		UpSQL: addMessageRevisionsSQL,
+	},
+	{
+		ID:    26,
+		Name:  "add_history_retention",
+		UpSQL: addHistoryRetentionSQL,
+	},
+	{
+		ID:    27,
+		Name:  "add_admin_event_sinks",
+		UpSQL: addAdminEventSinksSQL,
+	},
+	{
+		ID:    28,
+		Name:  "add_webhook_delivery_endpoint",
+		UpSQL: addWebhookDeliveryEndpointSQL,
+	},
+	{
+		ID:    29,
+		Name:  "add_webhook_outbox_event_time",
+		UpSQL: addWebhookOutboxEventTimeSQL,
+	},
 }
 
 const changeIDToStringSQL = `
@@ -229,6 +330,507 @@ BEGIN
 END $$;
 `
 
+const addWebhookOutboxSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'webhook_outbox') THEN
+        CREATE TABLE webhook_outbox (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            url TEXT NOT NULL,
+            event_type TEXT NOT NULL DEFAULT '',
+            payload TEXT NOT NULL,
+            file_path TEXT NOT NULL DEFAULT '',
+            hmac_key BYTEA,
+            status TEXT NOT NULL DEFAULT 'pending',
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt_at BIGINT NOT NULL DEFAULT 0,
+            last_error TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_webhook_outbox_status_next ON webhook_outbox (status, next_attempt_at);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhookDeliveriesSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'webhook_deliveries') THEN
+        CREATE TABLE webhook_deliveries (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            url TEXT NOT NULL,
+            event_type TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL,
+            status_code INTEGER NOT NULL DEFAULT 0,
+            latency_ms BIGINT NOT NULL DEFAULT 0,
+            error TEXT NOT NULL DEFAULT '',
+            attempt INTEGER NOT NULL DEFAULT 1,
+            payload TEXT NOT NULL,
+            file_path TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMP NOT NULL
+        );
+        CREATE INDEX idx_webhook_deliveries_user_created ON webhook_deliveries (user_id, created_at DESC);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhookEndpointsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'webhook_endpoints') THEN
+        CREATE TABLE webhook_endpoints (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            url TEXT NOT NULL,
+            events TEXT NOT NULL DEFAULT '',
+            hmac_key BYTEA,
+            format TEXT NOT NULL DEFAULT '',
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_webhook_endpoints_user ON webhook_endpoints (user_id);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_outbox' AND column_name = 'format') THEN
+        ALTER TABLE webhook_outbox ADD COLUMN format TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addHmacSigningSchemeSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'hmac_scheme') THEN
+        ALTER TABLE users ADD COLUMN hmac_scheme TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'hmac_previous_keys') THEN
+        ALTER TABLE users ADD COLUMN hmac_previous_keys TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addEventSinksSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'event_sinks') THEN
+        ALTER TABLE users ADD COLUMN event_sinks TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addRabbitMQConfigSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'rabbitmq_exchange') THEN
+        ALTER TABLE users ADD COLUMN rabbitmq_exchange TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'rabbitmq_exchange_type') THEN
+        ALTER TABLE users ADD COLUMN rabbitmq_exchange_type TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'rabbitmq_routing_key') THEN
+        ALTER TABLE users ADD COLUMN rabbitmq_routing_key TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'rabbitmq_queue') THEN
+        ALTER TABLE users ADD COLUMN rabbitmq_queue TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'rabbitmq_queue_type') THEN
+        ALTER TABLE users ADD COLUMN rabbitmq_queue_type TEXT NOT NULL DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'rabbitmq_durable') THEN
+        ALTER TABLE users ADD COLUMN rabbitmq_durable BOOLEAN NOT NULL DEFAULT TRUE;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'rabbitmq_message_ttl') THEN
+        ALTER TABLE users ADD COLUMN rabbitmq_message_ttl INTEGER NOT NULL DEFAULT 0;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addScheduledMessagesSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'scheduled_messages') THEN
+        CREATE TABLE scheduled_messages (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            send_at BIGINT NOT NULL,
+            next_attempt_at BIGINT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending',
+            message_id TEXT NOT NULL DEFAULT '',
+            error TEXT NOT NULL DEFAULT '',
+            attempts INTEGER NOT NULL DEFAULT 0,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_scheduled_messages_status_next ON scheduled_messages (status, next_attempt_at);
+        CREATE INDEX idx_scheduled_messages_user ON scheduled_messages (user_id, send_at);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addCampaignsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'campaigns') THEN
+        CREATE TABLE campaigns (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            name TEXT NOT NULL DEFAULT '',
+            type TEXT NOT NULL,
+            message TEXT NOT NULL,
+            rate_per_minute INTEGER NOT NULL,
+            jitter_seconds INTEGER NOT NULL DEFAULT 0,
+            quiet_start TEXT NOT NULL DEFAULT '',
+            quiet_end TEXT NOT NULL DEFAULT '',
+            timezone TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT 'running',
+            next_send_at BIGINT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_campaigns_status_next ON campaigns (status, next_send_at);
+        CREATE INDEX idx_campaigns_user ON campaigns (user_id, created_at);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'campaign_recipients') THEN
+        CREATE TABLE campaign_recipients (
+            campaign_id TEXT NOT NULL,
+            position INTEGER NOT NULL,
+            user_id TEXT NOT NULL,
+            phone TEXT NOT NULL,
+            variables TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL DEFAULT 'queued',
+            message_id TEXT NOT NULL DEFAULT '',
+            error TEXT NOT NULL DEFAULT '',
+            sent_at BIGINT NOT NULL DEFAULT 0,
+            delivered_at BIGINT NOT NULL DEFAULT 0,
+            read_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (campaign_id, position)
+        );
+        CREATE INDEX idx_campaign_recipients_message ON campaign_recipients (user_id, message_id);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addSendJobsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'send_jobs') THEN
+        CREATE TABLE send_jobs (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'queued',
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt_at BIGINT NOT NULL,
+            message_id TEXT NOT NULL DEFAULT '',
+            error TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX idx_send_jobs_status_next ON send_jobs (status, next_attempt_at);
+        CREATE INDEX idx_send_jobs_user ON send_jobs (user_id, created_at);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'send_queue_rate') THEN
+        ALTER TABLE users ADD COLUMN send_queue_rate INTEGER NOT NULL DEFAULT 0;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addIdempotencyKeysSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'idempotency_keys') THEN
+        CREATE TABLE idempotency_keys (
+            user_id TEXT NOT NULL,
+            idempotency_key TEXT NOT NULL,
+            request_hash TEXT NOT NULL,
+            status_code INTEGER NOT NULL DEFAULT 0,
+            response TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            expires_at BIGINT NOT NULL,
+            PRIMARY KEY (user_id, idempotency_key)
+        );
+        CREATE INDEX idx_idempotency_keys_expires ON idempotency_keys (expires_at);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addMessageTemplatesSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'message_templates') THEN
+        CREATE TABLE message_templates (
+            id TEXT PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            name TEXT NOT NULL,
+            body TEXT NOT NULL,
+            media_url TEXT NOT NULL DEFAULT '',
+            media_type TEXT NOT NULL DEFAULT '',
+            buttons TEXT NOT NULL DEFAULT '',
+            list TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            UNIQUE (user_id, name)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addMessageStatusSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'message_status') THEN
+        CREATE TABLE message_status (
+            user_id TEXT NOT NULL,
+            message_id TEXT NOT NULL,
+            chat_jid TEXT NOT NULL,
+            message_type TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'sent',
+            sent_at BIGINT NOT NULL,
+            delivered_at BIGINT NOT NULL DEFAULT 0,
+            read_at BIGINT NOT NULL DEFAULT 0,
+            played_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, message_id)
+        );
+        CREATE INDEX idx_message_status_chat_sent ON message_status (user_id, chat_jid, sent_at);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'message_participant_status') THEN
+        CREATE TABLE message_participant_status (
+            user_id TEXT NOT NULL,
+            message_id TEXT NOT NULL,
+            participant TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'sent',
+            delivered_at BIGINT NOT NULL DEFAULT 0,
+            read_at BIGINT NOT NULL DEFAULT 0,
+            played_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, message_id, participant)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addPollsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'polls') THEN
+        CREATE TABLE polls (
+            user_id TEXT NOT NULL,
+            poll_id TEXT NOT NULL,
+            chat_jid TEXT NOT NULL,
+            question TEXT NOT NULL,
+            options TEXT NOT NULL,
+            selectable_count INTEGER NOT NULL DEFAULT 1,
+            from_me BOOLEAN NOT NULL DEFAULT FALSE,
+            created_at BIGINT NOT NULL,
+            PRIMARY KEY (user_id, poll_id)
+        );
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'poll_votes') THEN
+        CREATE TABLE poll_votes (
+            user_id TEXT NOT NULL,
+            poll_id TEXT NOT NULL,
+            voter TEXT NOT NULL,
+            options TEXT NOT NULL,
+            voted_at BIGINT NOT NULL,
+            PRIMARY KEY (user_id, poll_id, voter)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addMessageHistorySearchSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'message_history' AND column_name = 'search_vector') THEN
+        ALTER TABLE message_history ADD COLUMN search_vector tsvector
+            GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(text_content, ''))) STORED;
+    END IF;
+    CREATE INDEX IF NOT EXISTS idx_message_history_search ON message_history USING GIN (search_vector);
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addChatsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'chats') THEN
+        CREATE TABLE chats (
+            user_id TEXT NOT NULL,
+            chat_jid TEXT NOT NULL,
+            name TEXT NOT NULL DEFAULT '',
+            unread_count INTEGER NOT NULL DEFAULT 0,
+            last_message_id TEXT NOT NULL DEFAULT '',
+            last_message_type TEXT NOT NULL DEFAULT '',
+            last_message_preview TEXT NOT NULL DEFAULT '',
+            last_sender TEXT NOT NULL DEFAULT '',
+            last_from_me BOOLEAN NOT NULL DEFAULT FALSE,
+            last_message_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, chat_jid)
+        );
+        CREATE INDEX idx_chats_user_activity ON chats (user_id, last_message_at DESC);
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addMessageRevisionsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'message_history' AND column_name = 'edited_at') THEN
+        ALTER TABLE message_history ADD COLUMN edited_at BIGINT NOT NULL DEFAULT 0;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'message_history' AND column_name = 'deleted_at') THEN
+        ALTER TABLE message_history ADD COLUMN deleted_at BIGINT NOT NULL DEFAULT 0;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'message_edits') THEN
+        CREATE TABLE message_edits (
+            id SERIAL PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            message_id TEXT NOT NULL,
+            previous_text TEXT NOT NULL,
+            edited_at BIGINT NOT NULL
+        );
+        CREATE INDEX idx_message_edits_message ON message_edits (user_id, message_id);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'message_reactions') THEN
+        CREATE TABLE message_reactions (
+            user_id TEXT NOT NULL,
+            message_id TEXT NOT NULL,
+            sender_jid TEXT NOT NULL,
+            emoji TEXT NOT NULL,
+            reacted_at BIGINT NOT NULL,
+            PRIMARY KEY (user_id, message_id, sender_jid)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addHistoryRetentionSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'history_retention') THEN
+        CREATE TABLE history_retention (
+            user_id TEXT NOT NULL,
+            chat_jid TEXT NOT NULL DEFAULT '',
+            retention_days INTEGER,
+            legal_hold BOOLEAN NOT NULL DEFAULT FALSE,
+            updated_at BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, chat_jid)
+        );
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addAdminEventSinksSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'admin_event_sinks') THEN
+        ALTER TABLE users ADD COLUMN admin_event_sinks TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhookDeliveryEndpointSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_deliveries' AND column_name = 'endpoint_id') THEN
+        ALTER TABLE webhook_deliveries ADD COLUMN endpoint_id TEXT NOT NULL DEFAULT '';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_deliveries' AND column_name = 'format') THEN
+        ALTER TABLE webhook_deliveries ADD COLUMN format TEXT NOT NULL DEFAULT '';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_outbox' AND column_name = 'endpoint_id') THEN
+        ALTER TABLE webhook_outbox ADD COLUMN endpoint_id TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhookOutboxEventTimeSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'webhook_outbox' AND column_name = 'event_time') THEN
+        ALTER TABLE webhook_outbox ADD COLUMN event_time BIGINT NOT NULL DEFAULT 0;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
 // GenerateRandomID creates a random string ID
 func GenerateRandomID() (string, error) {
 	bytes := make([]byte, 16) // 128 bits
@@ -456,6 +1058,469 @@ func applyMigration(db *sqlx.DB, migration Migration) error {
 		} else {
 			_, err = tx.Exec(migration.UpSQL)
 		}
+	} else if migration.ID == 10 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "webhook_outbox", `
+				CREATE TABLE webhook_outbox (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					url TEXT NOT NULL,
+					event_type TEXT NOT NULL DEFAULT '',
+					payload TEXT NOT NULL,
+					file_path TEXT NOT NULL DEFAULT '',
+					hmac_key BLOB,
+					status TEXT NOT NULL DEFAULT 'pending',
+					attempts INTEGER NOT NULL DEFAULT 0,
+					next_attempt_at INTEGER NOT NULL DEFAULT 0,
+					last_error TEXT NOT NULL DEFAULT '',
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_webhook_outbox_status_next
+					ON webhook_outbox (status, next_attempt_at)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 11 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "webhook_deliveries", `
+				CREATE TABLE webhook_deliveries (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					url TEXT NOT NULL,
+					event_type TEXT NOT NULL DEFAULT '',
+					status TEXT NOT NULL,
+					status_code INTEGER NOT NULL DEFAULT 0,
+					latency_ms INTEGER NOT NULL DEFAULT 0,
+					error TEXT NOT NULL DEFAULT '',
+					attempt INTEGER NOT NULL DEFAULT 1,
+					payload TEXT NOT NULL,
+					file_path TEXT NOT NULL DEFAULT '',
+					created_at DATETIME NOT NULL
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_user_created
+					ON webhook_deliveries (user_id, created_at DESC)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 12 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "webhook_endpoints", `
+				CREATE TABLE webhook_endpoints (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					url TEXT NOT NULL,
+					events TEXT NOT NULL DEFAULT '',
+					hmac_key BLOB,
+					format TEXT NOT NULL DEFAULT '',
+					enabled BOOLEAN NOT NULL DEFAULT 1,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_user
+					ON webhook_endpoints (user_id)`)
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_outbox", "format", "TEXT NOT NULL DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 13 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "hmac_scheme", "TEXT NOT NULL DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "hmac_previous_keys", "TEXT NOT NULL DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 14 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "event_sinks", "TEXT NOT NULL DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 15 {
+		if db.DriverName() == "sqlite" {
+			for _, column := range [][2]string{
+				{"rabbitmq_exchange", "TEXT NOT NULL DEFAULT ''"},
+				{"rabbitmq_exchange_type", "TEXT NOT NULL DEFAULT ''"},
+				{"rabbitmq_routing_key", "TEXT NOT NULL DEFAULT ''"},
+				{"rabbitmq_queue", "TEXT NOT NULL DEFAULT ''"},
+				{"rabbitmq_queue_type", "TEXT NOT NULL DEFAULT ''"},
+				{"rabbitmq_durable", "BOOLEAN NOT NULL DEFAULT 1"},
+				{"rabbitmq_message_ttl", "INTEGER NOT NULL DEFAULT 0"},
+			} {
+				if err = addColumnIfNotExistsSQLite(tx, "users", column[0], column[1]); err != nil {
+					break
+				}
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 16 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "scheduled_messages", `
+				CREATE TABLE scheduled_messages (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					type TEXT NOT NULL,
+					payload TEXT NOT NULL,
+					send_at INTEGER NOT NULL,
+					next_attempt_at INTEGER NOT NULL,
+					status TEXT NOT NULL DEFAULT 'pending',
+					message_id TEXT NOT NULL DEFAULT '',
+					error TEXT NOT NULL DEFAULT '',
+					attempts INTEGER NOT NULL DEFAULT 0,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_scheduled_messages_status_next
+					ON scheduled_messages (status, next_attempt_at)`)
+			}
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_scheduled_messages_user
+					ON scheduled_messages (user_id, send_at)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 17 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "campaigns", `
+				CREATE TABLE campaigns (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					name TEXT NOT NULL DEFAULT '',
+					type TEXT NOT NULL,
+					message TEXT NOT NULL,
+					rate_per_minute INTEGER NOT NULL,
+					jitter_seconds INTEGER NOT NULL DEFAULT 0,
+					quiet_start TEXT NOT NULL DEFAULT '',
+					quiet_end TEXT NOT NULL DEFAULT '',
+					timezone TEXT NOT NULL DEFAULT '',
+					status TEXT NOT NULL DEFAULT 'running',
+					next_send_at INTEGER NOT NULL,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_campaigns_status_next
+					ON campaigns (status, next_send_at)`)
+			}
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_campaigns_user
+					ON campaigns (user_id, created_at)`)
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "campaign_recipients", `
+					CREATE TABLE campaign_recipients (
+						campaign_id TEXT NOT NULL,
+						position INTEGER NOT NULL,
+						user_id TEXT NOT NULL,
+						phone TEXT NOT NULL,
+						variables TEXT NOT NULL DEFAULT '',
+						status TEXT NOT NULL DEFAULT 'queued',
+						message_id TEXT NOT NULL DEFAULT '',
+						error TEXT NOT NULL DEFAULT '',
+						sent_at INTEGER NOT NULL DEFAULT 0,
+						delivered_at INTEGER NOT NULL DEFAULT 0,
+						read_at INTEGER NOT NULL DEFAULT 0,
+						PRIMARY KEY (campaign_id, position)
+					)`)
+			}
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_campaign_recipients_message
+					ON campaign_recipients (user_id, message_id)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 18 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "send_jobs", `
+				CREATE TABLE send_jobs (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					type TEXT NOT NULL,
+					payload TEXT NOT NULL,
+					status TEXT NOT NULL DEFAULT 'queued',
+					attempts INTEGER NOT NULL DEFAULT 0,
+					next_attempt_at INTEGER NOT NULL,
+					message_id TEXT NOT NULL DEFAULT '',
+					error TEXT NOT NULL DEFAULT '',
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_send_jobs_status_next
+					ON send_jobs (status, next_attempt_at)`)
+			}
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_send_jobs_user
+					ON send_jobs (user_id, created_at)`)
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "send_queue_rate", "INTEGER NOT NULL DEFAULT 0")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 19 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "idempotency_keys", `
+				CREATE TABLE idempotency_keys (
+					user_id TEXT NOT NULL,
+					idempotency_key TEXT NOT NULL,
+					request_hash TEXT NOT NULL,
+					status_code INTEGER NOT NULL DEFAULT 0,
+					response TEXT NOT NULL DEFAULT '',
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					expires_at INTEGER NOT NULL,
+					PRIMARY KEY (user_id, idempotency_key)
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires
+					ON idempotency_keys (expires_at)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 20 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "message_templates", `
+				CREATE TABLE message_templates (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					name TEXT NOT NULL,
+					body TEXT NOT NULL,
+					media_url TEXT NOT NULL DEFAULT '',
+					media_type TEXT NOT NULL DEFAULT '',
+					buttons TEXT NOT NULL DEFAULT '',
+					list TEXT NOT NULL DEFAULT '',
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					UNIQUE (user_id, name)
+				)`)
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 21 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "message_status", `
+				CREATE TABLE message_status (
+					user_id TEXT NOT NULL,
+					message_id TEXT NOT NULL,
+					chat_jid TEXT NOT NULL,
+					message_type TEXT NOT NULL,
+					status TEXT NOT NULL DEFAULT 'sent',
+					sent_at INTEGER NOT NULL,
+					delivered_at INTEGER NOT NULL DEFAULT 0,
+					read_at INTEGER NOT NULL DEFAULT 0,
+					played_at INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (user_id, message_id)
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_message_status_chat_sent
+					ON message_status (user_id, chat_jid, sent_at)`)
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "message_participant_status", `
+					CREATE TABLE message_participant_status (
+						user_id TEXT NOT NULL,
+						message_id TEXT NOT NULL,
+						participant TEXT NOT NULL,
+						status TEXT NOT NULL DEFAULT 'sent',
+						delivered_at INTEGER NOT NULL DEFAULT 0,
+						read_at INTEGER NOT NULL DEFAULT 0,
+						played_at INTEGER NOT NULL DEFAULT 0,
+						PRIMARY KEY (user_id, message_id, participant)
+					)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 22 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "polls", `
+				CREATE TABLE polls (
+					user_id TEXT NOT NULL,
+					poll_id TEXT NOT NULL,
+					chat_jid TEXT NOT NULL,
+					question TEXT NOT NULL,
+					options TEXT NOT NULL,
+					selectable_count INTEGER NOT NULL DEFAULT 1,
+					from_me BOOLEAN NOT NULL DEFAULT 0,
+					created_at INTEGER NOT NULL,
+					PRIMARY KEY (user_id, poll_id)
+				)`)
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "poll_votes", `
+					CREATE TABLE poll_votes (
+						user_id TEXT NOT NULL,
+						poll_id TEXT NOT NULL,
+						voter TEXT NOT NULL,
+						options TEXT NOT NULL,
+						voted_at INTEGER NOT NULL,
+						PRIMARY KEY (user_id, poll_id, voter)
+					)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 23 {
+		if db.DriverName() == "sqlite" {
+			// External content FTS5 index of message_history, kept in sync by triggers
+			// and rebuilt to index the existing rows
+			for _, statement := range []string{
+				`CREATE VIRTUAL TABLE IF NOT EXISTS message_history_fts USING fts5(
+					text_content, content='message_history', content_rowid='id',
+					tokenize='unicode61 remove_diacritics 2')`,
+				`CREATE TRIGGER IF NOT EXISTS message_history_fts_insert AFTER INSERT ON message_history BEGIN
+					INSERT INTO message_history_fts (rowid, text_content) VALUES (new.id, new.text_content);
+				END`,
+				`CREATE TRIGGER IF NOT EXISTS message_history_fts_delete AFTER DELETE ON message_history BEGIN
+					INSERT INTO message_history_fts (message_history_fts, rowid, text_content) VALUES ('delete', old.id, old.text_content);
+				END`,
+				`CREATE TRIGGER IF NOT EXISTS message_history_fts_update AFTER UPDATE OF text_content ON message_history BEGIN
+					INSERT INTO message_history_fts (message_history_fts, rowid, text_content) VALUES ('delete', old.id, old.text_content);
+					INSERT INTO message_history_fts (rowid, text_content) VALUES (new.id, new.text_content);
+				END`,
+				`INSERT INTO message_history_fts (message_history_fts) VALUES ('rebuild')`,
+			} {
+				if _, err = tx.Exec(statement); err != nil {
+					break
+				}
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 24 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "chats", `
+				CREATE TABLE chats (
+					user_id TEXT NOT NULL,
+					chat_jid TEXT NOT NULL,
+					name TEXT NOT NULL DEFAULT '',
+					unread_count INTEGER NOT NULL DEFAULT 0,
+					last_message_id TEXT NOT NULL DEFAULT '',
+					last_message_type TEXT NOT NULL DEFAULT '',
+					last_message_preview TEXT NOT NULL DEFAULT '',
+					last_sender TEXT NOT NULL DEFAULT '',
+					last_from_me BOOLEAN NOT NULL DEFAULT 0,
+					last_message_at INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (user_id, chat_jid)
+				)`)
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_chats_user_activity
+					ON chats (user_id, last_message_at DESC)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+		if err == nil {
+			err = backfillChats(tx)
+		}
+	} else if migration.ID == 25 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "message_history", "edited_at", "INTEGER NOT NULL DEFAULT 0")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "message_history", "deleted_at", "INTEGER NOT NULL DEFAULT 0")
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "message_edits", `
+					CREATE TABLE message_edits (
+						id INTEGER PRIMARY KEY AUTOINCREMENT,
+						user_id TEXT NOT NULL,
+						message_id TEXT NOT NULL,
+						previous_text TEXT NOT NULL,
+						edited_at INTEGER NOT NULL
+					)`)
+			}
+			if err == nil {
+				_, err = tx.Exec(`
+					CREATE INDEX IF NOT EXISTS idx_message_edits_message
+					ON message_edits (user_id, message_id)`)
+			}
+			if err == nil {
+				err = createTableIfNotExistsSQLite(tx, "message_reactions", `
+					CREATE TABLE message_reactions (
+						user_id TEXT NOT NULL,
+						message_id TEXT NOT NULL,
+						sender_jid TEXT NOT NULL,
+						emoji TEXT NOT NULL,
+						reacted_at INTEGER NOT NULL,
+						PRIMARY KEY (user_id, message_id, sender_jid)
+					)`)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+		if err == nil {
+			err = foldHistoryRevisions(tx)
+		}
+	} else if migration.ID == 26 {
+		if db.DriverName() == "sqlite" {
+			err = createTableIfNotExistsSQLite(tx, "history_retention", `
+				CREATE TABLE history_retention (
+					user_id TEXT NOT NULL,
+					chat_jid TEXT NOT NULL DEFAULT '',
+					retention_days INTEGER,
+					legal_hold BOOLEAN NOT NULL DEFAULT 0,
+					updated_at INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (user_id, chat_jid)
+				)`)
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 27 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "admin_event_sinks", "TEXT NOT NULL DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 28 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "webhook_deliveries", "endpoint_id", "TEXT NOT NULL DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_deliveries", "format", "TEXT NOT NULL DEFAULT ''")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhook_outbox", "endpoint_id", "TEXT NOT NULL DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 29 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "webhook_outbox", "event_time", "INTEGER NOT NULL DEFAULT 0")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+		if err == nil {
+			// Entries still pending keep the time of the upgrade on every attempt
+			_, err = tx.Exec("UPDATE webhook_outbox SET event_time = $1 WHERE event_time = 0", time.Now().UnixMilli())
+		}
 	} else {
 		_, err = tx.Exec(migration.UpSQL)
 	}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// jetStreamPublisher is the part of jetstream.JetStream used by the sink, so tests can use a fake
+type jetStreamPublisher interface {
+	PublishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error)
+}
+
+// natsSink publishes events to NATS JetStream (NATS_URL) on
+// "<subject>.<userID>.<eventType>", so consumers can filter with wildcards
+type natsSink struct {
+	conn    *nats.Conn
+	js      jetStreamPublisher
+	subject string
+}
+
+// newNatsSink connects to NATS and, when stream is set, creates or updates a
+// stream capturing every subject under the base subject
+func newNatsSink(url string, subject string, stream string) (*natsSink, error) {
+	conn, err := nats.Connect(url, nats.Name("wuzapi"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if stream != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     stream,
+			Subjects: []string{subject + ".>"},
+		})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return &natsSink{conn: conn, js: js, subject: subject}, nil
+}
+
+func (n *natsSink) Name() string               { return sinkNameNATS }
+func (n *natsSink) Enabled() bool              { return true }
+func (n *natsSink) DefaultDestination() string { return n.subject }
+
+func (n *natsSink) Close() error {
+	if n.conn != nil {
+		return n.conn.Drain()
+	}
+	return nil
+}
+
+func (n *natsSink) Publish(ctx context.Context, event SinkEvent, destination string) error {
+	data, contentType, err := brokerMessage(event, *eventSinkFormat)
+	if err != nil {
+		return err
+	}
+
+	subject := n.subject
+	if destination != "" {
+		subject = destination
+	}
+
+	msg := nats.NewMsg(subject + "." + event.UserID + "." + event.Type)
+	msg.Data = data
+	msg.Header.Set("Content-Type", contentType)
+	_, err = n.js.PublishMsg(ctx, msg)
+	return err
+}
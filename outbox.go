@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	outboxStatusPending    = "pending"
+	outboxStatusDelivering = "delivering"
+	outboxStatusFailed     = "failed"
+
+	outboxPollInterval = 1 * time.Second
+)
+
+// webhookOutbox is the process-wide outbox; nil until InitWebhookOutbox is called
+var webhookOutbox *WebhookOutbox
+
+// WebhookOutbox persists webhook deliveries in the database and drains them
+// with a pool of workers, so pending deliveries survive a restart.
+type WebhookOutbox struct {
+	db      *sqlx.DB
+	workers int
+	jobs    chan string
+	wake    chan struct{}
+}
+
+type webhookOutboxEntry struct {
+	ID            string `db:"id"`
+	UserID        string `db:"user_id"`
+	URL           string `db:"url"`
+	EventType     string `db:"event_type"`
+	Payload       string `db:"payload"`
+	FilePath      string `db:"file_path"`
+	HmacKey       []byte `db:"hmac_key"`
+	Format        string `db:"format"`
+	EndpointID    string `db:"endpoint_id"`
+	EventTime     int64  `db:"event_time"`
+	Status        string `db:"status"`
+	Attempts      int    `db:"attempts"`
+	NextAttemptAt int64  `db:"next_attempt_at"`
+	LastError     string `db:"last_error"`
+}
+
+// event returns the event an entry delivers
+func (entry webhookOutboxEntry) event() webhookEvent {
+	return webhookEvent{ID: entry.ID, Time: time.UnixMilli(entry.EventTime).UTC()}
+}
+
+// InitWebhookOutbox requeues deliveries interrupted by a previous shutdown and
+// starts the dispatcher and worker pool.
+func InitWebhookOutbox(db *sqlx.DB, workers int) {
+	o := newWebhookOutbox(db, workers)
+	o.requeueInterrupted()
+
+	for i := 0; i < o.workers; i++ {
+		go o.worker()
+	}
+	go o.dispatch()
+
+	webhookOutbox = o
+	log.Info().Int("workers", o.workers).Msg("Webhook outbox started")
+}
+
+func newWebhookOutbox(db *sqlx.DB, workers int) *WebhookOutbox {
+	if workers < 1 {
+		workers = 1
+	}
+	return &WebhookOutbox{
+		db:      db,
+		workers: workers,
+		jobs:    make(chan string, workers*2),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// requeueInterrupted puts back deliveries that were in flight when the process stopped
+func (o *WebhookOutbox) requeueInterrupted() {
+	res, err := o.db.Exec("UPDATE webhook_outbox SET status=$1 WHERE status=$2", outboxStatusPending, outboxStatusDelivering)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to requeue interrupted webhook deliveries")
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		log.Info().Int64("count", n).Msg("Requeued interrupted webhook deliveries")
+	}
+}
+
+// enqueueWebhook stores a webhook delivery in the outbox. When the outbox is not
+// running or the insert fails, it falls back to delivering in a goroutine.
+// An empty format uses WEBHOOK_FORMAT; an empty endpointID is the user's own webhook.
+func enqueueWebhook(myurl string, payload map[string]string, userID string, endpointID string, file string, encryptedHmacKey []byte, format string) {
+	if webhookOutbox != nil {
+		err := webhookOutbox.Enqueue(myurl, payload, userID, endpointID, file, encryptedHmacKey, format)
+		if err == nil {
+			return
+		}
+		log.Error().Err(err).Str("url", myurl).Msg("Failed to store webhook in outbox, delivering directly")
+	}
+
+	if file == "" {
+		go callHookWithFormat(myurl, payload, userID, endpointID, encryptedHmacKey, format)
+	} else {
+		go func() {
+			if err := callHookFileToEndpoint(myurl, payload, userID, endpointID, file, encryptedHmacKey); err != nil {
+				log.Error().Err(err).Msg("Error calling hook file")
+			}
+		}()
+	}
+}
+
+// Enqueue inserts a pending delivery and wakes up the dispatcher. The entry ID and
+// the time it is enqueued identify the event on every attempt.
+func (o *WebhookOutbox) Enqueue(myurl string, payload map[string]string, userID string, endpointID string, file string, encryptedHmacKey []byte, format string) error {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return err
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	_, err = o.db.Exec(`
+		INSERT INTO webhook_outbox (id, user_id, url, endpoint_id, event_type, payload, file_path, hmac_key, format, status, attempts, next_attempt_at, event_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 0, $11, $12)`,
+		id, userID, myurl, endpointID, webhookEventType(payload), string(payloadJSON), file, encryptedHmacKey, format, outboxStatusPending, time.Now().Unix(), time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook into outbox: %w", err)
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dispatch polls for due deliveries and hands them to the workers
+func (o *WebhookOutbox) dispatch() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		}
+		o.claimDue()
+	}
+}
+
+func (o *WebhookOutbox) claimDue() {
+	var due []struct {
+		ID  string `db:"id"`
+		URL string `db:"url"`
+	}
+	err := o.db.Select(&due, `
+		SELECT id, url FROM webhook_outbox
+		WHERE status = $1 AND next_attempt_at <= $2
+		ORDER BY next_attempt_at ASC
+		LIMIT $3`, outboxStatusPending, time.Now().Unix(), cap(o.jobs))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query webhook outbox")
+		return
+	}
+
+	for _, entry := range due {
+		// Park deliveries to URLs whose circuit is open instead of burning their attempts
+		if !webhookBreakers.Allow(entry.URL) {
+			o.park(entry.ID, webhookBreakers.RetryAt(entry.URL))
+			continue
+		}
+
+		res, err := o.db.Exec("UPDATE webhook_outbox SET status=$1, updated_at=CURRENT_TIMESTAMP WHERE id=$2 AND status=$3",
+			outboxStatusDelivering, entry.ID, outboxStatusPending)
+		if err != nil {
+			log.Error().Err(err).Str("id", entry.ID).Msg("Failed to claim webhook outbox entry")
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		o.jobs <- entry.ID
+	}
+}
+
+// park postpones a pending delivery without counting an attempt
+func (o *WebhookOutbox) park(id string, until time.Time) {
+	_, err := o.db.Exec("UPDATE webhook_outbox SET next_attempt_at=$1, updated_at=CURRENT_TIMESTAMP WHERE id=$2 AND status=$3",
+		until.Unix(), id, outboxStatusPending)
+	if err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Failed to park webhook outbox entry")
+	}
+}
+
+func (o *WebhookOutbox) worker() {
+	for id := range o.jobs {
+		o.deliver(id)
+	}
+}
+
+// deliver makes one attempt for an outbox entry and either removes it,
+// schedules the next attempt with exponential backoff, or marks it failed.
+func (o *WebhookOutbox) deliver(id string) {
+	var entry webhookOutboxEntry
+	err := o.db.Get(&entry, `
+		SELECT id, user_id, url, endpoint_id, event_type, payload, file_path, hmac_key, format, status, attempts, next_attempt_at, last_error, event_time
+		FROM webhook_outbox WHERE id=$1`, id)
+	if err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Failed to load webhook outbox entry")
+		return
+	}
+
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(entry.Payload), &payload); err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Invalid webhook outbox payload")
+		o.markFailed(entry, err)
+		return
+	}
+
+	attempt := entry.Attempts + 1
+	log.Info().Str("url", entry.URL).Str("userID", entry.UserID).Int("attempt", attempt).Msg("Delivering webhook from outbox")
+
+	var body interface{}
+	if entry.FilePath == "" {
+		body, _, err = postWebhookOnce(entry.URL, payload, entry.UserID, entry.EndpointID, entry.event(), entry.HmacKey, entry.Format, attempt)
+	} else {
+		_, err = postWebhookFileOnce(entry.URL, payload, entry.UserID, entry.EndpointID, entry.event(), entry.FilePath, entry.HmacKey, attempt)
+	}
+
+	if err == nil {
+		if _, dbErr := o.db.Exec("DELETE FROM webhook_outbox WHERE id=$1", id); dbErr != nil {
+			log.Error().Err(dbErr).Str("id", id).Msg("Failed to remove delivered webhook from outbox")
+		}
+		return
+	}
+
+	entry.Attempts = attempt
+	if attempt >= webhookMaxAttempts() {
+		log.Error().Str("url", entry.URL).Msg("Webhook permanently failed after all retries. Sending to error queue...")
+		o.markFailed(entry, err)
+		if entry.FilePath == "" {
+			publishWebhookError(entry.URL, body, entry.UserID, entry.HmacKey, err)
+		} else {
+			publishWebhookFileError(entry.URL, payload, entry.UserID, entry.FilePath, entry.HmacKey, err)
+		}
+		return
+	}
+
+	delay := webhookRetryDelay(attempt)
+	log.Warn().
+		Int("attempt", attempt+1).
+		Str("url", entry.URL).
+		Dur("delay", delay).
+		Msg("Retrying webhook request with exponential backoff...")
+
+	_, dbErr := o.db.Exec(`
+		UPDATE webhook_outbox
+		SET status=$1, attempts=$2, next_attempt_at=$3, last_error=$4, updated_at=CURRENT_TIMESTAMP
+		WHERE id=$5`,
+		outboxStatusPending, attempt, time.Now().Add(delay).Unix(), err.Error(), id)
+	if dbErr != nil {
+		log.Error().Err(dbErr).Str("id", id).Msg("Failed to reschedule webhook outbox entry")
+	}
+}
+
+// markFailed keeps an entry that exhausted its retries as failed until the delivery
+// log purge removes it with the attempts it logged
+func (o *WebhookOutbox) markFailed(entry webhookOutboxEntry, cause error) {
+	_, err := o.db.Exec(`
+		UPDATE webhook_outbox
+		SET status=$1, attempts=$2, last_error=$3, updated_at=$4
+		WHERE id=$5`,
+		outboxStatusFailed, entry.Attempts, cause.Error(), time.Now(), entry.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", entry.ID).Msg("Failed to mark webhook outbox entry as failed")
+	}
+}
+
+// webhookEventType extracts the event type from the jsonData field of a webhook payload
+func webhookEventType(payload map[string]string) string {
+	var event struct {
+		Type string `json:"type"`
+	}
+	if jsonStr, ok := payload["jsonData"]; ok {
+		if err := json.Unmarshal([]byte(jsonStr), &event); err == nil {
+			return event.Type
+		}
+	}
+	return ""
+}
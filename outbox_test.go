@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func makeTestOutbox(t *testing.T) *WebhookOutbox {
+	t.Helper()
+
+	s := makeTestServer(t)
+	// Keep every query on the same in-memory database
+	s.db.SetMaxOpenConns(1)
+
+	retryEnabled, retryCount, retryDelay := *webhookRetryEnabled, *webhookRetryCount, *webhookRetryDelaySeconds
+	*webhookRetryEnabled, *webhookRetryCount, *webhookRetryDelaySeconds = true, 2, 0
+	t.Cleanup(func() {
+		*webhookRetryEnabled, *webhookRetryCount, *webhookRetryDelaySeconds = retryEnabled, retryCount, retryDelay
+	})
+
+	return newWebhookOutbox(s.db, 1)
+}
+
+// drainOutbox claims and delivers every due entry once
+func drainOutbox(o *WebhookOutbox) {
+	o.claimDue()
+	for {
+		select {
+		case id := <-o.jobs:
+			o.deliver(id)
+		default:
+			return
+		}
+	}
+}
+
+func TestWebhookOutboxDelivers(t *testing.T) {
+	o := makeTestOutbox(t)
+
+	var received atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse form: %v", err)
+		}
+		if r.FormValue("userID") != "user-1" {
+			t.Errorf("Expected userID user-1, got %q", r.FormValue("userID"))
+		}
+		received.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	payload := map[string]string{"jsonData": `{"type":"Message"}`, "userID": "user-1"}
+	if err := o.Enqueue(ts.URL, payload, "user-1", "", "", nil, ""); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	var eventType string
+	if err := o.db.Get(&eventType, "SELECT event_type FROM webhook_outbox"); err != nil {
+		t.Fatalf("Failed to read outbox entry: %v", err)
+	}
+	if eventType != "Message" {
+		t.Errorf("Expected event type Message, got %q", eventType)
+	}
+
+	drainOutbox(o)
+
+	if received.Load() != 1 {
+		t.Errorf("Expected 1 delivery, got %d", received.Load())
+	}
+	var remaining int
+	if err := o.db.Get(&remaining, "SELECT COUNT(*) FROM webhook_outbox"); err != nil {
+		t.Fatalf("Failed to count outbox entries: %v", err)
+	}
+	if remaining != 0 {
+		t.Errorf("Expected delivered entry to be removed, %d left", remaining)
+	}
+}
+
+func TestWebhookOutboxRetriesThenFails(t *testing.T) {
+	o := makeTestOutbox(t)
+
+	var received atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	if err := o.Enqueue(ts.URL, map[string]string{"jsonData": `{"type":"Message"}`}, "user-1", "", "", nil, ""); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	drainOutbox(o)
+
+	var entry webhookOutboxEntry
+	if err := o.db.Get(&entry, "SELECT id, status, attempts, last_error FROM webhook_outbox"); err != nil {
+		t.Fatalf("Failed to read outbox entry: %v", err)
+	}
+	if entry.Status != outboxStatusPending || entry.Attempts != 1 || entry.LastError == "" {
+		t.Errorf("Expected pending entry with 1 attempt and an error, got %+v", entry)
+	}
+
+	drainOutbox(o)
+
+	if err := o.db.Get(&entry, "SELECT id, status, attempts, last_error FROM webhook_outbox"); err != nil {
+		t.Fatalf("Failed to read outbox entry: %v", err)
+	}
+	if entry.Status != outboxStatusFailed || entry.Attempts != 2 {
+		t.Errorf("Expected failed entry after 2 attempts, got %+v", entry)
+	}
+	if received.Load() != 2 {
+		t.Errorf("Expected 2 delivery attempts, got %d", received.Load())
+	}
+
+	// Failed entries are purged with the delivery log, pending ones are kept
+	if err := o.Enqueue(ts.URL, map[string]string{}, "user-1", "", "", nil, ""); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	purgeWebhookDeliveries(o.db, 1)
+	var statuses []string
+	if err := o.db.Select(&statuses, "SELECT status FROM webhook_outbox ORDER BY status"); err != nil || len(statuses) != 2 {
+		t.Fatalf("Expected a recent failed entry to be kept, got %v (%v)", statuses, err)
+	}
+	if _, err := o.db.Exec("UPDATE webhook_outbox SET updated_at=$1 WHERE status=$2", time.Now().AddDate(0, 0, -2), outboxStatusFailed); err != nil {
+		t.Fatalf("Failed to age outbox entry: %v", err)
+	}
+	purgeWebhookDeliveries(o.db, 1)
+	if err := o.db.Select(&statuses, "SELECT status FROM webhook_outbox"); err != nil || len(statuses) != 1 || statuses[0] != outboxStatusPending {
+		t.Errorf("Expected only the pending entry left, got %v (%v)", statuses, err)
+	}
+}
+
+func TestWebhookOutboxRequeuesInterruptedDeliveries(t *testing.T) {
+	o := makeTestOutbox(t)
+
+	if err := o.Enqueue("http://example.invalid/hook", map[string]string{}, "user-1", "", "", nil, ""); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if _, err := o.db.Exec("UPDATE webhook_outbox SET status=$1", outboxStatusDelivering); err != nil {
+		t.Fatalf("Failed to update entry: %v", err)
+	}
+
+	o.requeueInterrupted()
+
+	var status string
+	if err := o.db.Get(&status, "SELECT status FROM webhook_outbox"); err != nil {
+		t.Fatalf("Failed to read outbox entry: %v", err)
+	}
+	if status != outboxStatusPending {
+		t.Errorf("Expected interrupted delivery to be requeued, got %q", status)
+	}
+}
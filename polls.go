@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Poll is a poll sent or received by an instance. Its options are kept to map the
+// option hashes of votes back to names; whatsmeow keeps the message secret that
+// decrypts the votes.
+type Poll struct {
+	ID              string    `json:"id" db:"poll_id"`
+	UserID          string    `json:"-" db:"user_id"`
+	Chat            string    `json:"chat" db:"chat_jid"`
+	Question        string    `json:"question" db:"question"`
+	Options         []string  `json:"options" db:"-"`
+	StoredOptions   string    `json:"-" db:"options"`
+	SelectableCount int       `json:"selectable_count" db:"selectable_count"`
+	FromMe          bool      `json:"from_me" db:"from_me"`
+	CreatedAtUnix   int64     `json:"-" db:"created_at"`
+	CreatedAt       time.Time `json:"created_at" db:"-"`
+}
+
+// fill sets the API fields from the stored columns
+func (p *Poll) fill() {
+	p.Options = []string{}
+	_ = json.Unmarshal([]byte(p.StoredOptions), &p.Options)
+	p.CreatedAt = time.Unix(p.CreatedAtUnix, 0).UTC()
+}
+
+// PollVote is the current vote of a voter; a new vote replaces the previous one
+type PollVote struct {
+	Voter         string    `json:"voter" db:"voter"`
+	Options       []string  `json:"options" db:"-"`
+	StoredOptions string    `json:"-" db:"options"`
+	VotedAtUnix   int64     `json:"-" db:"voted_at"`
+	VotedAt       time.Time `json:"voted_at" db:"-"`
+}
+
+// fill sets the API fields from the stored columns
+func (v *PollVote) fill() {
+	v.Options = []string{}
+	_ = json.Unmarshal([]byte(v.StoredOptions), &v.Options)
+	v.VotedAt = time.Unix(v.VotedAtUnix, 0).UTC()
+}
+
+// PollOptionResult is the tally of one option
+type PollOptionResult struct {
+	Option string   `json:"option"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
+
+const pollColumns = `poll_id, user_id, chat_jid, question, options, selectable_count, from_me, created_at`
+
+// getPoll returns a poll of a user
+func getPoll(db *sqlx.DB, userID string, pollID string) (Poll, error) {
+	var poll Poll
+	err := db.Get(&poll, "SELECT "+pollColumns+" FROM polls WHERE user_id = $1 AND poll_id = $2", userID, pollID)
+	poll.fill()
+	return poll, err
+}
+
+// recordPoll stores a poll so its votes can be tallied
+func recordPoll(db *sqlx.DB, userID string, pollID string, chatJID string, question string, options []string, selectableCount int, fromMe bool, createdAt time.Time) error {
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO polls (user_id, poll_id, chat_jid, question, options, selectable_count, from_me, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (user_id, poll_id) DO NOTHING`,
+		userID, pollID, chatJID, question, string(encoded), selectableCount, fromMe, createdAt.Unix())
+	return err
+}
+
+// pollCreationOf returns the poll created by a message, whatever its version
+func pollCreationOf(msg *waE2E.Message) *waE2E.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3()
+	}
+	return nil
+}
+
+// applyPollVote replaces the vote of voter with the options matching the selected
+// hashes and returns their names. Votes older than the stored one are ignored and
+// an empty selection removes the vote.
+func applyPollVote(db *sqlx.DB, userID string, poll Poll, voter string, selectedHashes [][]byte, votedAt time.Time) ([]string, error) {
+	hashes := whatsmeow.HashPollOptions(poll.Options)
+	selected := []string{}
+	for _, selectedHash := range selectedHashes {
+		for i, hash := range hashes {
+			if bytes.Equal(hash, selectedHash) {
+				selected = append(selected, poll.Options[i])
+				break
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		_, err := db.Exec("DELETE FROM poll_votes WHERE user_id = $1 AND poll_id = $2 AND voter = $3 AND voted_at <= $4",
+			userID, poll.ID, voter, votedAt.Unix())
+		return selected, err
+	}
+
+	encoded, _ := json.Marshal(selected)
+	_, err := db.Exec(`
+		INSERT INTO poll_votes (user_id, poll_id, voter, options, voted_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, poll_id, voter) DO UPDATE SET options = excluded.options, voted_at = excluded.voted_at
+		WHERE poll_votes.voted_at <= excluded.voted_at`,
+		userID, poll.ID, voter, string(encoded), votedAt.Unix())
+	return selected, err
+}
+
+// pollResults tallies the current votes of a poll, keeping the options in poll order
+func pollResults(db *sqlx.DB, userID string, poll Poll) ([]PollOptionResult, []PollVote, error) {
+	votes := []PollVote{}
+	err := db.Select(&votes, "SELECT voter, options, voted_at FROM poll_votes WHERE user_id = $1 AND poll_id = $2 ORDER BY voted_at",
+		userID, poll.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results := make([]PollOptionResult, len(poll.Options))
+	index := make(map[string]int, len(poll.Options))
+	for i, option := range poll.Options {
+		results[i] = PollOptionResult{Option: option, Voters: []string{}}
+		index[option] = i
+	}
+	for i := range votes {
+		votes[i].fill()
+		for _, option := range votes[i].Options {
+			if j, ok := index[option]; ok {
+				results[j].Votes++
+				results[j].Voters = append(results[j].Voters, votes[i].Voter)
+			}
+		}
+	}
+	return results, votes, nil
+}
+
+// handlePollMessage records the polls an instance receives and tallies the votes on
+// its polls, emitting a PollVote event for every decrypted vote
+func (mycli *MyClient) handlePollMessage(evt *events.Message) {
+	if creation := pollCreationOf(evt.Message); creation != nil {
+		options := make([]string, len(creation.GetOptions()))
+		for i, option := range creation.GetOptions() {
+			options[i] = option.GetOptionName()
+		}
+		err := recordPoll(mycli.db, mycli.userID, evt.Info.ID, evt.Info.Chat.String(), creation.GetName(), options,
+			int(creation.GetSelectableOptionsCount()), evt.Info.IsFromMe, evt.Info.Timestamp)
+		if err != nil {
+			log.Error().Err(err).Str("pollID", evt.Info.ID).Msg("Failed to record poll")
+		}
+		return
+	}
+
+	update := evt.Message.GetPollUpdateMessage()
+	if update == nil {
+		return
+	}
+	pollID := update.GetPollCreationMessageKey().GetID()
+	poll, err := getPoll(mycli.db, mycli.userID, pollID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error().Err(err).Str("pollID", pollID).Msg("Failed to get poll")
+		}
+		return
+	}
+
+	vote, err := mycli.WAClient.DecryptPollVote(context.Background(), evt)
+	if err != nil {
+		log.Error().Err(err).Str("pollID", pollID).Msg("Failed to decrypt poll vote")
+		return
+	}
+	voter := evt.Info.Sender.ToNonAD().String()
+	selected, err := applyPollVote(mycli.db, mycli.userID, poll, voter, vote.GetSelectedOptions(), evt.Info.Timestamp)
+	if err != nil {
+		log.Error().Err(err).Str("pollID", pollID).Msg("Failed to record poll vote")
+		return
+	}
+	log.Info().Str("pollID", pollID).Str("voter", voter).Strs("options", selected).Msg("Poll vote received")
+
+	postmap := map[string]interface{}{
+		"type": "PollVote",
+		"event": map[string]interface{}{
+			"PollID":          pollID,
+			"Chat":            poll.Chat,
+			"Question":        poll.Question,
+			"Voter":           voter,
+			"SelectedOptions": selected,
+			"Timestamp":       evt.Info.Timestamp,
+		},
+	}
+	sendEventWithWebHook(mycli, postmap, "")
+}
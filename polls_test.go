@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPollResults(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "PollUser",
+		"token":      "poll-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "poll-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	// Polls received from other devices are recorded from their creation message
+	created := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	group := types.NewJID("120363313346913103", types.GroupServer)
+	mycli := &MyClient{db: s.db, userID: userID}
+	mycli.handlePollMessage(&events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: group, IsGroup: true, IsFromMe: true},
+			ID:            "POLL1",
+			Timestamp:     created,
+		},
+		Message: &waE2E.Message{PollCreationMessageV3: &waE2E.PollCreationMessage{
+			Name: proto.String("Lunch?"),
+			Options: []*waE2E.PollCreationMessage_Option{
+				{OptionName: proto.String("Pizza")},
+				{OptionName: proto.String("Sushi")},
+				{OptionName: proto.String("Tacos")},
+			},
+			SelectableOptionsCount: proto.Uint32(1),
+		}},
+	})
+
+	poll, err := getPoll(s.db, userID, "POLL1")
+	if err != nil {
+		t.Fatalf("Failed to get poll: %v", err)
+	}
+	if poll.Question != "Lunch?" || len(poll.Options) != 3 || poll.Chat != group.String() || !poll.FromMe {
+		t.Fatalf("Unexpected poll: %+v", poll)
+	}
+
+	hashes := whatsmeow.HashPollOptions([]string{"Pizza", "Sushi", "Tacos"})
+	vote := func(voter string, at time.Time, selected ...[]byte) []string {
+		names, err := applyPollVote(s.db, userID, poll, voter, selected, at)
+		if err != nil {
+			t.Fatalf("Failed to apply vote: %v", err)
+		}
+		return names
+	}
+	if names := vote("5491155550001@s.whatsapp.net", created.Add(time.Minute), hashes[1]); len(names) != 1 || names[0] != "Sushi" {
+		t.Errorf("Unexpected selected options: %v", names)
+	}
+	vote("5491155550002@s.whatsapp.net", created.Add(time.Minute), hashes[1])
+	vote("5491155550003@s.whatsapp.net", created.Add(time.Minute), hashes[2])
+	// A new vote replaces the previous one, an older one is ignored
+	vote("5491155550002@s.whatsapp.net", created.Add(3*time.Minute), hashes[0])
+	vote("5491155550002@s.whatsapp.net", created.Add(2*time.Minute), hashes[2])
+	// An empty selection removes the vote
+	vote("5491155550003@s.whatsapp.net", created.Add(4*time.Minute))
+
+	got := executeRequest(t, s, newRequest("2", "chat.poll.results", map[string]interface{}{
+		"token": "poll-token",
+		"id":    "POLL1",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, got, "2").(map[string]interface{})
+	if result["total_votes"] != float64(2) {
+		t.Errorf("Expected 2 votes, got %v", result["total_votes"])
+	}
+	expected := map[string][]string{
+		"Pizza": {"5491155550002@s.whatsapp.net"},
+		"Sushi": {"5491155550001@s.whatsapp.net"},
+		"Tacos": {},
+	}
+	results := result["results"].([]interface{})
+	if len(results) != 3 || results[0].(map[string]interface{})["option"] != "Pizza" {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+	for _, entry := range results {
+		option := entry.(map[string]interface{})
+		voters := option["voters"].([]interface{})
+		want := expected[option["option"].(string)]
+		if option["votes"] != float64(len(want)) || len(voters) != len(want) || (len(want) > 0 && voters[0] != want[0]) {
+			t.Errorf("Unexpected result for %v: %v", option["option"], option)
+		}
+	}
+
+	got = executeRequest(t, s, newRequest("3", "chat.poll.results", map[string]interface{}{
+		"token": "poll-token",
+		"id":    "UNKNOWN",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, got, "3", 404)
+}
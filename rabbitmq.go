@@ -153,9 +153,14 @@ func handleConnectionErrors() {
 			rabbitConn = conn
 			rabbitChannel = channel
 			rabbitEnabled = true
+			resetRabbitDeclarations()
 
 			log.Info().Msg("RabbitMQ reconnected successfully")
 
+			if rabbitCommandServer != nil {
+				go consumeRabbitCommands(rabbitCommandServer)
+			}
+
 			// Restart monitoring
 			go handleConnectionErrors()
 			return
@@ -168,6 +173,10 @@ func handleConnectionErrors() {
 
 // Optionally, allow overriding the queue per message
 func PublishToRabbit(data []byte, queueOverride ...string) error {
+	return publishToRabbit(data, "application/json", queueOverride...)
+}
+
+func publishToRabbit(data []byte, contentType string, queueOverride ...string) error {
 	if !rabbitEnabled {
 		return nil
 	}
@@ -194,7 +203,7 @@ func PublishToRabbit(data []byte, queueOverride ...string) error {
 		false,     // mandatory
 		false,     // immediate
 		amqp091.Publishing{
-			ContentType:  "application/json",
+			ContentType:  contentType,
 			Body:         data,
 			DeliveryMode: amqp091.Persistent,
 		},
@@ -207,7 +216,9 @@ func PublishToRabbit(data []byte, queueOverride ...string) error {
 	return err
 }
 
-func sendToGlobalRabbit(jsonData []byte, token string, userID string, queueName ...string) {
+// sendToGlobalRabbit publishes an event with the RabbitMQ settings of its user;
+// destination is the queue chosen by the sink override
+func sendToGlobalRabbit(event SinkEvent, destination string) error {
 	if !rabbitEnabled {
 		// Check if RabbitMQ is configured but disabled due to connection issues
 		rabbitURL := os.Getenv("RABBITMQ_URL")
@@ -229,39 +240,23 @@ func sendToGlobalRabbit(jsonData []byte, token string, userID string, queueName
 		} else {
 			log.Debug().Msg("RabbitMQ not configured. Event not published to queue.")
 		}
-		return
-	}
-
-	// Extract instance information
-	instance_name := ""
-	userinfo, found := userinfocache.Get(token)
-	if found {
-		instance_name = userinfo.(Values).Get("Name")
+		return nil
 	}
 
-	// Parse the original JSON into a map
-	var originalData map[string]interface{}
-	err := json.Unmarshal(jsonData, &originalData)
+	data, contentType, err := brokerMessage(event, rabbitFormat())
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to unmarshal original JSON data for RabbitMQ")
-		return
+		log.Error().Err(err).Msg("Failed to build RabbitMQ message")
+		return err
 	}
 
-	// Add the new fields directly to the original data
-	originalData["userID"] = userID
-	originalData["instanceName"] = instance_name
-
-	// Marshal back to JSON
-	enhancedJSON, err := json.Marshal(originalData)
+	config, err := getRabbitConfig(rabbitConfigDB, event.UserID)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to marshal enhanced data for RabbitMQ")
-		return
+		log.Error().Err(err).Str("userID", event.UserID).Msg("Failed to load RabbitMQ configuration")
 	}
-
-	err = PublishToRabbit(enhancedJSON, queueName...)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to publish to RabbitMQ")
+	if config.isDefault() {
+		return publishToRabbit(data, contentType, destination)
 	}
+	return publishToRabbitRoute(config, event, destination, data, contentType)
 }
 
 func PublishFileErrorToQueue(payload WebhookFileErrorPayload) {
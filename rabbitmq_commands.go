@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+// rabbitCommandServer is the server commands are executed on; it is set when the
+// consumer starts so the consumer can be restarted after a reconnection
+var rabbitCommandServer *server
+
+// rabbitCommand is a message of the command queue. The method names and params
+// are those of stdio mode; the instance is given by userID or token.
+type rabbitCommand struct {
+	ID     json.RawMessage        `json:"id,omitempty"`
+	UserID string                 `json:"userID"`
+	Token  string                 `json:"token"`
+	Method string                 `json:"method"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// StartRabbitCommandConsumer consumes the command queue (RABBITMQ_COMMAND_QUEUE)
+// when RabbitMQ is connected
+func StartRabbitCommandConsumer(s *server) {
+	if *rabbitCommandQueue == "" {
+		return
+	}
+	rabbitCommandServer = s
+	if !rabbitEnabled {
+		log.Warn().Str("queue", *rabbitCommandQueue).Msg("RabbitMQ is not connected. Command consumer not started.")
+		return
+	}
+	go consumeRabbitCommands(s)
+}
+
+// consumeRabbitCommands consumes the command queue on the current connection. A
+// channel closed or a consumer cancelled by the broker, such as when the queue is
+// deleted, is reopened; when the connection closes, the reconnection restarts the
+// consumer.
+func consumeRabbitCommands(s *server) {
+	conn := rabbitConn
+	for {
+		consumeRabbitCommandChannel(s, conn)
+		if conn.IsClosed() {
+			log.Warn().Str("queue", *rabbitCommandQueue).Msg("RabbitMQ command consumer stopped")
+			return
+		}
+		log.Warn().Str("queue", *rabbitCommandQueue).Dur("retry_in", retryInterval).Msg("RabbitMQ command consumer stopped, reopening")
+		time.Sleep(retryInterval)
+	}
+}
+
+// consumeRabbitCommandChannel runs the command workers on a channel of its own
+// until the channel closes or the broker cancels the consumer. The prefetch equals
+// the number of workers, so the broker holds back the commands that cannot be
+// executed yet.
+func consumeRabbitCommandChannel(s *server, conn *amqp091.Connection) {
+	workers := *rabbitCommandWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not open RabbitMQ channel for commands")
+		return
+	}
+	defer ch.Close()
+	closed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+	cancelled := ch.NotifyCancel(make(chan string, 1))
+
+	queue := *rabbitCommandQueue
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		log.Error().Err(err).Str("queue", queue).Msg("Could not declare RabbitMQ command queue")
+		return
+	}
+	if err := ch.Qos(workers, 0, false); err != nil {
+		log.Error().Err(err).Msg("Could not set RabbitMQ command prefetch")
+		return
+	}
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		log.Error().Err(err).Str("queue", queue).Msg("Could not consume RabbitMQ command queue")
+		return
+	}
+
+	log.Info().Str("queue", queue).Int("workers", workers).Msg("RabbitMQ command consumer started")
+
+	go func() {
+		select {
+		case err, ok := <-closed:
+			if ok {
+				log.Error().Err(err).Str("queue", queue).Msg("RabbitMQ command channel closed")
+			}
+		case tag := <-cancelled:
+			// The deliveries end too, so the workers finish those received and return
+			log.Error().Str("queue", queue).Str("consumer", tag).Msg("RabbitMQ command consumer cancelled by the broker")
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivery := range deliveries {
+				handleRabbitCommand(s, delivery)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// handleRabbitCommand executes one command, publishes the reply when reply_to is
+// set and acknowledges it. Failed commands are answered, not requeued.
+func handleRabbitCommand(s *server, delivery amqp091.Delivery) {
+	reply := executeRabbitCommand(s, delivery.Body, delivery.CorrelationId)
+
+	if delivery.ReplyTo != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := rabbitChannel.PublishWithContext(ctx, "", delivery.ReplyTo, false, false, amqp091.Publishing{
+			ContentType:   "application/json",
+			CorrelationId: delivery.CorrelationId,
+			Body:          reply,
+		})
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Str("replyTo", delivery.ReplyTo).Msg("Could not publish RabbitMQ command reply")
+		}
+	}
+
+	if err := delivery.Ack(false); err != nil {
+		log.Error().Err(err).Msg("Could not acknowledge RabbitMQ command")
+	}
+}
+
+// executeRabbitCommand runs a command through the stdio method mapping and returns
+// the JSON-RPC response. Without an id the correlation_id is used as request id.
+func executeRabbitCommand(s *server, body []byte, correlationID string) []byte {
+	var response bytes.Buffer
+	rpc := newStdioServerWithIO(s, nil, &response)
+
+	var command rabbitCommand
+	if err := json.Unmarshal(body, &command); err != nil {
+		rpc.sendError(ID{Str: correlationID, IsString: true, IsSet: correlationID != ""}, 400, "invalid command: "+err.Error())
+		return bytes.TrimSpace(response.Bytes())
+	}
+
+	id := command.ID
+	if len(id) == 0 || string(id) == "null" {
+		id, _ = json.Marshal(correlationID)
+	}
+	var requestID ID
+	_ = json.Unmarshal(id, &requestID)
+
+	if strings.HasPrefix(command.Method, "admin.") {
+		rpc.sendError(requestID, 403, "admin methods are not available through RabbitMQ")
+		return bytes.TrimSpace(response.Bytes())
+	}
+
+	token := command.Token
+	if token == "" {
+		err := s.db.Get(&token, "SELECT token FROM users WHERE id = $1", command.UserID)
+		if err == sql.ErrNoRows || (err == nil && token == "") {
+			rpc.sendError(requestID, 404, "unknown userID")
+			return bytes.TrimSpace(response.Bytes())
+		}
+		if err != nil {
+			log.Error().Err(err).Str("userID", command.UserID).Msg("Failed to look up user of RabbitMQ command")
+			rpc.sendError(requestID, 500, "failed to look up user")
+			return bytes.TrimSpace(response.Bytes())
+		}
+	}
+	rpc.token = token
+
+	request, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  command.Method,
+		"params":  command.Params,
+	})
+	if err != nil {
+		rpc.sendError(requestID, 400, "invalid command: "+err.Error())
+		return bytes.TrimSpace(response.Bytes())
+	}
+
+	rpc.handleRequest(request)
+	return bytes.TrimSpace(response.Bytes())
+}
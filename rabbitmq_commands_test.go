@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExecuteRabbitCommand(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "CommandUser",
+		"token":      "command-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "command-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	decode := func(reply []byte) map[string]interface{} {
+		t.Helper()
+		var response map[string]interface{}
+		if err := json.Unmarshal(reply, &response); err != nil {
+			t.Fatalf("Invalid reply %s: %v", reply, err)
+		}
+		if response["jsonrpc"] != "2.0" {
+			t.Fatalf("Expected a JSON-RPC 2.0 reply, got %v", response)
+		}
+		return response
+	}
+
+	// Without an id the correlation_id identifies the reply
+	reply := decode(executeRabbitCommand(s, []byte(`{"userID":"`+userID+`","method":"webhook.endpoints.list"}`), "corr-1"))
+	if reply["id"] != "corr-1" || reply["error"] != nil {
+		t.Errorf("Expected a successful reply to corr-1, got %v", reply)
+	}
+
+	reply = decode(executeRabbitCommand(s, []byte(`{"id":42,"token":"command-token","method":"webhook.endpoints.list"}`), "corr-2"))
+	if reply["id"] != float64(42) || reply["error"] != nil {
+		t.Errorf("Expected a successful reply to id 42, got %v", reply)
+	}
+
+	errorCode := func(reply map[string]interface{}) float64 {
+		t.Helper()
+		rpcError, ok := reply["error"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("Expected an error reply, got %v", reply)
+		}
+		return rpcError["code"].(float64)
+	}
+
+	if code := errorCode(decode(executeRabbitCommand(s, []byte(`{"userID":"nobody","method":"session.status"}`), "corr-3"))); code != 404 {
+		t.Errorf("Expected 404 for an unknown user, got %v", code)
+	}
+	if code := errorCode(decode(executeRabbitCommand(s, []byte(`{"userID":"`+userID+`","method":"admin.users.list","params":{"adminToken":"test-admin-token"}}`), "corr-4"))); code != 403 {
+		t.Errorf("Expected 403 for admin methods, got %v", code)
+	}
+	invalid := decode(executeRabbitCommand(s, []byte(`not json`), "corr-5"))
+	if code := errorCode(invalid); code != 400 || invalid["id"] != "corr-5" {
+		t.Errorf("Expected 400 for corr-5, got %v", invalid)
+	}
+	if code := errorCode(decode(executeRabbitCommand(s, []byte(`{"userID":"`+userID+`","method":"no.such.method"}`), "corr-6"))); code != 404 {
+		t.Errorf("Expected 404 for an unknown method, got %v", code)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	rabbitExchangeTypeDefault = "topic"
+	rabbitQueueTypeClassic    = "classic"
+	rabbitQueueTypeQuorum     = "quorum"
+	rabbitRoutingKeyDefault   = "{userID}.{eventType}"
+)
+
+var (
+	supportedRabbitExchangeTypes = []string{"", "direct", "topic", "fanout", "headers"}
+	supportedRabbitQueueTypes    = []string{"", rabbitQueueTypeClassic, rabbitQueueTypeQuorum}
+
+	rabbitTemplatePlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+	rabbitRoutingPlaceholders = []string{"{userID}", "{eventType}", "{instanceName}"}
+	rabbitQueuePlaceholders   = []string{"{userID}", "{instanceName}"}
+)
+
+// rabbitConfigDB is used to look up the RabbitMQ settings of each user; nil uses the global queue
+var rabbitConfigDB *sqlx.DB
+
+// rabbitConfigCache holds the RabbitMQ settings of each user, keyed by user ID
+var rabbitConfigCache = cache.New(5*time.Minute, 10*time.Minute)
+
+// rabbitDeclared remembers the exchanges, queues and bindings declared on the current connection
+var rabbitDeclared sync.Map
+
+// RabbitConfig is the RabbitMQ routing of one instance. Without an exchange events
+// go through the default exchange to the queue; with one they are published with
+// a routing key rendered from the template, and the queue, if any, is bound to it.
+type RabbitConfig struct {
+	Exchange     string `json:"exchange" db:"exchange"`
+	ExchangeType string `json:"exchange_type" db:"exchange_type"`
+	RoutingKey   string `json:"routing_key" db:"routing_key"`
+	Queue        string `json:"queue" db:"queue"`
+	QueueType    string `json:"queue_type" db:"queue_type"`
+	Durable      bool   `json:"durable" db:"durable"`
+	MessageTTL   int    `json:"message_ttl" db:"message_ttl"` // milliseconds, 0 keeps messages until consumed
+}
+
+// isDefault reports whether the user keeps the global RabbitMQ settings
+func (c RabbitConfig) isDefault() bool {
+	return c.Exchange == "" && c.Queue == "" && c.QueueType == "" && c.MessageTTL == 0
+}
+
+// withDefaults fills in the exchange type and routing key of an exchange
+func (c RabbitConfig) withDefaults() RabbitConfig {
+	if c.Exchange != "" {
+		if c.ExchangeType == "" {
+			c.ExchangeType = rabbitExchangeTypeDefault
+		}
+		if c.RoutingKey == "" {
+			c.RoutingKey = rabbitRoutingKeyDefault
+		}
+	}
+	if c.QueueType == "" {
+		c.QueueType = rabbitQueueTypeClassic
+	}
+	return c
+}
+
+// rabbitTenantPrefix returns the prefix the exchange and queue names of an instance
+// must have: the global queue followed by the user ID, as for its sink destinations
+func rabbitTenantPrefix(userID string) string {
+	return tenantSinkPrefix(sinkNameRabbitMQ, userID)
+}
+
+// checkRabbitName returns an error unless name is the prefix of the instance or
+// starts with it followed by a dot
+func checkRabbitName(field string, name string, userID string) error {
+	prefix := rabbitTenantPrefix(userID)
+	if name != prefix && !strings.HasPrefix(name, prefix+".") {
+		return fmt.Errorf("%s must be %s or start with %q", field, prefix, prefix+".")
+	}
+	if *rabbitCommandQueue != "" && name == *rabbitCommandQueue {
+		return fmt.Errorf("%s %q is the command queue", field, name)
+	}
+	return nil
+}
+
+// validate checks a configuration of a user before it is saved
+func (c RabbitConfig) validate(userID string) error {
+	if !Find(supportedRabbitExchangeTypes, c.ExchangeType) {
+		return errors.New("invalid exchange_type. Use: direct, topic, fanout or headers")
+	}
+	if !Find(supportedRabbitQueueTypes, c.QueueType) {
+		return errors.New("invalid queue_type. Use: classic or quorum")
+	}
+	if strings.HasPrefix(c.Exchange, "amq.") {
+		return errors.New("exchange names starting with amq. are reserved")
+	}
+	if c.Exchange == "" && (c.ExchangeType != "" || c.RoutingKey != "") {
+		return errors.New("exchange_type and routing_key require an exchange")
+	}
+	// The global queue is shared, so its arguments cannot be changed for one instance
+	if c.Exchange == "" && c.Queue == "" && (c.QueueType != "" || c.MessageTTL != 0 || !c.Durable) {
+		return errors.New("queue_type, durable and message_ttl require a queue or an exchange")
+	}
+	if c.QueueType == rabbitQueueTypeQuorum && !c.Durable {
+		return errors.New("quorum queues must be durable")
+	}
+	if c.MessageTTL < 0 {
+		return errors.New("message_ttl must not be negative")
+	}
+	if err := checkRabbitTemplate(c.RoutingKey, rabbitRoutingPlaceholders); err != nil {
+		return fmt.Errorf("invalid routing_key: %w", err)
+	}
+	if err := checkRabbitTemplate(c.Queue, rabbitQueuePlaceholders); err != nil {
+		return fmt.Errorf("invalid queue: %w", err)
+	}
+	if c.Exchange != "" {
+		if err := checkRabbitName("exchange", c.Exchange, userID); err != nil {
+			return err
+		}
+	}
+	if c.Queue != "" {
+		if err := checkRabbitName("queue", strings.ReplaceAll(c.Queue, "{userID}", userID), userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRabbitTemplate(template string, allowed []string) error {
+	for _, placeholder := range rabbitTemplatePlaceholder.FindAllString(template, -1) {
+		if !Find(allowed, placeholder) {
+			return fmt.Errorf("unknown placeholder %s, use %s", placeholder, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// renderRabbitTemplate replaces the placeholders of a routing key or queue template
+func renderRabbitTemplate(template string, event SinkEvent) string {
+	return strings.NewReplacer(
+		"{userID}", event.UserID,
+		"{eventType}", event.Type,
+		"{instanceName}", event.InstanceName,
+	).Replace(template)
+}
+
+// rabbitRoute is where one event is published and which queue receives it
+type rabbitRoute struct {
+	Exchange   string
+	RoutingKey string
+	Queue      string
+	BindingKey string
+}
+
+// route resolves the exchange, routing key and queue of an event. destination is
+// the queue chosen by the sink override, used when the config names no queue.
+func (c RabbitConfig) route(event SinkEvent, destination string) rabbitRoute {
+	c = c.withDefaults()
+
+	queue := renderRabbitTemplate(c.Queue, event)
+	if queue == "" {
+		queue = destination
+	}
+
+	if c.Exchange == "" {
+		if queue == "" {
+			queue = rabbitQueue
+		}
+		return rabbitRoute{RoutingKey: queue, Queue: queue}
+	}
+
+	route := rabbitRoute{
+		Exchange:   c.Exchange,
+		RoutingKey: renderRabbitTemplate(c.RoutingKey, event),
+		Queue:      queue,
+	}
+	if queue != "" {
+		// A topic binding covers every event type of the instance; other exchange
+		// types are bound with the exact key the first time it is used
+		route.BindingKey = route.RoutingKey
+		if c.ExchangeType == "topic" {
+			wildcard := event
+			wildcard.Type = "*"
+			route.BindingKey = renderRabbitTemplate(c.RoutingKey, wildcard)
+		}
+	}
+	return route
+}
+
+// queueArgs returns the x-arguments of the queue declaration
+func (c RabbitConfig) queueArgs() amqp091.Table {
+	args := amqp091.Table{}
+	if c.QueueType == rabbitQueueTypeQuorum {
+		args["x-queue-type"] = rabbitQueueTypeQuorum
+	}
+	if c.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(c.MessageTTL)
+	}
+	return args
+}
+
+// getRabbitConfig returns the RabbitMQ settings of a user, using the cache when possible
+func getRabbitConfig(db *sqlx.DB, userID string) (RabbitConfig, error) {
+	if cached, found := rabbitConfigCache.Get(userID); found {
+		return cached.(RabbitConfig), nil
+	}
+
+	config := RabbitConfig{Durable: true}
+	if db == nil {
+		return config, nil
+	}
+	err := db.Get(&config, `
+		SELECT
+			COALESCE(rabbitmq_exchange, '') AS exchange,
+			COALESCE(rabbitmq_exchange_type, '') AS exchange_type,
+			COALESCE(rabbitmq_routing_key, '') AS routing_key,
+			COALESCE(rabbitmq_queue, '') AS queue,
+			COALESCE(rabbitmq_queue_type, '') AS queue_type,
+			COALESCE(rabbitmq_durable, true) AS durable,
+			COALESCE(rabbitmq_message_ttl, 0) AS message_ttl
+		FROM users WHERE id = $1`, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return RabbitConfig{Durable: true}, err
+	}
+	// Configurations saved before the checks existed are not trusted
+	if !config.isDefault() {
+		if err := config.validate(userID); err != nil {
+			log.Warn().Err(err).Str("userID", userID).Msg("Ignoring invalid RabbitMQ configuration")
+			config = RabbitConfig{Durable: true}
+		}
+	}
+
+	rabbitConfigCache.Set(userID, config, cache.DefaultExpiration)
+	return config, nil
+}
+
+// declareRabbitRoute declares the exchange, queue and binding of a route once per
+// connection. It uses a channel of its own because a declaration that conflicts
+// with an existing object closes the channel. Only the queue of the configuration
+// gets its type, durability and TTL; the global queue and sink destinations are
+// declared as publishToRabbit does.
+func declareRabbitRoute(config RabbitConfig, route rabbitRoute) error {
+	config = config.withDefaults()
+	durable, args := true, amqp091.Table(nil)
+	if config.Queue != "" {
+		durable, args = config.Durable, config.queueArgs()
+	}
+	key := strings.Join([]string{route.Exchange, config.ExchangeType, route.Queue, route.BindingKey, fmt.Sprint(args), strconv.FormatBool(durable)}, "|")
+	if _, done := rabbitDeclared.Load(key); done {
+		return nil
+	}
+	if rabbitConn == nil || rabbitConn.IsClosed() {
+		return errors.New("RabbitMQ is not connected")
+	}
+
+	ch, err := rabbitConn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if route.Exchange != "" {
+		if err := ch.ExchangeDeclare(route.Exchange, config.ExchangeType, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("declare exchange %s: %w", route.Exchange, err)
+		}
+	}
+	if route.Queue != "" {
+		if _, err := ch.QueueDeclare(route.Queue, durable, false, false, false, args); err != nil {
+			return fmt.Errorf("declare queue %s: %w", route.Queue, err)
+		}
+		if route.Exchange != "" {
+			if err := ch.QueueBind(route.Queue, route.BindingKey, route.Exchange, false, nil); err != nil {
+				return fmt.Errorf("bind queue %s: %w", route.Queue, err)
+			}
+		}
+	}
+
+	rabbitDeclared.Store(key, true)
+	log.Info().
+		Str("exchange", route.Exchange).
+		Str("queue", route.Queue).
+		Str("binding", route.BindingKey).
+		Msg("Declared RabbitMQ route")
+	return nil
+}
+
+// resetRabbitDeclarations forgets the declarations of a closed connection
+func resetRabbitDeclarations() {
+	rabbitDeclared.Range(func(key, _ interface{}) bool {
+		rabbitDeclared.Delete(key)
+		return true
+	})
+}
+
+// publishToRabbitRoute publishes an event with the RabbitMQ settings of its user
+func publishToRabbitRoute(config RabbitConfig, event SinkEvent, destination string, data []byte, contentType string) error {
+	route := config.route(event, destination)
+	if err := declareRabbitRoute(config, route); err != nil {
+		log.Error().Err(err).Str("userID", event.UserID).Msg("Could not declare RabbitMQ route")
+		return err
+	}
+
+	publishing := amqp091.Publishing{
+		ContentType:  contentType,
+		Body:         data,
+		DeliveryMode: amqp091.Persistent,
+		Type:         event.Type,
+	}
+	if !config.Durable {
+		publishing.DeliveryMode = amqp091.Transient
+	}
+	if config.MessageTTL > 0 {
+		publishing.Expiration = strconv.Itoa(config.MessageTTL)
+	}
+
+	err := rabbitChannel.Publish(route.Exchange, route.RoutingKey, false, false, publishing)
+	if err != nil {
+		log.Error().Err(err).Str("exchange", route.Exchange).Str("routingKey", route.RoutingKey).Msg("Could not publish to RabbitMQ")
+	} else {
+		log.Debug().Str("exchange", route.Exchange).Str("routingKey", route.RoutingKey).Msg("Published message to RabbitMQ")
+	}
+	return err
+}
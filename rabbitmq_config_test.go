@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+)
+
+// useRabbitQueue sets the global RabbitMQ queue for the duration of a test
+func useRabbitQueue(t *testing.T, queue string) {
+	previous := rabbitQueue
+	rabbitQueue = queue
+	t.Cleanup(func() { rabbitQueue = previous })
+}
+
+func TestRabbitConfigRoute(t *testing.T) {
+	useRabbitQueue(t, "whatsapp_events")
+	event := SinkEvent{UserID: "user1", InstanceName: "Sales", Type: "ReadReceipt"}
+
+	legacy := RabbitConfig{Durable: true}
+	if !legacy.isDefault() {
+		t.Fatal("Expected an empty config to keep the global queue")
+	}
+	if route := legacy.route(event, "tenant-queue"); route.Exchange != "" || route.Queue != "tenant-queue" || route.RoutingKey != "tenant-queue" {
+		t.Errorf("Expected the sink destination as queue, got %+v", route)
+	}
+
+	topic := RabbitConfig{Exchange: "whatsapp_events.user1", Queue: "whatsapp_events.{userID}.events", Durable: true, QueueType: rabbitQueueTypeQuorum, MessageTTL: 60000}
+	route := topic.route(event, "ignored")
+	if route.Exchange != "whatsapp_events.user1" || route.RoutingKey != "user1.ReadReceipt" || route.Queue != "whatsapp_events.user1.events" || route.BindingKey != "user1.*" {
+		t.Errorf("Unexpected topic route: %+v", route)
+	}
+	args := topic.queueArgs()
+	if args["x-queue-type"] != rabbitQueueTypeQuorum || args["x-message-ttl"] != int64(60000) {
+		t.Errorf("Unexpected queue arguments: %v", args)
+	}
+
+	if err := topic.validate("user1"); err != nil {
+		t.Errorf("Expected the topic config to be valid, got %v", err)
+	}
+
+	direct := RabbitConfig{Exchange: "whatsapp_events.user1.direct", ExchangeType: "direct", RoutingKey: "{instanceName}-{eventType}", Queue: "whatsapp_events.user1.sales"}
+	if route := direct.route(event, ""); route.RoutingKey != "Sales-ReadReceipt" || route.BindingKey != "Sales-ReadReceipt" {
+		t.Errorf("Expected a direct binding on the exact key, got %+v", route)
+	}
+
+	exchangeOnly := RabbitConfig{Exchange: "whatsapp_events.user1"}
+	if route := exchangeOnly.route(event, ""); route.Queue != "" || route.BindingKey != "" {
+		t.Errorf("Expected no queue without one configured, got %+v", route)
+	}
+
+	invalid := []RabbitConfig{
+		{Exchange: "amq.topic", Durable: true},
+		{RoutingKey: "{userID}", Durable: true},
+		{Exchange: "whatsapp_events.user1", ExchangeType: "random", Durable: true},
+		{Queue: "whatsapp_events.user1", QueueType: rabbitQueueTypeQuorum},
+		{Queue: "whatsapp_events.user1.{eventType}", Durable: true},
+		{Exchange: "whatsapp_events.user1", RoutingKey: "{tenant}", Durable: true},
+		{Queue: "whatsapp_events.user1", MessageTTL: -1, Durable: true},
+		// The global queue must not be declared with the arguments of one instance
+		{MessageTTL: 60000, Durable: true},
+		{QueueType: rabbitQueueTypeQuorum, Durable: true},
+		{Durable: false},
+		// Names of other instances, or of the server
+		{Exchange: "wuzapi.events", Durable: true},
+		{Queue: "whatsapp_events", Durable: true},
+		{Queue: "whatsapp_events.user2", Durable: true},
+		{Queue: "whatsapp_events.user1x", Durable: true},
+		{Exchange: "whatsapp_events.{userID}", Durable: true},
+	}
+	for _, config := range invalid {
+		if err := config.validate("user1"); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestRabbitMQConfigEndpoints(t *testing.T) {
+	useRabbitQueue(t, "whatsapp_events")
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "RabbitUser",
+		"token":      "rabbit-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "rabbit-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+	t.Cleanup(func() { rabbitConfigCache.Delete(userID) })
+
+	getResponse := executeRequest(t, s, newRequest("2", "session.rabbitmq.config.get", map[string]interface{}{
+		"token": "rabbit-token",
+	}).toJSON(t))
+	if result := assertJSONRPC20Success(t, getResponse, "2").(map[string]interface{}); result["default"] != true {
+		t.Fatalf("Expected the default configuration, got %v", result)
+	}
+
+	invalid := executeRequest(t, s, newRequest("3", "session.rabbitmq.config", map[string]interface{}{
+		"token":      "rabbit-token",
+		"queue":      "events",
+		"queue_type": "quorum",
+		"durable":    false,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, invalid, "3", 400)
+
+	foreign := executeRequest(t, s, newRequest("3.1", "session.rabbitmq.config", map[string]interface{}{
+		"token":    "rabbit-token",
+		"exchange": "wuzapi.events",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, foreign, "3.1", 400)
+	ttlOnly := executeRequest(t, s, newRequest("3.2", "session.rabbitmq.config", map[string]interface{}{
+		"token":       "rabbit-token",
+		"message_ttl": 60000,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, ttlOnly, "3.2", 400)
+
+	saved := executeRequest(t, s, newRequest("4", "session.rabbitmq.config", map[string]interface{}{
+		"token":       "rabbit-token",
+		"exchange":    "whatsapp_events." + userID,
+		"queue":       "whatsapp_events.{userID}.events",
+		"queue_type":  "quorum",
+		"message_ttl": 3600000,
+	}).toJSON(t))
+	assertJSONRPC20Success(t, saved, "4")
+
+	config, err := getRabbitConfig(s.db, userID)
+	if err != nil {
+		t.Fatalf("Failed to load RabbitMQ config: %v", err)
+	}
+	if config.Exchange != "whatsapp_events."+userID || !config.Durable || config.QueueType != rabbitQueueTypeQuorum || config.MessageTTL != 3600000 {
+		t.Fatalf("Unexpected stored config: %+v", config)
+	}
+
+	getResponse = executeRequest(t, s, newRequest("5", "session.rabbitmq.config.get", map[string]interface{}{
+		"token": "rabbit-token",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, getResponse, "5").(map[string]interface{})
+	returned := result["config"].(map[string]interface{})
+	if result["default"] != false || returned["routing_key"] != rabbitRoutingKeyDefault || returned["exchange_type"] != "topic" {
+		t.Errorf("Expected defaults to be filled in, got %v", result)
+	}
+
+	// A config saved before the checks existed falls back to the global queue
+	if _, err := s.db.Exec("UPDATE users SET rabbitmq_exchange = '', rabbitmq_queue = '' WHERE id = $1", userID); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+	rabbitConfigCache.Delete(userID)
+	if config, err := getRabbitConfig(s.db, userID); err != nil || !config.isDefault() {
+		t.Errorf("Expected an invalid stored config to be ignored, got %+v (%v)", config, err)
+	}
+
+	deleted := executeRequest(t, s, newRequest("6", "session.rabbitmq.config.delete", map[string]interface{}{
+		"token": "rabbit-token",
+	}).toJSON(t))
+	assertJSONRPC20Success(t, deleted, "6")
+	if config, err := getRabbitConfig(s.db, userID); err != nil || !config.isDefault() {
+		t.Errorf("Expected the default configuration after delete, got %+v (%v)", config, err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStreamClient is the part of *redis.Client used by the sink, so tests can use a fake
+type redisStreamClient interface {
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	Close() error
+}
+
+// redisSink appends events to a Redis Stream (REDIS_URL), trimmed to about maxLen entries
+type redisSink struct {
+	client redisStreamClient
+	stream string
+	maxLen int64
+}
+
+func newRedisSink(url string, stream string, maxLen int64) (*redisSink, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &redisSink{client: redis.NewClient(options), stream: stream, maxLen: maxLen}, nil
+}
+
+func (rs *redisSink) Name() string               { return sinkNameRedis }
+func (rs *redisSink) Enabled() bool              { return true }
+func (rs *redisSink) DefaultDestination() string { return rs.stream }
+func (rs *redisSink) Close() error               { return rs.client.Close() }
+
+func (rs *redisSink) Publish(ctx context.Context, event SinkEvent, destination string) error {
+	data, contentType, err := brokerMessage(event, *eventSinkFormat)
+	if err != nil {
+		return err
+	}
+
+	stream := rs.stream
+	if destination != "" {
+		stream = destination
+	}
+
+	return rs.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: rs.maxLen,
+		Approx: rs.maxLen > 0,
+		Values: map[string]interface{}{
+			"type":         event.Type,
+			"userID":       event.UserID,
+			"instanceName": event.InstanceName,
+			"contentType":  contentType,
+			"data":         data,
+		},
+	}).Err()
+}
@@ -57,6 +57,15 @@ func (s *server) routes() {
 	adminRoutes.Handle("/users/{id}", s.EditUser()).Methods("PUT")
 	adminRoutes.Handle("/users/{id}", s.DeleteUser()).Methods("DELETE")
 	adminRoutes.Handle("/users/{id}/full", s.DeleteUserComplete()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/retention", s.GetRetentionPolicies()).Methods("GET")
+	adminRoutes.Handle("/users/{id}/retention", s.SetRetentionPolicy()).Methods("PUT")
+	adminRoutes.Handle("/users/{id}/retention", s.DeleteRetentionPolicy()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/retention/preview", s.PreviewRetentionPolicy()).Methods("POST")
+	adminRoutes.Handle("/users/{id}/sinks", s.GetAdminEventSinks()).Methods("GET")
+	adminRoutes.Handle("/users/{id}/sinks", s.SetAdminEventSinks()).Methods("PUT")
+	adminRoutes.Handle("/users/{id}/sinks", s.DeleteAdminEventSinks()).Methods("DELETE")
+	adminRoutes.Handle("/webhooks/breakers", s.ListWebhookBreakers()).Methods("GET")
+	adminRoutes.Handle("/webhooks/dead-letters/replay", s.ReplayWebhookDeadLetters()).Methods("POST")
 
 	c := alice.New()
 	c = c.Append(s.authalice)
@@ -90,6 +99,16 @@ func (s *server) routes() {
 	s.router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
 	s.router.Handle("/webhook", c.Then(s.DeleteWebhook())).Methods("DELETE")
 	s.router.Handle("/webhook", c.Then(s.UpdateWebhook())).Methods("PUT")
+	s.router.Handle("/webhook/deliveries", c.Then(s.GetWebhookDeliveries())).Methods("GET")
+	s.router.Handle("/webhook/deliveries/{id}/replay", c.Then(s.ReplayWebhookDelivery())).Methods("POST")
+	s.router.Handle("/webhook/endpoints", c.Then(s.ListWebhookEndpoints())).Methods("GET")
+	s.router.Handle("/webhook/endpoints", c.Then(s.AddWebhookEndpoint())).Methods("POST")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.GetWebhookEndpoint())).Methods("GET")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.UpdateWebhookEndpoint())).Methods("PUT")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.DeleteWebhookEndpoint())).Methods("DELETE")
+
+	s.router.Handle("/events/stream", c.Then(s.StreamEvents())).Methods("GET")
+	s.router.Handle("/ws", c.Then(s.WebSocket())).Methods("GET")
 
 	s.router.Handle("/session/proxy", c.Then(s.SetProxy())).Methods("POST")
 	s.router.Handle("/session/history", c.Then(s.SetHistory())).Methods("POST")
@@ -103,22 +122,61 @@ func (s *server) routes() {
 	s.router.Handle("/session/hmac/config", c.Then(s.GetHmacConfig())).Methods("GET")
 	s.router.Handle("/session/hmac/config", c.Then(s.DeleteHmacConfig())).Methods("DELETE")
 
-	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
+	s.router.Handle("/session/sinks", c.Then(s.GetEventSinks())).Methods("GET")
+	s.router.Handle("/session/sinks", c.Then(s.SetEventSinks())).Methods("POST")
+	s.router.Handle("/session/sinks", c.Then(s.DeleteEventSinks())).Methods("DELETE")
+
+	s.router.Handle("/session/rabbitmq/config", c.Then(s.ConfigureRabbitMQ())).Methods("POST")
+	s.router.Handle("/session/rabbitmq/config", c.Then(s.GetRabbitMQConfig())).Methods("GET")
+	s.router.Handle("/session/rabbitmq/config", c.Then(s.DeleteRabbitMQConfig())).Methods("DELETE")
+
+	s.router.Handle("/session/sendqueue/config", c.Then(s.ConfigureSendQueue())).Methods("POST")
+	s.router.Handle("/session/sendqueue/config", c.Then(s.GetSendQueueConfig())).Methods("GET")
+
+	s.router.Handle("/chat/send/text", c.Then(s.sendRoute("text", s.SendMessage()))).Methods("POST")
 	s.router.Handle("/chat/delete", c.Then(s.DeleteMessage())).Methods("POST")
-	s.router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
-	s.router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
-	s.router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
+	s.router.Handle("/chat/send/image", c.Then(s.sendRoute("image", s.SendImage()))).Methods("POST")
+	s.router.Handle("/chat/send/audio", c.Then(s.sendRoute("audio", s.SendAudio()))).Methods("POST")
+	s.router.Handle("/chat/send/document", c.Then(s.sendRoute("document", s.SendDocument()))).Methods("POST")
 	//	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
-	s.router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
-	s.router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
-	s.router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
-	s.router.Handle("/chat/send/contact", c.Then(s.SendContact())).Methods("POST")
+	s.router.Handle("/chat/send/video", c.Then(s.sendRoute("video", s.SendVideo()))).Methods("POST")
+	s.router.Handle("/chat/send/sticker", c.Then(s.sendRoute("sticker", s.SendSticker()))).Methods("POST")
+	s.router.Handle("/chat/send/location", c.Then(s.sendRoute("location", s.SendLocation()))).Methods("POST")
+	s.router.Handle("/chat/send/contact", c.Then(s.sendRoute("contact", s.SendContact()))).Methods("POST")
 	s.router.Handle("/chat/react", c.Then(s.React())).Methods("POST")
-	s.router.Handle("/chat/send/buttons", c.Then(s.SendButtons())).Methods("POST")
-	s.router.Handle("/chat/send/list", c.Then(s.SendList())).Methods("POST")
-	s.router.Handle("/chat/send/poll", c.Then(s.SendPoll())).Methods("POST")
-	s.router.Handle("/chat/send/edit", c.Then(s.SendEditMessage())).Methods("POST")
+	s.router.Handle("/chat/send/buttons", c.Then(s.sendRoute("buttons", s.SendButtons()))).Methods("POST")
+	s.router.Handle("/chat/send/list", c.Then(s.sendRoute("list", s.SendList()))).Methods("POST")
+	s.router.Handle("/chat/send/poll", c.Then(s.sendRoute("poll", s.SendPoll()))).Methods("POST")
+	s.router.Handle("/chat/send/edit", c.Then(s.idempotent(s.SendEditMessage()))).Methods("POST")
+	s.router.Handle("/chat/send/template-stored", c.Then(s.idempotent(s.SendStoredTemplate()))).Methods("POST")
 	s.router.Handle("/chat/history", c.Then(s.GetHistory())).Methods("GET")
+	s.router.Handle("/chat/history/search", c.Then(s.SearchHistory())).Methods("GET")
+	s.router.Handle("/chat/history/export", c.Then(s.ExportHistory())).Methods("GET")
+	s.router.Handle("/chat/list", c.Then(s.ListChats())).Methods("GET")
+	s.router.Handle("/chat/jobs/{id}", c.Then(s.GetSendJob())).Methods("GET")
+	s.router.Handle("/chat/message/{id}/status", c.Then(s.GetMessageStatus())).Methods("GET")
+	s.router.Handle("/chat/message/status", c.Then(s.QueryMessageStatus())).Methods("POST")
+	s.router.Handle("/chat/poll/{id}/results", c.Then(s.GetPollResults())).Methods("GET")
+
+	s.router.Handle("/chat/schedule", c.Then(s.ScheduleMessage())).Methods("POST")
+	s.router.Handle("/chat/schedule", c.Then(s.ListScheduledMessages())).Methods("GET")
+	s.router.Handle("/chat/schedule/{id}", c.Then(s.GetScheduledMessage())).Methods("GET")
+	s.router.Handle("/chat/schedule/{id}", c.Then(s.RescheduleMessage())).Methods("PUT")
+	s.router.Handle("/chat/schedule/{id}", c.Then(s.CancelScheduledMessage())).Methods("DELETE")
+
+	s.router.Handle("/templates", c.Then(s.CreateTemplate())).Methods("POST")
+	s.router.Handle("/templates", c.Then(s.ListTemplates())).Methods("GET")
+	s.router.Handle("/templates/{id}", c.Then(s.GetTemplate())).Methods("GET")
+	s.router.Handle("/templates/{id}", c.Then(s.UpdateTemplate())).Methods("PUT")
+	s.router.Handle("/templates/{id}", c.Then(s.DeleteTemplate())).Methods("DELETE")
+
+	s.router.Handle("/campaigns", c.Then(s.CreateCampaign())).Methods("POST")
+	s.router.Handle("/campaigns", c.Then(s.ListCampaigns())).Methods("GET")
+	s.router.Handle("/campaigns/{id}", c.Then(s.GetCampaign())).Methods("GET")
+	s.router.Handle("/campaigns/{id}/recipients", c.Then(s.GetCampaignRecipients())).Methods("GET")
+	s.router.Handle("/campaigns/{id}/pause", c.Then(s.PauseCampaign())).Methods("POST")
+	s.router.Handle("/campaigns/{id}/resume", c.Then(s.ResumeCampaign())).Methods("POST")
+	s.router.Handle("/campaigns/{id}/cancel", c.Then(s.CancelCampaign())).Methods("POST")
 	s.router.Handle("/chat/request-unavailable-message", c.Then(s.RequestUnavailableMessage())).Methods("POST")
 	s.router.Handle("/chat/archive", c.Then(s.ArchiveChat())).Methods("POST")
 
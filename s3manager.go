@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -268,6 +269,32 @@ func (m *S3Manager) GetPublicURL(userID, key string) string {
 	return fmt.Sprintf("https://%s.%s/%s", config.Bucket, endpoint, key)
 }
 
+// KeyFromURL returns the object key of a URL built by GetPublicURL for a user
+func (m *S3Manager) KeyFromURL(userID, url string) (string, bool) {
+	prefix := m.GetPublicURL(userID, "")
+	if prefix == "" || !strings.HasPrefix(url, prefix) || len(url) == len(prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(url, prefix), true
+}
+
+// GetObject opens an object of the user's bucket
+func (m *S3Manager) GetObject(ctx context.Context, userID, key string) (io.ReadCloser, error) {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return nil, fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get S3 object: %w", err)
+	}
+	return output.Body, nil
+}
+
 // TestConnection tests S3 connection
 func (m *S3Manager) TestConnection(ctx context.Context, userID string) error {
 	client, config, ok := m.GetClient(userID)
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	scheduledStatusPending   = "pending"
+	scheduledStatusSending   = "sending"
+	scheduledStatusSent      = "sent"
+	scheduledStatusFailed    = "failed"
+	scheduledStatusCancelled = "cancelled"
+
+	schedulerPollInterval = 1 * time.Second
+	schedulerBatchSize    = 50
+
+	// A job whose instance is not connected is retried this many times before it fails
+	scheduledMaxAttempts = 5
+	scheduledRetryDelay  = 1 * time.Minute
+)
+
+// sendRoutes maps the message types accepted by deferred sends to their send route
+var sendRoutes = map[string]string{
+	"text":     "/chat/send/text",
+	"image":    "/chat/send/image",
+	"audio":    "/chat/send/audio",
+	"document": "/chat/send/document",
+	"video":    "/chat/send/video",
+	"sticker":  "/chat/send/sticker",
+	"location": "/chat/send/location",
+	"contact":  "/chat/send/contact",
+	"buttons":  "/chat/send/buttons",
+	"list":     "/chat/send/list",
+	"poll":     "/chat/send/poll",
+}
+
+// sendRouteTypes returns the accepted message types, sorted for error messages
+func sendRouteTypes() []string {
+	types := make([]string, 0, len(sendRoutes))
+	for messageType := range sendRoutes {
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// sendRouteResult is the outcome of a send executed through its route
+type sendRouteResult struct {
+	StatusCode int
+	MessageID  string
+	Timestamp  int64
+	Err        error
+}
+
+// callSendRoute runs a send handler for the instance of token, exactly as if the
+// payload had been posted to its route, and extracts the message ID it returned
+func (s *server) callSendRoute(token string, messageType string, payload []byte) sendRouteResult {
+	route, ok := sendRoutes[messageType]
+	if !ok {
+		return sendRouteResult{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("unsupported message type %q", messageType)}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, route, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("token", token)
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, req)
+
+	var envelope struct {
+		Data struct {
+			Id        string
+			Timestamp int64
+		} `json:"data"`
+		Error string `json:"error"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &envelope)
+
+	result := sendRouteResult{StatusCode: recorder.Code, MessageID: envelope.Data.Id, Timestamp: envelope.Data.Timestamp}
+	if recorder.Code < 200 || recorder.Code >= 300 {
+		message := envelope.Error
+		if message == "" {
+			message = strings.TrimSpace(recorder.Body.String())
+		}
+		result.Err = fmt.Errorf("send failed with status %d: %s", recorder.Code, message)
+	}
+	return result
+}
+
+// emitEvent sends an event generated by wuzapi itself to the webhooks and sinks of an instance
+func (s *server) emitEvent(userID string, token string, eventType string, event map[string]interface{}) {
+	mycli := clientManager.GetMyClient(userID)
+	if mycli == nil {
+		mycli = &MyClient{userID: userID, token: token, db: s.db, s: s}
+	}
+
+	postmap := map[string]interface{}{
+		"type":  eventType,
+		"event": event,
+	}
+	sendEventWithWebHook(mycli, postmap, "")
+}
+
+// ScheduledMessage is a message to be sent through one of the send routes at SendAt
+type ScheduledMessage struct {
+	ID            string          `json:"id" db:"id"`
+	UserID        string          `json:"-" db:"user_id"`
+	Type          string          `json:"type" db:"type"`
+	Payload       json.RawMessage `json:"payload" db:"-"`
+	StoredPayload string          `json:"-" db:"payload"`
+	SendAtUnix    int64           `json:"-" db:"send_at"`
+	SendAt        time.Time       `json:"send_at" db:"-"`
+	NextAttemptAt int64           `json:"-" db:"next_attempt_at"`
+	Status        string          `json:"status" db:"status"`
+	MessageID     string          `json:"message_id" db:"message_id"`
+	Error         string          `json:"error" db:"error"`
+	Attempts      int             `json:"attempts" db:"attempts"`
+	CreatedAt     time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// fill sets the API fields from the stored columns
+func (m *ScheduledMessage) fill() {
+	m.Payload = json.RawMessage(m.StoredPayload)
+	m.SendAt = time.Unix(m.SendAtUnix, 0).UTC()
+}
+
+const scheduledMessageColumns = `id, user_id, type, payload, send_at, next_attempt_at, status, message_id, error, attempts, created_at, updated_at`
+
+// getScheduledMessage returns one scheduled message of a user
+func (s *server) getScheduledMessage(userID string, id string) (ScheduledMessage, error) {
+	var message ScheduledMessage
+	err := s.db.Get(&message, "SELECT "+scheduledMessageColumns+" FROM scheduled_messages WHERE id = $1 AND user_id = $2", id, userID)
+	message.fill()
+	return message, err
+}
+
+// parseScheduleRequest splits a schedule request into the message type, the send
+// time and the payload of the send route: the request is a send payload with Type
+// and SendAt added, or carries the send payload in Payload.
+func parseScheduleRequest(body []byte) (string, time.Time, []byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", time.Time{}, nil, errors.New("could not decode payload")
+	}
+
+	var messageType string
+	if raw, ok := fields["Type"]; ok {
+		if err := json.Unmarshal(raw, &messageType); err != nil {
+			return "", time.Time{}, nil, errors.New("invalid Type in payload")
+		}
+	}
+	if _, ok := sendRoutes[messageType]; !ok {
+		return "", time.Time{}, nil, fmt.Errorf("invalid Type in payload. Use: %s", strings.Join(sendRouteTypes(), ", "))
+	}
+
+	raw, ok := fields["SendAt"]
+	if !ok {
+		return "", time.Time{}, nil, errors.New("missing SendAt in payload")
+	}
+	var sendAt time.Time
+	if err := json.Unmarshal(raw, &sendAt); err != nil {
+		return "", time.Time{}, nil, errors.New("invalid SendAt in payload, use an RFC3339 time")
+	}
+
+	var payload []byte
+	if nested, ok := fields["Payload"]; ok {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(nested, &object); err != nil || object == nil {
+			return "", time.Time{}, nil, errors.New("Payload must be a JSON object")
+		}
+		payload = nested
+	} else {
+		delete(fields, "Type")
+		delete(fields, "SendAt")
+		payload, _ = json.Marshal(fields)
+	}
+	return messageType, sendAt, payload, nil
+}
+
+// MessageScheduler fires the due scheduled messages of a server through the send
+// routes. It polls every schedulerPollInterval: messages are only accepted for the
+// future, so none is due when it is stored.
+type MessageScheduler struct {
+	s *server
+}
+
+// StartMessageScheduler fails the jobs interrupted by a previous shutdown and starts the scheduler
+func StartMessageScheduler(s *server) *MessageScheduler {
+	scheduler := &MessageScheduler{s: s}
+	scheduler.failInterrupted()
+	go scheduler.run()
+	log.Info().Msg("Message scheduler started")
+	return scheduler
+}
+
+// failInterrupted marks the jobs that were being sent when the process stopped as
+// failed: the message may or may not have gone out, so it is not sent twice.
+func (m *MessageScheduler) failInterrupted() {
+	res, err := m.s.db.Exec("UPDATE scheduled_messages SET status=$1, error=$2, updated_at=$3 WHERE status=$4",
+		scheduledStatusFailed, "interrupted while sending, the message may not have been sent", time.Now(), scheduledStatusSending)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update interrupted scheduled messages")
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		log.Warn().Int64("count", n).Msg("Marked interrupted scheduled messages as failed")
+	}
+}
+
+func (m *MessageScheduler) run() {
+	ticker := time.NewTicker(schedulerPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.fireDue(time.Now())
+	}
+}
+
+// fireDue sends the jobs due at now, oldest first
+func (m *MessageScheduler) fireDue(now time.Time) {
+	due := []ScheduledMessage{}
+	err := m.s.db.Select(&due, `
+		SELECT `+scheduledMessageColumns+` FROM scheduled_messages
+		WHERE status = $1 AND next_attempt_at <= $2
+		ORDER BY next_attempt_at ASC
+		LIMIT $3`, scheduledStatusPending, now.Unix(), schedulerBatchSize)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query scheduled messages")
+		return
+	}
+
+	for _, message := range due {
+		message.fill()
+		m.fire(message)
+	}
+}
+
+// fire claims a job and sends it, unless another scheduler or a cancel got there first
+func (m *MessageScheduler) fire(message ScheduledMessage) {
+	res, err := m.s.db.Exec("UPDATE scheduled_messages SET status=$1, attempts=attempts+1, updated_at=$2 WHERE id=$3 AND status=$4",
+		scheduledStatusSending, time.Now(), message.ID, scheduledStatusPending)
+	if err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Failed to claim scheduled message")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	message.Attempts++
+
+	var token string
+	if err := m.s.db.Get(&token, "SELECT token FROM users WHERE id = $1", message.UserID); err != nil {
+		m.fail(message, "", fmt.Errorf("instance not found: %w", err))
+		return
+	}
+
+	// A disconnected instance gets a few more chances before the job fails
+	if clientManager.GetWhatsmeowClient(message.UserID) == nil && message.Attempts < scheduledMaxAttempts {
+		m.retryLater(message, "no session")
+		return
+	}
+
+	result := m.s.callSendRoute(token, message.Type, message.Payload)
+	if result.Err != nil {
+		m.fail(message, token, result.Err)
+		return
+	}
+
+	message.Status = scheduledStatusSent
+	message.MessageID = result.MessageID
+	message.Error = ""
+	_, err = m.s.db.Exec("UPDATE scheduled_messages SET status=$1, message_id=$2, error='', updated_at=$3 WHERE id=$4",
+		scheduledStatusSent, result.MessageID, time.Now(), message.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Failed to record sent scheduled message")
+	}
+	log.Info().Str("id", message.ID).Str("userID", message.UserID).Str("messageID", result.MessageID).Msg("Scheduled message sent")
+
+	m.notify(message, token, "ScheduledMessageSent")
+}
+
+func (m *MessageScheduler) retryLater(message ScheduledMessage, reason string) {
+	next := time.Now().Add(scheduledRetryDelay)
+	_, err := m.s.db.Exec("UPDATE scheduled_messages SET status=$1, error=$2, next_attempt_at=$3, updated_at=$4 WHERE id=$5",
+		scheduledStatusPending, reason, next.Unix(), time.Now(), message.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Failed to postpone scheduled message")
+	}
+	log.Warn().Str("id", message.ID).Str("userID", message.UserID).Str("reason", reason).Time("retryAt", next).Msg("Scheduled message postponed")
+}
+
+func (m *MessageScheduler) fail(message ScheduledMessage, token string, sendErr error) {
+	message.Status = scheduledStatusFailed
+	message.Error = sendErr.Error()
+	_, err := m.s.db.Exec("UPDATE scheduled_messages SET status=$1, error=$2, updated_at=$3 WHERE id=$4",
+		scheduledStatusFailed, message.Error, time.Now(), message.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Failed to record failed scheduled message")
+	}
+	log.Error().Err(sendErr).Str("id", message.ID).Str("userID", message.UserID).Msg("Scheduled message failed")
+
+	if token != "" {
+		m.notify(message, token, "ScheduledMessageFailed")
+	}
+}
+
+// notify emits the outcome of a job as an event of its instance
+func (m *MessageScheduler) notify(message ScheduledMessage, token string, eventType string) {
+	event := map[string]interface{}{
+		"ScheduleID":  message.ID,
+		"MessageType": message.Type,
+		"SendAt":      message.SendAt,
+		"Attempts":    message.Attempts,
+	}
+	if message.MessageID != "" {
+		event["MessageID"] = message.MessageID
+	}
+	if message.Error != "" {
+		event["Error"] = message.Error
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(message.Payload, &payload); err == nil {
+		if phone, ok := payload["Phone"]; ok {
+			event["Phone"] = phone
+		}
+	}
+	m.s.emitEvent(message.UserID, token, eventType, event)
+}
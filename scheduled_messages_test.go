@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleRequest(t *testing.T) {
+	messageType, sendAt, payload, err := parseScheduleRequest([]byte(`{"Type":"text","SendAt":"2030-01-02T15:04:05Z","Phone":"5491155553934","Body":"Hello"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if messageType != "text" || !sendAt.Equal(time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Errorf("Unexpected type or time: %s %v", messageType, sendAt)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatalf("Invalid payload: %v", err)
+	}
+	if len(fields) != 2 || fields["Phone"] != "5491155553934" || fields["Body"] != "Hello" {
+		t.Errorf("Expected the send payload without Type and SendAt, got %v", fields)
+	}
+
+	_, _, payload, err = parseScheduleRequest([]byte(`{"Type":"poll","SendAt":"2030-01-02T15:04:05Z","Payload":{"group":"120363313346913103@g.us"}}`))
+	if err != nil || string(payload) != `{"group":"120363313346913103@g.us"}` {
+		t.Errorf("Expected the nested payload, got %s (%v)", payload, err)
+	}
+
+	for _, body := range []string{
+		`{"SendAt":"2030-01-02T15:04:05Z","Phone":"1"}`,
+		`{"Type":"edit","SendAt":"2030-01-02T15:04:05Z"}`,
+		`{"Type":"text","Phone":"1"}`,
+		`{"Type":"text","SendAt":"tomorrow"}`,
+		`{"Type":"text","SendAt":"2030-01-02T15:04:05Z","Payload":"hello"}`,
+	} {
+		if _, _, _, err := parseScheduleRequest([]byte(body)); err == nil {
+			t.Errorf("Expected an error for %s", body)
+		}
+	}
+}
+
+func TestScheduledMessages(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "ScheduleUser",
+		"token":      "schedule-token",
+		"events":     "ScheduledMessageFailed",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "schedule-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	past := executeRequest(t, s, newRequest("2", "chat.schedule", map[string]interface{}{
+		"token":  "schedule-token",
+		"Type":   "text",
+		"SendAt": time.Now().Add(-time.Minute).Format(time.RFC3339),
+		"Phone":  "5491155553934",
+		"Body":   "Too late",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, past, "2", 400)
+
+	created := executeRequest(t, s, newRequest("3", "chat.schedule", map[string]interface{}{
+		"token":  "schedule-token",
+		"Type":   "text",
+		"SendAt": time.Now().Add(time.Hour).Format(time.RFC3339),
+		"Phone":  "5491155553934",
+		"Body":   "Hello later",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, created, "3").(map[string]interface{})
+	scheduleID, _ := result["id"].(string)
+	if scheduleID == "" || result["status"] != scheduledStatusPending || result["type"] != "text" {
+		t.Fatalf("Unexpected scheduled message: %v", result)
+	}
+	if payload := result["payload"].(map[string]interface{}); payload["Body"] != "Hello later" {
+		t.Errorf("Expected the send payload to be stored, got %v", payload)
+	}
+
+	list := executeRequest(t, s, newRequest("4", "chat.schedule.list", map[string]interface{}{
+		"token":  "schedule-token",
+		"status": "pending",
+	}).toJSON(t))
+	listed := assertJSONRPC20Success(t, list, "4").(map[string]interface{})
+	if listed["total"] != float64(1) {
+		t.Errorf("Expected one pending message, got %v", listed)
+	}
+
+	newTime := time.Now().Add(2 * time.Hour).Truncate(time.Second).UTC()
+	rescheduled := executeRequest(t, s, newRequest("5", "chat.schedule.reschedule", map[string]interface{}{
+		"token":  "schedule-token",
+		"id":     scheduleID,
+		"SendAt": newTime.Format(time.RFC3339),
+	}).toJSON(t))
+	result = assertJSONRPC20Success(t, rescheduled, "5").(map[string]interface{})
+	if result["send_at"] != newTime.Format(time.RFC3339) {
+		t.Errorf("Expected send_at %s, got %v", newTime.Format(time.RFC3339), result["send_at"])
+	}
+
+	cancelled := executeRequest(t, s, newRequest("6", "chat.schedule.cancel", map[string]interface{}{
+		"token": "schedule-token",
+		"id":    scheduleID,
+	}).toJSON(t))
+	result = assertJSONRPC20Success(t, cancelled, "6").(map[string]interface{})
+	if result["status"] != scheduledStatusCancelled {
+		t.Errorf("Expected a cancelled message, got %v", result)
+	}
+
+	again := executeRequest(t, s, newRequest("7", "chat.schedule.cancel", map[string]interface{}{
+		"token": "schedule-token",
+		"id":    scheduleID,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, again, "7", 409)
+
+	missing := executeRequest(t, s, newRequest("8", "chat.schedule.get", map[string]interface{}{
+		"token": "schedule-token",
+		"id":    "does-not-exist",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, missing, "8", 404)
+}
+
+func TestMessageSchedulerFiresDueMessages(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "SchedulerUser",
+		"token":      "scheduler-token",
+		"events":     "ScheduledMessageFailed",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "scheduler-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	sub, _ := eventStreams.Subscribe(userID, []string{"ScheduledMessageFailed"}, "")
+	t.Cleanup(func() { eventStreams.Unsubscribe(userID, sub) })
+
+	due := time.Now().Add(-time.Second).Unix()
+	_, err := s.db.Exec(`
+		INSERT INTO scheduled_messages (id, user_id, type, payload, send_at, next_attempt_at, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		"job1", userID, "text", `{"Phone":"5491155553934","Body":"Hi"}`, due, due, scheduledStatusPending)
+	if err != nil {
+		t.Fatalf("Failed to insert scheduled message: %v", err)
+	}
+
+	scheduler := &MessageScheduler{s: s}
+
+	// Without a session the job is postponed until its attempts run out
+	scheduler.fireDue(time.Now())
+	message, err := s.getScheduledMessage(userID, "job1")
+	if err != nil {
+		t.Fatalf("Failed to get scheduled message: %v", err)
+	}
+	if message.Status != scheduledStatusPending || message.Attempts != 1 || message.NextAttemptAt <= due {
+		t.Fatalf("Expected the message to be postponed, got %+v", message)
+	}
+
+	if _, err := s.db.Exec("UPDATE scheduled_messages SET attempts=$1, next_attempt_at=$2 WHERE id=$3", scheduledMaxAttempts-1, due, "job1"); err != nil {
+		t.Fatalf("Failed to update scheduled message: %v", err)
+	}
+	scheduler.fireDue(time.Now())
+
+	message, err = s.getScheduledMessage(userID, "job1")
+	if err != nil {
+		t.Fatalf("Failed to get scheduled message: %v", err)
+	}
+	if message.Status != scheduledStatusFailed || !strings.Contains(message.Error, "no session") {
+		t.Fatalf("Expected the send route error to be recorded, got %+v", message)
+	}
+
+	select {
+	case event := <-sub.events:
+		var postmap map[string]interface{}
+		if err := json.Unmarshal(event.Data, &postmap); err != nil {
+			t.Fatalf("Invalid event: %v", err)
+		}
+		details := postmap["event"].(map[string]interface{})
+		if postmap["type"] != "ScheduledMessageFailed" || details["ScheduleID"] != "job1" || details["Phone"] != "5491155553934" {
+			t.Errorf("Unexpected event: %v", postmap)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a ScheduledMessageFailed event")
+	}
+}
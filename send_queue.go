@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	sendJobStatusQueued  = "queued"
+	sendJobStatusSending = "sending"
+	sendJobStatusSent    = "sent"
+	sendJobStatusFailed  = "failed"
+
+	sendQueuePollInterval = 250 * time.Millisecond
+	maxSendQueueRate      = 600
+
+	// Transient failures are retried after sendQueueRetryBase, doubling up to sendQueueRetryMax
+	sendQueueRetryBase = 5 * time.Second
+	sendQueueRetryMax  = 5 * time.Minute
+)
+
+// transientSendErrors are the parts of send errors worth retrying: the instance
+// was offline or the connection to WhatsApp failed, not the request itself
+var transientSendErrors = []string{
+	"no session",
+	"not connected",
+	"timed out",
+	"timeout",
+	"context deadline exceeded",
+	"websocket",
+	"connection",
+	"broken pipe",
+	"eof",
+	"server returned error 5",
+	"rate-overlimit",
+}
+
+// isTransientSendError tells whether a failed send may succeed if tried again
+func isTransientSendError(result sendRouteResult) bool {
+	if result.Err == nil || result.StatusCode < http.StatusInternalServerError {
+		return false
+	}
+	message := strings.ToLower(result.Err.Error())
+	for _, part := range transientSendErrors {
+		if strings.Contains(message, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendQueueRetryDelay is the backoff before the next attempt of a job that failed attempts times
+func sendQueueRetryDelay(attempts int) time.Duration {
+	delay := sendQueueRetryBase
+	for i := 1; i < attempts && delay < sendQueueRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > sendQueueRetryMax {
+		delay = sendQueueRetryMax
+	}
+	return delay
+}
+
+// isAsyncRequest tells whether a send was asked to be queued, with ?async=true or Prefer: respond-async
+func isAsyncRequest(r *http.Request) bool {
+	if async, err := strconv.ParseBool(r.URL.Query().Get("async")); err == nil && async {
+		return true
+	}
+	return strings.Contains(strings.ToLower(r.Header.Get("Prefer")), "respond-async")
+}
+
+// isSendRoute tells whether path is one of the routes that can be queued
+func isSendRoute(path string) bool {
+	if path == storedTemplateRoute {
+		return true
+	}
+	for _, route := range sendRoutes {
+		if route == path {
+			return true
+		}
+	}
+	return false
+}
+
+// SendJob is a send queued for an instance and executed through its send route
+type SendJob struct {
+	ID                string          `json:"id" db:"id"`
+	UserID            string          `json:"-" db:"user_id"`
+	Type              string          `json:"type" db:"type"`
+	StoredPayload     string          `json:"-" db:"payload"`
+	Phone             string          `json:"phone,omitempty" db:"-"`
+	Status            string          `json:"status" db:"status"`
+	Attempts          int             `json:"attempts" db:"attempts"`
+	NextAttemptAtUnix int64           `json:"-" db:"next_attempt_at"`
+	NextAttemptAt     *time.Time      `json:"next_attempt_at,omitempty" db:"-"`
+	MessageID         string          `json:"message_id" db:"message_id"`
+	Error             string          `json:"error" db:"error"`
+	CreatedAt         time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time       `json:"updated_at" db:"updated_at"`
+	payload           json.RawMessage `db:"-"`
+}
+
+// fill sets the API fields from the stored columns
+func (j *SendJob) fill() {
+	j.payload = json.RawMessage(j.StoredPayload)
+	var fields struct{ Phone string }
+	if err := json.Unmarshal(j.payload, &fields); err == nil {
+		j.Phone = fields.Phone
+	}
+	if j.Status == sendJobStatusQueued {
+		j.NextAttemptAt = unixTime(j.NextAttemptAtUnix)
+	}
+}
+
+const sendJobColumns = `id, user_id, type, payload, status, attempts, next_attempt_at, message_id, error, created_at, updated_at`
+
+// getSendJob returns one queued send of a user
+func (s *server) getSendJob(userID string, id string) (SendJob, error) {
+	var job SendJob
+	err := s.db.Get(&job, "SELECT "+sendJobColumns+" FROM send_jobs WHERE id = $1 AND user_id = $2", id, userID)
+	job.fill()
+	return job, err
+}
+
+// sendQueueRate returns the messages per minute an instance sends from its queue
+func (s *server) sendQueueRate(userID string) int {
+	var rate int
+	if err := s.db.Get(&rate, "SELECT send_queue_rate FROM users WHERE id = $1", userID); err != nil || rate <= 0 {
+		return *sendQueueRate
+	}
+	return rate
+}
+
+// queueable lets a send route queue its payload instead of sending it right away
+// when the request asks for it; other requests go to the send handler untouched.
+func (s *server) queueable(messageType string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAsyncRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var fields map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&fields); err != nil || fields == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+		// Requests over stdio carry their credentials in the payload
+		delete(fields, "token")
+		delete(fields, "adminToken")
+		delete(fields, "async")
+		delete(fields, "idempotencyKey")
+		payload, _ := json.Marshal(fields)
+
+		jobID, err := GenerateRandomID()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to generate job id"))
+			return
+		}
+		now := time.Now()
+		_, err = s.db.Exec(`
+			INSERT INTO send_jobs (id, user_id, type, payload, status, next_attempt_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			jobID, txtid, messageType, string(payload), sendJobStatusQueued, now.Unix(), now, now)
+		if err != nil {
+			log.Error().Err(err).Str("userID", txtid).Msg("Failed to queue send")
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("failed to queue message"))
+			return
+		}
+		s.sendQueue.Wake()
+
+		response := map[string]interface{}{"Details": "Queued", "JobId": jobID, "Status": sendJobStatusQueued}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.Respond(w, r, http.StatusAccepted, string(responseJson))
+	})
+}
+
+// SendQueue sends the queued jobs of every instance, one at a time per instance
+// and no faster than its rate, retrying the failures that look transient
+type SendQueue struct {
+	s    *server
+	wake chan struct{}
+
+	mu       sync.Mutex
+	busy     map[string]bool
+	nextSend map[string]time.Time
+	inflight sync.WaitGroup
+}
+
+func newSendQueue(s *server) *SendQueue {
+	return &SendQueue{
+		s:        s,
+		wake:     make(chan struct{}, 1),
+		busy:     make(map[string]bool),
+		nextSend: make(map[string]time.Time),
+	}
+}
+
+// StartSendQueue fails the jobs interrupted by a previous shutdown and starts the queue
+func StartSendQueue(s *server) *SendQueue {
+	queue := newSendQueue(s)
+	queue.failInterrupted()
+	go queue.run()
+	log.Info().Int("rate", *sendQueueRate).Int("maxAttempts", *sendQueueMaxAttempts).Msg("Send queue started")
+	return queue
+}
+
+// Wake makes the queue look for due jobs right away
+func (q *SendQueue) Wake() {
+	if q == nil {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// failInterrupted marks the jobs that were being sent when the process stopped as
+// failed: the message may or may not have gone out, so it is not sent twice.
+func (q *SendQueue) failInterrupted() {
+	res, err := q.s.db.Exec("UPDATE send_jobs SET status=$1, error=$2, updated_at=$3 WHERE status=$4",
+		sendJobStatusFailed, "interrupted while sending, the message may not have been sent", time.Now(), sendJobStatusSending)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update interrupted send jobs")
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		log.Warn().Int64("count", n).Msg("Marked interrupted send jobs as failed")
+	}
+}
+
+func (q *SendQueue) run() {
+	ticker := time.NewTicker(sendQueuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+		q.dispatchDue(time.Now())
+	}
+}
+
+// dispatchDue starts the oldest due job of every instance that is idle and within its rate
+func (q *SendQueue) dispatchDue(now time.Time) {
+	users := []string{}
+	err := q.s.db.Select(&users, "SELECT DISTINCT user_id FROM send_jobs WHERE status = $1 AND next_attempt_at <= $2",
+		sendJobStatusQueued, now.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query send jobs")
+		return
+	}
+
+	for _, userID := range users {
+		q.mu.Lock()
+		ready := !q.busy[userID] && !q.nextSend[userID].After(now)
+		if ready {
+			q.busy[userID] = true
+		}
+		q.mu.Unlock()
+		if !ready {
+			continue
+		}
+
+		job, ok := q.claim(userID, now)
+		if !ok {
+			q.release(userID, time.Time{})
+			continue
+		}
+		q.inflight.Add(1)
+		go func() {
+			defer q.inflight.Done()
+			q.process(job)
+		}()
+	}
+}
+
+// claim marks the oldest due job of an instance as sending
+func (q *SendQueue) claim(userID string, now time.Time) (SendJob, bool) {
+	var job SendJob
+	err := q.s.db.Get(&job, `
+		SELECT `+sendJobColumns+` FROM send_jobs
+		WHERE user_id = $1 AND status = $2 AND next_attempt_at <= $3
+		ORDER BY next_attempt_at ASC, created_at ASC
+		LIMIT 1`, userID, sendJobStatusQueued, now.Unix())
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error().Err(err).Str("userID", userID).Msg("Failed to get send job")
+		}
+		return job, false
+	}
+
+	res, err := q.s.db.Exec("UPDATE send_jobs SET status=$1, attempts=attempts+1, updated_at=$2 WHERE id=$3 AND status=$4",
+		sendJobStatusSending, time.Now(), job.ID, sendJobStatusQueued)
+	if err != nil {
+		log.Error().Err(err).Str("id", job.ID).Msg("Failed to claim send job")
+		return job, false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return job, false
+	}
+	job.fill()
+	job.Status = sendJobStatusSending
+	job.Attempts++
+	return job, true
+}
+
+// release lets the queue dispatch the next job of an instance from next on
+func (q *SendQueue) release(userID string, next time.Time) {
+	q.mu.Lock()
+	delete(q.busy, userID)
+	if !next.IsZero() {
+		q.nextSend[userID] = next
+	}
+	q.mu.Unlock()
+}
+
+// process sends a claimed job and records its outcome
+func (q *SendQueue) process(job SendJob) {
+	var next time.Time
+	defer func() {
+		q.release(job.UserID, next)
+		q.Wake()
+	}()
+
+	var token string
+	if err := q.s.db.Get(&token, "SELECT token FROM users WHERE id = $1", job.UserID); err != nil {
+		q.settle(job, "", sendRouteResult{Err: fmt.Errorf("instance not found: %w", err)})
+		return
+	}
+
+	client := clientManager.GetWhatsmeowClient(job.UserID)
+	if client == nil {
+		q.settle(job, token, sendRouteResult{StatusCode: http.StatusInternalServerError, Err: errors.New("no session")})
+		return
+	}
+
+	// The message ID is fixed before the first attempt so retries reuse it
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(job.payload, &fields); err == nil {
+		if _, ok := fields["Id"]; !ok {
+			fields["Id"], _ = json.Marshal(client.GenerateMessageID())
+			job.payload, _ = json.Marshal(fields)
+			if _, err := q.s.db.Exec("UPDATE send_jobs SET payload=$1 WHERE id=$2", string(job.payload), job.ID); err != nil {
+				log.Error().Err(err).Str("id", job.ID).Msg("Failed to store message id of send job")
+			}
+		}
+	}
+
+	result := q.s.callSendRoute(token, job.Type, job.payload)
+	next = time.Now().Add(time.Minute / time.Duration(q.s.sendQueueRate(job.UserID)))
+	q.settle(job, token, result)
+}
+
+// settle records the result of an attempt: sent, queued again for a transient
+// failure while attempts remain, or failed. Settled jobs emit a SendResult event.
+func (q *SendQueue) settle(job SendJob, token string, result sendRouteResult) {
+	now := time.Now()
+	if result.Err != nil && isTransientSendError(result) && job.Attempts < *sendQueueMaxAttempts {
+		next := now.Add(sendQueueRetryDelay(job.Attempts))
+		_, err := q.s.db.Exec("UPDATE send_jobs SET status=$1, error=$2, next_attempt_at=$3, updated_at=$4 WHERE id=$5",
+			sendJobStatusQueued, result.Err.Error(), next.Unix(), now, job.ID)
+		if err != nil {
+			log.Error().Err(err).Str("id", job.ID).Msg("Failed to requeue send job")
+		}
+		log.Warn().Err(result.Err).Str("id", job.ID).Str("userID", job.UserID).Int("attempts", job.Attempts).Time("retryAt", next).Msg("Queued send will be retried")
+		return
+	}
+
+	if result.Err != nil {
+		job.Status = sendJobStatusFailed
+		job.Error = result.Err.Error()
+		log.Error().Err(result.Err).Str("id", job.ID).Str("userID", job.UserID).Msg("Queued send failed")
+	} else {
+		job.Status = sendJobStatusSent
+		job.MessageID = result.MessageID
+		job.Error = ""
+		log.Info().Str("id", job.ID).Str("userID", job.UserID).Str("messageID", result.MessageID).Msg("Queued send sent")
+	}
+	_, err := q.s.db.Exec("UPDATE send_jobs SET status=$1, message_id=$2, error=$3, updated_at=$4 WHERE id=$5",
+		job.Status, job.MessageID, job.Error, now, job.ID)
+	if err != nil {
+		log.Error().Err(err).Str("id", job.ID).Msg("Failed to record send job result")
+	}
+
+	if token == "" {
+		return
+	}
+	event := map[string]interface{}{
+		"JobID":       job.ID,
+		"MessageType": job.Type,
+		"Status":      job.Status,
+		"Attempts":    job.Attempts,
+	}
+	if job.MessageID != "" {
+		event["MessageID"] = job.MessageID
+	}
+	if job.Error != "" {
+		event["Error"] = job.Error
+	}
+	if job.Phone != "" {
+		event["Phone"] = job.Phone
+	}
+	q.s.emitEvent(job.UserID, token, "SendResult", event)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendQueueRetryPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		result    sendRouteResult
+		transient bool
+	}{
+		{sendRouteResult{StatusCode: 500, Err: errors.New("send failed with status 500: no session")}, true},
+		{sendRouteResult{StatusCode: 500, Err: errors.New("send failed with status 500: error sending message: websocket not connected")}, true},
+		{sendRouteResult{StatusCode: 500, Err: errors.New("send failed with status 500: error sending message: info query timed out")}, true},
+		{sendRouteResult{StatusCode: 500, Err: errors.New("send failed with status 500: error sending message: server returned error 479")}, false},
+		{sendRouteResult{StatusCode: 400, Err: errors.New("send failed with status 400: missing Phone in Payload")}, false},
+		{sendRouteResult{StatusCode: 200}, false},
+	} {
+		if transient := isTransientSendError(tc.result); transient != tc.transient {
+			t.Errorf("%v: expected transient %v, got %v", tc.result.Err, tc.transient, transient)
+		}
+	}
+
+	for attempts, expected := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 4: 40 * time.Second, 20: sendQueueRetryMax} {
+		if delay := sendQueueRetryDelay(attempts); delay != expected {
+			t.Errorf("After %d attempts: expected %v, got %v", attempts, expected, delay)
+		}
+	}
+}
+
+func TestAsyncSendQueue(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "QueueUser",
+		"token":      "queue-token",
+		"events":     "SendResult",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "queue-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	sub, _ := eventStreams.Subscribe(userID, []string{"SendResult"}, "")
+	t.Cleanup(func() { eventStreams.Unsubscribe(userID, sub) })
+
+	invalid := executeRequest(t, s, newRequest("2", "session.sendqueue.config", map[string]interface{}{
+		"token":           "queue-token",
+		"rate_per_minute": maxSendQueueRate + 1,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, invalid, "2", 400)
+
+	configured := executeRequest(t, s, newRequest("3", "session.sendqueue.config", map[string]interface{}{
+		"token":           "queue-token",
+		"rate_per_minute": 120,
+	}).toJSON(t))
+	assertJSONRPC20Success(t, configured, "3")
+	if rate := s.sendQueueRate(userID); rate != 120 {
+		t.Errorf("Expected a rate of 120, got %d", rate)
+	}
+
+	queued := executeRequest(t, s, newRequest("4", "chat.send.text", map[string]interface{}{
+		"token": "queue-token",
+		"async": true,
+		"Phone": "5491155553934",
+		"Body":  "Hello from the queue",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, queued, "4").(map[string]interface{})
+	jobID, _ := result["JobId"].(string)
+	if jobID == "" || result["Status"] != sendJobStatusQueued {
+		t.Fatalf("Unexpected queued send: %v", result)
+	}
+
+	var stored string
+	if err := s.db.Get(&stored, "SELECT payload FROM send_jobs WHERE id = $1", jobID); err != nil {
+		t.Fatalf("Failed to get job payload: %v", err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(stored), &payload); err != nil || len(payload) != 2 || payload["Body"] != "Hello from the queue" {
+		t.Errorf("Expected the send payload without credentials, got %s", stored)
+	}
+
+	config := executeRequest(t, s, newRequest("5", "session.sendqueue.config.get", map[string]interface{}{
+		"token": "queue-token",
+	}).toJSON(t))
+	if result := assertJSONRPC20Success(t, config, "5").(map[string]interface{}); result["queued"] != float64(1) || result["rate_per_minute"] != float64(120) {
+		t.Errorf("Unexpected send queue configuration: %v", result)
+	}
+
+	// Without a session the job is retried with a backoff until its attempts run out
+	queue := newSendQueue(s)
+	queue.dispatchDue(time.Now())
+	queue.inflight.Wait()
+
+	job, err := s.getSendJob(userID, jobID)
+	if err != nil {
+		t.Fatalf("Failed to get job: %v", err)
+	}
+	if job.Status != sendJobStatusQueued || job.Attempts != 1 || job.Error != "no session" || job.NextAttemptAt == nil || !job.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("Expected the job to be retried later, got %+v", job)
+	}
+
+	if _, err := s.db.Exec("UPDATE send_jobs SET attempts=$1, next_attempt_at=$2 WHERE id=$3",
+		*sendQueueMaxAttempts-1, time.Now().Unix(), jobID); err != nil {
+		t.Fatalf("Failed to update job: %v", err)
+	}
+	queue.dispatchDue(time.Now())
+	queue.inflight.Wait()
+
+	got := executeRequest(t, s, newRequest("6", "chat.jobs.get", map[string]interface{}{
+		"token": "queue-token",
+		"id":    jobID,
+	}).toJSON(t))
+	result = assertJSONRPC20Success(t, got, "6").(map[string]interface{})
+	if result["status"] != sendJobStatusFailed || result["phone"] != "5491155553934" || result["attempts"] != float64(*sendQueueMaxAttempts) {
+		t.Errorf("Expected a failed job, got %v", result)
+	}
+
+	select {
+	case event := <-sub.events:
+		var postmap map[string]interface{}
+		if err := json.Unmarshal(event.Data, &postmap); err != nil {
+			t.Fatalf("Invalid event: %v", err)
+		}
+		details := postmap["event"].(map[string]interface{})
+		if postmap["type"] != "SendResult" || details["JobID"] != jobID || details["Status"] != sendJobStatusFailed {
+			t.Errorf("Unexpected event: %v", postmap)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a SendResult event")
+	}
+
+	missing := executeRequest(t, s, newRequest("7", "chat.jobs.get", map[string]interface{}{
+		"token": "queue-token",
+		"id":    "does-not-exist",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, missing, "7", 404)
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"net/http/httptest"
+	"net/url"
 	"os"
 
 	"github.com/rs/zerolog/log"
@@ -112,6 +113,8 @@ type stdioServer struct {
 	server *server
 	stdin  io.Reader
 	stdout io.Writer
+	// token, when set, authenticates every request instead of the token param (WebSocket connections)
+	token string
 }
 
 // NewStdioServer creates a new stdio server instance
@@ -240,6 +243,48 @@ func (ss *stdioServer) routeRequest(req *jsonRpcRequest) {
 			return
 		}
 		httpPath = "/admin/users/" + userId + "/full"
+	case "admin.users.retention.get", "admin.users.retention.set", "admin.users.retention.delete", "admin.users.retention.preview":
+		userId, ok := ss.getUserIdParam(req)
+		if !ok {
+			// Error sent by getUserIdParam.
+			return
+		}
+		httpPath = "/admin/users/" + userId + "/retention"
+		switch req.Method {
+		case "admin.users.retention.get":
+			httpMethod = "GET"
+		case "admin.users.retention.set":
+			httpMethod = "PUT"
+		case "admin.users.retention.delete":
+			httpMethod = "DELETE"
+			if chatJID, ok := req.Params["chat_jid"].(string); ok && chatJID != "" {
+				httpPath += "?" + url.Values{"chat_jid": {chatJID}}.Encode()
+			}
+		default:
+			httpMethod = "POST"
+			httpPath += "/preview"
+		}
+	case "admin.users.sinks.get", "admin.users.sinks.set", "admin.users.sinks.delete":
+		userId, ok := ss.getUserIdParam(req)
+		if !ok {
+			// Error sent by getUserIdParam.
+			return
+		}
+		httpPath = "/admin/users/" + userId + "/sinks"
+		switch req.Method {
+		case "admin.users.sinks.get":
+			httpMethod = "GET"
+		case "admin.users.sinks.set":
+			httpMethod = "PUT"
+		default:
+			httpMethod = "DELETE"
+		}
+	case "admin.webhooks.breakers":
+		httpMethod = "GET"
+		httpPath = "/admin/webhooks/breakers"
+	case "admin.webhooks.deadletters.replay":
+		httpMethod = "POST"
+		httpPath = "/admin/webhooks/dead-letters/replay"
 
 	// Session management
 	case "session.connect":
@@ -278,6 +323,30 @@ func (ss *stdioServer) routeRequest(req *jsonRpcRequest) {
 	case "session.hmac.config.delete":
 		httpMethod = "DELETE"
 		httpPath = "/session/hmac/config"
+	case "session.sinks.get":
+		httpMethod = "GET"
+		httpPath = "/session/sinks"
+	case "session.sinks.set":
+		httpMethod = "POST"
+		httpPath = "/session/sinks"
+	case "session.sinks.delete":
+		httpMethod = "DELETE"
+		httpPath = "/session/sinks"
+	case "session.rabbitmq.config":
+		httpMethod = "POST"
+		httpPath = "/session/rabbitmq/config"
+	case "session.rabbitmq.config.get":
+		httpMethod = "GET"
+		httpPath = "/session/rabbitmq/config"
+	case "session.rabbitmq.config.delete":
+		httpMethod = "DELETE"
+		httpPath = "/session/rabbitmq/config"
+	case "session.sendqueue.config":
+		httpMethod = "POST"
+		httpPath = "/session/sendqueue/config"
+	case "session.sendqueue.config.get":
+		httpMethod = "GET"
+		httpPath = "/session/sendqueue/config"
 
 	// Messaging
 	case "chat.send.text":
@@ -316,6 +385,9 @@ func (ss *stdioServer) routeRequest(req *jsonRpcRequest) {
 	case "chat.send.edit":
 		httpMethod = "POST"
 		httpPath = "/chat/send/edit"
+	case "chat.send.template":
+		httpMethod = "POST"
+		httpPath = storedTemplateRoute
 	case "chat.delete":
 		httpMethod = "POST"
 		httpPath = "/chat/delete"
@@ -353,10 +425,185 @@ func (ss *stdioServer) routeRequest(req *jsonRpcRequest) {
 			ss.sendError(req.ID, 400, "missing or invalid chat_jid parameter")
 			return
 		}
-		httpPath = "/chat/history?chat_jid=" + chatJID
+		query := url.Values{"chat_jid": {chatJID}}
+		for _, key := range historyPagingParams {
+			if value, ok := req.Params[key].(string); ok && value != "" {
+				query.Set(key, value)
+			}
+		}
 		// Add optional limit parameter
 		if limit, ok := req.Params["limit"].(float64); ok {
-			httpPath += fmt.Sprintf("&limit=%d", int(limit))
+			query.Set("limit", fmt.Sprintf("%d", int(limit)))
+		}
+		httpPath = "/chat/history?" + query.Encode()
+	case "chat.history.search":
+		httpMethod = "GET"
+		query := url.Values{}
+		for _, key := range []string{"q", "chat_jid", "sender_jid", "message_type", "from", "to"} {
+			if value, ok := req.Params[key].(string); ok && value != "" {
+				query.Set(key, value)
+			}
+		}
+		for _, key := range []string{"limit", "offset"} {
+			if value, ok := req.Params[key].(float64); ok {
+				query.Set(key, fmt.Sprintf("%d", int(value)))
+			}
+		}
+		httpPath = "/chat/history/search?" + query.Encode()
+	case "chat.history.export":
+		httpMethod = "GET"
+		if zip, ok := req.Params["zip"].(bool); ok && zip {
+			ss.sendError(req.ID, 400, "zip exports are only available over HTTP")
+			return
+		}
+		query := url.Values{}
+		for _, key := range []string{"chat_jid", "format", "from", "to"} {
+			if value, ok := req.Params[key].(string); ok && value != "" {
+				query.Set(key, value)
+			}
+		}
+		httpPath = "/chat/history/export?" + query.Encode()
+	case "chat.list":
+		httpMethod = "GET"
+		query := url.Values{}
+		if cursor, ok := req.Params["cursor"].(string); ok && cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		if limit, ok := req.Params["limit"].(float64); ok {
+			query.Set("limit", fmt.Sprintf("%d", int(limit)))
+		}
+		httpPath = "/chat/list?" + query.Encode()
+	case "chat.jobs.get":
+		httpMethod = "GET"
+		jobID, ok := req.Params["id"].(string)
+		if !ok || jobID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		httpPath = "/chat/jobs/" + url.PathEscape(jobID)
+	case "chat.message.status":
+		httpMethod = "GET"
+		messageID, ok := req.Params["id"].(string)
+		if !ok || messageID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		httpPath = "/chat/message/" + url.PathEscape(messageID) + "/status"
+	case "chat.message.status.query":
+		httpMethod = "POST"
+		httpPath = "/chat/message/status"
+	case "chat.poll.results":
+		httpMethod = "GET"
+		pollID, ok := req.Params["id"].(string)
+		if !ok || pollID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		httpPath = "/chat/poll/" + url.PathEscape(pollID) + "/results"
+	case "chat.schedule":
+		httpMethod = "POST"
+		httpPath = "/chat/schedule"
+	case "chat.schedule.list":
+		httpMethod = "GET"
+		query := url.Values{}
+		if status, ok := req.Params["status"].(string); ok && status != "" {
+			query.Set("status", status)
+		}
+		for _, key := range []string{"limit", "offset"} {
+			if value, ok := req.Params[key].(float64); ok {
+				query.Set(key, fmt.Sprintf("%d", int(value)))
+			}
+		}
+		httpPath = "/chat/schedule"
+		if len(query) > 0 {
+			httpPath += "?" + query.Encode()
+		}
+	case "chat.schedule.get", "chat.schedule.reschedule", "chat.schedule.cancel":
+		switch req.Method {
+		case "chat.schedule.get":
+			httpMethod = "GET"
+		case "chat.schedule.reschedule":
+			httpMethod = "PUT"
+		default:
+			httpMethod = "DELETE"
+		}
+		scheduleID, ok := req.Params["id"].(string)
+		if !ok || scheduleID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		httpPath = "/chat/schedule/" + url.PathEscape(scheduleID)
+
+	// Templates
+	case "templates.create":
+		httpMethod = "POST"
+		httpPath = "/templates"
+	case "templates.list":
+		httpMethod = "GET"
+		httpPath = "/templates"
+	case "templates.get", "templates.update", "templates.delete":
+		switch req.Method {
+		case "templates.get":
+			httpMethod = "GET"
+		case "templates.update":
+			httpMethod = "PUT"
+		default:
+			httpMethod = "DELETE"
+		}
+		templateID, ok := req.Params["id"].(string)
+		if !ok || templateID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		httpPath = "/templates/" + url.PathEscape(templateID)
+
+	// Campaigns
+	case "campaigns.create":
+		httpMethod = "POST"
+		httpPath = "/campaigns"
+	case "campaigns.list":
+		httpMethod = "GET"
+		httpPath = "/campaigns"
+		if status, ok := req.Params["status"].(string); ok && status != "" {
+			httpPath += "?status=" + url.QueryEscape(status)
+		}
+	case "campaigns.get", "campaigns.pause", "campaigns.resume", "campaigns.cancel":
+		campaignID, ok := req.Params["id"].(string)
+		if !ok || campaignID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		httpMethod = "POST"
+		httpPath = "/campaigns/" + url.PathEscape(campaignID)
+		switch req.Method {
+		case "campaigns.get":
+			httpMethod = "GET"
+		case "campaigns.pause":
+			httpPath += "/pause"
+		case "campaigns.resume":
+			httpPath += "/resume"
+		default:
+			httpPath += "/cancel"
+		}
+	case "campaigns.recipients":
+		httpMethod = "GET"
+		campaignID, ok := req.Params["id"].(string)
+		if !ok || campaignID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		query := url.Values{}
+		if status, ok := req.Params["status"].(string); ok && status != "" {
+			query.Set("status", status)
+		}
+		for _, key := range []string{"limit", "offset"} {
+			if value, ok := req.Params[key].(float64); ok {
+				query.Set(key, fmt.Sprintf("%d", int(value)))
+			}
+		}
+		httpPath = "/campaigns/" + url.PathEscape(campaignID) + "/recipients"
+		if len(query) > 0 {
+			httpPath += "?" + query.Encode()
 		}
 
 	// User info
@@ -459,11 +706,61 @@ func (ss *stdioServer) routeRequest(req *jsonRpcRequest) {
 	case "webhook.delete":
 		httpMethod = "DELETE"
 		httpPath = "/webhook"
+	case "webhook.deliveries":
+		httpMethod = "GET"
+		query := url.Values{}
+		for _, key := range []string{"status", "event_type"} {
+			if value, ok := req.Params[key].(string); ok && value != "" {
+				query.Set(key, value)
+			}
+		}
+		for _, key := range []string{"limit", "offset"} {
+			if value, ok := req.Params[key].(float64); ok {
+				query.Set(key, fmt.Sprintf("%d", int(value)))
+			}
+		}
+		httpPath = "/webhook/deliveries"
+		if len(query) > 0 {
+			httpPath += "?" + query.Encode()
+		}
+	case "webhook.deliveries.replay":
+		httpMethod = "POST"
+		deliveryID, ok := req.Params["id"].(string)
+		if !ok || deliveryID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		httpPath = "/webhook/deliveries/" + url.PathEscape(deliveryID) + "/replay"
+	case "webhook.endpoints.list":
+		httpMethod = "GET"
+		httpPath = "/webhook/endpoints"
+	case "webhook.endpoints.add":
+		httpMethod = "POST"
+		httpPath = "/webhook/endpoints"
+	case "webhook.endpoints.get", "webhook.endpoints.update", "webhook.endpoints.delete":
+		switch req.Method {
+		case "webhook.endpoints.get":
+			httpMethod = "GET"
+		case "webhook.endpoints.update":
+			httpMethod = "PUT"
+		default:
+			httpMethod = "DELETE"
+		}
+		endpointID, ok := req.Params["id"].(string)
+		if !ok || endpointID == "" {
+			ss.sendError(req.ID, 400, "missing or invalid id parameter")
+			return
+		}
+		httpPath = "/webhook/endpoints/" + url.PathEscape(endpointID)
 
 	default:
 		ss.sendError(req.ID, 404, fmt.Sprintf("unknown method: %s", req.Method))
 		return
 	}
+	// Sends with "async": true are queued like ?async=true over HTTP
+	if async, ok := req.Params["async"].(bool); ok && async && isSendRoute(httpPath) {
+		httpPath += "?async=true"
+	}
 	ss.executeHTTPHandler(req, httpMethod, httpPath)
 }
 
@@ -484,13 +781,19 @@ func (ss *stdioServer) executeHTTPHandler(req *jsonRpcRequest, httpMethod, httpP
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	// Set user token header (for user authentication)
-	if token, ok := req.Params["token"].(string); ok {
+	if ss.token != "" {
+		httpReq.Header.Set("token", ss.token)
+	} else if token, ok := req.Params["token"].(string); ok {
 		httpReq.Header.Set("token", token)
 	}
 	// Set admin token header (for admin authentication)
 	if adminToken, ok := req.Params["adminToken"].(string); ok {
 		httpReq.Header.Set("Authorization", adminToken)
 	}
+	// Set the idempotency key of sends
+	if key, ok := req.Params["idempotencyKey"].(string); ok {
+		httpReq.Header.Set(idempotencyKeyHeader, key)
+	}
 
 	recorder := httptest.NewRecorder()
 	ss.server.router.ServeHTTP(recorder, httpReq)
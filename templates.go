@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxTemplateNameLength = 100
+	maxTemplateButtons    = 3
+
+	// storedTemplateRoute renders a stored template and sends it through its send route
+	storedTemplateRoute = "/chat/send/template-stored"
+)
+
+// templateButton is a quick reply button of a template, as taken by /chat/send/buttons
+type templateButton struct {
+	ButtonId   string
+	ButtonText string
+}
+
+// templateList is the list of a template, as taken by /chat/send/list; the template body is its Desc
+type templateList struct {
+	ButtonText string            `json:"ButtonText"`
+	TopText    string            `json:"TopText"`
+	FooterText string            `json:"FooterText,omitempty"`
+	Sections   []json.RawMessage `json:"Sections"`
+}
+
+// MessageTemplate is a stored message of an instance with {{variable}} placeholders
+type MessageTemplate struct {
+	ID            string           `json:"id" db:"id"`
+	UserID        string           `json:"-" db:"user_id"`
+	Name          string           `json:"name" db:"name"`
+	Body          string           `json:"body" db:"body"`
+	MediaURL      string           `json:"media_url,omitempty" db:"media_url"`
+	MediaType     string           `json:"media_type,omitempty" db:"media_type"`
+	Buttons       []templateButton `json:"buttons,omitempty" db:"-"`
+	StoredButtons string           `json:"-" db:"buttons"`
+	List          *templateList    `json:"list,omitempty" db:"-"`
+	StoredList    string           `json:"-" db:"list"`
+	Variables     []string         `json:"variables" db:"-"`
+	CreatedAt     time.Time        `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at" db:"updated_at"`
+}
+
+const templateColumns = `id, user_id, name, body, media_url, media_type, buttons, list, created_at, updated_at`
+
+// fill sets the API fields from the stored columns
+func (t *MessageTemplate) fill() {
+	t.Buttons = nil
+	if t.StoredButtons != "" {
+		_ = json.Unmarshal([]byte(t.StoredButtons), &t.Buttons)
+	}
+	t.List = nil
+	if t.StoredList != "" {
+		t.List = &templateList{}
+		_ = json.Unmarshal([]byte(t.StoredList), t.List)
+	}
+	t.Variables = t.variables()
+}
+
+// store sets the stored columns from the API fields
+func (t *MessageTemplate) store() {
+	t.StoredButtons = ""
+	if len(t.Buttons) > 0 {
+		encoded, _ := json.Marshal(t.Buttons)
+		t.StoredButtons = string(encoded)
+	}
+	t.StoredList = ""
+	if t.List != nil {
+		encoded, _ := json.Marshal(t.List)
+		t.StoredList = string(encoded)
+	}
+}
+
+// validate checks a template before it is stored
+func (t *MessageTemplate) validate() error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return errors.New("missing name in payload")
+	}
+	if len(t.Name) > maxTemplateNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxTemplateNameLength)
+	}
+	if strings.TrimSpace(t.Body) == "" {
+		return errors.New("missing body in payload")
+	}
+
+	kinds := 0
+	if t.MediaURL != "" {
+		kinds++
+		if t.MediaType == "" {
+			t.MediaType = "image"
+		}
+		if t.MediaType != "image" && t.MediaType != "video" {
+			return errors.New("media_type must be image or video")
+		}
+		if !isHTTPURL(templateVariablePattern.ReplaceAllString(t.MediaURL, "x")) {
+			return errors.New("media_url must be an http or https URL")
+		}
+	} else if t.MediaType != "" {
+		return errors.New("media_type requires media_url")
+	}
+	if len(t.Buttons) > 0 {
+		kinds++
+		if len(t.Buttons) > maxTemplateButtons {
+			return fmt.Errorf("at most %d buttons are allowed", maxTemplateButtons)
+		}
+		for _, button := range t.Buttons {
+			if button.ButtonText == "" {
+				return errors.New("every button needs a ButtonText")
+			}
+		}
+	}
+	if t.List != nil {
+		kinds++
+		if t.List.ButtonText == "" || t.List.TopText == "" || len(t.List.Sections) == 0 {
+			return errors.New("list needs ButtonText, TopText and Sections")
+		}
+	}
+	if kinds > 1 {
+		return errors.New("a template can have media, buttons or a list, not several")
+	}
+	return nil
+}
+
+// messageType returns the send route type a template is sent with
+func (t *MessageTemplate) messageType() string {
+	switch {
+	case t.MediaURL != "":
+		return t.MediaType
+	case len(t.Buttons) > 0:
+		return "buttons"
+	case t.List != nil:
+		return "list"
+	default:
+		return "text"
+	}
+}
+
+// payload returns the unrendered payload of the template's send route
+func (t *MessageTemplate) payload() map[string]interface{} {
+	var payload map[string]interface{}
+	switch t.messageType() {
+	case "image":
+		payload = map[string]interface{}{"Image": t.MediaURL, "Caption": t.Body}
+	case "video":
+		payload = map[string]interface{}{"Video": t.MediaURL, "Caption": t.Body}
+	case "buttons":
+		encoded, _ := json.Marshal(map[string]interface{}{"Title": t.Body, "Buttons": t.Buttons})
+		_ = json.Unmarshal(encoded, &payload)
+	case "list":
+		encoded, _ := json.Marshal(t.List)
+		_ = json.Unmarshal(encoded, &payload)
+		payload["Desc"] = t.Body
+	default:
+		payload = map[string]interface{}{"Body": t.Body}
+	}
+	return payload
+}
+
+// variables returns the sorted names of the placeholders used by the template
+func (t *MessageTemplate) variables() []string {
+	encoded, _ := json.Marshal(t.payload())
+	seen := map[string]bool{}
+	names := []string{}
+	for _, match := range templateVariablePattern.FindAllStringSubmatch(string(encoded), -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// render returns the send route type and payload of the template for variables
+func (t *MessageTemplate) render(variables map[string]string) (string, map[string]interface{}, error) {
+	rendered, err := renderTemplate(t.payload(), variables)
+	if err != nil {
+		return "", nil, err
+	}
+	return t.messageType(), rendered, nil
+}
+
+// getTemplate returns a template of a user by ID or, failing that, by name
+func (s *server) getTemplate(userID string, idOrName string) (MessageTemplate, error) {
+	var template MessageTemplate
+	err := s.db.Get(&template, "SELECT "+templateColumns+" FROM message_templates WHERE user_id = $1 AND (id = $2 OR name = $2) ORDER BY CASE WHEN id = $2 THEN 0 ELSE 1 END LIMIT 1", userID, idOrName)
+	template.fill()
+	return template, err
+}
+
+// forwardToSendRoute serves a request with payload through the send route of
+// messageType, keeping the caller's query so ?async=true still queues it
+func (s *server) forwardToSendRoute(w http.ResponseWriter, r *http.Request, messageType string, payload map[string]interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.URL.Path = sendRoutes[messageType]
+	req.RequestURI = req.URL.RequestURI()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	// The key was already claimed for the template request itself
+	req.Header.Del(idempotencyKeyHeader)
+	s.router.ServeHTTP(w, req)
+}
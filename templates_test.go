@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMessageTemplateRender(t *testing.T) {
+	text := MessageTemplate{Name: "welcome", Body: "Hi {{name}}, welcome to {{ shop }}"}
+	if err := text.validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if vars := text.variables(); len(vars) != 2 || vars[0] != "name" || vars[1] != "shop" {
+		t.Errorf("Unexpected variables: %v", vars)
+	}
+	if _, _, err := text.render(map[string]string{"name": "Ana"}); err == nil || err.Error() != "missing variables: shop" {
+		t.Errorf("Expected the missing variable to be reported, got %v", err)
+	}
+	messageType, payload, err := text.render(map[string]string{"name": "Ana", "shop": "Meow"})
+	if err != nil || messageType != "text" || payload["Body"] != "Hi Ana, welcome to Meow" {
+		t.Errorf("Unexpected rendering: %s %v (%v)", messageType, payload, err)
+	}
+
+	image := MessageTemplate{Name: "product", Body: "{{name}} is back", MediaURL: "https://cdn.example.com/{{sku}}.jpg"}
+	if err := image.validate(); err != nil || image.MediaType != "image" {
+		t.Fatalf("Expected an image template, got %q (%v)", image.MediaType, err)
+	}
+	messageType, payload, _ = image.render(map[string]string{"name": "Hat", "sku": "H1"})
+	if messageType != "image" || payload["Image"] != "https://cdn.example.com/H1.jpg" || payload["Caption"] != "Hat is back" {
+		t.Errorf("Unexpected rendering: %s %v", messageType, payload)
+	}
+
+	buttons := MessageTemplate{Name: "confirm", Body: "Confirm order {{order}}?", Buttons: []templateButton{{ButtonId: "yes-{{order}}", ButtonText: "Yes"}}}
+	if err := buttons.validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	messageType, payload, _ = buttons.render(map[string]string{"order": "42"})
+	button := payload["Buttons"].([]interface{})[0].(map[string]interface{})
+	if messageType != "buttons" || payload["Title"] != "Confirm order 42?" || button["ButtonId"] != "yes-42" {
+		t.Errorf("Unexpected rendering: %s %v", messageType, payload)
+	}
+
+	for _, invalid := range []MessageTemplate{
+		{Body: "No name"},
+		{Name: "empty"},
+		{Name: "both", Body: "x", MediaURL: "https://example.com/a.jpg", Buttons: []templateButton{{ButtonText: "Yes"}}},
+		{Name: "audio", Body: "x", MediaURL: "https://example.com/a.ogg", MediaType: "audio"},
+		{Name: "local", Body: "x", MediaURL: "/tmp/a.jpg"},
+		{Name: "list", Body: "x", List: &templateList{ButtonText: "Open"}},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestStoredTemplates(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "TemplateUser",
+		"token":      "template-token",
+	}).toJSON(t))
+
+	created := executeRequest(t, s, newRequest("2", "templates.create", map[string]interface{}{
+		"token": "template-token",
+		"name":  "welcome",
+		"body":  "Hi {{name}}, your number is {{phone}}",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, created, "2").(map[string]interface{})
+	templateID, _ := result["id"].(string)
+	if templateID == "" || len(result["variables"].([]interface{})) != 2 {
+		t.Fatalf("Unexpected template: %v", result)
+	}
+
+	duplicate := executeRequest(t, s, newRequest("3", "templates.create", map[string]interface{}{
+		"token": "template-token",
+		"name":  "welcome",
+		"body":  "Hello",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, duplicate, "3", 409)
+
+	updated := executeRequest(t, s, newRequest("4", "templates.update", map[string]interface{}{
+		"token": "template-token",
+		"id":    "welcome",
+		"name":  "welcome",
+		"body":  "Hello {{name}}",
+	}).toJSON(t))
+	if result := assertJSONRPC20Success(t, updated, "4").(map[string]interface{}); result["id"] != templateID || result["body"] != "Hello {{name}}" {
+		t.Errorf("Unexpected updated template: %v", result)
+	}
+
+	list := executeRequest(t, s, newRequest("5", "templates.list", map[string]interface{}{
+		"token": "template-token",
+	}).toJSON(t))
+	if listed := assertJSONRPC20Success(t, list, "5").([]interface{}); len(listed) != 1 {
+		t.Errorf("Expected one template, got %v", listed)
+	}
+
+	missing := executeRequest(t, s, newRequest("6", "chat.send.template", map[string]interface{}{
+		"token":    "template-token",
+		"Phone":    "5491155553934",
+		"Template": "welcome",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, missing, "6", 400)
+
+	// Rendered templates go through the send route of their kind, queued here
+	queued := executeRequest(t, s, newRequest("7", "chat.send.template", map[string]interface{}{
+		"token":     "template-token",
+		"async":     true,
+		"Phone":     "5491155553934",
+		"Template":  "welcome",
+		"Variables": map[string]string{"name": "Ana"},
+	}).toJSON(t))
+	jobID, _ := assertJSONRPC20Success(t, queued, "7").(map[string]interface{})["JobId"].(string)
+	var job struct {
+		Type    string `db:"type"`
+		Payload string `db:"payload"`
+	}
+	if err := s.db.Get(&job, "SELECT type, payload FROM send_jobs WHERE id = $1", jobID); err != nil {
+		t.Fatalf("Failed to get job: %v", err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil || job.Type != "text" || payload["Body"] != "Hello Ana" || payload["Phone"] != "5491155553934" {
+		t.Errorf("Unexpected queued send: %s %s", job.Type, job.Payload)
+	}
+
+	deleted := executeRequest(t, s, newRequest("8", "templates.delete", map[string]interface{}{
+		"token": "template-token",
+		"id":    templateID,
+	}).toJSON(t))
+	assertJSONRPC20Success(t, deleted, "8")
+
+	gone := executeRequest(t, s, newRequest("9", "templates.get", map[string]interface{}{
+		"token": "template-token",
+		"id":    templateID,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, gone, "9", 404)
+}
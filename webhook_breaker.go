@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	breakerStateClosed   = "closed"
+	breakerStateOpen     = "open"
+	breakerStateHalfOpen = "half-open"
+
+	// breakerProbeWait is how long deliveries are parked while a half-open probe is in flight
+	breakerProbeWait = 5 * time.Second
+	// breakerProbeTimeout lets another probe through when the previous one never reported back
+	breakerProbeTimeout = 2 * time.Minute
+)
+
+// errCircuitOpen is returned for deliveries shed because the URL's circuit is open
+var errCircuitOpen = errors.New("circuit breaker open for webhook URL")
+
+// webhookBreakers tracks the health of every webhook URL
+var webhookBreakers = newWebhookBreakerRegistry()
+
+// circuitBreaker opens after a number of consecutive failures, rejects deliveries
+// during the cool-down and then lets a single probe through (half-open). The probe
+// closes the circuit on success and reopens it on failure.
+type circuitBreaker struct {
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	lastFailureAt       time.Time
+	lastError           string
+	probeInFlight       bool
+	probeStartedAt      time.Time
+}
+
+// BreakerStatus is the API representation of a circuit breaker
+type BreakerStatus struct {
+	URL                 string     `json:"url"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+type webhookBreakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newWebhookBreakerRegistry() *webhookBreakerRegistry {
+	return &webhookBreakerRegistry{breakers: make(map[string]*circuitBreaker)}
+}
+
+func webhookBreakerCooldown() time.Duration {
+	return time.Duration(*webhookBreakerCooldownSeconds) * time.Second
+}
+
+// enabled reports whether circuit breaking is configured (WEBHOOK_BREAKER_THRESHOLD > 0)
+func (r *webhookBreakerRegistry) enabled() bool {
+	return *webhookBreakerThreshold > 0
+}
+
+func (r *webhookBreakerRegistry) get(url string) *circuitBreaker {
+	b, ok := r.breakers[url]
+	if !ok {
+		b = &circuitBreaker{state: breakerStateClosed}
+		r.breakers[url] = b
+	}
+	return b
+}
+
+// Allow reports whether a delivery to url may be attempted now. When the
+// cool-down is over, the first caller becomes the half-open probe.
+func (r *webhookBreakerRegistry) Allow(url string) bool {
+	if !r.enabled() {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := r.get(url)
+	switch b.state {
+	case breakerStateOpen:
+		if time.Since(b.openedAt) < webhookBreakerCooldown() {
+			return false
+		}
+		b.state = breakerStateHalfOpen
+		b.probeInFlight = true
+		b.probeStartedAt = time.Now()
+		log.Info().Str("url", url).Msg("Webhook circuit half-open, sending probe")
+		return true
+	case breakerStateHalfOpen:
+		if b.probeInFlight && time.Since(b.probeStartedAt) < breakerProbeTimeout {
+			return false
+		}
+		b.probeInFlight = true
+		b.probeStartedAt = time.Now()
+		return true
+	}
+	return true
+}
+
+// RetryAt returns when a delivery rejected by Allow should be tried again
+func (r *webhookBreakerRegistry) RetryAt(url string) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := r.get(url)
+	if b.state == breakerStateOpen {
+		if retryAt := b.openedAt.Add(webhookBreakerCooldown()); retryAt.After(time.Now()) {
+			return retryAt
+		}
+	}
+	return time.Now().Add(breakerProbeWait)
+}
+
+// Record updates the breaker of url with the outcome of a delivery
+func (r *webhookBreakerRegistry) Record(url string, deliveryErr error) {
+	if !r.enabled() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := r.get(url)
+	b.probeInFlight = false
+
+	if deliveryErr == nil {
+		if b.state != breakerStateClosed {
+			log.Info().Str("url", url).Msg("Webhook circuit closed")
+		}
+		b.state = breakerStateClosed
+		b.consecutiveFailures = 0
+		return
+	}
+
+	b.consecutiveFailures++
+	b.lastFailureAt = time.Now()
+	b.lastError = deliveryErr.Error()
+
+	if b.state == breakerStateHalfOpen || (b.state == breakerStateClosed && b.consecutiveFailures >= *webhookBreakerThreshold) {
+		b.state = breakerStateOpen
+		b.openedAt = time.Now()
+		log.Warn().
+			Str("url", url).
+			Int("failures", b.consecutiveFailures).
+			Dur("cooldown", webhookBreakerCooldown()).
+			Msg("Webhook circuit opened")
+	}
+}
+
+// Status returns the state of the breaker of url
+func (r *webhookBreakerRegistry) Status(url string) BreakerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.breakers[url]
+	if !ok {
+		return BreakerStatus{URL: url, State: breakerStateClosed}
+	}
+	return b.status(url)
+}
+
+// List returns the state of every known webhook URL, sorted by URL
+func (r *webhookBreakerRegistry) List() []BreakerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]BreakerStatus, 0, len(r.breakers))
+	for url, b := range r.breakers {
+		statuses = append(statuses, b.status(url))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].URL < statuses[j].URL })
+	return statuses
+}
+
+func (b *circuitBreaker) status(url string) BreakerStatus {
+	status := BreakerStatus{
+		URL:                 url,
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		LastError:           b.lastError,
+	}
+	if !b.lastFailureAt.IsZero() {
+		lastFailureAt := b.lastFailureAt
+		status.LastFailureAt = &lastFailureAt
+	}
+	if b.state != breakerStateClosed {
+		openedAt := b.openedAt
+		retryAt := b.openedAt.Add(webhookBreakerCooldown())
+		status.OpenedAt = &openedAt
+		status.RetryAt = &retryAt
+	}
+	return status
+}
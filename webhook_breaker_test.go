@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func setBreakerConfig(t *testing.T, threshold int, cooldownSeconds int) {
+	t.Helper()
+	previousThreshold, previousCooldown := *webhookBreakerThreshold, *webhookBreakerCooldownSeconds
+	*webhookBreakerThreshold, *webhookBreakerCooldownSeconds = threshold, cooldownSeconds
+	t.Cleanup(func() {
+		*webhookBreakerThreshold, *webhookBreakerCooldownSeconds = previousThreshold, previousCooldown
+	})
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	setBreakerConfig(t, 2, 60)
+	r := newWebhookBreakerRegistry()
+	url := "https://down.example.net/hook"
+
+	r.Record(url, errors.New("boom"))
+	if !r.Allow(url) || r.Status(url).State != breakerStateClosed {
+		t.Fatalf("Expected circuit to stay closed below the threshold")
+	}
+
+	r.Record(url, errors.New("boom"))
+	status := r.Status(url)
+	if status.State != breakerStateOpen || status.ConsecutiveFailures != 2 || status.RetryAt == nil {
+		t.Fatalf("Expected open circuit, got %+v", status)
+	}
+	if r.Allow(url) {
+		t.Errorf("Expected deliveries to be rejected while open")
+	}
+	if retryAt := r.RetryAt(url); retryAt.Before(time.Now().Add(59 * time.Second)) {
+		t.Errorf("Expected retry after the cool-down, got %v", retryAt)
+	}
+
+	// Cool-down over: a single probe goes through
+	*webhookBreakerCooldownSeconds = 0
+	if !r.Allow(url) {
+		t.Fatalf("Expected a probe after the cool-down")
+	}
+	if r.Status(url).State != breakerStateHalfOpen || r.Allow(url) {
+		t.Errorf("Expected half-open circuit with one probe in flight")
+	}
+
+	r.Record(url, errors.New("still down"))
+	if r.Status(url).State != breakerStateOpen {
+		t.Errorf("Expected failed probe to reopen the circuit")
+	}
+
+	if !r.Allow(url) {
+		t.Fatalf("Expected another probe")
+	}
+	r.Record(url, nil)
+	if status := r.Status(url); status.State != breakerStateClosed || status.ConsecutiveFailures != 0 {
+		t.Errorf("Expected successful probe to close the circuit, got %+v", status)
+	}
+}
+
+func TestWebhookOutboxParksOpenCircuit(t *testing.T) {
+	o := makeTestOutbox(t)
+	setBreakerConfig(t, 1, 60)
+
+	var received atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	webhookBreakers.Record(ts.URL, errors.New("boom"))
+
+	payload := map[string]string{"jsonData": `{"type":"Message"}`, "userID": "user-1"}
+	if err := o.Enqueue(ts.URL, payload, "user-1", "", "", nil, ""); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	drainOutbox(o)
+
+	if received.Load() != 0 {
+		t.Errorf("Expected no delivery while the circuit is open, got %d", received.Load())
+	}
+
+	var entry webhookOutboxEntry
+	if err := o.db.Get(&entry, "SELECT id, status, attempts, next_attempt_at FROM webhook_outbox"); err != nil {
+		t.Fatalf("Failed to read outbox entry: %v", err)
+	}
+	if entry.Status != outboxStatusPending || entry.Attempts != 0 || entry.NextAttemptAt < time.Now().Add(30*time.Second).Unix() {
+		t.Errorf("Expected entry parked until the cool-down ends, got %+v", entry)
+	}
+}
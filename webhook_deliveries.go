@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	deliveryStatusSuccess = "success"
+	deliveryStatusFailed  = "failed"
+
+	// globalWebhookEndpoint is the endpoint ID of deliveries to the operator's global
+	// webhook, which are not shown to instances
+	globalWebhookEndpoint = "global"
+)
+
+// webhookDeliveryDB is where webhook attempts are logged; nil disables the log
+var webhookDeliveryDB *sqlx.DB
+
+// WebhookDelivery is one recorded webhook attempt
+type WebhookDelivery struct {
+	ID         string    `json:"id" db:"id"`
+	UserID     string    `json:"user_id" db:"user_id"`
+	URL        string    `json:"url" db:"url"`
+	EndpointID string    `json:"endpoint_id" db:"endpoint_id"`
+	Format     string    `json:"format" db:"format"`
+	EventType  string    `json:"event_type" db:"event_type"`
+	Status     string    `json:"status" db:"status"`
+	StatusCode int       `json:"status_code" db:"status_code"`
+	LatencyMs  int64     `json:"latency_ms" db:"latency_ms"`
+	Error      string    `json:"error" db:"error"`
+	Attempt    int       `json:"attempt" db:"attempt"`
+	Payload    string    `json:"payload" db:"payload"`
+	FilePath   string    `json:"file_path" db:"file_path"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// InitWebhookDeliveryLog enables delivery logging and purges entries older than retentionDays
+func InitWebhookDeliveryLog(db *sqlx.DB, retentionDays int) {
+	webhookDeliveryDB = db
+
+	if retentionDays <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for {
+			purgeWebhookDeliveries(db, retentionDays)
+			<-ticker.C
+		}
+	}()
+}
+
+func purgeWebhookDeliveries(db *sqlx.DB, retentionDays int) {
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	res, err := db.Exec("DELETE FROM webhook_deliveries WHERE created_at < $1", cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge webhook delivery log")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Info().Int64("count", n).Msg("Purged old webhook deliveries")
+	}
+
+	// Outbox entries that exhausted their retries go with their attempts
+	res, err = db.Exec("DELETE FROM webhook_outbox WHERE status = $1 AND updated_at < $2", outboxStatusFailed, cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge failed webhooks from outbox")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Info().Int64("count", n).Msg("Purged failed webhooks from outbox")
+	}
+}
+
+// recordWebhookDelivery stores the outcome of a single webhook attempt, with the
+// endpoint and format it was sent to and with so it can be replayed the same way
+func recordWebhookDelivery(myurl string, payload map[string]string, userID string, endpointID string, format string, file string, attempt int, statusCode int, latency time.Duration, deliveryErr error) {
+	if webhookDeliveryDB == nil {
+		return
+	}
+
+	id, err := GenerateRandomID()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate webhook delivery ID")
+		return
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal webhook delivery payload")
+		return
+	}
+
+	status := deliveryStatusSuccess
+	errorText := ""
+	if deliveryErr != nil {
+		status = deliveryStatusFailed
+		errorText = deliveryErr.Error()
+	}
+
+	_, err = webhookDeliveryDB.Exec(`
+		INSERT INTO webhook_deliveries (id, user_id, url, endpoint_id, format, event_type, status, status_code, latency_ms, error, attempt, payload, file_path, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		id, userID, myurl, endpointID, format, webhookEventType(payload), status, statusCode, latency.Milliseconds(), errorText, attempt, string(payloadJSON), file, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("url", myurl).Msg("Failed to record webhook delivery")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWebhookDeliveriesListAndReplay(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	webhookDeliveryDB = s.db
+	t.Cleanup(func() { webhookDeliveryDB = nil })
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "DeliveryUser",
+		"token":      "delivery-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "delivery-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first call, accept the replay
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	payload := map[string]string{"jsonData": `{"type":"Message"}`, "userID": userID}
+	if _, statusCode, err := postWebhookOnce(ts.URL, payload, userID, "", webhookEvent{ID: "E1"}, nil, "", 1); err == nil || statusCode != http.StatusBadGateway {
+		t.Fatalf("Expected failed attempt with status 502, got %d (%v)", statusCode, err)
+	}
+
+	listResponse := executeRequest(t, s, newRequest("2", "webhook.deliveries", map[string]interface{}{
+		"token":      "delivery-token",
+		"status":     "failed",
+		"event_type": "Message",
+	}).toJSON(t))
+	result := assertJSONRPC20Success(t, listResponse, "2").(map[string]interface{})
+
+	deliveries := result["deliveries"].([]interface{})
+	if len(deliveries) != 1 || result["total"].(float64) != 1 {
+		t.Fatalf("Expected 1 failed delivery, got %v", result)
+	}
+	delivery := deliveries[0].(map[string]interface{})
+	if delivery["status_code"].(float64) != http.StatusBadGateway || delivery["attempt"].(float64) != 1 || delivery["error"] == "" {
+		t.Errorf("Unexpected delivery record: %v", delivery)
+	}
+
+	replayResponse := executeRequest(t, s, newRequest("3", "webhook.deliveries.replay", map[string]interface{}{
+		"token": "delivery-token",
+		"id":    delivery["id"],
+	}).toJSON(t))
+	replay := assertJSONRPC20Success(t, replayResponse, "3").(map[string]interface{})
+	if replay["status"] != "success" {
+		t.Errorf("Expected replay to succeed, got %v", replay)
+	}
+
+	var total int
+	if err := s.db.Get(&total, "SELECT COUNT(*) FROM webhook_deliveries WHERE user_id = $1", userID); err != nil {
+		t.Fatalf("Failed to count deliveries: %v", err)
+	}
+	if total != 2 {
+		t.Errorf("Expected replay to be logged as a new delivery, got %d rows", total)
+	}
+
+	notFound := executeRequest(t, s, newRequest("4", "webhook.deliveries.replay", map[string]interface{}{
+		"token": "delivery-token",
+		"id":    "missing",
+	}).toJSON(t))
+	assertJSONRPC20Error(t, notFound, "4", 404)
+}
+
+func TestWebhookDeliveryReplayUsesEndpoint(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	previousKey := *globalEncryptionKey
+	*globalEncryptionKey = "test-encryption-key-0123456789ab"
+	webhookDeliveryDB = s.db
+	t.Cleanup(func() {
+		*globalEncryptionKey = previousKey
+		webhookDeliveryDB = nil
+	})
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "EndpointReplayUser",
+		"token":      "endpoint-replay-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "endpoint-replay-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	var contentType, signature string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		signature = r.Header.Get("x-hmac-signature")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	added := executeRequest(t, s, newRequest("2", "webhook.endpoints.add", map[string]interface{}{
+		"token":    "endpoint-replay-token",
+		"url":      ts.URL,
+		"events":   []string{"Message"},
+		"format":   "json",
+		"hmac_key": "0123456789abcdef0123456789abcdef",
+	}).toJSON(t))
+	endpointID := assertJSONRPC20Success(t, added, "2").(map[string]interface{})["id"].(string)
+	endpoints, err := getWebhookEndpoints(s.db, userID)
+	if err != nil || len(endpoints) != 1 {
+		t.Fatalf("Failed to get endpoints: %v (%v)", endpoints, err)
+	}
+
+	payload := map[string]string{"jsonData": `{"type":"Message"}`, "userID": userID}
+	if _, _, err := postWebhookOnce(ts.URL, payload, userID, endpointID, webhookEvent{ID: "E1"}, endpoints[0].HmacKey, "json", 1); err != nil {
+		t.Fatalf("Webhook failed: %v", err)
+	}
+	if _, _, err := postWebhookOnce(ts.URL, payload, userID, globalWebhookEndpoint, webhookEvent{ID: "E1"}, nil, "", 1); err != nil {
+		t.Fatalf("Webhook failed: %v", err)
+	}
+
+	var endpoint, global WebhookDelivery
+	if err := s.db.Get(&endpoint, "SELECT id, format FROM webhook_deliveries WHERE endpoint_id = $1", endpointID); err != nil || endpoint.Format != "json" {
+		t.Fatalf("Expected the endpoint delivery with its format, got %+v (%v)", endpoint, err)
+	}
+	if err := s.db.Get(&global, "SELECT id FROM webhook_deliveries WHERE endpoint_id = $1", globalWebhookEndpoint); err != nil {
+		t.Fatalf("Expected the global delivery: %v", err)
+	}
+
+	contentType, signature = "", ""
+	replayed := executeRequest(t, s, newRequest("3", "webhook.deliveries.replay", map[string]interface{}{
+		"token": "endpoint-replay-token",
+		"id":    endpoint.ID,
+	}).toJSON(t))
+	if replay := assertJSONRPC20Success(t, replayed, "3").(map[string]interface{}); replay["status"] != "success" {
+		t.Errorf("Expected replay to succeed, got %v", replay)
+	}
+	if contentType != "application/json" || signature == "" {
+		t.Errorf("Expected a JSON replay signed with the endpoint key, got %q (signature %q)", contentType, signature)
+	}
+
+	hidden := executeRequest(t, s, newRequest("4", "webhook.deliveries.replay", map[string]interface{}{
+		"token": "endpoint-replay-token",
+		"id":    global.ID,
+	}).toJSON(t))
+	assertJSONRPC20Error(t, hidden, "4", 404)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// Payload formats accepted for webhook endpoints; empty uses WEBHOOK_FORMAT
+var supportedWebhookFormats = []string{"", "json", "form", webhookFormatCloudEvents, webhookFormatCloudEventsBinary}
+
+// webhookEndpointCache holds the endpoints of each user, keyed by user ID
+var webhookEndpointCache = cache.New(5*time.Minute, 10*time.Minute)
+
+// WebhookEndpoint is an additional webhook destination of an instance with
+// its own event routing, HMAC key and payload format
+type WebhookEndpoint struct {
+	ID        string    `json:"id" db:"id"`
+	UserID    string    `json:"-" db:"user_id"`
+	URL       string    `json:"url" db:"url"`
+	Events    string    `json:"-" db:"events"`
+	HmacKey   []byte    `json:"-" db:"hmac_key"`
+	Format    string    `json:"format" db:"format"`
+	Enabled   bool      `json:"enabled" db:"enabled"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// EventList returns the subscribed events of the endpoint
+func (e WebhookEndpoint) EventList() []string {
+	events := []string{}
+	for _, event := range strings.Split(e.Events, ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Matches reports whether the endpoint should receive the given event type
+func (e WebhookEndpoint) Matches(eventType string) bool {
+	if !e.Enabled {
+		return false
+	}
+	events := e.EventList()
+	return Find(events, eventType) || Find(events, "All")
+}
+
+// apiResponse is the API representation of an endpoint, with the HMAC key masked
+func (e WebhookEndpoint) apiResponse() map[string]interface{} {
+	return map[string]interface{}{
+		"id":         e.ID,
+		"url":        e.URL,
+		"events":     e.EventList(),
+		"format":     e.Format,
+		"enabled":    e.Enabled,
+		"has_hmac":   len(e.HmacKey) > 0,
+		"breaker":    webhookBreakers.Status(e.URL),
+		"created_at": e.CreatedAt,
+		"updated_at": e.UpdatedAt,
+	}
+}
+
+// getWebhookEndpoints returns all endpoints configured for a user, using the cache when possible
+func getWebhookEndpoints(db *sqlx.DB, userID string) ([]WebhookEndpoint, error) {
+	if cached, found := webhookEndpointCache.Get(userID); found {
+		return cached.([]WebhookEndpoint), nil
+	}
+
+	endpoints := []WebhookEndpoint{}
+	err := db.Select(&endpoints, `
+		SELECT id, user_id, url, events, hmac_key, format, enabled, created_at, updated_at
+		FROM webhook_endpoints WHERE user_id = $1
+		ORDER BY created_at ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookEndpointCache.Set(userID, endpoints, cache.DefaultExpiration)
+	return endpoints, nil
+}
+
+// matchingWebhookEndpoints returns the enabled endpoints of a user subscribed to eventType
+func matchingWebhookEndpoints(db *sqlx.DB, userID string, eventType string) []WebhookEndpoint {
+	endpoints, err := getWebhookEndpoints(db, userID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to load webhook endpoints")
+		return nil
+	}
+
+	var matching []WebhookEndpoint
+	for _, endpoint := range endpoints {
+		if endpoint.Matches(eventType) {
+			matching = append(matching, endpoint)
+		}
+	}
+	return matching
+}
+
+// sendToWebhookEndpoints queues the event for every matching endpoint
+func sendToWebhookEndpoints(endpoints []WebhookEndpoint, path string, jsonData []byte, userID string, token string) {
+	if len(endpoints) == 0 {
+		return
+	}
+
+	instance_name := ""
+	userinfo, found := userinfocache.Get(token)
+	if found {
+		instance_name = userinfo.(Values).Get("Name")
+	}
+	data := map[string]string{
+		"jsonData":     string(jsonData),
+		"userID":       userID,
+		"instanceName": instance_name,
+	}
+
+	for _, endpoint := range endpoints {
+		log.Info().Str("url", endpoint.URL).Str("endpoint", endpoint.ID).Msg("Calling webhook endpoint")
+		enqueueWebhook(endpoint.URL, data, userID, endpoint.ID, path, endpoint.HmacKey, endpoint.Format)
+	}
+}
+
+// validWebhookEvents keeps the supported event types, discarding the rest
+func validWebhookEvents(events []string) []string {
+	var validEvents []string
+	for _, event := range events {
+		if !Find(supportedEventTypes, event) {
+			log.Warn().Str("Type", event).Msg("Event type discarded")
+			continue
+		}
+		validEvents = append(validEvents, event)
+	}
+	return validEvents
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWebhookEndpointsCRUDAndRouting(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	previousKey := *globalEncryptionKey
+	*globalEncryptionKey = "test-encryption-key-0123456789ab"
+	t.Cleanup(func() { *globalEncryptionKey = previousKey })
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "EndpointUser",
+		"token":      "endpoint-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "endpoint-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+	t.Cleanup(func() { webhookEndpointCache.Delete(userID) })
+
+	invalid := executeRequest(t, s, newRequest("2", "webhook.endpoints.add", map[string]interface{}{
+		"token":  "endpoint-token",
+		"url":    "https://crm.example.net/hook",
+		"events": []string{"NotAnEvent"},
+	}).toJSON(t))
+	assertJSONRPC20Error(t, invalid, "2", 400)
+
+	crmResponse := executeRequest(t, s, newRequest("3", "webhook.endpoints.add", map[string]interface{}{
+		"token":    "endpoint-token",
+		"url":      "https://crm.example.net/hook",
+		"events":   []string{"Message"},
+		"format":   "json",
+		"hmac_key": "0123456789abcdef0123456789abcdef",
+	}).toJSON(t))
+	crm := assertJSONRPC20Success(t, crmResponse, "3").(map[string]interface{})
+	if crm["has_hmac"] != true || crm["enabled"] != true || crm["format"] != "json" {
+		t.Fatalf("Unexpected endpoint: %v", crm)
+	}
+
+	opsResponse := executeRequest(t, s, newRequest("4", "webhook.endpoints.add", map[string]interface{}{
+		"token":  "endpoint-token",
+		"url":    "https://ops.example.net/hook",
+		"events": []string{"Disconnected", "LoggedOut", "TemporaryBan"},
+	}).toJSON(t))
+	ops := assertJSONRPC20Success(t, opsResponse, "4").(map[string]interface{})
+
+	listResponse := executeRequest(t, s, newRequest("5", "webhook.endpoints.list", map[string]interface{}{
+		"token": "endpoint-token",
+	}).toJSON(t))
+	if list := assertJSONRPC20Success(t, listResponse, "5").([]interface{}); len(list) != 2 {
+		t.Fatalf("Expected 2 endpoints, got %d", len(list))
+	}
+
+	if matching := matchingWebhookEndpoints(s.db, userID, "Message"); len(matching) != 1 || matching[0].ID != crm["id"] {
+		t.Errorf("Expected only the CRM endpoint for Message, got %v", matching)
+	}
+	if matching := matchingWebhookEndpoints(s.db, userID, "LoggedOut"); len(matching) != 1 || matching[0].ID != ops["id"] {
+		t.Errorf("Expected only the ops endpoint for LoggedOut, got %v", matching)
+	}
+
+	updateResponse := executeRequest(t, s, newRequest("6", "webhook.endpoints.update", map[string]interface{}{
+		"token":   "endpoint-token",
+		"id":      crm["id"],
+		"enabled": false,
+	}).toJSON(t))
+	if updated := assertJSONRPC20Success(t, updateResponse, "6").(map[string]interface{}); updated["enabled"] != false || updated["url"] != "https://crm.example.net/hook" {
+		t.Errorf("Expected only enabled to change, got %v", updated)
+	}
+	if matching := matchingWebhookEndpoints(s.db, userID, "Message"); len(matching) != 0 {
+		t.Errorf("Expected disabled endpoint to be skipped, got %v", matching)
+	}
+
+	deleteResponse := executeRequest(t, s, newRequest("7", "webhook.endpoints.delete", map[string]interface{}{
+		"token": "endpoint-token",
+		"id":    ops["id"],
+	}).toJSON(t))
+	assertJSONRPC20Success(t, deleteResponse, "7")
+
+	getResponse := executeRequest(t, s, newRequest("8", "webhook.endpoints.get", map[string]interface{}{
+		"token": "endpoint-token",
+		"id":    ops["id"],
+	}).toJSON(t))
+	assertJSONRPC20Error(t, getResponse, "8", 404)
+}
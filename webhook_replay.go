@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	deadLetterDelivered = "delivered"
+	deadLetterFailed    = "failed"
+	deadLetterMatched   = "matched"
+
+	defaultDeadLetterLimit = 100
+
+	formContentType = "application/x-www-form-urlencoded"
+)
+
+// deadLetter is a message of the webhook error queue: a WebhookErrorPayload, or a
+// WebhookFileErrorPayload when FilePath is set
+type deadLetter struct {
+	URL              string                 `json:"url"`
+	Payload          map[string]interface{} `json:"payload"`
+	UserID           string                 `json:"userID"`
+	EncryptedHmacKey string                 `json:"encryptedHmacKey"`
+	FilePath         string                 `json:"filePath"`
+	AttemptTime      time.Time              `json:"attemptTime"`
+	ErrorMessage     string                 `json:"errorMessage"`
+	ContentType      string                 `json:"contentType"`
+	Body             json.RawMessage        `json:"body"`
+}
+
+// DeadLetterFilter selects the failed webhooks to replay; empty fields match everything
+type DeadLetterFilter struct {
+	UserID string
+	URL    string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	DryRun bool
+}
+
+func (f DeadLetterFilter) matches(item deadLetter) bool {
+	if f.UserID != "" && item.UserID != f.UserID {
+		return false
+	}
+	if f.URL != "" && item.URL != f.URL {
+		return false
+	}
+	if !f.Since.IsZero() && item.AttemptTime.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && item.AttemptTime.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// DeadLetterOutcome is the replay result of one failed webhook
+type DeadLetterOutcome struct {
+	UserID        string    `json:"user_id"`
+	URL           string    `json:"url"`
+	FilePath      string    `json:"file_path,omitempty"`
+	AttemptTime   time.Time `json:"attempt_time"`
+	OriginalError string    `json:"original_error"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// DeadLetterReport summarizes a replay
+type DeadLetterReport struct {
+	Queue     string              `json:"queue"`
+	Scanned   int                 `json:"scanned"`
+	Matched   int                 `json:"matched"`
+	Delivered int                 `json:"delivered"`
+	Failed    int                 `json:"failed"`
+	Invalid   int                 `json:"invalid"`
+	Items     []DeadLetterOutcome `json:"items"`
+}
+
+// deadLetterQueue is the part of an AMQP channel used to read the error queue
+type deadLetterQueue interface {
+	Get(queue string, autoAck bool) (amqp091.Delivery, bool, error)
+}
+
+// redeliverDeadLetter sends a failed webhook again, once, signed with its stored
+// key. The body is posted as it was the first time. A delivery that fails again is
+// queued back to the error queue with its new error.
+func redeliverDeadLetter(item deadLetter) error {
+	var encryptedHmacKey []byte
+	if item.EncryptedHmacKey != "" {
+		key, err := hex.DecodeString(item.EncryptedHmacKey)
+		if err != nil {
+			return fmt.Errorf("invalid stored HMAC key: %w", err)
+		}
+		encryptedHmacKey = key
+	}
+
+	// Form and file posts only ever had string fields
+	payload := make(map[string]string, len(item.Payload))
+	form := true
+	for k, v := range item.Payload {
+		str, ok := v.(string)
+		if !ok {
+			form = false
+			encoded, _ := json.Marshal(v)
+			str = string(encoded)
+		}
+		payload[k] = str
+	}
+
+	if !webhookBreakers.Allow(item.URL) {
+		return errCircuitOpen
+	}
+	// The error queue does not keep webhook IDs, so the replay is a new event
+	event, err := newWebhookEvent()
+	if err != nil {
+		return err
+	}
+
+	if item.FilePath != "" {
+		if _, err := os.Stat(item.FilePath); err != nil {
+			return fmt.Errorf("file no longer available: %w", err)
+		}
+		_, err := postWebhookFileOnce(item.URL, payload, item.UserID, deadLetterEndpoint(item), event, item.FilePath, encryptedHmacKey, 1)
+		if err != nil {
+			PublishFileErrorToQueue(WebhookFileErrorPayload{
+				URL:              item.URL,
+				Payload:          item.Payload,
+				UserID:           item.UserID,
+				EncryptedHmacKey: item.EncryptedHmacKey,
+				FilePath:         item.FilePath,
+				AttemptTime:      time.Now(),
+				ErrorMessage:     err.Error(),
+			})
+		}
+		return err
+	}
+
+	contentType, body := item.ContentType, []byte(item.Body)
+	if len(body) == 0 {
+		// Dead letters queued before bodies were kept: form posts had only string
+		// fields, JSON posts had the sent object as payload
+		if contentType == "" && !form {
+			contentType = "application/json"
+		}
+		if contentType == "" || contentType == formContentType {
+			contentType = formContentType
+			values := url.Values{}
+			for k, v := range payload {
+				values.Add(k, v)
+			}
+			body = []byte(values.Encode())
+		} else {
+			var err error
+			if body, err = json.Marshal(item.Payload); err != nil {
+				return fmt.Errorf("invalid payload: %w", err)
+			}
+		}
+	}
+
+	_, err = postWebhookBodyOnce(item.URL, payload, item.UserID, deadLetterEndpoint(item), event, encryptedHmacKey, contentType, body)
+	if err != nil {
+		PublishDataErrorToQueue(WebhookErrorPayload{
+			URL:              item.URL,
+			Payload:          item.Payload,
+			UserID:           item.UserID,
+			EncryptedHmacKey: item.EncryptedHmacKey,
+			AttemptTime:      time.Now(),
+			ErrorMessage:     err.Error(),
+			ContentType:      contentType,
+			Body:             item.Body,
+		})
+	}
+	return err
+}
+
+// deadLetterEndpoint returns the endpoint ID a dead letter is logged with: the
+// error queue does not keep endpoints, but deliveries to the global webhook must
+// stay hidden from the instance
+func deadLetterEndpoint(item deadLetter) string {
+	if *globalWebhook != "" && item.URL == *globalWebhook {
+		return globalWebhookEndpoint
+	}
+	return ""
+}
+
+// postWebhookBodyOnce posts the body of an event as is, signed with the key, and
+// records it in the delivery log with payload
+func postWebhookBodyOnce(myurl string, payload map[string]string, userID string, endpointID string, event webhookEvent, encryptedHmacKey []byte, contentType string, body []byte) (statusCode int, err error) {
+	start := time.Now()
+	defer func() {
+		recordWebhookDelivery(myurl, payload, userID, endpointID, "", "", 1, statusCode, time.Since(start), err)
+		webhookBreakers.Record(myurl, err)
+	}()
+
+	req := webhookHTTPClient(userID).R().SetHeader("Content-Type", contentType).SetBody(body)
+	if len(encryptedHmacKey) > 0 {
+		req.SetHeaders(webhookSignatureHeaders(event.ID, body, webhookSignerFor(userID, encryptedHmacKey)))
+	}
+
+	resp, err := req.Post(myurl)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return resp.StatusCode(), fmt.Errorf("unexpected status code: %d. Body: %s", resp.StatusCode(), string(resp.Body()))
+	}
+	return resp.StatusCode(), nil
+}
+
+// replayDeadLetters reads the error queue and redelivers the matching webhooks.
+// Replayed messages are acknowledged, whatever the outcome, since failures are
+// queued again; the others are requeued untouched once the scan is over.
+func replayDeadLetters(source deadLetterQueue, queue string, filter DeadLetterFilter, redeliver func(deadLetter) error) (DeadLetterReport, error) {
+	report := DeadLetterReport{Queue: queue, Items: []DeadLetterOutcome{}}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultDeadLetterLimit
+	}
+
+	var kept []amqp091.Delivery
+	defer func() {
+		for _, delivery := range kept {
+			if err := delivery.Nack(false, true); err != nil {
+				log.Error().Err(err).Msg("Could not requeue webhook error")
+			}
+		}
+	}()
+
+	// Failed redeliveries are queued again behind the others, so the scan stops
+	// after the messages that were in the queue when it started
+	queued := -1
+	for report.Matched < limit && report.Scanned != queued {
+		delivery, ok, err := source.Get(queue, false)
+		if err != nil {
+			return report, err
+		}
+		if !ok {
+			break
+		}
+		if queued < 0 {
+			queued = int(delivery.MessageCount) + 1
+		}
+		report.Scanned++
+
+		var item deadLetter
+		if err := json.Unmarshal(delivery.Body, &item); err != nil || item.URL == "" {
+			report.Invalid++
+			kept = append(kept, delivery)
+			continue
+		}
+		if !filter.matches(item) {
+			kept = append(kept, delivery)
+			continue
+		}
+		report.Matched++
+
+		outcome := DeadLetterOutcome{
+			UserID:        item.UserID,
+			URL:           item.URL,
+			FilePath:      item.FilePath,
+			AttemptTime:   item.AttemptTime,
+			OriginalError: item.ErrorMessage,
+			Status:        deadLetterMatched,
+		}
+		if filter.DryRun {
+			report.Items = append(report.Items, outcome)
+			kept = append(kept, delivery)
+			continue
+		}
+
+		if err := redeliver(item); err != nil {
+			outcome.Status = deadLetterFailed
+			outcome.Error = err.Error()
+			report.Failed++
+		} else {
+			outcome.Status = deadLetterDelivered
+			report.Delivered++
+		}
+		report.Items = append(report.Items, outcome)
+
+		if err := delivery.Ack(false); err != nil {
+			log.Error().Err(err).Msg("Could not acknowledge replayed webhook error")
+		}
+	}
+
+	log.Info().
+		Str("queue", queue).
+		Int("scanned", report.Scanned).
+		Int("matched", report.Matched).
+		Int("delivered", report.Delivered).
+		Int("failed", report.Failed).
+		Msg("Replayed webhook error queue")
+	return report, nil
+}
+
+// ReplayWebhookErrorQueue replays the webhook error queue (WEBHOOK_ERROR_QUEUE_NAME)
+func ReplayWebhookErrorQueue(filter DeadLetterFilter) (DeadLetterReport, error) {
+	if !rabbitEnabled || rabbitConn == nil {
+		return DeadLetterReport{}, errors.New("RabbitMQ is not connected")
+	}
+
+	ch, err := rabbitConn.Channel()
+	if err != nil {
+		return DeadLetterReport{}, err
+	}
+	// Closing the channel also requeues anything left unacknowledged
+	defer ch.Close()
+
+	return replayDeadLetters(ch, *webhookErrorQueueName, filter, redeliverDeadLetter)
+}
+
+// runReplayWebhooksCommand implements "wuzapi replay-webhooks [flags]" and returns the exit code
+func runReplayWebhooksCommand(args []string) int {
+	fs := flag.NewFlagSet("replay-webhooks", flag.ContinueOnError)
+	userID := fs.String("user", "", "Only replay webhooks of this user ID")
+	url := fs.String("url", "", "Only replay webhooks to this URL")
+	since := fs.String("since", "", "Only replay webhooks that failed at or after this time (RFC3339)")
+	until := fs.String("until", "", "Only replay webhooks that failed at or before this time (RFC3339)")
+	limit := fs.Int("limit", defaultDeadLetterLimit, "Maximum number of webhooks to replay")
+	dryRun := fs.Bool("dry-run", false, "List the matching webhooks without replaying them")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	filter := DeadLetterFilter{UserID: *userID, URL: *url, Limit: *limit, DryRun: *dryRun}
+	var err error
+	if filter.Since, err = parseOptionalTime(*since); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -since: %v\n", err)
+		return 2
+	}
+	if filter.Until, err = parseOptionalTime(*until); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -until: %v\n", err)
+		return 2
+	}
+
+	report, err := ReplayWebhookErrorQueue(filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay failed: %v\n", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return 1
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// parseOptionalTime parses an RFC3339 time, returning the zero time for ""
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
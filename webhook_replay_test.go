@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// fakeDeadLetterQueue serves messages like basic.get and records their acknowledgements
+type fakeDeadLetterQueue struct {
+	bodies   [][]byte
+	next     int
+	acked    []uint64
+	requeued []uint64
+}
+
+func (q *fakeDeadLetterQueue) Get(queue string, autoAck bool) (amqp091.Delivery, bool, error) {
+	if q.next >= len(q.bodies) {
+		return amqp091.Delivery{}, false, nil
+	}
+	q.next++
+	return amqp091.Delivery{
+		Acknowledger: q,
+		DeliveryTag:  uint64(q.next),
+		MessageCount: uint32(len(q.bodies) - q.next),
+		Body:         q.bodies[q.next-1],
+	}, true, nil
+}
+
+func (q *fakeDeadLetterQueue) Ack(tag uint64, multiple bool) error {
+	q.acked = append(q.acked, tag)
+	return nil
+}
+
+func (q *fakeDeadLetterQueue) Nack(tag uint64, multiple bool, requeue bool) error {
+	q.requeued = append(q.requeued, tag)
+	return nil
+}
+
+func (q *fakeDeadLetterQueue) Reject(tag uint64, requeue bool) error {
+	return q.Nack(tag, false, requeue)
+}
+
+func deadLetterBody(t *testing.T, item deadLetter) []byte {
+	t.Helper()
+	body, err := json.Marshal(item)
+	if err != nil {
+		t.Fatalf("Failed to marshal dead letter: %v", err)
+	}
+	return body
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	failedAt := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	queue := &fakeDeadLetterQueue{bodies: [][]byte{
+		deadLetterBody(t, deadLetter{URL: "https://a.example.net/hook", UserID: "user1", AttemptTime: failedAt, ErrorMessage: "timeout"}),
+		deadLetterBody(t, deadLetter{URL: "https://b.example.net/hook", UserID: "user2", AttemptTime: failedAt}),
+		[]byte("not json"),
+		deadLetterBody(t, deadLetter{URL: "https://down.example.net/hook", UserID: "user1", AttemptTime: failedAt}),
+		deadLetterBody(t, deadLetter{URL: "https://a.example.net/hook", UserID: "user1", AttemptTime: failedAt.Add(-48 * time.Hour)}),
+	}}
+
+	var replayed []string
+	redeliver := func(item deadLetter) error {
+		replayed = append(replayed, item.URL)
+		if item.URL == "https://down.example.net/hook" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	filter := DeadLetterFilter{UserID: "user1", Since: failedAt.Add(-time.Hour)}
+	report, err := replayDeadLetters(queue, "webhook_errors", filter, redeliver)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if report.Scanned != 5 || report.Matched != 2 || report.Delivered != 1 || report.Failed != 1 || report.Invalid != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if len(replayed) != 2 || replayed[0] != "https://a.example.net/hook" || replayed[1] != "https://down.example.net/hook" {
+		t.Errorf("Unexpected redeliveries: %v", replayed)
+	}
+	if report.Items[0].Status != deadLetterDelivered || report.Items[0].OriginalError != "timeout" {
+		t.Errorf("Unexpected first outcome: %+v", report.Items[0])
+	}
+	if report.Items[1].Status != deadLetterFailed || report.Items[1].Error != "connection refused" {
+		t.Errorf("Unexpected second outcome: %+v", report.Items[1])
+	}
+	if len(queue.acked) != 2 || len(queue.requeued) != 3 {
+		t.Errorf("Expected 2 acked and 3 requeued messages, got %v and %v", queue.acked, queue.requeued)
+	}
+
+	dryQueue := &fakeDeadLetterQueue{bodies: queue.bodies}
+	report, err = replayDeadLetters(dryQueue, "webhook_errors", DeadLetterFilter{URL: "https://b.example.net/hook", DryRun: true}, func(deadLetter) error {
+		t.Fatal("Dry run must not redeliver")
+		return nil
+	})
+	if err != nil || report.Matched != 1 || report.Items[0].Status != deadLetterMatched || len(dryQueue.acked) != 0 {
+		t.Errorf("Unexpected dry run: %+v (%v), acked %v", report, err, dryQueue.acked)
+	}
+}
+
+func TestRedeliverDeadLetterSignsWithStoredKey(t *testing.T) {
+	previousKey := *globalEncryptionKey
+	*globalEncryptionKey = "test-encryption-key-0123456789ab"
+	t.Cleanup(func() { *globalEncryptionKey = previousKey })
+
+	encryptedKey, err := encryptHMACKey("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf("Failed to encrypt HMAC key: %v", err)
+	}
+
+	var signature, jsonData string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("x-hmac-signature")
+		jsonData = r.FormValue("jsonData")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	item := deadLetter{
+		URL:              ts.URL,
+		UserID:           "user1",
+		EncryptedHmacKey: hex.EncodeToString(encryptedKey),
+		Payload:          map[string]interface{}{"jsonData": `{"type":"Message"}`, "userID": "user1"},
+	}
+	if err := redeliverDeadLetter(item); err != nil {
+		t.Fatalf("Redelivery failed: %v", err)
+	}
+	if signature == "" {
+		t.Error("Expected the redelivery to be signed with the stored key")
+	}
+	if jsonData != `{"type":"Message"}` {
+		t.Errorf("Expected the original payload, got %q", jsonData)
+	}
+
+	item.FilePath = "/nonexistent/file.jpg"
+	if err := redeliverDeadLetter(item); err == nil {
+		t.Error("Expected an error for a file that no longer exists")
+	}
+}
+
+func TestRedeliverDeadLetterPostsBodyVerbatim(t *testing.T) {
+	var contentType, received string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// A JSON-format body with nested objects, as postWebhookOnce sends it
+	sent := map[string]interface{}{
+		"type":         "Message",
+		"event":        map[string]interface{}{"Info": map[string]interface{}{"Chat": "123@s.whatsapp.net", "IsGroup": false}},
+		"instanceName": "Sales",
+		"userID":       "user1",
+	}
+	expected, _ := json.Marshal(sent)
+
+	queued, err := json.Marshal(newWebhookErrorPayload(ts.URL, sent, "user1", nil, errors.New("timeout")))
+	if err != nil {
+		t.Fatalf("Failed to marshal error payload: %v", err)
+	}
+	var item deadLetter
+	if err := json.Unmarshal(queued, &item); err != nil {
+		t.Fatalf("Failed to decode dead letter: %v", err)
+	}
+	if err := redeliverDeadLetter(item); err != nil {
+		t.Fatalf("Redelivery failed: %v", err)
+	}
+	if contentType != "application/json" || received != string(expected) {
+		t.Errorf("Expected %s as JSON, got %q (%s)", expected, received, contentType)
+	}
+
+	// Dead letters queued before bodies were kept are rebuilt as JSON
+	item.Body = nil
+	item.ContentType = ""
+	if err := redeliverDeadLetter(item); err != nil {
+		t.Fatalf("Redelivery failed: %v", err)
+	}
+	if contentType != "application/json" || received != string(expected) {
+		t.Errorf("Expected %s as JSON, got %q (%s)", expected, received, contentType)
+	}
+
+	// CloudEvents keep their envelope and content type
+	event, err := newCloudEvent(webhookEvent{ID: "E1", Time: time.Now()}, `{"type":"Message","event":{"Info":{"Chat":"123@s.whatsapp.net"}}}`, "user1", "Sales")
+	if err != nil {
+		t.Fatalf("Failed to build CloudEvent: %v", err)
+	}
+	expected, _ = json.Marshal(event)
+	queued, _ = json.Marshal(newWebhookErrorPayload(ts.URL, event, "user1", nil, errors.New("timeout")))
+	item = deadLetter{}
+	if err := json.Unmarshal(queued, &item); err != nil {
+		t.Fatalf("Failed to decode dead letter: %v", err)
+	}
+	if err := redeliverDeadLetter(item); err != nil {
+		t.Fatalf("Redelivery failed: %v", err)
+	}
+	if contentType != cloudEventsContentType || received != string(expected) {
+		t.Errorf("Expected the CloudEvent %s, got %q (%s)", expected, received, contentType)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// hmacSchemeV1 signs only the body and sends it in x-hmac-signature (default)
+	hmacSchemeV1 = "v1"
+	// hmacSchemeV2 signs "id.timestamp.body" and sends x-webhook-id, x-webhook-timestamp and x-webhook-signature
+	hmacSchemeV2 = "v2"
+
+	defaultPreviousKeyTTLHours = 24
+)
+
+// Signing schemes accepted by /session/hmac/config; empty means v1
+var supportedHmacSchemes = []string{"", hmacSchemeV1, hmacSchemeV2}
+
+// webhookSigningDB is used to look up the signing settings of each user; nil keeps v1 signing
+var webhookSigningDB *sqlx.DB
+
+// webhookSigningCache holds the signing settings of each user, keyed by user ID
+var webhookSigningCache = cache.New(5*time.Minute, 10*time.Minute)
+
+// previousHmacKey is a rotated-out key that keeps signing v2 webhooks until it expires
+type previousHmacKey struct {
+	Key       []byte    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type webhookSigningConfig struct {
+	Scheme       string
+	Key          []byte
+	PreviousKeys []previousHmacKey
+}
+
+// getWebhookSigningConfig returns the signing settings of a user, using the cache when possible
+func getWebhookSigningConfig(db *sqlx.DB, userID string) (webhookSigningConfig, error) {
+	if cached, found := webhookSigningCache.Get(userID); found {
+		return cached.(webhookSigningConfig), nil
+	}
+
+	var row struct {
+		Key          []byte `db:"hmac_key"`
+		Scheme       string `db:"hmac_scheme"`
+		PreviousKeys string `db:"hmac_previous_keys"`
+	}
+	err := db.Get(&row, `
+		SELECT hmac_key, COALESCE(hmac_scheme, '') AS hmac_scheme, COALESCE(hmac_previous_keys, '') AS hmac_previous_keys
+		FROM users WHERE id = $1`, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return webhookSigningConfig{}, err
+	}
+
+	config := webhookSigningConfig{
+		Scheme:       row.Scheme,
+		Key:          row.Key,
+		PreviousKeys: parsePreviousHmacKeys(row.PreviousKeys),
+	}
+	webhookSigningCache.Set(userID, config, cache.DefaultExpiration)
+	return config, nil
+}
+
+// parsePreviousHmacKeys decodes the hmac_previous_keys column, ignoring malformed content
+func parsePreviousHmacKeys(encoded string) []previousHmacKey {
+	if encoded == "" {
+		return nil
+	}
+	var keys []previousHmacKey
+	if err := json.Unmarshal([]byte(encoded), &keys); err != nil {
+		log.Error().Err(err).Msg("Failed to decode previous HMAC keys")
+		return nil
+	}
+	return keys
+}
+
+// activePreviousHmacKeys drops the keys that expired before now
+func activePreviousHmacKeys(keys []previousHmacKey, now time.Time) []previousHmacKey {
+	var active []previousHmacKey
+	for _, key := range keys {
+		if now.Before(key.ExpiresAt) {
+			active = append(active, key)
+		}
+	}
+	return active
+}
+
+// webhookSigner is how a webhook is signed: the scheme, and the keys to sign with,
+// the current one first
+type webhookSigner struct {
+	Scheme string
+	Keys   [][]byte
+}
+
+// webhookSignerFor returns the signer of a key used for a user's webhooks. The
+// global webhook key belongs to the operator and keeps the default scheme; the
+// user's own key and its endpoint keys use the user's scheme, and the user's key
+// also signs with its previous keys still active.
+func webhookSignerFor(userID string, encryptedHmacKey []byte) webhookSigner {
+	signer := webhookSigner{Scheme: hmacSchemeV1}
+	if len(encryptedHmacKey) == 0 {
+		return signer
+	}
+	signer.Keys = [][]byte{encryptedHmacKey}
+	if bytes.Equal(encryptedHmacKey, globalHMACKeyEncrypted) || webhookSigningDB == nil {
+		return signer
+	}
+
+	config, err := getWebhookSigningConfig(webhookSigningDB, userID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to load HMAC signing config")
+		return signer
+	}
+	if config.Scheme == hmacSchemeV2 {
+		signer.Scheme = hmacSchemeV2
+	}
+	if bytes.Equal(encryptedHmacKey, config.Key) {
+		for _, previous := range activePreviousHmacKeys(config.PreviousKeys, time.Now()) {
+			signer.Keys = append(signer.Keys, previous.Key)
+		}
+	}
+	return signer
+}
+
+// webhookSignatureHeaders signs a webhook body and returns the headers to send.
+// v1 returns x-hmac-signature with the current key; v2 signs "id.timestamp.body"
+// with every key, where the id is the webhookID of the event, the same on every
+// attempt, and the timestamp is the time of the attempt.
+func webhookSignatureHeaders(webhookID string, signedBody []byte, signer webhookSigner) map[string]string {
+	if len(signer.Keys) == 0 || len(signedBody) == 0 {
+		return nil
+	}
+
+	if signer.Scheme != hmacSchemeV2 {
+		hmacSignature, err := generateHmacSignature(signedBody, signer.Keys[0])
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to generate HMAC signature")
+			return nil
+		}
+		return map[string]string{"x-hmac-signature": hmacSignature}
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return signWebhookV2(webhookID, timestamp, signedBody, signer.Keys)
+}
+
+// signWebhookV2 builds the v2 headers, with one "v2=<hex>" entry per key
+func signWebhookV2(webhookID string, timestamp string, body []byte, keys [][]byte) map[string]string {
+	content := make([]byte, 0, len(webhookID)+len(timestamp)+len(body)+2)
+	content = append(content, webhookID...)
+	content = append(content, '.')
+	content = append(content, timestamp...)
+	content = append(content, '.')
+	content = append(content, body...)
+
+	var signatures []string
+	for _, key := range keys {
+		signature, err := generateHmacSignature(content, key)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to generate HMAC signature")
+			continue
+		}
+		signatures = append(signatures, hmacSchemeV2+"="+signature)
+	}
+	if len(signatures) == 0 {
+		return nil
+	}
+
+	return map[string]string{
+		"x-webhook-id":        webhookID,
+		"x-webhook-timestamp": timestamp,
+		"x-webhook-signature": strings.Join(signatures, " "),
+	}
+}
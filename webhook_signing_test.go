@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookV2SigningWithKeyRotation(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	previousKey := *globalEncryptionKey
+	*globalEncryptionKey = "test-encryption-key-0123456789ab"
+	webhookSigningDB = s.db
+	t.Cleanup(func() {
+		*globalEncryptionKey = previousKey
+		webhookSigningDB = nil
+	})
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "SigningUser",
+		"token":      "signing-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "signing-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+	t.Cleanup(func() { webhookSigningCache.Delete(userID) })
+
+	oldKey := "old-key-0123456789abcdef0123456789"
+	newKey := "new-key-0123456789abcdef0123456789"
+
+	executeRequest(t, s, newRequest("2", "session.hmac.config", map[string]interface{}{
+		"token":    "signing-token",
+		"hmac_key": oldKey,
+		"scheme":   "v2",
+	}).toJSON(t))
+	executeRequest(t, s, newRequest("3", "session.hmac.config", map[string]interface{}{
+		"token":         "signing-token",
+		"hmac_key":      newKey,
+		"keep_previous": true,
+	}).toJSON(t))
+
+	configResponse := executeRequest(t, s, newRequest("4", "session.hmac.config.get", map[string]interface{}{
+		"token": "signing-token",
+	}).toJSON(t))
+	config := assertJSONRPC20Success(t, configResponse, "4").(map[string]interface{})
+	if config["scheme"] != "v2" || config["previous_keys"].(float64) != 1 {
+		t.Fatalf("Unexpected HMAC config: %v", config)
+	}
+
+	var encryptedKey []byte
+	if err := s.db.Get(&encryptedKey, "SELECT hmac_key FROM users WHERE id = $1", userID); err != nil {
+		t.Fatalf("Failed to get HMAC key: %v", err)
+	}
+
+	var headers http.Header
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	payload := map[string]string{"jsonData": `{"type":"Message"}`, "userID": userID}
+	if _, _, err := postWebhookOnce(ts.URL, payload, userID, "", webhookEvent{ID: "E1"}, encryptedKey, "", 1); err != nil {
+		t.Fatalf("Webhook failed: %v", err)
+	}
+
+	if headers.Get("x-hmac-signature") != "" {
+		t.Errorf("Expected no legacy signature with the v2 scheme")
+	}
+	webhookID := headers.Get("x-webhook-id")
+	timestamp := headers.Get("x-webhook-timestamp")
+	if webhookID == "" || timestamp == "" {
+		t.Fatalf("Missing v2 headers: %v", headers)
+	}
+
+	signatures := strings.Fields(headers.Get("x-webhook-signature"))
+	if len(signatures) != 2 {
+		t.Fatalf("Expected signatures for the current and previous key, got %v", signatures)
+	}
+	for i, key := range []string{newKey, oldKey} {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(webhookID + "." + timestamp + "." + string(body)))
+		if expected := "v2=" + hex.EncodeToString(mac.Sum(nil)); signatures[i] != expected {
+			t.Errorf("Signature %d does not match: got %s, want %s", i, signatures[i], expected)
+		}
+	}
+
+	// A retry keeps the webhook ID of the failed attempt and signs it again
+	retryEnabled, retryCount, retryDelay := *webhookRetryEnabled, *webhookRetryCount, *webhookRetryDelaySeconds
+	*webhookRetryEnabled, *webhookRetryCount, *webhookRetryDelaySeconds = true, 2, 0
+	t.Cleanup(func() {
+		*webhookRetryEnabled, *webhookRetryCount, *webhookRetryDelaySeconds = retryEnabled, retryCount, retryDelay
+	})
+	var attempts []http.Header
+	var bodies []string
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, r.Header.Clone())
+		received, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(received))
+		if len(attempts) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer failing.Close()
+
+	o := newWebhookOutbox(s.db, 1)
+	if err := o.Enqueue(failing.URL, payload, userID, "", "", encryptedKey, "json"); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	var entryID string
+	if err := s.db.Get(&entryID, "SELECT id FROM webhook_outbox"); err != nil {
+		t.Fatalf("Failed to read outbox entry: %v", err)
+	}
+	drainOutbox(o)
+	drainOutbox(o)
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(attempts))
+	}
+	for i, attempt := range attempts {
+		if id := attempt.Get("x-webhook-id"); id != entryID {
+			t.Errorf("Expected attempt %d to carry webhook ID %s, got %q", i+1, entryID, id)
+		}
+		mac := hmac.New(sha256.New, []byte(newKey))
+		mac.Write([]byte(entryID + "." + attempt.Get("x-webhook-timestamp") + "." + bodies[i]))
+		if expected := "v2=" + hex.EncodeToString(mac.Sum(nil)); !strings.Contains(attempt.Get("x-webhook-signature"), expected) {
+			t.Errorf("Signature of attempt %d does not match", i+1)
+		}
+	}
+
+	// The global webhook key keeps the operator's default scheme
+	globalKey, err := encryptHMACKey("global-key-0123456789abcdef012345")
+	if err != nil {
+		t.Fatalf("Failed to encrypt global key: %v", err)
+	}
+	previousGlobalKey := globalHMACKeyEncrypted
+	globalHMACKeyEncrypted = globalKey
+	t.Cleanup(func() { globalHMACKeyEncrypted = previousGlobalKey })
+
+	if _, _, err := postWebhookOnce(ts.URL, payload, userID, "", webhookEvent{ID: "E1"}, globalKey, "", 1); err != nil {
+		t.Fatalf("Webhook failed: %v", err)
+	}
+	if headers.Get("x-webhook-signature") != "" || headers.Get("x-hmac-signature") == "" {
+		t.Errorf("Expected a v1 signature with the global key, got %v", headers)
+	}
+}
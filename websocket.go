@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// wsMaxMessageSize matches the maximum line length accepted in stdio mode
+	wsMaxMessageSize = 512 * 1024
+	// wsMaxConcurrentRequests bounds the requests of one connection executed at the same time
+	wsMaxConcurrentRequests = 8
+	wsPingInterval          = 30 * time.Second
+	wsWriteTimeout          = 10 * time.Second
+)
+
+// wsMessageWriter sends every line written by the stdio server as one text message
+type wsMessageWriter struct {
+	ctx  context.Context
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (w *wsMessageWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(w.ctx, wsWriteTimeout)
+	defer cancel()
+	if err := w.conn.Write(ctx, websocket.MessageText, bytes.TrimRight(p, "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// wsNotification is a JSON-RPC notification carrying an already encoded event
+type wsNotification struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// WebSocket accepts JSON-RPC 2.0 requests using the stdio method names and pushes
+// the instance events as notifications, like stdio mode does. Requests are
+// authenticated with the token of the connection.
+func (s *server) WebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userinfo := r.Context().Value("userinfo").(Values)
+		txtid := userinfo.Get("Id")
+		token := userinfo.Get("Token")
+
+		// Events default to the webhook subscription of the instance
+		var types []string
+		events := r.URL.Query().Get("events")
+		if events == "" {
+			events = userinfo.Get("Events")
+		}
+		if events != "" {
+			types = validWebhookEvents(strings.Split(events, ","))
+		}
+
+		// The connection outlives the server read and write timeouts
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Time{}); err != nil {
+			log.Warn().Err(err).Msg("Could not clear read deadline for WebSocket")
+		}
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Warn().Err(err).Msg("Could not clear write deadline for WebSocket")
+		}
+
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: wsOriginPatterns()})
+		if err != nil {
+			log.Warn().Err(err).Str("userID", txtid).Msg("WebSocket handshake failed")
+			return
+		}
+		defer conn.CloseNow()
+		conn.SetReadLimit(wsMaxMessageSize)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		writer := &wsMessageWriter{ctx: ctx, conn: conn}
+		rpc := newStdioServerWithIO(s, nil, writer)
+		rpc.token = token
+
+		// Without events the connection only serves requests; a nil channel never fires
+		var notifications <-chan streamEvent
+		if len(types) > 0 {
+			if Find(types, "All") {
+				types = nil
+			}
+			sub, _ := eventStreams.Subscribe(txtid, types, "")
+			defer eventStreams.Unsubscribe(txtid, sub)
+			notifications = sub.events
+		}
+
+		log.Info().Str("userID", txtid).Msg("WebSocket connected")
+
+		go func() {
+			defer cancel()
+			ping := time.NewTicker(wsPingInterval)
+			defer ping.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event, ok := <-notifications:
+					if !ok {
+						if ctx.Err() == nil {
+							conn.Close(websocket.StatusPolicyViolation, "event consumer too slow")
+						}
+						return
+					}
+					notification, err := json.Marshal(wsNotification{JSONRPC: "2.0", Method: event.Type, Params: event.Data})
+					if err != nil {
+						log.Error().Err(err).Msg("Failed to marshal WebSocket notification")
+						continue
+					}
+					if _, err := writer.Write(notification); err != nil {
+						return
+					}
+				case <-ping.C:
+					pingCtx, pingCancel := context.WithTimeout(ctx, wsWriteTimeout)
+					err := conn.Ping(pingCtx)
+					pingCancel()
+					if err != nil {
+						return
+					}
+				}
+			}
+		}()
+
+		var requests sync.WaitGroup
+		defer requests.Wait()
+		slots := make(chan struct{}, wsMaxConcurrentRequests)
+
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				log.Info().Str("userID", txtid).Str("reason", websocket.CloseStatus(err).String()).Msg("WebSocket disconnected")
+				// Stop the notifier before the subscription is closed
+				cancel()
+				return
+			}
+			if typ != websocket.MessageText {
+				continue
+			}
+
+			slots <- struct{}{}
+			requests.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					requests.Done()
+				}()
+				rpc.handleRequest(data)
+			}()
+		}
+	}
+}
+
+// wsOriginPatterns returns the cross-origin hosts allowed to open WebSockets (WS_ORIGINS)
+func wsOriginPatterns() []string {
+	return splitList(*wsOrigins)
+}
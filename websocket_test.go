@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestWebSocketRequestsAndNotifications(t *testing.T) {
+	s := makeTestServer(t)
+	s.db.SetMaxOpenConns(1)
+
+	executeRequest(t, s, newRequest("1", "admin.users.add", map[string]interface{}{
+		"adminToken": "test-admin-token",
+		"name":       "SocketUser",
+		"token":      "socket-token",
+	}).toJSON(t))
+
+	var userID string
+	if err := s.db.Get(&userID, "SELECT id FROM users WHERE token = $1", "socket-token"); err != nil {
+		t.Fatalf("Failed to get user id: %v", err)
+	}
+
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=socket-token&events=Message"
+	conn, _, err := websocket.Dial(ctx, wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to open WebSocket: %v", err)
+	}
+	defer conn.CloseNow()
+
+	readMessage := func() map[string]interface{} {
+		t.Helper()
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read WebSocket message: %v", err)
+		}
+		var message map[string]interface{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatalf("Invalid JSON message %s: %v", data, err)
+		}
+		return message
+	}
+
+	// The token of the connection authenticates requests without a token param
+	request := `{"jsonrpc":"2.0","id":7,"method":"webhook.endpoints.list"}`
+	if err := conn.Write(ctx, websocket.MessageText, []byte(request)); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	response := readMessage()
+	if response["id"].(float64) != 7 || response["error"] != nil {
+		t.Fatalf("Unexpected response: %v", response)
+	}
+
+	unknown := `{"jsonrpc":"2.0","id":8,"method":"no.such.method"}`
+	if err := conn.Write(ctx, websocket.MessageText, []byte(unknown)); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if response := readMessage(); response["error"].(map[string]interface{})["code"].(float64) != 404 {
+		t.Fatalf("Expected unknown method error, got %v", response)
+	}
+
+	eventStreams.Publish(userID, "ReadReceipt", map[string]interface{}{"type": "ReadReceipt"})
+	eventStreams.Publish(userID, "Message", map[string]interface{}{"type": "Message", "event": "hello"})
+
+	notification := readMessage()
+	if notification["method"] != "Message" || notification["id"] != nil {
+		t.Fatalf("Expected a Message notification, got %v", notification)
+	}
+	if params := notification["params"].(map[string]interface{}); params["event"] != "hello" {
+		t.Errorf("Expected the event as params, got %v", params)
+	}
+
+	conn.Close(websocket.StatusNormalClosure, "")
+}
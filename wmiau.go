@@ -60,7 +60,7 @@ func sendToGlobalWebHook(jsonData []byte, token string, userID string) {
 			"userID":       userID,
 			"instanceName": instance_name,
 		}
-		callHookWithHmac(*globalWebhook, globalData, userID, globalHMACKeyEncrypted)
+		enqueueWebhook(*globalWebhook, globalData, userID, globalWebhookEndpoint, "", globalHMACKeyEncrypted, "")
 	}
 }
 
@@ -86,21 +86,7 @@ func sendToUserWebHookWithHmac(webhookurl string, path string, jsonData []byte,
 	if webhookurl != "" {
 		log.Info().Str("url", webhookurl).Msg("Calling user webhook")
 
-		if path == "" {
-			go callHookWithHmac(webhookurl, data, userID, encryptedHmacKey)
-		} else {
-			// Create a channel to capture the error from the goroutine
-			errChan := make(chan error, 1)
-			go func() {
-				err := callHookFileWithHmac(webhookurl, data, userID, path, encryptedHmacKey)
-				errChan <- err
-			}()
-
-			// Optionally handle the error from the channel (if needed)
-			if err := <-errChan; err != nil {
-				log.Error().Err(err).Msg("Error calling hook file")
-			}
-		}
+		enqueueWebhook(webhookurl, data, userID, "", path, encryptedHmacKey, "")
 	} else {
 		log.Warn().Str("userid", userID).Msg("No webhook set for user")
 	}
@@ -152,8 +138,6 @@ func getUserWebhookUrl(token string) string {
 }
 
 func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path string) {
-	webhookurl := getUserWebhookUrl(mycli.token)
-
 	// Get updated events from cache/database
 	subscribedEvents, err := updateAndGetUserSubscriptions(mycli)
 	if err != nil {
@@ -166,6 +150,9 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		return
 	}
 
+	// Live streams have their own event filter
+	eventStreams.Publish(mycli.userID, eventType, postmap)
+
 	// Log subscription details for debugging
 	log.Debug().
 		Str("userID", mycli.userID).
@@ -175,13 +162,19 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 
 	// Check if the current event is in the subscriptions
 	checkIfSubscribedInEvent := checkIfSubscribedToEvent(subscribedEvents, postmap["type"].(string), mycli.userID)
-	if !checkIfSubscribedInEvent {
+
+	// Additional webhook endpoints have their own event routing
+	endpoints := matchingWebhookEndpoints(mycli.db, mycli.userID, eventType)
+
+	if !checkIfSubscribedInEvent && len(endpoints) == 0 {
 		return
 	}
 
 	// In stdio mode, send as JSON-RPC notification instead of HTTP webhook
 	if mycli.s != nil && mycli.s.mode == Stdio {
-		mycli.s.SendNotification(eventType, postmap)
+		if checkIfSubscribedInEvent {
+			mycli.s.SendNotification(eventType, postmap)
+		}
 		return
 	}
 
@@ -205,12 +198,22 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		}
 	}
 
-	sendToUserWebHookWithHmac(webhookurl, path, jsonData, mycli.userID, mycli.token, encryptedHmacKey)
+	sendToWebhookEndpoints(endpoints, path, jsonData, mycli.userID, mycli.token)
 
-	// Get global webhook if configured
-	go sendToGlobalWebHook(jsonData, mycli.token, mycli.userID)
+	if !checkIfSubscribedInEvent {
+		return
+	}
 
-	go sendToGlobalRabbit(jsonData, mycli.token, mycli.userID)
+	// User webhook, global webhook, RabbitMQ and the configured brokers
+	eventSinks.Dispatch(mycli.db, SinkEvent{
+		UserID:       mycli.userID,
+		Token:        mycli.token,
+		InstanceName: instanceNameForToken(mycli.token),
+		Type:         eventType,
+		Path:         path,
+		Data:         jsonData,
+		HmacKey:      encryptedHmacKey,
+	})
 }
 
 func checkIfSubscribedToEvent(subscribedEvents []string, eventType string, userId string) bool {
@@ -835,6 +838,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 
 		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Str("parts", strings.Join(metaParts, ", ")).Msg("Message Received")
 
+		mycli.handlePollMessage(evt)
+		mycli.handleChatMessage(evt)
+
 		if !*skipMedia {
 			// try to get Image if any
 			img := evt.Message.GetImageMessage()
@@ -1269,26 +1275,15 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			historyLimit = 0
 		}
 
-		if historyLimit > 0 {
+		// Edits, deletes and reactions change the message they refer to
+		if historyLimit > 0 && !mycli.applyHistoryRevision(evt) {
 			messageType := "text"
 			textContent := ""
 			mediaLink := ""
 			caption := ""
 			replyToMessageID := ""
 
-			// Check for delete messages first
-			if protocolMsg := evt.Message.GetProtocolMessage(); protocolMsg != nil && protocolMsg.GetType() == 0 {
-				messageType = "delete"
-				if protocolMsg.GetKey() != nil {
-					textContent = protocolMsg.GetKey().GetID() // Store the deleted message ID
-				}
-				log.Info().Str("deletedMessageID", textContent).Str("messageID", evt.Info.ID).Msg("Delete message detected")
-				// Check for reactions
-			} else if reaction := evt.Message.GetReactionMessage(); reaction != nil {
-				messageType = "reaction"
-				replyToMessageID = reaction.GetKey().GetID()
-				textContent = reaction.GetText() // This will be the emoji
-			} else if img := evt.Message.GetImageMessage(); img != nil {
+			if img := evt.Message.GetImageMessage(); img != nil {
 				messageType = "image"
 				caption = img.GetCaption()
 			} else if video := evt.Message.GetVideoMessage(); video != nil {
@@ -1309,41 +1304,39 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				textContent = location.GetName()
 			}
 
-			// Extract text content for non-reaction and non-delete messages
-			if messageType != "reaction" && messageType != "delete" {
-				if conv := evt.Message.GetConversation(); conv != "" {
-					textContent = conv
-				} else if ext := evt.Message.GetExtendedTextMessage(); ext != nil {
-					textContent = ext.GetText()
-					// Check if this is a reply to another message
-					if contextInfo := ext.GetContextInfo(); contextInfo != nil && contextInfo.GetStanzaID() != "" {
-						replyToMessageID = contextInfo.GetStanzaID()
-					}
-				} else {
-					textContent = caption
+			// Extract text content
+			if conv := evt.Message.GetConversation(); conv != "" {
+				textContent = conv
+			} else if ext := evt.Message.GetExtendedTextMessage(); ext != nil {
+				textContent = ext.GetText()
+				// Check if this is a reply to another message
+				if contextInfo := ext.GetContextInfo(); contextInfo != nil && contextInfo.GetStanzaID() != "" {
+					replyToMessageID = contextInfo.GetStanzaID()
 				}
+			} else {
+				textContent = caption
+			}
 
-				// Set default text content for media messages without captions
-				if textContent == "" {
-					switch messageType {
-					case "image":
-						textContent = ":image:"
-					case "video":
-						textContent = ":video:"
-					case "audio":
-						textContent = ":audio:"
-					case "document":
-						textContent = ":document:"
-					case "sticker":
-						textContent = ":sticker:"
-					case "contact":
-						if textContent == "" {
-							textContent = ":contact:"
-						}
-					case "location":
-						if textContent == "" {
-							textContent = ":location:"
-						}
+			// Set default text content for media messages without captions
+			if textContent == "" {
+				switch messageType {
+				case "image":
+					textContent = ":image:"
+				case "video":
+					textContent = ":video:"
+				case "audio":
+					textContent = ":audio:"
+				case "document":
+					textContent = ":document:"
+				case "sticker":
+					textContent = ":sticker:"
+				case "contact":
+					if textContent == "" {
+						textContent = ":contact:"
+					}
+				case "location":
+					if textContent == "" {
+						textContent = ":location:"
 					}
 				}
 			}
@@ -1365,8 +1358,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				}
 			}
 
-			// Only save if there's meaningful content (including delete messages)
-			if textContent != "" || mediaLink != "" || (messageType != "text" && messageType != "reaction") || messageType == "delete" {
+			// Only save if there's meaningful content
+			if textContent != "" || mediaLink != "" || messageType != "text" {
 				// Serializar evt para JSON
 				evtJSON, err := json.Marshal(evt)
 				if err != nil {
@@ -1401,6 +1394,13 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Receipt:
 		postmap["type"] = "ReadReceipt"
 		dowebhook = 1
+		go updateCampaignReceipts(mycli.db, mycli.userID, evt.MessageIDs, evt.Type, evt.Timestamp)
+		go updateMessageStatus(mycli.db, mycli.userID, evt)
+		if evt.Type == types.ReceiptTypeReadSelf {
+			if err := setChatUnread(mycli.db, mycli.userID, evt.Chat.String(), true); err != nil {
+				log.Error().Err(err).Str("chat", evt.Chat.String()).Msg("Failed to update chat unread count")
+			}
+		}
 		//if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
 		if evt.Type == types.ReceiptTypeRead || evt.Type == types.ReceiptTypeReadSelf {
 			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%v", evt.Timestamp)).Msg("Message was read")
@@ -1446,6 +1446,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					accountOwnerJID = mycli.WAClient.Store.ID.ToNonAD().String()
 				}
 
+				mycli.handleHistorySyncChats(evt.Data.Conversations, accountOwnerJID)
+
 				savedCount := 0
 				for _, conv := range evt.Data.Conversations {
 					if conv == nil || conv.ID == nil || conv.Messages == nil {
@@ -1586,6 +1588,18 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 							msgTimestamp = time.Unix(int64(timestamp), 0)
 						}
 
+						// Reactions are applied to the message they refer to
+						if messageType == "reaction" {
+							reactionSender := senderJID
+							if isFromMe {
+								reactionSender = "me"
+							}
+							if err := reactToHistoryMessage(mycli.db, mycli.userID, quotedMessageID, reactionSender, textContent, msgTimestamp); err != nil {
+								log.Error().Err(err).Str("messageID", messageID).Msg("Failed to apply reaction to history")
+							}
+							continue
+						}
+
 						// Parse sender JID for MessageInfo
 						var senderJIDForInfo types.JID
 						if isFromMe {
@@ -1667,7 +1681,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 
 						// Save message to history
 						// Only save if there's meaningful content
-						if textContent != "" || mediaLink != "" || (messageType != "text" && messageType != "reaction") {
+						if textContent != "" || mediaLink != "" || messageType != "text" {
 							err = mycli.s.saveMessageToHistory(
 								mycli.userID,
 								chatJID.String(),
@@ -1764,10 +1778,23 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		postmap["type"] = "GroupInfo"
 		dowebhook = 1
 		log.Info().Str("jid", evt.JID.String()).Msg("Group info updated")
+		if evt.Name != nil {
+			if err := setChatName(mycli.db, mycli.userID, evt.JID.String(), evt.Name.Name); err != nil {
+				log.Error().Err(err).Str("jid", evt.JID.String()).Msg("Failed to update chat name")
+			}
+		}
 	case *events.JoinedGroup:
 		postmap["type"] = "JoinedGroup"
 		dowebhook = 1
 		log.Info().Str("jid", evt.JID.String()).Msg("Joined group")
+		if err := setChatName(mycli.db, mycli.userID, evt.JID.String(), evt.Name); err != nil {
+			log.Error().Err(err).Str("jid", evt.JID.String()).Msg("Failed to update chat name")
+		}
+	case *events.MarkChatAsRead:
+		log.Info().Str("jid", evt.JID.String()).Bool("read", evt.Action.GetRead()).Msg("Chat marked as read from another device")
+		if err := setChatUnread(mycli.db, mycli.userID, evt.JID.String(), evt.Action.GetRead()); err != nil {
+			log.Error().Err(err).Str("jid", evt.JID.String()).Msg("Failed to update chat unread count")
+		}
 	case *events.Picture:
 		postmap["type"] = "Picture"
 		dowebhook = 1